@@ -1,15 +1,44 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Storage backends a domain can select with rclone.backend
+const (
+	BackendExec  = "exec"  // spawn an rclone process per operation, the default
+	BackendRcd   = "rcd"   // call a long-lived rclone rcd over its remote control API
+	BackendLocal = "local" // read the directory named by remote directly from the filesystem
+	BackendS3    = "s3"    // talk to S3-compatible object storage directly, configured by the s3 block
+)
+
 type RcloneConfig struct {
-	Remote string
-	Flags []string
+	Remote  string
+	Flags   []string
+	// Options configure the remote like its rclone.conf section, e.g. url or pass. They
+	// reach rclone through the environment, keeping secrets off the command line.
+	Options map[string]string `yaml:"options,omitempty"`
+	// Obscure names options given in plain text that rclone expects obscured, e.g. pass
+	Obscure []string  `yaml:"obscure,omitempty"`
+	Backend string    `yaml:"backend,omitempty"`
+	S3      *S3Config `yaml:"s3,omitempty"`
+}
+
+// S3Config configures the native S3 backend
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint"` // e.g. https://s3.eu-central-1.amazonaws.com
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	AccessKeyID     string `yaml:"access_key_id,omitempty"` // anonymous access when empty
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+	PathStyle       bool   `yaml:"path_style,omitempty"` // endpoint/bucket/key instead of bucket.endpoint/key
 }
 
 type SecurityMode string
@@ -36,10 +65,195 @@ type SecretKey struct {
 	Secret string `yaml:"secret"`
 }
 
+// CacheSettings controls how rendered outputs and listings of a domain are cached
+type CacheSettings struct {
+	DisableDisk bool `yaml:"disable_disk"` // opt out of the local derivative cache
+	// DisableListing lists directories on every request instead of caching them
+	DisableListing bool `yaml:"disable_listing,omitempty"`
+	// ListingTTL is how long a cached listing is served without asking the remote
+	ListingTTL time.Duration `yaml:"listing_ttl,omitempty"`
+	// ListingStale is how long past its TTL a listing is still served while it's
+	// refreshed in the background
+	ListingStale time.Duration `yaml:"listing_stale,omitempty"`
+}
+
+// Lifetimes of cached listings for domains that don't set their own
+const (
+	DefaultListingTTL   = 30 * time.Second
+	DefaultListingStale = 5 * time.Minute
+)
+
+// WithDefaults returns the settings with unset listing lifetimes replaced by the defaults
+func (c CacheSettings) WithDefaults() CacheSettings {
+	if c.ListingTTL <= 0 {
+		c.ListingTTL = DefaultListingTTL
+	}
+	if c.ListingStale < 0 {
+		c.ListingStale = 0
+	} else if c.ListingStale == 0 {
+		c.ListingStale = DefaultListingStale
+	}
+	return c
+}
+
+// Limits of storage operations for domains that don't set their own
+const (
+	DefaultListTimeout  = 30 * time.Second
+	DefaultFetchTimeout = 2 * time.Minute
+	DefaultWriteTimeout = 2 * time.Minute
+)
+
+// TimeoutSettings bounds the storage operations of a domain, written as durations
+// such as "30s". Streamed downloads are only bound to the request.
+type TimeoutSettings struct {
+	List  time.Duration `yaml:"list,omitempty"`  // listing and stat
+	Fetch time.Duration `yaml:"fetch,omitempty"` // reading whole files, e.g. images to transform
+	Write time.Duration `yaml:"write,omitempty"`
+}
+
+// WithDefaults returns the settings with unset timeouts replaced by the defaults
+func (t TimeoutSettings) WithDefaults() TimeoutSettings {
+	if t.List <= 0 {
+		t.List = DefaultListTimeout
+	}
+	if t.Fetch <= 0 {
+		t.Fetch = DefaultFetchTimeout
+	}
+	if t.Write <= 0 {
+		t.Write = DefaultWriteTimeout
+	}
+	return t
+}
+
+// DefaultIndexInterval is how often indexed domains are crawled again when they don't
+// set their own interval
+const DefaultIndexInterval = time.Hour
+
+// SearchSettings configures the search index of a domain
+type SearchSettings struct {
+	// Index crawls the domain in the background to serve /v2/search
+	Index bool `yaml:"index,omitempty"`
+	// Interval is the time between crawls, changes seen by the listing cache are
+	// applied in between
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// WithDefaults returns the settings with an unset interval replaced by the default
+func (s SearchSettings) WithDefaults() SearchSettings {
+	if s.Interval <= 0 {
+		s.Interval = DefaultIndexInterval
+	}
+	return s
+}
+
+// Overwrite policies for uploads to an existing path
+const (
+	OverwriteDeny    = "deny"    // refuse the upload, the default
+	OverwriteReplace = "replace" // replace the existing file
+	OverwriteRename  = "rename"  // store the upload as name-1.ext, name-2.ext, ...
+)
+
+// Limits of uploads for domains that don't set their own
+const (
+	DefaultMaxUploadSize = 32 << 20
+	DefaultUploadQuality = 90
+)
+
+// DefaultUploadTypes are the types uploads are sniffed as when allowed_types is unset
+var DefaultUploadTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+// UploadSettings configures writes through /v2/files. Writes are refused for paths
+// without API keys.
+type UploadSettings struct {
+	MaxSize      int64    `yaml:"max_size,omitempty"`      // request body limit in bytes
+	AllowedTypes []string `yaml:"allowed_types,omitempty"` // sniffed MIME types, e.g. image/jpeg or image/*
+	Overwrite    string   `yaml:"overwrite,omitempty"`     // deny, replace or rename
+	// Reencode converts uploaded images to jpg, png or webp, changing their extension
+	Reencode string `yaml:"reencode,omitempty"`
+	// Strip re-encodes uploaded images without metadata such as EXIF and GPS positions
+	Strip   bool `yaml:"strip,omitempty"`
+	Quality int  `yaml:"quality,omitempty"` // of re-encoded images
+	// Trash is a folder deleted files are moved to instead of being removed, deletes
+	// inside it are permanent
+	Trash string `yaml:"trash,omitempty"`
+}
+
+// WithDefaults returns the settings with unset limits replaced by the defaults
+func (u UploadSettings) WithDefaults() UploadSettings {
+	if u.MaxSize <= 0 {
+		u.MaxSize = DefaultMaxUploadSize
+	}
+	if len(u.AllowedTypes) == 0 {
+		u.AllowedTypes = DefaultUploadTypes
+	}
+	if u.Overwrite == "" {
+		u.Overwrite = OverwriteDeny
+	}
+	if u.Quality <= 0 {
+		u.Quality = DefaultUploadQuality
+	}
+	return u
+}
+
 // DomainConfig represents configuration for a specific domain
 type DomainConfig struct {
 	Rclone   RcloneConfig     `yaml:"rclone"`
+	// Root confines every request of the domain to this folder of the remote
+	Root     string           `yaml:"root,omitempty"`
 	Security SecuritySettings  `yaml:"security"`
+	Cache    CacheSettings     `yaml:"cache,omitempty"`
+	Timeouts TimeoutSettings   `yaml:"timeouts,omitempty"`
+	Uploads  UploadSettings    `yaml:"uploads,omitempty"`
+	// Replicas are read from in order when rclone, the primary, is unavailable. They
+	// mirror its layout, root applies to them too.
+	Replicas []RcloneConfig `yaml:"replicas,omitempty"`
+	// Mounts serve path prefixes of the domain from other remotes
+	Mounts []MountConfig `yaml:"mounts,omitempty"`
+	// DerivativeCache names a second remote rendered outputs are written to and read back from
+	DerivativeCache *RcloneConfig `yaml:"derivative_cache,omitempty"`
+	// Presets name transform parameters for the URLs of signed listings, e.g.
+	// thumbnail: w=256&h=256&fit=crop
+	Presets map[string]string `yaml:"presets,omitempty"`
+	Search  SearchSettings    `yaml:"search,omitempty"`
+}
+
+// MountConfig maps the requests below a path prefix to a remote of their own
+type MountConfig struct {
+	Prefix string       `yaml:"prefix"` // e.g. products or press/2024
+	Rclone RcloneConfig `yaml:"rclone"`
+	// Root is the folder of the mount's remote the prefix maps to
+	Root string `yaml:"root,omitempty"`
+	// Security replaces the domain's security settings below the prefix
+	Security *SecuritySettings `yaml:"security,omitempty"`
+}
+
+// MountFor returns the mount serving path by longest prefix match and the path relative
+// to it, nil when path is served by the domain's own remote. path must be canonical.
+func (c DomainConfig) MountFor(path string) (*MountConfig, string) {
+	var mount *MountConfig
+	var relative string
+	longest := 0
+	for i := range c.Mounts {
+		prefix := strings.Trim(c.Mounts[i].Prefix, "/")
+		if prefix == "" || len(prefix) <= longest {
+			continue
+		}
+		switch {
+		case path == prefix:
+			mount, relative, longest = &c.Mounts[i], "", len(prefix)
+		case strings.HasPrefix(path, prefix+"/"):
+			mount, relative, longest = &c.Mounts[i], path[len(prefix)+1:], len(prefix)
+		}
+	}
+	return mount, relative
+}
+
+// SecurityFor returns the security settings applying to path
+func (c DomainConfig) SecurityFor(path string) SecuritySettings {
+	if mount, _ := c.MountFor(path); mount != nil && mount.Security != nil {
+		return *mount.Security
+	}
+	return c.Security
 }
 
 type DomainsConfig struct {
@@ -63,6 +277,11 @@ type DomainConfigManager interface {
 	GetDomainConfig(domain string) (DomainConfig, error)
 }
 
+// DomainLister is implemented by config managers that can enumerate their domains
+type DomainLister interface {
+	Domains() ([]string, error)
+}
+
 // domainConfigManagerImpl implements DomainConfigManager
 type domainConfigManagerImpl struct {
 	loader     ConfigLoader
@@ -77,14 +296,110 @@ func NewDomainConfigManager(loader ConfigLoader, configPath string) DomainConfig
 	}
 }
 
+var ErrNoDerivativeCache = errors.New("no derivative cache configured")
+
+// derivativeCacheConfigManager presents the derivative cache remote of a domain as its rclone config,
+// so the regular storage implementation can be pointed at it
+type derivativeCacheConfigManager struct {
+	base DomainConfigManager
+}
+
+// NewDerivativeCacheConfigManager wraps a DomainConfigManager so that each domain resolves
+// to its derivative_cache remote instead of its source remote
+func NewDerivativeCacheConfigManager(base DomainConfigManager) DomainConfigManager {
+	return &derivativeCacheConfigManager{base: base}
+}
+
+func (m *derivativeCacheConfigManager) GetDomainConfig(domain string) (DomainConfig, error) {
+	cfg, err := m.base.GetDomainConfig(domain)
+	if err != nil {
+		return DomainConfig{}, err
+	}
+	if cfg.DerivativeCache == nil || cfg.DerivativeCache.Remote == "" {
+		return DomainConfig{}, fmt.Errorf("%w for: %s", ErrNoDerivativeCache, domain)
+	}
+
+	cfg.Rclone = *cfg.DerivativeCache
+	// root confines the source remote, the cache remote has its own layout
+	cfg.Root = ""
+	return cfg, nil
+}
+
+// ErrNoReplica is returned by a replica view for domains with fewer replicas
+var ErrNoReplica = errors.New("no replica configured")
+
+type replicaConfigManager struct {
+	base  DomainConfigManager
+	index int
+}
+
+// NewReplicaConfigManager wraps a DomainConfigManager so that each domain resolves to
+// its replica at index instead of its primary remote
+func NewReplicaConfigManager(base DomainConfigManager, index int) DomainConfigManager {
+	return &replicaConfigManager{base: base, index: index}
+}
+
+func (m *replicaConfigManager) GetDomainConfig(domain string) (DomainConfig, error) {
+	cfg, err := m.base.GetDomainConfig(domain)
+	if err != nil {
+		return DomainConfig{}, err
+	}
+	if m.index >= len(cfg.Replicas) {
+		return DomainConfig{}, fmt.Errorf("%w at index %d for: %s", ErrNoReplica, m.index, domain)
+	}
+
+	cfg.Rclone = cfg.Replicas[m.index]
+	return cfg, nil
+}
+
+// ErrNoMount is returned by a mount view for domains without the mount
+var ErrNoMount = errors.New("no mount configured")
+
+type mountConfigManager struct {
+	base   DomainConfigManager
+	prefix string
+}
+
+// NewMountConfigManager wraps a DomainConfigManager so that each domain resolves to its
+// mount at prefix instead of its own remote
+func NewMountConfigManager(base DomainConfigManager, prefix string) DomainConfigManager {
+	return &mountConfigManager{base: base, prefix: prefix}
+}
+
+func (m *mountConfigManager) GetDomainConfig(domain string) (DomainConfig, error) {
+	cfg, err := m.base.GetDomainConfig(domain)
+	if err != nil {
+		return DomainConfig{}, err
+	}
+	for _, mount := range cfg.Mounts {
+		if strings.Trim(mount.Prefix, "/") != m.prefix {
+			continue
+		}
+		cfg.Rclone = mount.Rclone
+		cfg.Root = mount.Root
+		if mount.Security != nil {
+			cfg.Security = *mount.Security
+		}
+		cfg.Replicas = nil
+		cfg.Mounts = nil
+		return cfg, nil
+	}
+	return DomainConfig{}, fmt.Errorf("%w at %q for: %s", ErrNoMount, m.prefix, domain)
+}
+
 type MockDomainConfigManager struct {
 	GetDomainConfigFunc func(domain string) (DomainConfig, error)
+	DomainsFunc         func() ([]string, error)
 }
 
 func (m *MockDomainConfigManager) GetDomainConfig(domain string) (DomainConfig, error) {
 	return m.GetDomainConfigFunc(domain)
 }
 
+func (m *MockDomainConfigManager) Domains() ([]string, error) {
+	return m.DomainsFunc()
+}
+
 // loadDomainsConfig reads and parses the domains.yaml file
 func (m *domainConfigManagerImpl) loadDomainsConfig() (DomainsConfig, error) {
 	var config DomainsConfig
@@ -117,4 +432,19 @@ func (m *domainConfigManagerImpl) GetDomainConfig(domain string) (DomainConfig,
 	}
 	
 	return DomainConfig{}, fmt.Errorf("domain config not found for: %s", domain)
-} 
\ No newline at end of file
+}
+
+// Domains returns the configured domains in sorted order
+func (m *domainConfigManagerImpl) Domains() ([]string, error) {
+	config, err := m.loadDomainsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make([]string, 0, len(config.Domains))
+	for domain := range config.Domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains, nil
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -81,4 +82,200 @@ func TestGetDomainConfig_InvalidYAML(t *testing.T) {
     assert.Error(t, err)
     assert.Contains(t, err.Error(), "error parsing config file")
     mockLoader.AssertExpectations(t)
-} 
\ No newline at end of file
+} 
+func TestDerivativeCacheConfigManager(t *testing.T) {
+    mockLoader := new(MockConfigLoader)
+    validYaml := `
+domains:
+  cached.com:
+    root: "sites/cached.com"
+    rclone:
+      remote: "source"
+    derivative_cache:
+      remote: "s3cache"
+      flags:
+        - "--s3-provider=Minio"
+  uncached.com:
+    rclone:
+      remote: "source"
+`
+    mockLoader.On("ReadConfig", "config/domains.yaml").Return([]byte(validYaml), nil)
+
+    manager := NewDerivativeCacheConfigManager(NewDomainConfigManager(mockLoader, "config/domains.yaml"))
+
+    config, err := manager.GetDomainConfig("cached.com")
+    assert.NoError(t, err)
+    assert.Equal(t, "s3cache", config.Rclone.Remote)
+    assert.Equal(t, []string{"--s3-provider=Minio"}, config.Rclone.Flags)
+    assert.Empty(t, config.Root)
+
+    _, err = manager.GetDomainConfig("uncached.com")
+    assert.ErrorIs(t, err, ErrNoDerivativeCache)
+}
+
+func TestGetDomainConfig_Timeouts(t *testing.T) {
+    mockLoader := new(MockConfigLoader)
+    validYaml := `
+domains:
+  example.com:
+    rclone:
+      remote: "remote1"
+    timeouts:
+      list: 5s
+      fetch: 1m30s
+`
+    mockLoader.On("ReadConfig", "config/domains.yaml").Return([]byte(validYaml), nil)
+
+    manager := NewDomainConfigManager(mockLoader, "config/domains.yaml")
+
+    config, err := manager.GetDomainConfig("example.com")
+    assert.NoError(t, err)
+    assert.Equal(t, 5*time.Second, config.Timeouts.List)
+    assert.Equal(t, 90*time.Second, config.Timeouts.Fetch)
+
+    timeouts := config.Timeouts.WithDefaults()
+    assert.Equal(t, 5*time.Second, timeouts.List)
+    assert.Equal(t, DefaultWriteTimeout, timeouts.Write)
+}
+
+func TestCacheSettings_WithDefaults(t *testing.T) {
+    settings := CacheSettings{}.WithDefaults()
+    assert.Equal(t, DefaultListingTTL, settings.ListingTTL)
+    assert.Equal(t, DefaultListingStale, settings.ListingStale)
+
+    settings = CacheSettings{ListingTTL: time.Minute, ListingStale: -1}.WithDefaults()
+    assert.Equal(t, time.Minute, settings.ListingTTL)
+    assert.Equal(t, time.Duration(0), settings.ListingStale)
+}
+
+func TestReplicaConfigManager(t *testing.T) {
+    mockLoader := new(MockConfigLoader)
+    validYaml := `
+domains:
+  example.com:
+    root: "sites/example.com"
+    rclone:
+      remote: "primary"
+    replicas:
+      - remote: "replica"
+      - backend: "s3"
+        s3:
+          bucket: "archive"
+`
+    mockLoader.On("ReadConfig", "config/domains.yaml").Return([]byte(validYaml), nil)
+    base := NewDomainConfigManager(mockLoader, "config/domains.yaml")
+
+    config, err := NewReplicaConfigManager(base, 0).GetDomainConfig("example.com")
+    assert.NoError(t, err)
+    assert.Equal(t, "replica", config.Rclone.Remote)
+    assert.Equal(t, "sites/example.com", config.Root)
+
+    config, err = NewReplicaConfigManager(base, 1).GetDomainConfig("example.com")
+    assert.NoError(t, err)
+    assert.Equal(t, BackendS3, config.Rclone.Backend)
+    assert.Equal(t, "archive", config.Rclone.S3.Bucket)
+
+    _, err = NewReplicaConfigManager(base, 2).GetDomainConfig("example.com")
+    assert.ErrorIs(t, err, ErrNoReplica)
+}
+
+func TestDomainConfig_Mounts(t *testing.T) {
+    mockLoader := new(MockConfigLoader)
+    validYaml := `
+domains:
+  brand.com:
+    rclone:
+      remote: "primary"
+    security:
+      mode: "hmac_timebound"
+    mounts:
+      - prefix: "products"
+        rclone:
+          backend: "s3"
+          s3:
+            bucket: "products"
+      - prefix: "/products/shoes/"
+        root: "catalogue/shoes"
+        rclone:
+          remote: "shoes"
+      - prefix: "press"
+        rclone:
+          remote: "nextcloud"
+          flags: ["--webdav-vendor=nextcloud"]
+        security:
+          api_keys:
+            - key: "press-key"
+`
+    mockLoader.On("ReadConfig", "config/domains.yaml").Return([]byte(validYaml), nil)
+    base := NewDomainConfigManager(mockLoader, "config/domains.yaml")
+    config, err := base.GetDomainConfig("brand.com")
+    assert.NoError(t, err)
+
+    tests := []struct {
+        path     string
+        prefix   string
+        relative string
+    }{
+        {path: "products", prefix: "products", relative: ""},
+        {path: "products/a.jpg", prefix: "products", relative: "a.jpg"},
+        {path: "products/shoes/b.jpg", prefix: "/products/shoes/", relative: "b.jpg"},
+        {path: "productshoes/c.jpg"},
+        {path: "press/2024/d.jpg", prefix: "press", relative: "2024/d.jpg"},
+        {path: "e.jpg"},
+    }
+    for _, tt := range tests {
+        mount, relative := config.MountFor(tt.path)
+        if tt.prefix == "" {
+            assert.Nil(t, mount, tt.path)
+            continue
+        }
+        if assert.NotNil(t, mount, tt.path) {
+            assert.Equal(t, tt.prefix, mount.Prefix)
+            assert.Equal(t, tt.relative, relative)
+        }
+    }
+
+    assert.Equal(t, HMACTimebound, config.SecurityFor("products/a.jpg").Mode)
+    assert.Equal(t, "press-key", config.SecurityFor("press/a.jpg").APIKeys[0].Key)
+
+    mounted, err := NewMountConfigManager(base, "products/shoes").GetDomainConfig("brand.com")
+    assert.NoError(t, err)
+    assert.Equal(t, "shoes", mounted.Rclone.Remote)
+    assert.Equal(t, "catalogue/shoes", mounted.Root)
+    assert.Empty(t, mounted.Mounts)
+
+    mounted, err = NewMountConfigManager(base, "press").GetDomainConfig("brand.com")
+    assert.NoError(t, err)
+    assert.Equal(t, []string{"--webdav-vendor=nextcloud"}, mounted.Rclone.Flags)
+    assert.Equal(t, SecurityMode(""), mounted.Security.Mode)
+
+    _, err = NewMountConfigManager(base, "archive").GetDomainConfig("brand.com")
+    assert.ErrorIs(t, err, ErrNoMount)
+}
+
+func TestDomains(t *testing.T) {
+    mockLoader := new(MockConfigLoader)
+    validYaml := `
+domains:
+  photos.example.com:
+    rclone:
+      remote: "remote1"
+    search:
+      index: true
+      interval: 30m
+  example.com:
+    rclone:
+      remote: "remote2"
+`
+    mockLoader.On("ReadConfig", "config/domains.yaml").Return([]byte(validYaml), nil)
+    manager := NewDomainConfigManager(mockLoader, "config/domains.yaml")
+
+    domains, err := manager.(DomainLister).Domains()
+    assert.NoError(t, err)
+    assert.Equal(t, []string{"example.com", "photos.example.com"}, domains)
+
+    config, err := manager.GetDomainConfig("photos.example.com")
+    assert.NoError(t, err)
+    assert.Equal(t, SearchSettings{Index: true, Interval: 30 * time.Minute}, config.Search)
+    assert.Equal(t, DefaultIndexInterval, SearchSettings{}.WithDefaults().Interval)
+}
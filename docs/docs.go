@@ -35,6 +35,30 @@ const docTemplate = `{
                         "name": "path",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Answer with 304 when the ETag matches",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Answer with 304 when the source is unchanged since",
+                        "name": "If-Modified-Since",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Byte ranges of a single file download, e.g. bytes=0-1023",
+                        "name": "Range",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only honour Range when the ETag or Last-Modified date still matches",
+                        "name": "If-Range",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -42,8 +66,41 @@ const docTemplate = `{
                         "description": "OK",
                         "schema": {
                             "type": "file"
+                        },
+                        "headers": {
+                            "Accept-Ranges": {
+                                "type": "string",
+                                "description": "bytes for single file downloads"
+                            },
+                            "ETag": {
+                                "type": "string",
+                                "description": "Strong validator derived from the source files and transform options"
+                            },
+                            "Last-Modified": {
+                                "type": "string",
+                                "description": "Most recent modification time of the source files"
+                            },
+                            "X-Storage-Remote": {
+                                "type": "string",
+                                "description": "Remote that served the storage reads, a replica while the primary is unavailable"
+                            }
+                        }
+                    },
+                    "206": {
+                        "description": "Requested byte ranges, multipart/byteranges for more than one range",
+                        "schema": {
+                            "type": "file"
+                        },
+                        "headers": {
+                            "Content-Range": {
+                                "type": "string",
+                                "description": "Range of the file contained in the response"
+                            }
                         }
                     },
+                    "304": {
+                        "description": "Not modified"
+                    },
                     "400": {
                         "description": "Invalid request parameters",
                         "schema": {
@@ -57,7 +114,7 @@ const docTemplate = `{
                         }
                     },
                     "403": {
-                        "description": "Forbidden - Invalid signature",
+                        "description": "Forbidden - Invalid signature or storage access denied",
                         "schema": {
                             "$ref": "#/definitions/utils.ErrorResponse"
                         }
@@ -74,11 +131,323 @@ const docTemplate = `{
                             "$ref": "#/definitions/utils.ErrorResponse"
                         }
                     },
+                    "416": {
+                        "description": "None of the requested ranges can be satisfied",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
                             "$ref": "#/definitions/utils.ErrorResponse"
                         }
+                    },
+                    "502": {
+                        "description": "Storage backend unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Transform queue is full, retry after the Retry-After header",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Storage backend timed out",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/files/{path}": {
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Store the request body at the specified path. The content type is sniffed and checked against the domain's allowed types.",
+                "consumes": [
+                    "*/*"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "files"
+                ],
+                "summary": "Upload a file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Path to store the file at",
+                        "name": "path",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Stored file, its path differs from the requested one when renamed or re-encoded",
+                        "schema": {
+                            "$ref": "#/definitions/handler.UploadResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid path or empty upload",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing API key",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Uploads are not enabled for the path",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "A file exists at the path and overwriting is denied",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "413": {
+                        "description": "Upload exceeds the domain's maximum size",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "415": {
+                        "description": "Content type is not allowed",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Storage backend unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Storage backend timed out",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Store the files of a multipart/form-data request in the specified directory, under their file names. The content types are sniffed and checked against the domain's allowed types.",
+                "consumes": [
+                    "multipart/form-data"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "files"
+                ],
+                "summary": "Upload files",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Directory to store the files in",
+                        "name": "path",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "file",
+                        "description": "Files to upload, the field name is not significant",
+                        "name": "file",
+                        "in": "formData",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Stored files",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/handler.UploadResponse"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid path, file name or form",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        },
+                        "headers": {
+                            "X-Stored-Path": {
+                                "type": "string",
+                                "description": "Files of the form stored before the error, which are kept, one URL-encoded path per header"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing API key",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Uploads are not enabled for the path",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "A file exists at the path and overwriting is denied",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        },
+                        "headers": {
+                            "X-Stored-Path": {
+                                "type": "string",
+                                "description": "Files of the form stored before the error, which are kept, one URL-encoded path per header"
+                            }
+                        }
+                    },
+                    "413": {
+                        "description": "Request exceeds the domain's maximum size",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        },
+                        "headers": {
+                            "X-Stored-Path": {
+                                "type": "string",
+                                "description": "Files of the form stored before the error, which are kept, one URL-encoded path per header"
+                            }
+                        }
+                    },
+                    "415": {
+                        "description": "Content type is not allowed",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        },
+                        "headers": {
+                            "X-Stored-Path": {
+                                "type": "string",
+                                "description": "Files of the form stored before the error, which are kept, one URL-encoded path per header"
+                            }
+                        }
+                    },
+                    "502": {
+                        "description": "Storage backend unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        },
+                        "headers": {
+                            "X-Stored-Path": {
+                                "type": "string",
+                                "description": "Files of the form stored before the error, which are kept, one URL-encoded path per header"
+                            }
+                        }
+                    },
+                    "504": {
+                        "description": "Storage backend timed out",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        },
+                        "headers": {
+                            "X-Stored-Path": {
+                                "type": "string",
+                                "description": "Files of the form stored before the error, which are kept, one URL-encoded path per header"
+                            }
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Delete the file at the specified path. Domains with a trash folder move it there instead, under its path and renamed if taken; deletes inside the trash are permanent.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "files"
+                ],
+                "summary": "Delete a file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Path of the file",
+                        "name": "path",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "1 to validate the delete without performing it",
+                        "name": "dry_run",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Deleted file, with its trash path when moved to the trash",
+                        "schema": {
+                            "$ref": "#/definitions/handler.FileOperationResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid path or the path is a directory",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid or missing API key",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Writes are not enabled for the path",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "File not found",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Storage backend unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Storage backend timed out",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
                     }
                 }
             }
@@ -164,6 +533,18 @@ const docTemplate = `{
                         "description": "Force download instead of display",
                         "name": "dl",
                         "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Answer with 304 when the ETag matches",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Answer with 304 when the source is unchanged since",
+                        "name": "If-Modified-Since",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -171,8 +552,29 @@ const docTemplate = `{
                         "description": "OK",
                         "schema": {
                             "type": "file"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Strong validator derived from the source file and transform options"
+                            },
+                            "Last-Modified": {
+                                "type": "string",
+                                "description": "Modification time of the source file"
+                            },
+                            "X-Cache": {
+                                "type": "string",
+                                "description": "HIT when served from the derivative cache, MISS otherwise"
+                            },
+                            "X-Storage-Remote": {
+                                "type": "string",
+                                "description": "Remote that served the storage reads, a replica while the primary is unavailable"
+                            }
                         }
                     },
+                    "304": {
+                        "description": "Not modified"
+                    },
                     "400": {
                         "description": "Invalid request parameters",
                         "schema": {
@@ -186,7 +588,7 @@ const docTemplate = `{
                         }
                     },
                     "403": {
-                        "description": "Forbidden - Invalid signature",
+                        "description": "Forbidden - Invalid signature or storage access denied",
                         "schema": {
                             "$ref": "#/definitions/utils.ErrorResponse"
                         }
@@ -208,6 +610,24 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/utils.ErrorResponse"
                         }
+                    },
+                    "502": {
+                        "description": "Storage backend unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Transform queue is full, retry after the Retry-After header",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Storage backend timed out",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
                     }
                 }
             }
@@ -219,12 +639,15 @@ const docTemplate = `{
                         "ApiKeyAuth": []
                     }
                 ],
-                "description": "Get a list of files and directories at the specified path",
+                "description": "Get a list of files and directories at the specified path. Without query parameters\nthe response is an array of all entries; with any of them it's a ListResponse page\nholding the entries after the cursor and a cursor for the next page.",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
-                    "application/json"
+                    "application/json",
+                    "application/x-ndjson",
+                    "text/csv",
+                    "text/html"
                 ],
                 "tags": [
                     "list"
@@ -233,22 +656,183 @@ const docTemplate = `{
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Path to list contents from",
+                        "description": "Path to list contents from, empty for the root",
                         "name": "path",
                         "in": "path",
                         "required": true
-                    }
-                ],
-                "responses": {
-                    "200": {
-                        "description": "List of files and directories",
-                        "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/utils.RcloneFile"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "List subdirectories too, their entries have paths relative to the listed one",
+                        "name": "recursive",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Levels of subdirectories to list, implies recursive",
+                        "name": "depth",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Entries per page, 1000 by default and at most 10000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "nextCursor of the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "name",
+                            "size",
+                            "modtime",
+                            "captured"
+                        ],
+                        "type": "string",
+                        "description": "Sort by name, size, modtime or captured (EXIF capture date, else modtime)",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "description": "Sort order",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma separated MIME types to include, e.g. image/*",
+                        "name": "type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma separated extension globs to include, e.g. jp*g,png",
+                        "name": "ext",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only images at least this wide",
+                        "name": "min_width",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only images at least this high",
+                        "name": "min_height",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only files whose name contains the keyword or that are tagged with it",
+                        "name": "keyword",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "json",
+                            "ndjson",
+                            "csv",
+                            "html"
+                        ],
+                        "type": "string",
+                        "description": "Output format, negotiated from Accept when missing",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma separated columns of CSV listings, e.g. path,size,width,height,downloadUrl",
+                        "name": "columns",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Attach url, thumbnailUrl and downloadUrl to the entries, signed for protected paths",
+                        "name": "sign",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Named transform parameters of the domain for url",
+                        "name": "preset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Width of url, overrides the preset; h, fit, fm, q, dpr and blur are passed on too",
+                        "name": "w",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Attach the file count, total bytes and image count below each directory",
+                        "name": "stats",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Attach the cover image of each directory: cover.jpg or folder.jpg, else the image captured first",
+                        "name": "cover",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Answer with 304 when the ETag matches, not for signed listings or those with directory aggregates",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Answer with 304 when no entry changed since",
+                        "name": "If-Modified-Since",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "List of files and directories",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/utils.RcloneFile"
+                            }
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Strong validator derived from the listed entries"
+                            },
+                            "Last-Modified": {
+                                "type": "string",
+                                "description": "Most recent modification time of the listed entries"
+                            },
+                            "X-Next-Cursor": {
+                                "type": "string",
+                                "description": "Cursor of the next page, for paginated NDJSON and CSV listings"
+                            },
+                            "X-Storage-Remote": {
+                                "type": "string",
+                                "description": "Remote that served the storage reads, a replica while the primary is unavailable"
+                            },
+                            "X-Total-Count": {
+                                "type": "string",
+                                "description": "Entries matching the filters, for paginated NDJSON and CSV listings"
                             }
                         }
                     },
+                    "304": {
+                        "description": "Not modified"
+                    },
                     "400": {
                         "description": "Invalid request parameters",
                         "schema": {
@@ -261,6 +845,12 @@ const docTemplate = `{
                             "$ref": "#/definitions/utils.ErrorResponse"
                         }
                     },
+                    "403": {
+                        "description": "Storage access denied",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
                     "404": {
                         "description": "Path not found",
                         "schema": {
@@ -272,12 +862,414 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/utils.ErrorResponse"
                         }
+                    },
+                    "502": {
+                        "description": "Storage backend unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Storage backend timed out",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/metrics": {
+            "get": {
+                "description": "Get the current transform queue depth, scheduler and cache counters",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "metrics"
+                ],
+                "summary": "Runtime metrics",
+                "responses": {
+                    "200": {
+                        "description": "Current runtime metrics",
+                        "schema": {
+                            "$ref": "#/definitions/handler.MetricsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request parameters",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/search/{path}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Search the index of a domain, or of a folder of it, by keyword, capture date, dimensions\nand file name. Domains are indexed in the background when their search.index is set,\nresults reflect the last crawl and the changes seen since. Result paths are full paths.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "search"
+                ],
+                "summary": "Search the files of a domain",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Folder to search in, empty for the whole domain",
+                        "name": "path",
+                        "in": "path"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only files whose name contains the keyword or that are tagged with it",
+                        "name": "keyword",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only files whose name contains this text, or matches it as a glob such as IMG_*.jpg",
+                        "name": "name",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only files captured (else modified) from this year, month, date or RFC 3339 time on, e.g. 2024",
+                        "name": "from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only files captured (else modified) up to and including this year, month, date or time",
+                        "name": "to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only images at least this wide",
+                        "name": "min_width",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only images at least this high",
+                        "name": "min_height",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only images at most this wide",
+                        "name": "max_width",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only images at most this high",
+                        "name": "max_height",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma separated MIME types to include, e.g. image/*",
+                        "name": "type",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma separated extension globs to include, e.g. jp*g,png",
+                        "name": "ext",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "name",
+                            "size",
+                            "modtime",
+                            "captured"
+                        ],
+                        "type": "string",
+                        "description": "Sort by name, size, modtime or captured (EXIF capture date, else modtime)",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "description": "Sort order",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Results per page, 1000 by default and at most 10000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "nextCursor of the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Attach url, thumbnailUrl and downloadUrl to the results, signed for protected paths",
+                        "name": "sign",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Page of matching files",
+                        "schema": {
+                            "$ref": "#/definitions/handler.ListResponse"
+                        },
+                        "headers": {
+                            "X-Indexed-At": {
+                                "type": "string",
+                                "description": "When the last crawl of the domain finished"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request parameters",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized - Invalid or missing API key",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Search isn't enabled for the domain",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "The domain hasn't been indexed yet",
+                        "schema": {
+                            "$ref": "#/definitions/utils.ErrorResponse"
+                        }
                     }
                 }
             }
         }
     },
     "definitions": {
+        "handler.CoverImage": {
+            "type": "object",
+            "properties": {
+                "height": {
+                    "type": "integer"
+                },
+                "path": {
+                    "description": "relative to the listed directory, like FileResponse.Path",
+                    "type": "string"
+                },
+                "thumbnailUrl": {
+                    "description": "of signed listings",
+                    "type": "string"
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.DirectoryStats": {
+            "type": "object",
+            "properties": {
+                "fileCount": {
+                    "type": "integer"
+                },
+                "imageCount": {
+                    "type": "integer"
+                },
+                "totalBytes": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.FileOperationResponse": {
+            "type": "object",
+            "properties": {
+                "destination": {
+                    "description": "of moves, copies and deletes moved to the trash",
+                    "type": "string"
+                },
+                "dryRun": {
+                    "type": "boolean"
+                },
+                "operation": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                }
+            }
+        },
+        "handler.FileResponse": {
+            "type": "object",
+            "properties": {
+                "capturedAt": {
+                    "type": "string"
+                },
+                "cover": {
+                    "$ref": "#/definitions/handler.CoverImage"
+                },
+                "downloadUrl": {
+                    "type": "string"
+                },
+                "height": {
+                    "type": "integer"
+                },
+                "isDir": {
+                    "type": "boolean"
+                },
+                "keywords": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "mimeType": {
+                    "type": "string"
+                },
+                "modTime": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                },
+                "stats": {
+                    "description": "Aggregates of directories, with stats= and cover=",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/handler.DirectoryStats"
+                        }
+                    ]
+                },
+                "thumbnailUrl": {
+                    "description": "image, with the thumbnail preset",
+                    "type": "string"
+                },
+                "url": {
+                    "description": "URLs of signed listings, signed when the path is protected",
+                    "type": "string"
+                },
+                "width": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.ListResponse": {
+            "type": "object",
+            "properties": {
+                "files": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/handler.FileResponse"
+                    }
+                },
+                "pagination": {
+                    "$ref": "#/definitions/handler.Pagination"
+                }
+            }
+        },
+        "handler.MetricsResponse": {
+            "type": "object",
+            "properties": {
+                "derivativeCache": {
+                    "$ref": "#/definitions/utils.DerivativeCacheStats"
+                },
+                "transform": {
+                    "$ref": "#/definitions/utils.SchedulerStats"
+                }
+            }
+        },
+        "handler.Pagination": {
+            "type": "object",
+            "properties": {
+                "limit": {
+                    "type": "integer"
+                },
+                "nextCursor": {
+                    "description": "empty on the last page",
+                    "type": "string"
+                },
+                "total": {
+                    "description": "entries matching the filters across all pages",
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.UploadResponse": {
+            "type": "object",
+            "properties": {
+                "mimeType": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                },
+                "size": {
+                    "type": "integer"
+                }
+            }
+        },
+        "utils.DerivativeCacheStats": {
+            "type": "object",
+            "properties": {
+                "bytes": {
+                    "type": "integer"
+                },
+                "entries": {
+                    "type": "integer"
+                },
+                "errors": {
+                    "type": "integer"
+                },
+                "evictions": {
+                    "type": "integer"
+                },
+                "hits": {
+                    "type": "integer"
+                },
+                "maxBytes": {
+                    "type": "integer"
+                },
+                "misses": {
+                    "type": "integer"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "skipped": {
+                    "type": "integer"
+                },
+                "tiers": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/utils.DerivativeCacheStats"
+                    }
+                }
+            }
+        },
         "utils.ErrorResponse": {
             "type": "object",
             "properties": {
@@ -295,6 +1287,13 @@ const docTemplate = `{
         "utils.RcloneFile": {
             "type": "object",
             "properties": {
+                "Hashes": {
+                    "description": "only present when listed with --hash",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
                 "IsDir": {
                     "type": "boolean"
                 },
@@ -314,6 +1313,38 @@ const docTemplate = `{
                     "type": "integer"
                 }
             }
+        },
+        "utils.SchedulerStats": {
+            "type": "object",
+            "properties": {
+                "bulkQueued": {
+                    "type": "integer"
+                },
+                "completed": {
+                    "type": "integer"
+                },
+                "interactiveQueued": {
+                    "type": "integer"
+                },
+                "maxConcurrent": {
+                    "type": "integer"
+                },
+                "maxQueue": {
+                    "type": "integer"
+                },
+                "queueDepth": {
+                    "type": "integer"
+                },
+                "rejected": {
+                    "type": "integer"
+                },
+                "running": {
+                    "type": "integer"
+                },
+                "timedOut": {
+                    "type": "integer"
+                }
+            }
         }
     },
     "securityDefinitions": {
@@ -2,11 +2,18 @@ package handler
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"path/filepath"
-	"strings"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"shuto-api/config"
 	"shuto-api/security"
@@ -20,13 +27,28 @@ import (
 // @Accept  json
 // @Produce  octet-stream
 // @Param   path     path    string     true        "Path to the file to download"
+// @Param   If-None-Match     header  string  false  "Answer with 304 when the ETag matches"
+// @Param   If-Modified-Since header  string  false  "Answer with 304 when the source is unchanged since"
+// @Param   Range             header  string  false  "Byte ranges of a single file download, e.g. bytes=0-1023"
+// @Param   If-Range          header  string  false  "Only honour Range when the ETag or Last-Modified date still matches"
 // @Success 200 {file}  []byte
+// @Success 206 {file}  []byte "Requested byte ranges, multipart/byteranges for more than one range"
+// @Success 304 "Not modified"
+// @Header  200 {string} Accept-Ranges "bytes for single file downloads"
+// @Header  206 {string} Content-Range "Range of the file contained in the response"
+// @Header  200 {string} ETag "Strong validator derived from the source files and transform options"
+// @Header  200 {string} Last-Modified "Most recent modification time of the source files"
+// @Header  200 {string} X-Storage-Remote "Remote that served the storage reads, a replica while the primary is unavailable"
 // @Failure 400 {object} utils.ErrorResponse "Invalid request parameters"
 // @Failure 401 {object} utils.ErrorResponse "Unauthorized - Invalid signature"
-// @Failure 403 {object} utils.ErrorResponse "Forbidden - Invalid signature"
+// @Failure 403 {object} utils.ErrorResponse "Forbidden - Invalid signature or storage access denied"
 // @Failure 404 {object} utils.ErrorResponse "File not found"
 // @Failure 410 {object} utils.ErrorResponse "Gone - Token expired"
+// @Failure 416 {object} utils.ErrorResponse "None of the requested ranges can be satisfied"
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Failure 502 {object} utils.ErrorResponse "Storage backend unavailable"
+// @Failure 503 {object} utils.ErrorResponse "Transform queue is full, retry after the Retry-After header"
+// @Failure 504 {object} utils.ErrorResponse "Storage backend timed out"
 // @Router /download/{path} [get]
 func DownloadHandler(w http.ResponseWriter, r *http.Request, imageUtils utils.ImageUtils, rclone utils.Rclone, domainConfig config.DomainConfigManager) {
 	if r.Method != http.MethodGet {
@@ -35,9 +57,9 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request, imageUtils utils.Im
 	}
 
 	domain := utils.GetDomainFromRequest(r)
-	path := strings.TrimPrefix(r.URL.Path, "/"+config.ApiVersion+"/download/")
-	if path == "" {
-		utils.WriteInvalidPathError(w, "Path is required")
+	path, err := utils.RequestPath(r, "download")
+	if err != nil {
+		utils.WriteInvalidPathError(w, err.Error())
 		return
 	}
 
@@ -47,8 +69,8 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request, imageUtils utils.Im
 		return
 	}
 
-	if cfg.Security.Mode != "" {
-		if err := security.ValidateSignedURLFromConfig(path, r.URL.Query(), cfg.Security.Secrets, cfg.Security.ValidityWindow); err != nil {
+	if settings := cfg.SecurityFor(path); settings.Mode != "" {
+		if err := security.ValidateSignedURLFromConfig(path, r.URL.Query(), settings.Secrets, settings.ValidityWindow); err != nil {
 			switch err {
 			case security.ErrKeyNotFound:
 				utils.WriteUnauthorizedError(w, "Invalid security key")
@@ -61,9 +83,9 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request, imageUtils utils.Im
 		}
 	}
 
-	files, err := rclone.ListPath(path, domain)
+	files, err := rclone.ListPath(r.Context(), path, domain)
 	if err != nil {
-		utils.WriteInternalError(w, "Failed to list files", err.Error())
+		utils.WriteStorageError(w, "Failed to list files", err)
 		return
 	}
 
@@ -73,9 +95,20 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request, imageUtils utils.Im
 		return
 	}
 
+	// Answer conditional requests before fetching anything
+	variant := "download"
+	if utils.HasImageTransformParams(r) {
+		variant += "|" + utils.ParseImageOptionsFromRequest(r).CacheKey()
+	}
+	etag := utils.ListingETag(files, variant)
+	lastModified, _ := utils.LastModified(files...)
+	if utils.CheckNotModified(w, r, etag, lastModified) {
+		return
+	}
+
 	// Handle single file download
 	if len(files) == 1 && !files[0].IsDir {
-		handleSingleFileDownload(w, r, path, domain, imageUtils, rclone)
+		handleSingleFileDownload(w, r, path, domain, files[0], etag, lastModified, imageUtils, rclone)
 		return
 	}
 
@@ -96,48 +129,157 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request, imageUtils utils.Im
 	handleFolderDownload(w, r, path, files, domain, imageUtils, rclone)
 }
 
-func handleSingleFileDownload(w http.ResponseWriter, r *http.Request, path string, domain string, imageUtils utils.ImageUtils, rclone utils.Rclone) {
-	content, err := rclone.FetchImage(path, domain)
-	if err != nil {
-		utils.WriteNotFoundError(w, "Failed to fetch file", err.Error())
-		return
-	}
+func handleSingleFileDownload(w http.ResponseWriter, r *http.Request, path string, domain string, file utils.RcloneFile, etag string, lastModified time.Time, imageUtils utils.ImageUtils, rclone utils.Rclone) {
+	w.Header().Set("Accept-Ranges", "bytes")
 
-	// Process image if it's an image file and has transformation parameters
+	// Transformed downloads are rendered in memory, ranges are served from the result
 	if utils.IsImageFile(path) && utils.HasImageTransformParams(r) {
+		content, err := rclone.FetchImage(r.Context(), path, domain)
+		if err != nil {
+			utils.WriteStorageError(w, "Failed to fetch file", err)
+			return
+		}
+
 		options := utils.ParseImageOptionsFromRequest(r)
-		content, err = imageUtils.TransformImage(content, options)
+		content, err = imageUtils.TransformImage(r.Context(), content, options)
 		if err != nil {
-			utils.WriteInternalError(w, "Failed to transform image", err.Error())
+			writeTransformError(w, err)
+			return
+		}
+
+		ranges, ok := parseDownloadRanges(w, r, int64(len(content)), etag, lastModified)
+		if !ok {
+			return
+		}
+		if ranges != nil {
+			w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(path)+"\"")
+			utils.ServeRanges(w, ranges, int64(len(content)), http.DetectContentType(content), func(offset int64, count int64) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(content[offset : offset+count])), nil
+			})
 			return
 		}
+		writeDownload(w, path, content)
+		return
 	}
 
+	// Ranges of untransformed files are read from the storage, not the whole object
+	ranges, ok := parseDownloadRanges(w, r, file.Size, etag, lastModified)
+	if !ok {
+		return
+	}
+	if ranges != nil {
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(path)+"\"")
+		err := utils.ServeRanges(w, ranges, file.Size, downloadContentType(path, file), func(offset int64, count int64) (io.ReadCloser, error) {
+			return rclone.OpenRange(r.Context(), path, domain, offset, count)
+		})
+		if err != nil {
+			w.Header().Del("Content-Disposition")
+			utils.WriteStorageError(w, "Failed to fetch file", err)
+		}
+		return
+	}
+
+	stream, err := rclone.Open(r.Context(), path, domain)
+	if err != nil {
+		utils.WriteStorageError(w, "Failed to fetch file", err)
+		return
+	}
+	defer stream.Close()
+
+	// Sniff the content type from the start of the stream without consuming it
+	reader := bufio.NewReader(stream)
+	head, err := reader.Peek(512)
+	if len(head) == 0 && err != nil && err != io.EOF {
+		utils.WriteStorageError(w, "Failed to fetch file", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(head))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(path)+"\"")
+	if stream.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(stream.Size, 10))
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		utils.Warn("Failed to stream download", "path", path, "error", err)
+	}
+}
+
+// writeDownload sends a file rendered in memory as an attachment
+func writeDownload(w http.ResponseWriter, path string, content []byte) {
 	mimeType := http.DetectContentType(content)
 	w.Header().Set("Content-Type", mimeType)
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(path)+"\"")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
 	w.Write(content)
 }
 
+// parseDownloadRanges returns the ranges to serve, or nil when the whole file should be sent.
+// It returns false when a 416 Range Not Satisfiable response has been written.
+func parseDownloadRanges(w http.ResponseWriter, r *http.Request, size int64, etag string, lastModified time.Time) ([]utils.ByteRange, bool) {
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" || size < 0 || !utils.IfRangeMatches(r, etag, lastModified) {
+		return nil, true
+	}
+
+	ranges, err := utils.ParseRange(rangeHeader, size)
+	if errors.Is(err, utils.ErrRangeNotSatisfiable) {
+		utils.WriteRangeNotSatisfiableError(w, size)
+		return nil, false
+	}
+	if err != nil {
+		// Malformed ranges are ignored and the whole file is sent
+		utils.Debug("Ignoring invalid range header", "range", rangeHeader)
+		return nil, true
+	}
+	return ranges, true
+}
+
+// downloadContentType determines the content type of a file without reading it, as
+// a partial response does not contain enough of the file to sniff it
+func downloadContentType(path string, file utils.RcloneFile) string {
+	if file.MimeType != "" {
+		return file.MimeType
+	}
+	if mimeType := mime.TypeByExtension(filepath.Ext(path)); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
 func handleFolderDownload(w http.ResponseWriter, r *http.Request, path string, files []utils.RcloneFile, domain string, imageUtils utils.ImageUtils, rclone utils.Rclone) {
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(path)+".zip\"")
 
-	zipWriter := zip.NewWriter(w)
-	defer zipWriter.Close()
+	// The zip writer is only created once the first entry is ready, so that a
+	// saturated transform queue can still be reported with a proper status code
+	var zipWriter *zip.Writer
+	aborted := false
+	defer func() {
+		if aborted {
+			return
+		}
+		if zipWriter == nil {
+			zipWriter = zip.NewWriter(w)
+		}
+		zipWriter.Close()
+	}()
 
 	options := utils.ParseImageOptionsFromRequest(r)
 	hasTransformParams := utils.HasImageTransformParams(r)
 
-	// Create a channel to receive processed files
+	// Create a channel to receive processed files. Transformed images are rendered
+	// in memory, everything else is streamed straight into its zip entry.
 	type processedFile struct {
-		name    string
+		file    utils.RcloneFile
 		content []byte
+		stream  io.ReadCloser
 		err     error
 	}
-	results := make(chan processedFile)
+	// Buffered so that workers never block once we stop reading results
+	results := make(chan processedFile, len(files))
 
-	// Create a worker pool to limit concurrent operations
+	// Create a worker pool to limit concurrent operations, an open stream holds
+	// its slot until it has been copied into the archive
 	const maxWorkers = 5
 	sem := make(chan struct{}, maxWorkers)
 	var activeWorkers int32
@@ -151,25 +293,33 @@ func handleFolderDownload(w http.ResponseWriter, r *http.Request, path string, f
 		go func(f utils.RcloneFile) {
 			// Acquire semaphore
 			sem <- struct{}{}
-			defer func() { <-sem }()
 
 			filePath := filepath.Join(path, f.Name)
-			content, err := rclone.FetchImage(filePath, domain)
+			if !hasTransformParams || !utils.IsImageFile(filePath) {
+				stream, err := rclone.Open(r.Context(), filePath, domain)
+				if err != nil {
+					<-sem
+					results <- processedFile{file: f, err: err}
+					return
+				}
+				results <- processedFile{file: f, stream: &releasingReader{ReadCloser: stream, release: func() { <-sem }}}
+				return
+			}
+			defer func() { <-sem }()
+
+			content, err := rclone.FetchImage(r.Context(), filePath, domain)
 			if err != nil {
-				results <- processedFile{name: f.Name, err: err}
+				results <- processedFile{file: f, err: err}
 				return
 			}
 
-			// Process image if needed
-			if hasTransformParams && utils.IsImageFile(filePath) {
-				content, err = imageUtils.TransformImage(content, options)
-				if err != nil {
-					results <- processedFile{name: f.Name, err: err}
-					return
-				}
+			content, err = imageUtils.TransformImage(r.Context(), content, options)
+			if err != nil {
+				results <- processedFile{file: f, err: err}
+				return
 			}
 
-			results <- processedFile{name: f.Name, content: content}
+			results <- processedFile{file: f, content: content}
 		}(file)
 
 		atomic.AddInt32(&activeWorkers, 1)
@@ -182,19 +332,69 @@ func handleFolderDownload(w http.ResponseWriter, r *http.Request, path string, f
 		atomic.AddInt32(&processedCount, 1)
 
 		if result.err != nil {
-			utils.Debug("Failed to process file", "error", result.err, "file", result.name)
+			var busy *utils.SchedulerBusyError
+			if zipWriter == nil && errors.As(result.err, &busy) {
+				aborted = true
+				w.Header().Del("Content-Disposition")
+				writeTransformError(w, result.err)
+				// Close the streams of the remaining results, releasing their worker slots
+				remaining := atomic.LoadInt32(&activeWorkers) - atomic.LoadInt32(&processedCount)
+				go func() {
+					for ; remaining > 0; remaining-- {
+						if pending := <-results; pending.stream != nil {
+							pending.stream.Close()
+						}
+					}
+				}()
+				return
+			}
+			utils.Debug("Failed to process file", "error", result.err, "file", result.file.Name)
 			continue
 		}
 
-		f, err := zipWriter.Create(result.name)
-		if err != nil {
-			utils.Debug("Failed to create zip entry", "error", err, "file", result.name)
-			continue
+		if zipWriter == nil {
+			zipWriter = zip.NewWriter(w)
 		}
 
-		if _, err := f.Write(result.content); err != nil {
-			utils.Debug("Failed to write to zip", "error", err, "file", result.name)
+		if err := writeZipEntry(zipWriter, result.file, result.content, result.stream); err != nil {
+			utils.Debug("Failed to write to zip", "error", err, "file", result.file.Name)
 			continue
 		}
 	}
-}
\ No newline at end of file
+}
+
+// writeZipEntry adds a file to the archive, from memory or from an open stream
+func writeZipEntry(zipWriter *zip.Writer, file utils.RcloneFile, content []byte, stream io.ReadCloser) error {
+	if stream != nil {
+		defer stream.Close()
+	}
+
+	header := &zip.FileHeader{Name: file.Name, Method: zip.Deflate}
+	if modTime, ok := utils.LastModified(file); ok {
+		header.Modified = modTime
+	}
+	entry, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to create zip entry: %w", err)
+	}
+
+	if stream != nil {
+		_, err = io.Copy(entry, stream)
+	} else {
+		_, err = entry.Write(content)
+	}
+	return err
+}
+
+// releasingReader calls release once the stream has been closed
+type releasingReader struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releasingReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
@@ -1,14 +1,32 @@
 package handler
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"shuto-api/config"
 	"shuto-api/utils"
 )
 
+// openFromFetch streams the data returned by a FetchImage mock
+func openFromFetch(fetch func(context.Context, string, string) ([]byte, error)) func(context.Context, string, string) (*utils.FileStream, error) {
+	return func(ctx context.Context, path, domain string) (*utils.FileStream, error) {
+		data, err := fetch(ctx, path, domain)
+		if err != nil {
+			return nil, err
+		}
+		return &utils.FileStream{ReadCloser: io.NopCloser(bytes.NewReader(data)), Size: int64(len(data))}, nil
+	}
+}
+
 func TestDownloadHandler(t *testing.T) {
 	defaultDomainConfig := func(domain string) (config.DomainConfig, error) {
 		return config.DomainConfig{}, nil
@@ -30,21 +48,21 @@ func TestDownloadHandler(t *testing.T) {
 		name           string
 		path           string
 		queryParams    map[string]string
-		mockFetch      func(string, string) ([]byte, error)
-		mockList       func(string, string) ([]utils.RcloneFile, error)
+		mockFetch      func(context.Context, string, string) ([]byte, error)
+		mockList       func(context.Context, string, string) ([]utils.RcloneFile, error)
 		mockDomainConfig func(string) (config.DomainConfig, error)
 		expectedStatus int
 		expectedHeaders map[string]string
 	}{
 		{
 			name: "Basic download without security",
-			path: "/download/test.jpg",
-			mockList: func(path, domain string) ([]utils.RcloneFile, error) {
+			path: "/v2/download/test.jpg",
+			mockList: func(ctx context.Context, path, domain string) ([]utils.RcloneFile, error) {
 				return []utils.RcloneFile{
 					{Name: "test.jpg", Size: 1024, IsDir: false},
 				}, nil
 			},
-			mockFetch: func(path, domain string) ([]byte, error) {
+			mockFetch: func(ctx context.Context, path, domain string) ([]byte, error) {
 				return []byte("test-data"), nil
 			},
 			mockDomainConfig: defaultDomainConfig,
@@ -56,8 +74,8 @@ func TestDownloadHandler(t *testing.T) {
 		},
 		{
 			name: "Download with security - missing signature",
-			path: "/download/test.jpg",
-			mockList: func(path, domain string) ([]utils.RcloneFile, error) {
+			path: "/v2/download/test.jpg",
+			mockList: func(ctx context.Context, path, domain string) ([]utils.RcloneFile, error) {
 				return []utils.RcloneFile{}, nil
 			},
 			mockDomainConfig: securedDomainConfig,
@@ -65,13 +83,13 @@ func TestDownloadHandler(t *testing.T) {
 		},
 		{
 			name: "Download with security - expired URL",
-			path: "/download/test.jpg",
+			path: "/v2/download/test.jpg",
 			queryParams: map[string]string{
 				"kid": "v1",
 				"ts":  "1000", // Old timestamp
 				"sig": "invalid",
 			},
-			mockList: func(path, domain string) ([]utils.RcloneFile, error) {
+			mockList: func(ctx context.Context, path, domain string) ([]utils.RcloneFile, error) {
 				return []utils.RcloneFile{}, nil
 			},
 			mockDomainConfig: securedDomainConfig,
@@ -79,13 +97,13 @@ func TestDownloadHandler(t *testing.T) {
 		},
 		{
 			name: "Download with security - invalid key",
-			path: "/download/test.jpg",
+			path: "/v2/download/test.jpg",
 			queryParams: map[string]string{
 				"kid": "v2", // Non-existent key
 				"ts":  "1000",
 				"sig": "invalid",
 			},
-			mockList: func(path, domain string) ([]utils.RcloneFile, error) {
+			mockList: func(ctx context.Context, path, domain string) ([]utils.RcloneFile, error) {
 				return []utils.RcloneFile{}, nil
 			},
 			mockDomainConfig: securedDomainConfig,
@@ -93,14 +111,14 @@ func TestDownloadHandler(t *testing.T) {
 		},
 		{
 			name: "Download size exceeds limit",
-			path: "/download/large-folder",
-			mockList: func(path, domain string) ([]utils.RcloneFile, error) {
+			path: "/v2/download/large-folder",
+			mockList: func(ctx context.Context, path, domain string) ([]utils.RcloneFile, error) {
 				return []utils.RcloneFile{
 					{Name: "large1.file", Size: 1 * 1024 * 1024 * 1024, IsDir: false}, // 1GB
 					{Name: "large2.file", Size: 1 * 1024 * 1024 * 1024, IsDir: false}, // 1GB
 				}, nil
 			},
-			mockFetch: func(path, domain string) ([]byte, error) {
+			mockFetch: func(ctx context.Context, path, domain string) ([]byte, error) {
 				return []byte("test-data"), nil
 			},
 			mockDomainConfig: defaultDomainConfig,
@@ -112,6 +130,7 @@ func TestDownloadHandler(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockRclone := &utils.MockRclone{
 				FetchImageFunc: tt.mockFetch,
+				OpenFunc:       openFromFetch(tt.mockFetch),
 				ListPathFunc:   tt.mockList,
 			}
 
@@ -151,4 +170,231 @@ func TestDownloadHandler(t *testing.T) {
 			}
 		})
 	}
-} 
\ No newline at end of file
+} 
+func TestDownloadHandler_NotModified(t *testing.T) {
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path, domain string) ([]utils.RcloneFile, error) {
+			return []utils.RcloneFile{
+				{Path: "test.jpg", Name: "test.jpg", Size: 1024, ModTime: "2024-01-01T00:00:00Z"},
+			}, nil
+		},
+		FetchImageFunc: func(ctx context.Context, path, domain string) ([]byte, error) {
+			return []byte("test-data"), nil
+		},
+		OpenFunc: openFromFetch(func(ctx context.Context, path, domain string) ([]byte, error) {
+			return []byte("test-data"), nil
+		}),
+	}
+	mockImageUtils := &MockImageUtils{
+		TransformImageFunc: func([]byte, utils.ImageTransformOptions) ([]byte, error) {
+			return []byte("transformed"), nil
+		},
+		GetMimeTypeFunc: func([]byte) (string, error) {
+			return "image/jpeg", nil
+		},
+	}
+	mockDomainConfig := &MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+
+	serve := func(target string, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		DownloadHandler(rr, req, mockImageUtils, mockRclone, mockDomainConfig)
+		return rr
+	}
+
+	first := serve("/v2/download/test.jpg", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with ETag, got %d %q", first.Code, etag)
+	}
+
+	if rr := serve("/v2/download/test.jpg", etag); rr.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", rr.Code)
+	}
+	if rr := serve("/v2/download/test.jpg?w=100", etag); rr.Code == http.StatusNotModified {
+		t.Errorf("expected transformed download to use a different ETag")
+	}
+}
+
+func TestDownloadHandler_Range(t *testing.T) {
+	content := []byte("0123456789")
+	var fullFetches int32
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path, domain string) ([]utils.RcloneFile, error) {
+			return []utils.RcloneFile{
+				{Path: "raw.bin", Name: "raw.bin", Size: int64(len(content)), ModTime: "2024-01-01T00:00:00Z"},
+			}, nil
+		},
+		OpenFunc: openFromFetch(func(ctx context.Context, path, domain string) ([]byte, error) {
+			atomic.AddInt32(&fullFetches, 1)
+			return content, nil
+		}),
+		OpenRangeFunc: func(ctx context.Context, path, domain string, offset int64, count int64) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(content[offset : offset+count])), nil
+		},
+	}
+	mockDomainConfig := &MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v2/download/raw.bin", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		DownloadHandler(rr, req, &MockImageUtils{}, mockRclone, mockDomainConfig)
+		return rr
+	}
+
+	full := serve(nil)
+	if full.Code != http.StatusOK || full.Header().Get("Accept-Ranges") != "bytes" || full.Header().Get("Content-Length") != "10" {
+		t.Fatalf("unexpected full download: %d %v", full.Code, full.Header())
+	}
+	etag := full.Header().Get("ETag")
+
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		expectedCode int
+		expectedBody string
+		contentRange string
+	}{
+		{
+			name:         "Single range",
+			headers:      map[string]string{"Range": "bytes=2-5"},
+			expectedCode: http.StatusPartialContent,
+			expectedBody: "2345",
+			contentRange: "bytes 2-5/10",
+		},
+		{
+			name:         "Resume from offset",
+			headers:      map[string]string{"Range": "bytes=7-", "If-Range": etag},
+			expectedCode: http.StatusPartialContent,
+			expectedBody: "789",
+			contentRange: "bytes 7-9/10",
+		},
+		{
+			name:         "Stale If-Range sends the whole file",
+			headers:      map[string]string{"Range": "bytes=7-", "If-Range": `"stale"`},
+			expectedCode: http.StatusOK,
+			expectedBody: "0123456789",
+		},
+		{
+			name:         "Unsatisfiable range",
+			headers:      map[string]string{"Range": "bytes=20-"},
+			expectedCode: http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(tt.headers)
+			if rr.Code != tt.expectedCode {
+				t.Fatalf("expected status %d, got %d", tt.expectedCode, rr.Code)
+			}
+			if tt.expectedBody != "" && rr.Body.String() != tt.expectedBody {
+				t.Errorf("expected body %q, got %q", tt.expectedBody, rr.Body.String())
+			}
+			if got := rr.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("expected Content-Range %q, got %q", tt.contentRange, got)
+			}
+		})
+	}
+
+	// Only the full downloads fetch the whole object
+	if got := atomic.LoadInt32(&fullFetches); got != 2 {
+		t.Errorf("expected 2 full fetches, got %d", got)
+	}
+
+	multi := serve(map[string]string{"Range": "bytes=0-1,8-9"})
+	if multi.Code != http.StatusPartialContent || !strings.HasPrefix(multi.Header().Get("Content-Type"), "multipart/byteranges; boundary=") {
+		t.Errorf("expected multipart/byteranges, got %d %q", multi.Code, multi.Header().Get("Content-Type"))
+	}
+}
+
+// closeRecorder records whether a stream has been closed
+type closeRecorder struct {
+	io.Reader
+	closed *int32
+}
+
+func (c closeRecorder) Close() error {
+	atomic.AddInt32(c.closed, 1)
+	return nil
+}
+
+func TestDownloadHandler_FolderStreamsEntries(t *testing.T) {
+	var closed int32
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path, domain string) ([]utils.RcloneFile, error) {
+			return []utils.RcloneFile{
+				{Name: "notes.txt", Size: 5, ModTime: "2024-01-01T10:00:00Z"},
+				{Name: "photo.jpg", Size: 9, ModTime: "2024-01-02T10:00:00Z"},
+				{Name: "sub", IsDir: true},
+			}, nil
+		},
+		OpenFunc: func(ctx context.Context, path, domain string) (*utils.FileStream, error) {
+			if path != "album/notes.txt" {
+				t.Errorf("unexpected stream of %s", path)
+			}
+			return &utils.FileStream{ReadCloser: closeRecorder{Reader: strings.NewReader("notes"), closed: &closed}, Size: 5}, nil
+		},
+		FetchImageFunc: func(ctx context.Context, path, domain string) ([]byte, error) {
+			return []byte("image-data"), nil
+		},
+	}
+	mockImageUtils := &MockImageUtils{
+		TransformImageFunc: func([]byte, utils.ImageTransformOptions) ([]byte, error) {
+			return []byte("transformed"), nil
+		},
+	}
+	mockDomainConfig := &MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/v2/download/album?w=100", nil)
+	rr := httptest.NewRecorder()
+	DownloadHandler(rr, req, mockImageUtils, mockRclone, mockDomainConfig)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("failed to read zip: %v", err)
+	}
+
+	contents := map[string]string{}
+	for _, entry := range archive.File {
+		reader, err := entry.Open()
+		if err != nil {
+			t.Fatalf("failed to open zip entry %s: %v", entry.Name, err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+		contents[entry.Name] = string(data)
+
+		if entry.Name == "notes.txt" && !entry.Modified.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)) {
+			t.Errorf("expected the listed ModTime on the zip entry, got %v", entry.Modified)
+		}
+	}
+	if contents["notes.txt"] != "notes" || contents["photo.jpg"] != "transformed" || len(contents) != 2 {
+		t.Errorf("unexpected zip contents: %v", contents)
+	}
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Errorf("expected the stream to be closed once, got %d", closed)
+	}
+}
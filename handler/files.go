@@ -0,0 +1,617 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"shuto-api/config"
+	"shuto-api/utils"
+)
+
+// UploadResponse describes a stored upload
+type UploadResponse struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+// FileOperationResponse describes a delete, move, copy or directory creation
+type FileOperationResponse struct {
+	Operation   string `json:"operation"`
+	Path        string `json:"path"`
+	Destination string `json:"destination,omitempty"` // of moves, copies and deletes moved to the trash
+	DryRun      bool   `json:"dryRun,omitempty"`
+}
+
+// WebDAV methods of the file management operations
+const (
+	methodMove  = "MOVE"
+	methodCopy  = "COPY"
+	methodMkcol = "MKCOL"
+)
+
+var (
+	errUploadExists  = errors.New("file already exists")
+	errUploadType    = errors.New("unsupported media type")
+	errUploadEmpty   = errors.New("upload is empty")
+	errUploadTooMany = errors.New("too many uploads with the same name")
+)
+
+// maxRenameAttempts bounds the suffixes tried by the rename overwrite policy
+const maxRenameAttempts = 100
+
+// uploadSniffSize is how much of an upload is looked at to detect its type, like
+// http.DetectContentType does
+const uploadSniffSize = 512
+
+// FilesHandler handles writes to the domain's storage below /v2/files/. What was derived
+// from the files it changes is dropped and they are reindexed, indexer may be nil.
+func FilesHandler(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUtils, rclone utils.Rclone, domainConfig config.DomainConfigManager, derivativeCache utils.DerivativeCache, indexer *utils.Indexer) {
+	switch r.Method {
+	case http.MethodPut:
+		uploadFile(w, r, imgUtils, rclone, domainConfig, derivativeCache, indexer)
+	case http.MethodPost:
+		uploadMultipart(w, r, imgUtils, rclone, domainConfig, derivativeCache, indexer)
+	case http.MethodDelete:
+		deleteFile(w, r, rclone, domainConfig, derivativeCache, indexer)
+	case methodMove, methodCopy:
+		transferFile(w, r, rclone, domainConfig, derivativeCache, indexer)
+	case methodMkcol:
+		makeDir(w, r, rclone, domainConfig)
+	default:
+		utils.WriteMethodNotAllowedError(w, http.MethodPut, http.MethodPost, http.MethodDelete, methodMove, methodCopy, methodMkcol)
+	}
+}
+
+// uploadFile stores the request body at path
+// @Summary Upload a file
+// @Description Store the request body at the specified path. The content type is sniffed and checked against the domain's allowed types.
+// @Tags files
+// @Accept  */*
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param   path     path    string     true        "Path to store the file at"
+// @Success 201 {object} UploadResponse "Stored file, its path differs from the requested one when renamed or re-encoded"
+// @Failure 400 {object} utils.ErrorResponse "Invalid path or empty upload"
+// @Failure 401 {object} utils.ErrorResponse "Invalid or missing API key"
+// @Failure 403 {object} utils.ErrorResponse "Uploads are not enabled for the path"
+// @Failure 409 {object} utils.ErrorResponse "A file exists at the path and overwriting is denied"
+// @Failure 413 {object} utils.ErrorResponse "Upload exceeds the domain's maximum size"
+// @Failure 415 {object} utils.ErrorResponse "Content type is not allowed"
+// @Failure 502 {object} utils.ErrorResponse "Storage backend unavailable"
+// @Failure 504 {object} utils.ErrorResponse "Storage backend timed out"
+// @Router /files/{path} [put]
+func uploadFile(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUtils, rclone utils.Rclone, domainConfig config.DomainConfigManager, derivativeCache utils.DerivativeCache, indexer *utils.Indexer) {
+	domain := utils.GetDomainFromRequest(r)
+	path, err := utils.RequestPath(r, "files")
+	if err != nil {
+		utils.WriteInvalidPathError(w, err.Error())
+		return
+	}
+
+	settings, ok := authorizeUpload(w, r, domain, path, domainConfig)
+	if !ok {
+		return
+	}
+	if r.ContentLength > settings.MaxSize {
+		utils.WritePayloadTooLargeError(w, settings.MaxSize)
+		return
+	}
+
+	stored, err := storeUpload(r, path, http.MaxBytesReader(w, r.Body, settings.MaxSize), settings, imgUtils, rclone, derivativeCache, indexer)
+	if err != nil {
+		writeUploadError(w, path, settings, err)
+		return
+	}
+
+	utils.Info("File uploaded", "domain", domain, "path", stored.Path, "size", stored.Size)
+	writeJSON(w, http.StatusCreated, stored)
+}
+
+// uploadMultipart stores the files of a multipart form in the directory at path
+// @Summary Upload files
+// @Description Store the files of a multipart/form-data request in the specified directory, under their file names. The content types are sniffed and checked against the domain's allowed types.
+// @Tags files
+// @Accept  multipart/form-data
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param   path     path    string     true        "Directory to store the files in"
+// @Param   file     formData file       true        "Files to upload, the field name is not significant"
+// @Success 201 {array}  UploadResponse "Stored files"
+// @Failure 400 {object} utils.ErrorResponse "Invalid path, file name or form"
+// @Failure 401 {object} utils.ErrorResponse "Invalid or missing API key"
+// @Failure 403 {object} utils.ErrorResponse "Uploads are not enabled for the path"
+// @Failure 409 {object} utils.ErrorResponse "A file exists at the path and overwriting is denied"
+// @Failure 413 {object} utils.ErrorResponse "Request exceeds the domain's maximum size"
+// @Failure 415 {object} utils.ErrorResponse "Content type is not allowed"
+// @Failure 502 {object} utils.ErrorResponse "Storage backend unavailable"
+// @Failure 504 {object} utils.ErrorResponse "Storage backend timed out"
+// @Header  400,409,413,415,502,504 {string} X-Stored-Path "Files of the form stored before the error, which are kept, one URL-encoded path per header"
+// @Router /files/{path} [post]
+func uploadMultipart(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUtils, rclone utils.Rclone, domainConfig config.DomainConfigManager, derivativeCache utils.DerivativeCache, indexer *utils.Indexer) {
+	domain := utils.GetDomainFromRequest(r)
+	dir, err := utils.RequestDir(r, "files")
+	if err != nil {
+		utils.WriteInvalidPathError(w, err.Error())
+		return
+	}
+
+	settings, ok := authorizeUpload(w, r, domain, dir, domainConfig)
+	if !ok {
+		return
+	}
+	if r.ContentLength > settings.MaxSize {
+		utils.WritePayloadTooLargeError(w, settings.MaxSize)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, settings.MaxSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		utils.WriteInvalidRequestError(w, "Expected a multipart/form-data request", err.Error())
+		return
+	}
+
+	stored := []UploadResponse{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			reportStored(w, domain, stored)
+			writeUploadError(w, dir, settings, err)
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		// Only the base of a file name is used, it can't name another directory
+		name := filepath.Base(strings.ReplaceAll(part.FileName(), `\`, "/"))
+		if name == "/" || name == "." || name == ".." {
+			part.Close()
+			reportStored(w, domain, stored)
+			utils.WriteInvalidPathError(w, part.FileName())
+			return
+		}
+		path, err := utils.CleanPath(strings.TrimPrefix(dir+"/"+name, "/"))
+		if err != nil {
+			part.Close()
+			reportStored(w, domain, stored)
+			utils.WriteInvalidPathError(w, err.Error())
+			return
+		}
+
+		upload, err := storeUpload(r, path, part, settings, imgUtils, rclone, derivativeCache, indexer)
+		part.Close()
+		if err != nil {
+			reportStored(w, domain, stored)
+			writeUploadError(w, path, settings, err)
+			return
+		}
+		utils.Info("File uploaded", "domain", domain, "path", upload.Path, "size", upload.Size)
+		stored = append(stored, upload)
+	}
+
+	if len(stored) == 0 {
+		utils.WriteInvalidRequestError(w, "No files in the form", "")
+		return
+	}
+	writeJSON(w, http.StatusCreated, stored)
+}
+
+// storedPathHeader lists the files of a multipart upload stored before it failed
+const storedPathHeader = "X-Stored-Path"
+
+// reportStored tells the client which files of a failed multipart upload were stored
+// before the error, they are kept rather than removed since they may have replaced
+// existing files
+func reportStored(w http.ResponseWriter, domain string, stored []UploadResponse) {
+	if len(stored) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(stored))
+	for _, upload := range stored {
+		w.Header().Add(storedPathHeader, url.PathEscape(upload.Path))
+		paths = append(paths, upload.Path)
+	}
+	utils.Warn("Multipart upload failed after storing files", "domain", domain, "paths", paths)
+}
+
+// authorizeUpload checks the API key of a write to path and returns the domain's
+// upload settings. Paths without API keys can't be written to.
+func authorizeUpload(w http.ResponseWriter, r *http.Request, domain string, path string, domainConfig config.DomainConfigManager) (config.UploadSettings, bool) {
+	cfg, err := domainConfig.GetDomainConfig(domain)
+	if err != nil {
+		utils.WriteInvalidDomainError(w, domain)
+		return config.UploadSettings{}, false
+	}
+
+	apiKeys := cfg.SecurityFor(path).APIKeys
+	if len(apiKeys) == 0 {
+		utils.WriteForbiddenError(w, "Uploads require API keys")
+		return config.UploadSettings{}, false
+	}
+	if !validateAPIKey(apiKeys, r.Header.Get("Authorization")) {
+		utils.WriteInvalidAPIKeyError(w)
+		return config.UploadSettings{}, false
+	}
+	return cfg.Uploads.WithDefaults(), true
+}
+
+// storeUpload validates body, re-encodes it if configured and writes it according to
+// the overwrite policy. The body is streamed to the storage unless it's re-encoded.
+func storeUpload(r *http.Request, path string, body io.Reader, settings config.UploadSettings, imgUtils utils.ImageUtils, rclone utils.Rclone, derivativeCache utils.DerivativeCache, indexer *utils.Indexer) (UploadResponse, error) {
+	source := bufio.NewReaderSize(body, uploadSniffSize)
+	head, err := source.Peek(uploadSniffSize)
+	if err != nil && err != io.EOF {
+		return UploadResponse{}, err
+	}
+	if len(head) == 0 {
+		return UploadResponse{}, errUploadEmpty
+	}
+
+	mimeType := sniffMimeType(head, imgUtils)
+	if !allowedType(settings.AllowedTypes, mimeType) {
+		return UploadResponse{}, fmt.Errorf("%w: %s", errUploadType, mimeType)
+	}
+
+	var data io.Reader = source
+	if format := uploadFormat(settings, mimeType); format != "" {
+		// Re-encoding needs the whole image
+		raw, err := io.ReadAll(source)
+		if err != nil {
+			return UploadResponse{}, err
+		}
+		encoded, err := imgUtils.TransformImage(r.Context(), raw, utils.ImageTransformOptions{Format: format, Quality: settings.Quality, Strip: settings.Strip})
+		if err != nil {
+			return UploadResponse{}, fmt.Errorf("failed to re-encode upload: %w", err)
+		}
+		data = bytes.NewReader(encoded)
+		mimeType = mime.TypeByExtension("." + format)
+		if ext := filepath.Ext(path); !strings.EqualFold(ext, "."+format) && !(format == "jpg" && strings.EqualFold(ext, ".jpeg")) {
+			path = strings.TrimSuffix(path, ext) + "." + format
+		}
+	}
+
+	path, err = uploadPath(r, path, settings.Overwrite, rclone)
+	if err != nil {
+		return UploadResponse{}, err
+	}
+	domain := utils.GetDomainFromRequest(r)
+	written := &countingReader{reader: data}
+	err = rclone.WriteFile(r.Context(), path, domain, written)
+	filesChanged(domain, derivativeCache, indexer, path)
+	if err != nil {
+		return UploadResponse{}, err
+	}
+	return UploadResponse{Path: path, Size: written.n, MimeType: mimeType}, nil
+}
+
+// filesChanged drops what was derived from paths and has them reindexed, like changes
+// found by polling listings. Failed writes may still have changed the remote, so
+// callers report them too. Empty paths are skipped.
+func filesChanged(domain string, derivativeCache utils.DerivativeCache, indexer *utils.Indexer, paths ...string) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		SourceChanged(domain, path, derivativeCache)
+		if indexer != nil {
+			indexer.Changed(domain, path)
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sniffMimeType detects images with vips and anything else from their first bytes
+func sniffMimeType(data []byte, imgUtils utils.ImageUtils) string {
+	if mimeType, err := imgUtils.GetMimeType(data); err == nil {
+		return mimeType
+	}
+	mimeType, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	return mimeType
+}
+
+// allowedType matches exact types and wildcards such as image/*
+func allowedType(allowed []string, mimeType string) bool {
+	for _, pattern := range allowed {
+		if pattern == mimeType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadFormat returns the format an image is re-encoded to, empty to store it as uploaded.
+// Only formats vips detects are re-encoded.
+func uploadFormat(settings config.UploadSettings, mimeType string) string {
+	formats := map[string]string{"image/jpeg": "jpg", "image/png": "png", "image/webp": "webp"}
+	format, ok := formats[mimeType]
+	if !ok {
+		return ""
+	}
+	switch strings.ToLower(settings.Reencode) {
+	case "jpg", "jpeg":
+		return "jpg"
+	case "png", "webp":
+		return strings.ToLower(settings.Reencode)
+	}
+	if settings.Strip {
+		return format
+	}
+	return ""
+}
+
+// uploadPath applies the overwrite policy to path
+func uploadPath(r *http.Request, path string, policy string, rclone utils.Rclone) (string, error) {
+	if policy == config.OverwriteReplace {
+		return path, nil
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	candidate := path
+	for i := 1; i <= maxRenameAttempts; i++ {
+		_, err := rclone.Stat(r.Context(), candidate, utils.GetDomainFromRequest(r))
+		if errors.Is(err, utils.ErrNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if policy != config.OverwriteRename {
+			return "", fmt.Errorf("%w: %s", errUploadExists, candidate)
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return "", fmt.Errorf("%w: %s", errUploadTooMany, path)
+}
+
+// deleteFile removes the file at path, or moves it to the domain's trash
+// @Summary Delete a file
+// @Description Delete the file at the specified path. Domains with a trash folder move it there instead, under its path and renamed if taken; deletes inside the trash are permanent.
+// @Tags files
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param   path     path    string     true        "Path of the file"
+// @Param   dry_run  query   string     false       "1 to validate the delete without performing it"
+// @Success 200 {object} FileOperationResponse "Deleted file, with its trash path when moved to the trash"
+// @Failure 400 {object} utils.ErrorResponse "Invalid path or the path is a directory"
+// @Failure 401 {object} utils.ErrorResponse "Invalid or missing API key"
+// @Failure 403 {object} utils.ErrorResponse "Writes are not enabled for the path"
+// @Failure 404 {object} utils.ErrorResponse "File not found"
+// @Failure 502 {object} utils.ErrorResponse "Storage backend unavailable"
+// @Failure 504 {object} utils.ErrorResponse "Storage backend timed out"
+// @Router /files/{path} [delete]
+func deleteFile(w http.ResponseWriter, r *http.Request, rclone utils.Rclone, domainConfig config.DomainConfigManager, derivativeCache utils.DerivativeCache, indexer *utils.Indexer) {
+	domain := utils.GetDomainFromRequest(r)
+	path, err := utils.RequestPath(r, "files")
+	if err != nil {
+		utils.WriteInvalidPathError(w, err.Error())
+		return
+	}
+
+	settings, ok := authorizeUpload(w, r, domain, path, domainConfig)
+	if !ok || !statFile(w, r, path, rclone) {
+		return
+	}
+
+	response := FileOperationResponse{Operation: "delete", Path: path, DryRun: dryRun(r)}
+	if trash := strings.Trim(settings.Trash, "/"); trash != "" && path != trash && !strings.HasPrefix(path, trash+"/") {
+		trashPath, err := utils.CleanPath(trash + "/" + path)
+		if err != nil {
+			utils.WriteInvalidPathError(w, err.Error())
+			return
+		}
+		response.Destination, err = uploadPath(r, trashPath, config.OverwriteRename, rclone)
+		if err != nil {
+			writeUploadError(w, trashPath, settings, err)
+			return
+		}
+	}
+	if response.DryRun {
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	if response.Destination != "" {
+		err = rclone.MoveFile(r.Context(), path, response.Destination, domain)
+	} else {
+		err = rclone.DeleteFile(r.Context(), path, domain)
+	}
+	filesChanged(domain, derivativeCache, indexer, path, response.Destination)
+	if err != nil {
+		utils.WriteStorageError(w, "Failed to delete file", err)
+		return
+	}
+
+	utils.Info("File deleted", "domain", domain, "path", path, "trash", response.Destination)
+	writeJSON(w, http.StatusOK, response)
+}
+
+// transferFile moves (MOVE) or copies (COPY) the file at path to the path of the
+// Destination header, a URL or absolute path below /v2/files/ of the same domain. The
+// domain's overwrite policy applies to the destination. OpenAPI can't describe WebDAV
+// methods, so this isn't in the swagger docs.
+func transferFile(w http.ResponseWriter, r *http.Request, rclone utils.Rclone, domainConfig config.DomainConfigManager, derivativeCache utils.DerivativeCache, indexer *utils.Indexer) {
+	domain := utils.GetDomainFromRequest(r)
+	path, err := utils.RequestPath(r, "files")
+	if err != nil {
+		utils.WriteInvalidPathError(w, err.Error())
+		return
+	}
+	destination, err := destinationPath(r, domain)
+	if err != nil {
+		utils.WriteInvalidPathError(w, err.Error())
+		return
+	}
+	if destination == path {
+		utils.WriteInvalidRequestError(w, "Source and destination are the same", path)
+		return
+	}
+
+	// The destination may be below a mount with API keys of its own
+	settings, ok := authorizeUpload(w, r, domain, path, domainConfig)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeUpload(w, r, domain, destination, domainConfig); !ok || !statFile(w, r, path, rclone) {
+		return
+	}
+
+	operation, transfer := "copy", rclone.CopyFile
+	if r.Method == methodMove {
+		operation, transfer = "move", rclone.MoveFile
+	}
+	target, err := uploadPath(r, destination, settings.Overwrite, rclone)
+	if err != nil {
+		writeUploadError(w, destination, settings, err)
+		return
+	}
+	response := FileOperationResponse{Operation: operation, Path: path, Destination: target, DryRun: dryRun(r)}
+	if response.DryRun {
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	err = transfer(r.Context(), path, target, domain)
+	if r.Method == methodMove {
+		filesChanged(domain, derivativeCache, indexer, path)
+	}
+	filesChanged(domain, derivativeCache, indexer, target)
+	if err != nil {
+		utils.WriteStorageError(w, "Failed to "+operation+" file", err)
+		return
+	}
+
+	utils.Info("File "+operation+"d", "domain", domain, "path", path, "destination", target)
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// makeDir creates the directory at path (MKCOL) and its missing parents. Bucket based
+// remotes have no directories, creating one succeeds without storing anything.
+func makeDir(w http.ResponseWriter, r *http.Request, rclone utils.Rclone, domainConfig config.DomainConfigManager) {
+	domain := utils.GetDomainFromRequest(r)
+	path, err := utils.RequestPath(r, "files")
+	if err != nil {
+		utils.WriteInvalidPathError(w, err.Error())
+		return
+	}
+	if _, ok := authorizeUpload(w, r, domain, path, domainConfig); !ok {
+		return
+	}
+
+	_, err = rclone.Stat(r.Context(), path, domain)
+	if err == nil {
+		utils.WriteConflictError(w, "Path already exists", path)
+		return
+	}
+	if !errors.Is(err, utils.ErrNotFound) {
+		utils.WriteStorageError(w, "Failed to stat path", err)
+		return
+	}
+
+	response := FileOperationResponse{Operation: "mkdir", Path: path, DryRun: dryRun(r)}
+	if response.DryRun {
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+	if err := rclone.Mkdir(r.Context(), path, domain); err != nil {
+		utils.WriteStorageError(w, "Failed to create directory", err)
+		return
+	}
+
+	utils.Info("Directory created", "domain", domain, "path", path)
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// statFile checks that path is an existing file, writing the error response otherwise
+func statFile(w http.ResponseWriter, r *http.Request, path string, rclone utils.Rclone) bool {
+	file, err := rclone.Stat(r.Context(), path, utils.GetDomainFromRequest(r))
+	if err == nil && file.IsDir {
+		err = fmt.Errorf("%w: %s", utils.ErrIsDirectory, path)
+	}
+	if err != nil {
+		utils.WriteStorageError(w, "Failed to stat file", err)
+		return false
+	}
+	return true
+}
+
+// destinationPath returns the path of the Destination header, which must be below
+// /v2/files/ of domain
+func destinationPath(r *http.Request, domain string) (string, error) {
+	header := r.Header.Get("Destination")
+	if header == "" {
+		return "", fmt.Errorf("%w: missing Destination header", utils.ErrInvalidPath)
+	}
+	destination, err := url.Parse(header)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", utils.ErrInvalidPath, header)
+	}
+	if destination.Host != "" && !strings.EqualFold(destination.Hostname(), domain) {
+		return "", fmt.Errorf("%w: destination %s is on another domain", utils.ErrInvalidPath, header)
+	}
+	prefix := "/" + config.ApiVersion + "/files/"
+	if !strings.HasPrefix(destination.Path, prefix) {
+		return "", fmt.Errorf("%w: destination %s is not below %s", utils.ErrInvalidPath, header, prefix)
+	}
+	return utils.CleanPath(strings.TrimPrefix(destination.Path, prefix))
+}
+
+// dryRun reports whether the request only validates an operation
+func dryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "1"
+}
+
+func writeUploadError(w http.ResponseWriter, path string, settings config.UploadSettings, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		utils.WritePayloadTooLargeError(w, settings.MaxSize)
+	case errors.Is(err, errUploadEmpty):
+		utils.WriteInvalidRequestError(w, "Upload is empty", path)
+	case errors.Is(err, errUploadType):
+		utils.WriteUnsupportedMediaTypeError(w, strings.TrimPrefix(err.Error(), errUploadType.Error()+": "))
+	case errors.Is(err, errUploadExists), errors.Is(err, errUploadTooMany):
+		utils.WriteConflictError(w, "File already exists", err.Error())
+	default:
+		utils.WriteStorageError(w, "Failed to store upload", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		utils.WriteInternalError(w, "Failed to encode response", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(data)
+}
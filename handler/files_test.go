@@ -0,0 +1,695 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"shuto-api/config"
+	"shuto-api/utils"
+)
+
+// uploadStorage records writes and operations, and reports the paths in existing as
+// taken and those in dirs as directories
+type uploadStorage struct {
+	existing map[string]bool
+	dirs     map[string]bool
+	written  map[string][]byte
+	ops      []string
+}
+
+func (s *uploadStorage) rclone() *utils.MockRclone {
+	return &utils.MockRclone{
+		StatFunc: func(ctx context.Context, path string, domain string) (utils.RcloneFile, error) {
+			if s.existing[path] {
+				return utils.RcloneFile{Path: path}, nil
+			}
+			if s.dirs[path] {
+				return utils.RcloneFile{Path: path, IsDir: true}, nil
+			}
+			return utils.RcloneFile{}, utils.ErrNotFound
+		},
+		WriteFileFunc: func(ctx context.Context, path string, domain string, data io.Reader) error {
+			content, err := io.ReadAll(data)
+			if err != nil {
+				return err
+			}
+			s.written[path] = content
+			return nil
+		},
+		DeleteFileFunc: func(ctx context.Context, path string, domain string) error {
+			s.ops = append(s.ops, "delete "+path)
+			return nil
+		},
+		MoveFileFunc: func(ctx context.Context, src string, dst string, domain string) error {
+			s.ops = append(s.ops, "move "+src+" "+dst)
+			return nil
+		},
+		CopyFileFunc: func(ctx context.Context, src string, dst string, domain string) error {
+			s.ops = append(s.ops, "copy "+src+" "+dst)
+			return nil
+		},
+		MkdirFunc: func(ctx context.Context, path string, domain string) error {
+			s.ops = append(s.ops, "mkdir "+path)
+			return nil
+		},
+	}
+}
+
+func uploadImageUtils() *MockImageUtils {
+	return &MockImageUtils{
+		GetMimeTypeFunc: func(data []byte) (string, error) {
+			if bytes.HasPrefix(data, []byte("\xff\xd8")) {
+				return "image/jpeg", nil
+			}
+			return "", errors.New("unsupported image format")
+		},
+		TransformImageFunc: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+			return []byte(opts.Format + " strip=" + map[bool]string{true: "true", false: "false"}[opts.Strip]), nil
+		},
+	}
+}
+
+func TestFilesHandler_Put(t *testing.T) {
+	jpeg := "\xff\xd8\xff\xe0 jpeg data"
+	apiKeys := config.SecuritySettings{APIKeys: []config.APIKey{{Key: "cms-key"}}}
+
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		authHeader     string
+		security       config.SecuritySettings
+		uploads        config.UploadSettings
+		existing       []string
+		chunked        bool // no Content-Length, the size limit applies while streaming
+		expectedStatus int
+		expectedPath   string
+		expectedData   string
+	}{
+		{
+			name:           "Upload",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg,
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusCreated,
+			expectedPath:   "photos/a.jpg",
+			expectedData:   jpeg,
+		},
+		{
+			name:           "Domain without API keys",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Invalid API key",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg,
+			authHeader:     "Bearer other",
+			security:       apiKeys,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Path traversal",
+			path:           "/v2/files/photos/../../a.jpg",
+			body:           jpeg,
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Too large",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg,
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			uploads:        config.UploadSettings{MaxSize: 4},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "Too large while sniffing",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg,
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			uploads:        config.UploadSettings{MaxSize: 4},
+			chunked:        true,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "Too large while storing",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg + strings.Repeat("x", 4096),
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			uploads:        config.UploadSettings{MaxSize: 1024},
+			chunked:        true,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "Streamed past the sniffed bytes",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg + strings.Repeat("x", 4096),
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			chunked:        true,
+			expectedStatus: http.StatusCreated,
+			expectedPath:   "photos/a.jpg",
+			expectedData:   jpeg + strings.Repeat("x", 4096),
+		},
+		{
+			name:           "Disallowed type",
+			path:           "/v2/files/photos/a.jpg",
+			body:           "<html><body>not an image</body></html>",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:           "Allowed type sniffed without vips",
+			path:           "/v2/files/docs/a.pdf",
+			body:           "%PDF-1.7 document",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			uploads:        config.UploadSettings{AllowedTypes: []string{"application/pdf", "image/*"}},
+			expectedStatus: http.StatusCreated,
+			expectedPath:   "docs/a.pdf",
+			expectedData:   "%PDF-1.7 document",
+		},
+		{
+			name:           "Empty upload",
+			path:           "/v2/files/photos/a.jpg",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Existing file is kept by default",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg,
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			existing:       []string{"photos/a.jpg"},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Existing file is replaced",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg,
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			uploads:        config.UploadSettings{Overwrite: config.OverwriteReplace},
+			existing:       []string{"photos/a.jpg"},
+			expectedStatus: http.StatusCreated,
+			expectedPath:   "photos/a.jpg",
+			expectedData:   jpeg,
+		},
+		{
+			name:           "Existing file is renamed",
+			path:           "/v2/files/photos/a.jpg",
+			body:           jpeg,
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			uploads:        config.UploadSettings{Overwrite: config.OverwriteRename},
+			existing:       []string{"photos/a.jpg", "photos/a-1.jpg"},
+			expectedStatus: http.StatusCreated,
+			expectedPath:   "photos/a-2.jpg",
+			expectedData:   jpeg,
+		},
+		{
+			name:           "Re-encoded",
+			path:           "/v2/files/photos/a.jpeg",
+			body:           jpeg,
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			uploads:        config.UploadSettings{Reencode: "webp", Strip: true},
+			expectedStatus: http.StatusCreated,
+			expectedPath:   "photos/a.webp",
+			expectedData:   "webp strip=true",
+		},
+		{
+			name:           "Stripped in its own format",
+			path:           "/v2/files/photos/a.jpeg",
+			body:           jpeg,
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			uploads:        config.UploadSettings{Strip: true},
+			expectedStatus: http.StatusCreated,
+			expectedPath:   "photos/a.jpeg",
+			expectedData:   "jpg strip=true",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &uploadStorage{existing: map[string]bool{}, written: map[string][]byte{}}
+			for _, path := range tt.existing {
+				storage.existing[path] = true
+			}
+			domainConfig := &config.MockDomainConfigManager{
+				GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+					return config.DomainConfig{Security: tt.security, Uploads: tt.uploads}, nil
+				},
+			}
+
+			req := httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			rec := httptest.NewRecorder()
+			FilesHandler(rec, req, uploadImageUtils(), storage.rclone(), domainConfig, nil, nil)
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rec.Code, rec.Body.String())
+			}
+			if tt.expectedPath == "" {
+				if len(storage.written) != 0 {
+					t.Errorf("expected no writes, got %v", storage.written)
+				}
+				return
+			}
+
+			var response UploadResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if response.Path != tt.expectedPath {
+				t.Errorf("expected path %q, got %q", tt.expectedPath, response.Path)
+			}
+			if string(storage.written[tt.expectedPath]) != tt.expectedData {
+				t.Errorf("expected %q written to %q, got %v", tt.expectedData, tt.expectedPath, storage.written)
+			}
+			if response.Size != int64(len(tt.expectedData)) {
+				t.Errorf("expected size %d, got %d", len(tt.expectedData), response.Size)
+			}
+		})
+	}
+}
+
+func TestFilesHandler_Multipart(t *testing.T) {
+	storage := &uploadStorage{existing: map[string]bool{}, written: map[string][]byte{}}
+	domainConfig := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{Security: config.SecuritySettings{APIKeys: []config.APIKey{{Key: "cms-key"}}}}, nil
+		},
+	}
+
+	upload := func(files map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("caption", "ignored")
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			part, _ := form.CreateFormFile("file", name)
+			part.Write([]byte(files[name]))
+		}
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/v2/files/press/2024", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Authorization", "Bearer cms-key")
+		rec := httptest.NewRecorder()
+		FilesHandler(rec, req, uploadImageUtils(), storage.rclone(), domainConfig, nil, nil)
+		return rec
+	}
+
+	rec := upload(map[string]string{`C:\Users\cms\b.jpg`: "\xff\xd8 b"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var response []UploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	expected := []UploadResponse{{Path: "press/2024/b.jpg", Size: 4, MimeType: "image/jpeg"}}
+	if !reflect.DeepEqual(response, expected) {
+		t.Errorf("expected %v, got %v", expected, response)
+	}
+
+	if rec := upload(map[string]string{"..": "\xff\xd8 c"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid file name, got %d", rec.Code)
+	}
+	if rec := upload(map[string]string{}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without files, got %d", rec.Code)
+	}
+
+	// Files stored before a failing one are kept and reported
+	rec = upload(map[string]string{"a 1.jpg": "\xff\xd8 a", "b.jpg": "\xff\xd8 b", "c.txt": "plain text"})
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if stored := rec.Header().Values("X-Stored-Path"); !reflect.DeepEqual(stored, []string{"press%2F2024%2Fa%201.jpg", "press%2F2024%2Fb.jpg"}) {
+		t.Errorf("expected the stored files to be reported, got %v", stored)
+	}
+	if _, ok := storage.written["press/2024/a 1.jpg"]; !ok {
+		t.Error("expected the stored files to be kept")
+	}
+}
+
+func TestFilesHandler_MethodNotAllowed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	FilesHandler(rec, httptest.NewRequest(http.MethodGet, "/v2/files/a.jpg", nil), uploadImageUtils(), &utils.MockRclone{}, &config.MockDomainConfigManager{}, nil, nil)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "PUT, POST, DELETE, MOVE, COPY, MKCOL" {
+		t.Errorf("expected Allow PUT, POST, DELETE, MOVE, COPY, MKCOL, got %q", allow)
+	}
+}
+
+func TestFilesHandler_Operations(t *testing.T) {
+	apiKeys := config.SecuritySettings{APIKeys: []config.APIKey{{Key: "cms-key"}}}
+
+	tests := []struct {
+		name             string
+		method           string
+		path             string
+		destination      string
+		authHeader       string
+		security         config.SecuritySettings
+		mounts           []config.MountConfig
+		uploads          config.UploadSettings
+		expectedStatus   int
+		expectedOps      []string
+		expectedResponse FileOperationResponse
+	}{
+		{
+			name:             "Delete",
+			method:           http.MethodDelete,
+			path:             "/v2/files/photos/a.jpg",
+			authHeader:       "Bearer cms-key",
+			security:         apiKeys,
+			expectedStatus:   http.StatusOK,
+			expectedOps:      []string{"delete photos/a.jpg"},
+			expectedResponse: FileOperationResponse{Operation: "delete", Path: "photos/a.jpg"},
+		},
+		{
+			name:           "Delete without API keys",
+			method:         http.MethodDelete,
+			path:           "/v2/files/photos/a.jpg",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Delete with an invalid API key",
+			method:         http.MethodDelete,
+			path:           "/v2/files/photos/a.jpg",
+			authHeader:     "Bearer other",
+			security:       apiKeys,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Delete a missing file",
+			method:         http.MethodDelete,
+			path:           "/v2/files/photos/missing.jpg",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Delete a directory",
+			method:         http.MethodDelete,
+			path:           "/v2/files/photos",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:             "Delete to the trash",
+			method:           http.MethodDelete,
+			path:             "/v2/files/photos/a.jpg",
+			authHeader:       "Bearer cms-key",
+			security:         apiKeys,
+			uploads:          config.UploadSettings{Trash: "/.trash/"},
+			expectedStatus:   http.StatusOK,
+			expectedOps:      []string{"move photos/a.jpg .trash/photos/a-1.jpg"},
+			expectedResponse: FileOperationResponse{Operation: "delete", Path: "photos/a.jpg", Destination: ".trash/photos/a-1.jpg"},
+		},
+		{
+			name:             "Delete inside the trash",
+			method:           http.MethodDelete,
+			path:             "/v2/files/.trash/photos/a.jpg",
+			authHeader:       "Bearer cms-key",
+			security:         apiKeys,
+			uploads:          config.UploadSettings{Trash: ".trash"},
+			expectedStatus:   http.StatusOK,
+			expectedOps:      []string{"delete .trash/photos/a.jpg"},
+			expectedResponse: FileOperationResponse{Operation: "delete", Path: ".trash/photos/a.jpg"},
+		},
+		{
+			name:             "Delete dry run",
+			method:           http.MethodDelete,
+			path:             "/v2/files/photos/a.jpg?dry_run=1",
+			authHeader:       "Bearer cms-key",
+			security:         apiKeys,
+			uploads:          config.UploadSettings{Trash: ".trash"},
+			expectedStatus:   http.StatusOK,
+			expectedResponse: FileOperationResponse{Operation: "delete", Path: "photos/a.jpg", Destination: ".trash/photos/a-1.jpg", DryRun: true},
+		},
+		{
+			name:             "Move",
+			method:           methodMove,
+			path:             "/v2/files/photos/a.jpg",
+			destination:      "/v2/files/archive/a.jpg",
+			authHeader:       "Bearer cms-key",
+			security:         apiKeys,
+			expectedStatus:   http.StatusCreated,
+			expectedOps:      []string{"move photos/a.jpg archive/a.jpg"},
+			expectedResponse: FileOperationResponse{Operation: "move", Path: "photos/a.jpg", Destination: "archive/a.jpg"},
+		},
+		{
+			name:             "Copy to a URL",
+			method:           methodCopy,
+			path:             "/v2/files/photos/a.jpg",
+			destination:      "https://example.com/v2/files/archive/a%20copy.jpg",
+			authHeader:       "Bearer cms-key",
+			security:         apiKeys,
+			expectedStatus:   http.StatusCreated,
+			expectedOps:      []string{"copy photos/a.jpg archive/a copy.jpg"},
+			expectedResponse: FileOperationResponse{Operation: "copy", Path: "photos/a.jpg", Destination: "archive/a copy.jpg"},
+		},
+		{
+			name:             "Copy renamed",
+			method:           methodCopy,
+			path:             "/v2/files/photos/a.jpg",
+			destination:      "/v2/files/photos/a.jpg.bak",
+			authHeader:       "Bearer cms-key",
+			security:         apiKeys,
+			uploads:          config.UploadSettings{Overwrite: config.OverwriteRename},
+			expectedStatus:   http.StatusCreated,
+			expectedOps:      []string{"copy photos/a.jpg photos/a.jpg-1.bak"},
+			expectedResponse: FileOperationResponse{Operation: "copy", Path: "photos/a.jpg", Destination: "photos/a.jpg-1.bak"},
+		},
+		{
+			name:           "Move over an existing file",
+			method:         methodMove,
+			path:           "/v2/files/photos/a.jpg",
+			destination:    "/v2/files/photos/a.jpg.bak",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Move without a destination",
+			method:         methodMove,
+			path:           "/v2/files/photos/a.jpg",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Move out of /v2/files",
+			method:         methodMove,
+			path:           "/v2/files/photos/a.jpg",
+			destination:    "/v2/image/a.jpg",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Move to another domain",
+			method:         methodMove,
+			path:           "/v2/files/photos/a.jpg",
+			destination:    "https://other.com/v2/files/a.jpg",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Move with path traversal",
+			method:         methodMove,
+			path:           "/v2/files/photos/a.jpg",
+			destination:    "/v2/files/photos/../../a.jpg",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Move onto itself",
+			method:         methodMove,
+			path:           "/v2/files/photos/a.jpg",
+			destination:    "/v2/files/photos//a.jpg",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Move to a mount with other API keys",
+			method:         methodMove,
+			path:           "/v2/files/photos/a.jpg",
+			destination:    "/v2/files/press/a.jpg",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			mounts:         []config.MountConfig{{Prefix: "press", Security: &config.SecuritySettings{APIKeys: []config.APIKey{{Key: "press-key"}}}}},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:             "Move dry run",
+			method:           methodMove,
+			path:             "/v2/files/photos/a.jpg?dry_run=1",
+			destination:      "/v2/files/archive/a.jpg",
+			authHeader:       "Bearer cms-key",
+			security:         apiKeys,
+			expectedStatus:   http.StatusOK,
+			expectedResponse: FileOperationResponse{Operation: "move", Path: "photos/a.jpg", Destination: "archive/a.jpg", DryRun: true},
+		},
+		{
+			name:             "Mkcol",
+			method:           methodMkcol,
+			path:             "/v2/files/photos/2024",
+			authHeader:       "Bearer cms-key",
+			security:         apiKeys,
+			expectedStatus:   http.StatusCreated,
+			expectedOps:      []string{"mkdir photos/2024"},
+			expectedResponse: FileOperationResponse{Operation: "mkdir", Path: "photos/2024"},
+		},
+		{
+			name:           "Mkcol on an existing directory",
+			method:         methodMkcol,
+			path:           "/v2/files/photos",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Mkcol on an existing file",
+			method:         methodMkcol,
+			path:           "/v2/files/photos/a.jpg",
+			authHeader:     "Bearer cms-key",
+			security:       apiKeys,
+			expectedStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &uploadStorage{
+				existing: map[string]bool{"photos/a.jpg": true, "photos/a.jpg.bak": true, ".trash/photos/a.jpg": true},
+				dirs:     map[string]bool{"photos": true},
+				written:  map[string][]byte{},
+			}
+			domainConfig := &config.MockDomainConfigManager{
+				GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+					return config.DomainConfig{Security: tt.security, Mounts: tt.mounts, Uploads: tt.uploads}, nil
+				},
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Host = "example.com"
+			if tt.destination != "" {
+				req.Header.Set("Destination", tt.destination)
+			}
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			rec := httptest.NewRecorder()
+			FilesHandler(rec, req, uploadImageUtils(), storage.rclone(), domainConfig, nil, nil)
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rec.Code, rec.Body.String())
+			}
+			if !reflect.DeepEqual(storage.ops, tt.expectedOps) {
+				t.Errorf("expected operations %v, got %v", tt.expectedOps, storage.ops)
+			}
+			if tt.expectedResponse.Operation == "" {
+				return
+			}
+
+			var response FileOperationResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if response != tt.expectedResponse {
+				t.Errorf("expected response %+v, got %+v", tt.expectedResponse, response)
+			}
+		})
+	}
+}
+
+func TestFilesHandler_InvalidatesMetadata(t *testing.T) {
+	resetListCaches(t)
+	storage := &uploadStorage{existing: map[string]bool{"meta/a.jpg": true}, written: map[string][]byte{}}
+	domainConfig := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{Security: config.SecuritySettings{APIKeys: []config.APIKey{{Key: "cms-key"}}}}, nil
+		},
+	}
+	cached := func(domain string, path string) bool {
+		_, err := metadataCache.GetCached(utils.GetCachedOptions{
+			Key: metadataKey(domain, path),
+			TTL: time.Hour,
+			GetFreshValue: func() (interface{}, error) {
+				return nil, errors.New("not cached")
+			},
+		})
+		return err == nil
+	}
+	for _, key := range []string{metadataKey("example.com", "meta/a.jpg"), metadataKey("example.com", "meta/b.jpg"), metadataKey("other.com", "meta/a.jpg")} {
+		metadataCache.GetCached(utils.GetCachedOptions{
+			Key: key,
+			TTL: time.Hour,
+			GetFreshValue: func() (interface{}, error) {
+				return utils.ImageMetadata{Width: 1}, nil
+			},
+		})
+	}
+	directoryStatsCache.Set(directoryKey("example.com", "meta"), DirectoryStats{FileCount: 1}, time.Hour, time.Hour)
+
+	req := httptest.NewRequest(methodMove, "/v2/files/meta/a.jpg", nil)
+	req.Header.Set("Destination", "/v2/files/meta/b.jpg")
+	req.Header.Set("Authorization", "Bearer cms-key")
+	rec := httptest.NewRecorder()
+	FilesHandler(rec, req, uploadImageUtils(), storage.rclone(), domainConfig, nil, nil)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if cached("example.com", "meta/a.jpg") || cached("example.com", "meta/b.jpg") {
+		t.Error("expected the metadata of both paths to be invalidated")
+	}
+	if !cached("other.com", "meta/a.jpg") {
+		t.Error("expected the metadata of the same path on another domain to be kept")
+	}
+	if _, ok := directoryStatsCache.Peek(directoryKey("example.com", "meta")); ok {
+		t.Error("expected the aggregates of the directory to be invalidated")
+	}
+}
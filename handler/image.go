@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strings"
 
@@ -24,24 +26,34 @@ import (
 // @Param   dpr      query   number     false       "Device pixel ratio (1-3)"
 // @Param   blur     query   int        false       "Gaussian blur intensity (0-100)"
 // @Param   dl       query   bool       false       "Force download instead of display"
+// @Param   If-None-Match     header  string  false  "Answer with 304 when the ETag matches"
+// @Param   If-Modified-Since header  string  false  "Answer with 304 when the source is unchanged since"
 // @Success 200 {file}  []byte
+// @Success 304 "Not modified"
+// @Header  200 {string} X-Cache "HIT when served from the derivative cache, MISS otherwise"
+// @Header  200 {string} ETag "Strong validator derived from the source file and transform options"
+// @Header  200 {string} Last-Modified "Modification time of the source file"
+// @Header  200 {string} X-Storage-Remote "Remote that served the storage reads, a replica while the primary is unavailable"
 // @Failure 400 {object} utils.ErrorResponse "Invalid request parameters"
 // @Failure 401 {object} utils.ErrorResponse "Unauthorized - Invalid signature"
-// @Failure 403 {object} utils.ErrorResponse "Forbidden - Invalid signature"
+// @Failure 403 {object} utils.ErrorResponse "Forbidden - Invalid signature or storage access denied"
 // @Failure 404 {object} utils.ErrorResponse "Image not found"
 // @Failure 410 {object} utils.ErrorResponse "Gone - Token expired"
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Failure 502 {object} utils.ErrorResponse "Storage backend unavailable"
+// @Failure 503 {object} utils.ErrorResponse "Transform queue is full, retry after the Retry-After header"
+// @Failure 504 {object} utils.ErrorResponse "Storage backend timed out"
 // @Router /image/{path} [get]
-func ImageHandler(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUtils, rclone utils.Rclone, domainConfig config.DomainConfigManager) {
+func ImageHandler(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUtils, rclone utils.Rclone, domainConfig config.DomainConfigManager, derivativeCache utils.DerivativeCache) {
 	if r.Method != http.MethodGet {
 		utils.WriteInvalidRequestError(w, "Method not allowed", r.Method)
 		return
 	}
 
 	domain := utils.GetDomainFromRequest(r)
-	path := strings.TrimPrefix(r.URL.Path, "/"+config.ApiVersion+"/image/")
-	if path == "" {
-		utils.WriteInvalidPathError(w, "Path is required")
+	path, err := utils.RequestPath(r, "image")
+	if err != nil {
+		utils.WriteInvalidPathError(w, err.Error())
 		return
 	}
 	
@@ -52,8 +64,8 @@ func ImageHandler(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUt
 	}
 
 	// Validate signed URL if security is enabled
-	if cfg.Security.Mode != "" {
-		if err := security.ValidateSignedURLFromConfig(path, r.URL.Query(), cfg.Security.Secrets, cfg.Security.ValidityWindow); err != nil {
+	if settings := cfg.SecurityFor(path); settings.Mode != "" {
+		if err := security.ValidateSignedURLFromConfig(path, r.URL.Query(), settings.Secrets, settings.ValidityWindow); err != nil {
 			switch err {
 			case security.ErrKeyNotFound:
 				utils.WriteUnauthorizedError(w, "Invalid security key")
@@ -67,22 +79,12 @@ func ImageHandler(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUt
 	}
 
 	// Check if path is a directory
-	files, err := rclone.ListPath(path, domain)
-	if err == nil && len(files) > 0 && files[0].IsDir {
+	source, statErr := rclone.Stat(r.Context(), path, domain)
+	if statErr == nil && source.IsDir {
 		utils.WriteInvalidRequestError(w, "Cannot serve directory as image", path)
 		return
 	}
 
-	data, err := rclone.FetchImage(path, domain)
-	if err != nil {
-		if strings.Contains(err.Error(), "directory not found") || strings.Contains(err.Error(), "file not found") {
-			utils.WriteNotFoundError(w, "Image not found", path)
-			return
-		}
-		utils.WriteInternalError(w, "Failed to fetch image", err.Error())
-		return
-	}
-
 	options := utils.ParseImageOptionsFromRequest(r)
 
 	// If no format is specified, automatically select the best format based on browser support
@@ -97,23 +99,155 @@ func ImageHandler(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUt
 		}
 	}
 
-	modifiedImg, err := imgUtils.TransformImage(data, options)
-	if err != nil {
-		utils.WriteInternalError(w, "Failed to transform image", err.Error())
-		return
+	// Answer conditional requests from the source metadata before doing any work
+	if statErr == nil {
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+		w.Header().Set("Vary", "Accept")
+		lastModified, _ := utils.LastModified(source)
+		if utils.CheckNotModified(w, r, utils.FileETag(source, options.CacheKey()), lastModified) {
+			return
+		}
 	}
 
-	mimeType, err := imgUtils.GetMimeType(modifiedImg)
+	// Serve a previously rendered output when the source is unchanged
+	var cacheKey string
+	if derivativeCache != nil && statErr == nil {
+		cacheKey = utils.DerivativeCacheKey(domain, path, source, options)
+		if data, mimeType, ok := derivativeCache.Get(r.Context(), domain, cacheKey); ok {
+			derivativeSources.Add(domain, path, cacheKey)
+			w.Header().Set("X-Cache", "HIT")
+			writeImage(w, data, mimeType, options)
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	// Identical concurrent requests share a single fetch and transform
+	key := domain + "|" + path + "|" + options.CacheKey()
+	rendered, err, shared := renderGroup.DoContext(r.Context(), key, func(ctx context.Context) (renderedImage, error) {
+		rendered, err := renderImage(ctx, path, domain, options, imgUtils, rclone)
+		if err == nil && cacheKey != "" {
+			if err := derivativeCache.Set(ctx, domain, cacheKey, rendered.data, rendered.mimeType); err != nil {
+				utils.Warn("Failed to cache derivative", "domain", domain, "path", path, "error", err)
+			} else {
+				derivativeSources.Add(domain, path, cacheKey)
+			}
+		}
+		return rendered, err
+	})
+	if shared {
+		utils.Debug("Coalesced image request", "domain", domain, "path", path, "options", options.CacheKey())
+	}
 	if err != nil {
-		utils.WriteInternalError(w, "Failed to get MIME type", err.Error())
+		writeRenderError(w, err)
 		return
 	}
 
+	writeImage(w, rendered.data, rendered.mimeType, options)
+}
+
+func writeImage(w http.ResponseWriter, data []byte, mimeType string, options utils.ImageTransformOptions) {
 	if options.ForceDownload {
 		w.Header().Set("Content-Disposition", "attachment")
 	}
 
 	w.Header().Set("Content-Type", mimeType)
 	w.Header().Set("Cache-Control", "public, max-age=31536000")
-	w.Write(modifiedImg)
+	w.Write(data)
+}
+
+// renderedImage is the outcome of fetching and transforming an image
+type renderedImage struct {
+	data     []byte
+	mimeType string
+}
+
+// renderStageError records which step of rendering an image failed
+type renderStageError struct {
+	stage string
+	err   error
+}
+
+func (e *renderStageError) Error() string {
+	return e.stage + ": " + e.err.Error()
+}
+
+func (e *renderStageError) Unwrap() error {
+	return e.err
+}
+
+const (
+	renderStageFetch     = "fetch"
+	renderStageTransform = "transform"
+	renderStageMimeType  = "mime type"
+)
+
+var renderGroup utils.CallGroup[renderedImage]
+
+// derivativeSources maps source files to their cached outputs, see SourceChanged
+var derivativeSources *utils.DerivativeSources
+
+func init() {
+	var err error
+	derivativeSources, err = utils.NewDerivativeSources(10000)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// SourceChanged drops what was derived from a changed or removed source file: its
+// cached image metadata, rendered outputs and the aggregates of its directories
+func SourceChanged(domain string, path string, derivativeCache utils.DerivativeCache) {
+	metadataCache.Invalidate(metadataKey(domain, path))
+	directoryChanged(domain, path)
+	if derivativeCache != nil {
+		derivativeSources.Evict(derivativeCache, domain, path)
+	}
+}
+
+func renderImage(ctx context.Context, path string, domain string, options utils.ImageTransformOptions, imgUtils utils.ImageUtils, rclone utils.Rclone) (renderedImage, error) {
+	data, err := rclone.FetchImage(ctx, path, domain)
+	if err != nil {
+		return renderedImage{}, &renderStageError{stage: renderStageFetch, err: err}
+	}
+
+	modifiedImg, err := imgUtils.TransformImage(ctx, data, options)
+	if err != nil {
+		return renderedImage{}, &renderStageError{stage: renderStageTransform, err: err}
+	}
+
+	mimeType, err := imgUtils.GetMimeType(modifiedImg)
+	if err != nil {
+		return renderedImage{}, &renderStageError{stage: renderStageMimeType, err: err}
+	}
+
+	return renderedImage{data: modifiedImg, mimeType: mimeType}, nil
+}
+
+func writeRenderError(w http.ResponseWriter, err error) {
+	var stageErr *renderStageError
+	if !errors.As(err, &stageErr) {
+		utils.WriteStorageError(w, "Failed to render image", err)
+		return
+	}
+
+	switch stageErr.stage {
+	case renderStageFetch:
+		utils.WriteStorageError(w, "Failed to fetch image", stageErr.err)
+	case renderStageTransform:
+		writeTransformError(w, stageErr.err)
+	default:
+		utils.WriteInternalError(w, "Failed to get MIME type", stageErr.err.Error())
+	}
+}
+
+// writeTransformError answers with 503 and a Retry-After hint when the transform
+// scheduler is saturated, and with 500 for any other transform failure
+func writeTransformError(w http.ResponseWriter, err error) {
+	var busy *utils.SchedulerBusyError
+	if errors.As(err, &busy) {
+		utils.WriteServiceUnavailableError(w, busy.RetryAfterSeconds(), err.Error())
+		return
+	}
+	utils.WriteInternalError(w, "Failed to transform image", err.Error())
 }
@@ -1,10 +1,14 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"shuto-api/config"
 	"shuto-api/utils"
@@ -17,7 +21,7 @@ type MockImageUtils struct {
 	GetImageMetadataFunc func([]byte) (utils.ImageMetadata, error)
 }
 
-func (m *MockImageUtils) TransformImage(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+func (m *MockImageUtils) TransformImage(ctx context.Context, data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
 	return m.TransformImageFunc(data, opts)
 }
 
@@ -47,7 +51,7 @@ func TestImageHandler(t *testing.T) {
 		name           string
 		path           string
 		queryParams    map[string]string
-		mockFetch      func(string, string) ([]byte, error)
+		mockFetch      func(context.Context, string, string) ([]byte, error)
 		mockTransform  func([]byte, utils.ImageTransformOptions) ([]byte, error)
 		mockMimeType   func([]byte) (string, error)
 		mockGetImageMetadata func([]byte) (utils.ImageMetadata, error)
@@ -63,7 +67,7 @@ func TestImageHandler(t *testing.T) {
 				"w": "100",
 				"h": "100",
 			},
-			mockFetch: func(remote, path string) ([]byte, error) {
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
 				return []byte("mock-image-data"), nil
 			},
 			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
@@ -95,7 +99,7 @@ func TestImageHandler(t *testing.T) {
 				"blur": "15",
 				"dl": "1",
 			},
-			mockFetch: func(remote, path string) ([]byte, error) {
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
 				return []byte("mock-image-data"), nil
 			},
 			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
@@ -124,7 +128,7 @@ func TestImageHandler(t *testing.T) {
 				"w": "100",
 				"h": "100",
 			},
-			mockFetch: func(remote, path string) ([]byte, error) {
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
 				return nil, fmt.Errorf("image not found")
 			},
 			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
@@ -136,6 +140,78 @@ func TestImageHandler(t *testing.T) {
 			mockDomainConfig: defaultDomainConfig,
 			expectedStatus: http.StatusInternalServerError,
 		},
+		{
+			name: "Image missing from storage",
+			path: "/v2/image/nonexistent.jpg",
+			queryParams: map[string]string{
+				"w": "100",
+			},
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
+				return nil, fmt.Errorf("failed to fetch image: %w", utils.ErrNotFound)
+			},
+			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+				return nil, nil
+			},
+			mockMimeType: func(data []byte) (string, error) {
+				return "", nil
+			},
+			mockDomainConfig: defaultDomainConfig,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Storage access denied",
+			path: "/v2/image/nonexistent.jpg",
+			queryParams: map[string]string{
+				"w": "100",
+			},
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
+				return nil, fmt.Errorf("failed to fetch image: %w", utils.ErrPermission)
+			},
+			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+				return nil, nil
+			},
+			mockMimeType: func(data []byte) (string, error) {
+				return "", nil
+			},
+			mockDomainConfig: defaultDomainConfig,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Storage timed out",
+			path: "/v2/image/nonexistent.jpg",
+			queryParams: map[string]string{
+				"w": "100",
+			},
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
+				return nil, fmt.Errorf("failed to fetch image: %w", utils.ErrTimeout)
+			},
+			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+				return nil, nil
+			},
+			mockMimeType: func(data []byte) (string, error) {
+				return "", nil
+			},
+			mockDomainConfig: defaultDomainConfig,
+			expectedStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name: "Storage unavailable",
+			path: "/v2/image/nonexistent.jpg",
+			queryParams: map[string]string{
+				"w": "100",
+			},
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
+				return nil, fmt.Errorf("failed to fetch image: %w", utils.ErrBackendUnavailable)
+			},
+			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+				return nil, nil
+			},
+			mockMimeType: func(data []byte) (string, error) {
+				return "", nil
+			},
+			mockDomainConfig: defaultDomainConfig,
+			expectedStatus: http.StatusBadGateway,
+		},
 		{
 			name: "Failed to transform image",
 			path: "/v2/image/test.jpg",
@@ -143,7 +219,7 @@ func TestImageHandler(t *testing.T) {
 				"w": "100",
 				"h": "100",
 			},
-			mockFetch: func(remote, path string) ([]byte, error) {
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
 				return []byte("mock-image-data"), nil
 			},
 			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
@@ -162,7 +238,7 @@ func TestImageHandler(t *testing.T) {
 				"w": "100",
 				"h": "100",
 			},
-			mockFetch: func(remote, path string) ([]byte, error) {
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
 				return []byte("mock-image-data"), nil
 			},
 			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
@@ -180,7 +256,7 @@ func TestImageHandler(t *testing.T) {
 			queryParams: map[string]string{
 				"w": "100", "h": "100",
 			},
-			mockFetch: func(remote, path string) ([]byte, error) {
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
 				return []byte("mock-image-data"), nil
 			},
 			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
@@ -208,7 +284,7 @@ func TestImageHandler(t *testing.T) {
 			queryParams: map[string]string{
 				"w": "100", "h": "100", "dpr": "3.1",
 			},
-			mockFetch: func(remote, path string) ([]byte, error) {
+			mockFetch: func(ctx context.Context, remote, path string) ([]byte, error) {
 				return []byte("mock-image-data"), nil
 			},
 			mockTransform: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
@@ -233,8 +309,8 @@ func TestImageHandler(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockRclone := &utils.MockRclone{
 				FetchImageFunc: tt.mockFetch,
-				ListPathFunc: func(path, domain string) ([]utils.RcloneFile, error) {
-					return []utils.RcloneFile{}, nil
+				StatFunc: func(ctx context.Context, path, domain string) (utils.RcloneFile, error) {
+					return utils.RcloneFile{}, utils.ErrNotFound
 				},
 			}
 
@@ -262,7 +338,7 @@ func TestImageHandler(t *testing.T) {
 			req.Host = "test.domain.com"
 
 			rr := httptest.NewRecorder()
-			ImageHandler(rr, req, mockImageUtils, mockRclone, mockDomainConfig)
+			ImageHandler(rr, req, mockImageUtils, mockRclone, mockDomainConfig, nil)
 
 			if rr.Code != tt.expectedStatus {
 				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
@@ -282,3 +358,251 @@ func TestImageHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestImageHandler_TransformQueueFull(t *testing.T) {
+	mockRclone := &utils.MockRclone{
+		FetchImageFunc: func(ctx context.Context, path, domain string) ([]byte, error) {
+			return []byte("mock-image-data"), nil
+		},
+		StatFunc: func(ctx context.Context, path, domain string) (utils.RcloneFile, error) {
+			return utils.RcloneFile{}, utils.ErrNotFound
+		},
+	}
+
+	mockImageUtils := &MockImageUtils{
+		TransformImageFunc: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+			return nil, &utils.SchedulerBusyError{Err: utils.ErrTransformQueueFull, RetryAfter: 5 * time.Second}
+		},
+	}
+
+	mockDomainConfig := &MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/v2/image/test.jpg?w=100", nil)
+	rr := httptest.NewRecorder()
+	ImageHandler(rr, req, mockImageUtils, mockRclone, mockDomainConfig, nil)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("expected Retry-After 5, got %s", got)
+	}
+}
+
+func TestImageHandler_CoalescesIdenticalRequests(t *testing.T) {
+	var fetches, transforms int32
+	release := make(chan struct{})
+
+	mockRclone := &utils.MockRclone{
+		FetchImageFunc: func(ctx context.Context, path, domain string) ([]byte, error) {
+			atomic.AddInt32(&fetches, 1)
+			<-release
+			return []byte("mock-image-data"), nil
+		},
+		StatFunc: func(ctx context.Context, path, domain string) (utils.RcloneFile, error) {
+			return utils.RcloneFile{}, utils.ErrNotFound
+		},
+	}
+
+	mockImageUtils := &MockImageUtils{
+		TransformImageFunc: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+			atomic.AddInt32(&transforms, 1)
+			return []byte("mock-transformed-image"), nil
+		},
+		GetMimeTypeFunc: func(data []byte) (string, error) {
+			return "image/jpeg", nil
+		},
+	}
+
+	mockDomainConfig := &MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, 5)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		// Same parameters in a different order must share the same work
+		url := "/v2/image/coalesced.jpg?w=100&h=50"
+		if i%2 == 1 {
+			url = "/v2/image/coalesced.jpg?h=50&w=100"
+		}
+		req := httptest.NewRequest("GET", url, nil)
+
+		wg.Add(1)
+		go func(rr *httptest.ResponseRecorder) {
+			defer wg.Done()
+			ImageHandler(rr, req, mockImageUtils, mockRclone, mockDomainConfig, nil)
+		}(recorders[i])
+	}
+
+	for atomic.LoadInt32(&fetches) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("expected 1 fetch, got %d", got)
+	}
+	if got := atomic.LoadInt32(&transforms); got != 1 {
+		t.Errorf("expected 1 transform, got %d", got)
+	}
+	for _, rr := range recorders {
+		if rr.Code != http.StatusOK || rr.Body.String() != "mock-transformed-image" {
+			t.Errorf("expected shared result, got status %d body %q", rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestImageHandler_DerivativeCache(t *testing.T) {
+
+	var transforms int32
+	mockRclone := &utils.MockRclone{
+		FetchImageFunc: func(ctx context.Context, path, domain string) ([]byte, error) {
+			return []byte("mock-image-data"), nil
+		},
+		StatFunc: func(ctx context.Context, path, domain string) (utils.RcloneFile, error) {
+			return utils.RcloneFile{Path: "cached.jpg", Name: "cached.jpg", Size: 15, ModTime: "2024-01-01T00:00:00Z"}, nil
+		},
+	}
+
+	mockImageUtils := &MockImageUtils{
+		TransformImageFunc: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+			atomic.AddInt32(&transforms, 1)
+			return []byte("mock-transformed-image"), nil
+		},
+		GetMimeTypeFunc: func(data []byte) (string, error) {
+			return "image/webp", nil
+		},
+	}
+
+	domainConfig := config.DomainConfig{}
+	mockDomainConfig := &MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return domainConfig, nil
+		},
+	}
+
+	derivativeCache, err := utils.NewDiskCache(utils.DiskCacheOptions{
+		Dir:           t.TempDir(),
+		MaxBytes:      1024 * 1024,
+		ConfigManager: mockDomainConfig,
+	})
+	if err != nil {
+		t.Fatalf("failed to create derivative cache: %v", err)
+	}
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v2/image/cached.jpg?w=100&fm=webp", nil)
+		rr := httptest.NewRecorder()
+		ImageHandler(rr, req, mockImageUtils, mockRclone, mockDomainConfig, derivativeCache)
+		return rr
+	}
+
+	first := serve()
+	if got := first.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("expected X-Cache MISS, got %q", got)
+	}
+
+	second := serve()
+	if got := second.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("expected X-Cache HIT, got %q", got)
+	}
+	if second.Body.String() != "mock-transformed-image" || second.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("unexpected cached response: %q %q", second.Header().Get("Content-Type"), second.Body.String())
+	}
+	if got := atomic.LoadInt32(&transforms); got != 1 {
+		t.Errorf("expected 1 transform, got %d", got)
+	}
+
+	// A changed source drops its outputs
+	SourceChanged("example.com", "cached.jpg", derivativeCache)
+	if entries := derivativeCache.Stats().Entries; entries != 0 {
+		t.Errorf("expected the outputs of the changed source to be deleted, got %d entries", entries)
+	}
+	if got := serve().Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("expected X-Cache MISS after the source changed, got %q", got)
+	}
+
+	// Domains can opt out of the disk cache
+	domainConfig.Cache.DisableDisk = true
+	third := serve()
+	if got := third.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("expected X-Cache MISS, got %q", got)
+	}
+	if got := atomic.LoadInt32(&transforms); got != 3 {
+		t.Errorf("expected 3 transforms, got %d", got)
+	}
+}
+
+func TestImageHandler_NotModified(t *testing.T) {
+	var fetches int32
+	mockRclone := &utils.MockRclone{
+		FetchImageFunc: func(ctx context.Context, path, domain string) ([]byte, error) {
+			atomic.AddInt32(&fetches, 1)
+			return []byte("mock-image-data"), nil
+		},
+		StatFunc: func(ctx context.Context, path, domain string) (utils.RcloneFile, error) {
+			return utils.RcloneFile{Path: "photo.jpg", Name: "photo.jpg", Size: 15, ModTime: "2024-01-01T00:00:00Z"}, nil
+		},
+	}
+	mockImageUtils := &MockImageUtils{
+		TransformImageFunc: func(data []byte, opts utils.ImageTransformOptions) ([]byte, error) {
+			return []byte("mock-transformed-image"), nil
+		},
+		GetMimeTypeFunc: func(data []byte) (string, error) {
+			return "image/jpeg", nil
+		},
+	}
+	mockDomainConfig := &MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+
+	serve := func(target string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		ImageHandler(rr, req, mockImageUtils, mockRclone, mockDomainConfig, nil)
+		return rr
+	}
+
+	first := serve("/v2/image/photo.jpg?w=100", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with ETag, got %d %q", first.Code, etag)
+	}
+	if got := first.Header().Get("Last-Modified"); got != "Mon, 01 Jan 2024 00:00:00 GMT" {
+		t.Errorf("unexpected Last-Modified %q", got)
+	}
+
+	revalidated := serve("/v2/image/photo.jpg?w=100", map[string]string{"If-None-Match": etag})
+	if revalidated.Code != http.StatusNotModified || revalidated.Body.Len() != 0 {
+		t.Errorf("expected empty 304, got %d with %d bytes", revalidated.Code, revalidated.Body.Len())
+	}
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("expected the 304 to skip fetching, got %d fetches", got)
+	}
+
+	// Different transform options are a different representation
+	other := serve("/v2/image/photo.jpg?w=200", map[string]string{"If-None-Match": etag})
+	if other.Code != http.StatusOK {
+		t.Errorf("expected 200 for other options, got %d", other.Code)
+	}
+
+	since := serve("/v2/image/photo.jpg?w=100", map[string]string{"If-Modified-Since": "Mon, 01 Jan 2024 00:00:00 GMT"})
+	if since.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for If-Modified-Since, got %d", since.Code)
+	}
+}
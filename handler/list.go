@@ -1,9 +1,10 @@
 package handler
 
 import (
-	"encoding/json"
+	"context"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"shuto-api/config"
@@ -16,17 +17,38 @@ type Utils interface {
 }
 
 type FileResponse struct {
-	Path     string    `json:"path"`
-	Size     int64     `json:"size"`
-	MimeType string    `json:"mimeType"`
-	IsDir    bool      `json:"isDir"`
-	Width    int       `json:"width,omitempty"`
-	Height   int       `json:"height,omitempty"`
-	Keywords []string  `json:"keywords,omitempty"`
+	Path       string     `json:"path"`
+	Size       int64      `json:"size"`
+	MimeType   string     `json:"mimeType"`
+	IsDir      bool       `json:"isDir"`
+	ModTime    string     `json:"modTime,omitempty"`
+	Width      int        `json:"width,omitempty"`
+	Height     int        `json:"height,omitempty"`
+	Keywords   []string   `json:"keywords,omitempty"`
+	CapturedAt *time.Time `json:"capturedAt,omitempty"`
+	// URLs of signed listings, signed when the path is protected
+	URL          string `json:"url,omitempty"`          // image, with the requested transform
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"` // image, with the thumbnail preset
+	DownloadURL  string `json:"downloadUrl,omitempty"`
+	// Aggregates of directories, with stats= and cover=
+	Stats *DirectoryStats `json:"stats,omitempty"`
+	Cover *CoverImage     `json:"cover,omitempty"`
 }
 
+// metadataCache holds the metadata of images by metadataKey
 var metadataCache *utils.Cache[utils.ImageMetadata]
 
+func metadataKey(domain string, path string) string {
+	return domain + "|" + path
+}
+
+const (
+	// maxMetadataWorkers bounds the images of a listing read at the same time
+	maxMetadataWorkers = 8
+	// listBatchSize is the number of entries whose metadata is loaded before they're written
+	listBatchSize = 4 * maxMetadataWorkers
+)
+
 func init() {
 	var err error
 	metadataCache, err = utils.NewCache[utils.ImageMetadata](utils.CacheOptions{
@@ -39,24 +61,54 @@ func init() {
 
 // ListHandler handles directory listing requests
 // @Summary List contents of a directory
-// @Description Get a list of files and directories at the specified path
+// @Description Get a list of files and directories at the specified path. Without query parameters
+// @Description the response is an array of all entries; with any of them it's a ListResponse page
+// @Description holding the entries after the cursor and a cursor for the next page.
 // @Tags list
 // @Accept  json
-// @Produce  json
+// @Produce  json,application/x-ndjson,text/csv,html
 // @Security ApiKeyAuth
-// @Param   path     path    string     true        "Path to list contents from"
+// @Param   path     path    string     true        "Path to list contents from, empty for the root"
+// @Param   recursive  query   bool    false  "List subdirectories too, their entries have paths relative to the listed one"
+// @Param   depth      query   int     false  "Levels of subdirectories to list, implies recursive"
+// @Param   limit      query   int     false  "Entries per page, 1000 by default and at most 10000"
+// @Param   cursor     query   string  false  "nextCursor of the previous page"
+// @Param   sort       query   string  false  "Sort by name, size, modtime or captured (EXIF capture date, else modtime)" Enums(name, size, modtime, captured)
+// @Param   order      query   string  false  "Sort order" Enums(asc, desc)
+// @Param   type       query   string  false  "Comma separated MIME types to include, e.g. image/*"
+// @Param   ext        query   string  false  "Comma separated extension globs to include, e.g. jp*g,png"
+// @Param   min_width  query   int     false  "Only images at least this wide"
+// @Param   min_height query   int     false  "Only images at least this high"
+// @Param   keyword    query   string  false  "Only files whose name contains the keyword or that are tagged with it"
+// @Param   format     query   string  false  "Output format, negotiated from Accept when missing" Enums(json, ndjson, csv, html)
+// @Param   columns    query   string  false  "Comma separated columns of CSV listings, e.g. path,size,width,height,downloadUrl"
+// @Param   sign       query   bool    false  "Attach url, thumbnailUrl and downloadUrl to the entries, signed for protected paths"
+// @Param   preset     query   string  false  "Named transform parameters of the domain for url"
+// @Param   w          query   int     false  "Width of url, overrides the preset; h, fit, fm, q, dpr and blur are passed on too"
+// @Param   stats      query   bool    false  "Attach the file count, total bytes and image count below each directory"
+// @Param   cover      query   bool    false  "Attach the cover image of each directory: cover.jpg or folder.jpg, else the image captured first"
+// @Param   If-None-Match     header  string  false  "Answer with 304 when the ETag matches, not for signed listings or those with directory aggregates"
+// @Param   If-Modified-Since header  string  false  "Answer with 304 when no entry changed since"
 // @Success 200 {array}  utils.RcloneFile "List of files and directories"
+// @Success 304 "Not modified"
+// @Header  200 {string} X-Total-Count "Entries matching the filters, for paginated NDJSON and CSV listings"
+// @Header  200 {string} X-Next-Cursor "Cursor of the next page, for paginated NDJSON and CSV listings"
+// @Header  200 {string} ETag "Strong validator derived from the listed entries"
+// @Header  200 {string} Last-Modified "Most recent modification time of the listed entries"
+// @Header  200 {string} X-Storage-Remote "Remote that served the storage reads, a replica while the primary is unavailable"
 // @Failure 400 {object} utils.ErrorResponse "Invalid request parameters"
 // @Failure 401 {object} utils.ErrorResponse "Unauthorized - Invalid or missing API key"
+// @Failure 403 {object} utils.ErrorResponse "Storage access denied"
 // @Failure 404 {object} utils.ErrorResponse "Path not found"
 // @Failure 500 {object} utils.ErrorResponse "Internal server error"
+// @Failure 502 {object} utils.ErrorResponse "Storage backend unavailable"
+// @Failure 504 {object} utils.ErrorResponse "Storage backend timed out"
 // @Router /list/{path} [get]
 func ListHandler(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUtils, rclone utils.Rclone, domainConfig config.DomainConfigManager) {
 	domain := utils.GetDomainFromRequest(r)
-	path := strings.TrimPrefix(r.URL.Path, "/"+config.ApiVersion+"/list/")
-	
-	if path == "" {
-		utils.WriteInvalidPathError(w, "Path is required")
+	path, err := utils.RequestDir(r, "list")
+	if err != nil {
+		utils.WriteInvalidPathError(w, err.Error())
 		return
 	}
 
@@ -69,16 +121,45 @@ func ListHandler(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUti
 		return
 	}
 
-	if !validateAPIKey(cfg.Security.APIKeys, r.Header.Get("Authorization")) {
+	if !validateAPIKey(cfg.SecurityFor(path).APIKeys, r.Header.Get("Authorization")) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Unauthorized\n"))
 		return
 	}
 
-	files, err := rclone.ListPath(path, domain)
+	query, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		utils.WriteInvalidRequestError(w, "Invalid listing parameters", err.Error())
+		return
+	}
+	format, err := parseListFormat(r)
 	if err != nil {
-		utils.WriteInternalError(w, "Failed to list directory", err.Error())
+		utils.WriteInvalidRequestError(w, "Invalid listing format", err.Error())
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	signQuery := r.URL.Query()
+	if format.name == formatHTML {
+		// The gallery links to the images and shows their thumbnails
+		signQuery.Set("sign", "1")
+	}
+	signing, err := parseSignQuery(signQuery, cfg.Presets)
+	if err != nil {
+		utils.WriteInvalidRequestError(w, "Invalid URL parameters", err.Error())
+		return
+	}
+
+	directories := parseDirectoryQuery(r.URL.Query())
+
+	var files []utils.RcloneFile
+	if query.tree {
+		files, err = rclone.ListTree(r.Context(), path, domain, query.depth)
+	} else {
+		files, err = rclone.ListPath(r.Context(), path, domain)
+	}
+	if err != nil {
+		utils.WriteStorageError(w, "Failed to list directory", err)
 		return
 	}
 
@@ -87,56 +168,193 @@ func ListHandler(w http.ResponseWriter, r *http.Request, imgUtils utils.ImageUti
 		return
 	}
 
-	response := make([]FileResponse, len(files))
-	for i, file := range files {
-		newFile := FileResponse{
-			Path:     file.Path,
-			Size:     file.Size,
-			MimeType: file.MimeType,
-			IsDir:    file.IsDir,
+	dir := listingDir(r.Context(), rclone, path, domain, files)
+	entries := make([]listEntry, 0, len(files))
+	for _, file := range files {
+		entry := listEntry{file: file, path: entryPath(dir, file)}
+		// Subdirectories of a tree may be protected by keys of their own
+		if query.tree && !validateAPIKey(cfg.SecurityFor(entry.path).APIKeys, r.Header.Get("Authorization")) {
+			continue
 		}
+		if query.matchesFile(file) {
+			entries = append(entries, entry)
+		}
+	}
 
-		if !file.IsDir && strings.HasPrefix(file.MimeType, "image/") {
-			imgPath := path
-			if !strings.HasSuffix(path, "/" + file.Path) {
-				imgPath = path + "/" + file.Path
+	variant := "list"
+	if query.envelope || format.name != formatJSON {
+		variant = "list|" + format.name + "?" + r.URL.Query().Encode()
+	}
+	visible := make([]utils.RcloneFile, len(entries))
+	for i, entry := range entries {
+		visible[i] = entry.file
+	}
+	// Signed URLs expire and directory aggregates change with the contents of the
+	// directories, listings carrying them are always sent in full
+	lastModified, _ := utils.LastModified(visible...)
+	if signing == nil && !directories.any() && utils.CheckNotModified(w, r, utils.ListingETag(visible, variant), lastModified) {
+		return
+	}
+
+	// Metadata outlives the request in the cache, don't let a disconnect abort its fetch
+	metadataCtx := context.WithoutCancel(r.Context())
+	loadMetadata := func(entries []listEntry) {
+		loadImageMetadata(r.Context(), metadataCtx, entries, domain, imgUtils, rclone)
+	}
+
+	var pagination *Pagination
+	if query.envelope {
+		if query.needsMetadata() {
+			loadMetadata(entries)
+			matching := entries[:0]
+			for _, entry := range entries {
+				if query.matchesMetadata(entry) {
+					matching = append(matching, entry)
+				}
 			}
+			entries = matching
+		}
 
-			metadata, err := metadataCache.GetCached(utils.GetCachedOptions{
-				Key: imgPath,
-				TTL: 24 * time.Hour,
-				StaleTime: time.Hour,
-				GetFreshValue: func() (interface{}, error) {
-					imgData, err := rclone.FetchImage(imgPath, domain)
-					if err != nil {
-						return utils.ImageMetadata{}, err
+		total := len(entries)
+		var nextCursor string
+		entries, nextCursor = query.paginate(entries)
+		pagination = &Pagination{Limit: query.limit, Total: total, NextCursor: nextCursor}
+	}
+
+	// Entries are written in batches as their metadata is loaded, streamed formats send
+	// each batch right away
+	writer := newListWriter(w, r, format, path)
+	writer.begin(pagination)
+	for start := 0; start < len(entries); start += listBatchSize {
+		batch := entries[start:min(start+listBatchSize, len(entries))]
+		loadMetadata(batch)
+		if directories.any() {
+			loadDirectorySummaries(r.Context(), metadataCtx, batch, directories, domain, imgUtils, rclone)
+		}
+		for _, entry := range batch {
+			response := newFileResponse(entry)
+			if signing != nil {
+				if err := signing.attachURLs(&response, entry, cfg); err != nil {
+					// Streamed formats already started, they end early
+					utils.Error("Failed to sign URLs", "path", entry.path, "error", err)
+					if format.name == formatJSON || format.name == formatHTML {
+						utils.WriteInternalError(w, "Failed to sign URLs", err.Error())
 					}
-					return imgUtils.GetImageMetadata(imgData)
-				},
-			})
-
-			if err == nil {
-				newFile.Width = metadata.Width
-				newFile.Height = metadata.Height
-				newFile.Keywords = metadata.Keywords
-			} else {
-				utils.Debug("Failed to get image metadata", "error", err, "path", imgPath)
+					return
+				}
+			}
+			if err := writer.write(entry, response); err != nil {
+				utils.Debug("Failed to write listing", "path", path, "error", err)
+				return
 			}
 		}
+		writer.flush()
+	}
+	if err := writer.end(); err != nil {
+		utils.Debug("Failed to write listing", "path", path, "error", err)
+		return
+	}
+
+	utils.Debug("Directory listed successfully", "path", path, "count", len(files), "format", format.name)
+}
+
+// listingDir returns the directory the entries of files, the listing of path, are
+// relative to. Listing a file yields the file itself, which looks like a directory
+// holding a single file of the same name until the path is stat'ed.
+func listingDir(ctx context.Context, rclone utils.Rclone, path string, domain string, files []utils.RcloneFile) string {
+	if !utils.IsFileListing(path, files) {
+		return path
+	}
+	if file, err := rclone.Stat(ctx, path, domain); err != nil || file.IsDir {
+		return path
+	}
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// entryPath returns the full path of a file listed in dir
+func entryPath(dir string, file utils.RcloneFile) string {
+	if dir == "" {
+		return file.Path
+	}
+	return dir + "/" + file.Path
+}
+
+func isImage(file utils.RcloneFile) bool {
+	return !file.IsDir && strings.HasPrefix(file.MimeType, "image/")
+}
+
+// loadImageMetadata loads the metadata of the images among entries that don't have it
+// yet with a bounded pool of workers. No more images are read once reqCtx is done.
+func loadImageMetadata(reqCtx context.Context, ctx context.Context, entries []listEntry, domain string, imgUtils utils.ImageUtils, rclone utils.Rclone) {
+	jobs := make(chan *listEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < maxMetadataWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				entry.metadata = imageMetadata(ctx, entry.path, domain, imgUtils, rclone)
+			}
+		}()
+	}
 
-		response[i] = newFile
+	for i := range entries {
+		if reqCtx.Err() != nil {
+			break
+		}
+		if entries[i].metadata == nil && isImage(entries[i].file) {
+			jobs <- &entries[i]
+		}
 	}
+	close(jobs)
+	wg.Wait()
+}
 
-	data, err := json.Marshal(response)
+// imageMetadata returns the cached metadata of the image at path, nil when it can't be read
+func imageMetadata(ctx context.Context, path string, domain string, imgUtils utils.ImageUtils, rclone utils.Rclone) *utils.ImageMetadata {
+	metadata, err := metadataCache.GetCached(utils.GetCachedOptions{
+		Key:       metadataKey(domain, path),
+		TTL:       24 * time.Hour,
+		StaleTime: time.Hour,
+		GetFreshValue: func() (interface{}, error) {
+			return utils.ReadImageMetadata(ctx, path, domain, imgUtils, rclone)
+		},
+	})
 	if err != nil {
-		utils.WriteInternalError(w, "Failed to encode response", err.Error())
-		return
+		utils.Debug("Failed to get image metadata", "error", err, "path", path)
+		return nil
 	}
+	return &metadata
+}
 
-	utils.Debug("Directory listed successfully", "path", path, "count", len(files))
-	
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+func newFileResponse(entry listEntry) FileResponse {
+	response := FileResponse{
+		Path:     entry.file.Path,
+		Size:     entry.file.Size,
+		MimeType: entry.file.MimeType,
+		IsDir:    entry.file.IsDir,
+		ModTime:  entry.file.ModTime,
+	}
+	if entry.metadata != nil {
+		response.Width = entry.metadata.Width
+		response.Height = entry.metadata.Height
+		response.Keywords = entry.metadata.Keywords
+		if !entry.metadata.CapturedAt.IsZero() {
+			response.CapturedAt = &entry.metadata.CapturedAt
+		}
+	}
+	response.Stats = entry.stats
+	if entry.cover != nil {
+		response.Cover = &CoverImage{
+			Path:   entry.file.Path + entry.cover.path[strings.LastIndex(entry.cover.path, "/"):],
+			Width:  entry.cover.width,
+			Height: entry.cover.height,
+		}
+	}
+	return response
 }
 
 func validateAPIKey(apiKeys []config.APIKey, authHeader string) bool {
@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"shuto-api/utils"
+)
+
+// DirectoryStats are the aggregates of the files below a listed directory
+type DirectoryStats struct {
+	FileCount  int64 `json:"fileCount"`
+	TotalBytes int64 `json:"totalBytes"`
+	ImageCount int64 `json:"imageCount"`
+}
+
+// CoverImage is the image shown for a listed directory
+type CoverImage struct {
+	Path         string `json:"path"` // relative to the listed directory, like FileResponse.Path
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"` // of signed listings
+}
+
+// directoryCover is the cached cover of a directory, path is empty when it has no images
+type directoryCover struct {
+	path   string // full path of the image
+	width  int
+	height int
+}
+
+// coverNames are the names of the images chosen as the cover of their directory, in
+// order of preference, with any image extension
+var coverNames = []string{"cover", "folder"}
+
+// maxCoverCandidates bounds the images of a directory without a conventional cover whose
+// metadata is read to find the one captured first, the earliest modified are read
+const maxCoverCandidates = 24
+
+var (
+	directoryStatsCache *utils.Cache[DirectoryStats]
+	directoryCoverCache *utils.Cache[directoryCover]
+)
+
+func init() {
+	var err error
+	if directoryStatsCache, err = utils.NewCache[DirectoryStats](utils.CacheOptions{MaxSize: 1000}); err != nil {
+		panic(err)
+	}
+	if directoryCoverCache, err = utils.NewCache[directoryCover](utils.CacheOptions{MaxSize: 1000}); err != nil {
+		panic(err)
+	}
+}
+
+// directoryQuery selects the aggregates computed for the directories of a listing
+type directoryQuery struct {
+	stats bool
+	cover bool
+}
+
+// parseDirectoryQuery parses the stats= and cover= parameters of a listing
+func parseDirectoryQuery(query url.Values) directoryQuery {
+	enabled := func(param string) bool {
+		return query.Get(param) == "1" || query.Get(param) == "true"
+	}
+	return directoryQuery{stats: enabled("stats"), cover: enabled("cover")}
+}
+
+func (q directoryQuery) any() bool {
+	return q.stats || q.cover
+}
+
+// directoryKey is the cache key of the aggregates of dir
+func directoryKey(domain string, dir string) string {
+	return domain + "|" + dir
+}
+
+// directoryChanged drops the aggregates of the directories containing a changed file
+func directoryChanged(domain string, file string) {
+	for dir := file; dir != ""; {
+		dir = path.Dir(dir)
+		if dir == "." || dir == "/" {
+			dir = ""
+		}
+		directoryStatsCache.Invalidate(directoryKey(domain, dir))
+		directoryCoverCache.Invalidate(directoryKey(domain, dir))
+	}
+}
+
+// loadDirectorySummaries loads the requested aggregates of the directories among entries
+// with a bounded pool of workers. No more directories are read once reqCtx is done.
+func loadDirectorySummaries(reqCtx context.Context, ctx context.Context, entries []listEntry, query directoryQuery, domain string, imgUtils utils.ImageUtils, rclone utils.Rclone) {
+	jobs := make(chan *listEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < maxMetadataWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				if query.stats {
+					entry.stats = directoryStats(ctx, entry.path, domain, rclone)
+				}
+				if query.cover {
+					entry.cover = coverImage(ctx, entry.path, domain, imgUtils, rclone)
+				}
+			}
+		}()
+	}
+
+	for i := range entries {
+		if reqCtx.Err() != nil {
+			break
+		}
+		if entries[i].file.IsDir {
+			jobs <- &entries[i]
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// directoryStats returns the cached aggregates of the files below dir, nil when they
+// can't be computed
+func directoryStats(ctx context.Context, dir string, domain string, rclone utils.Rclone) *DirectoryStats {
+	stats, err := directoryStatsCache.GetCached(utils.GetCachedOptions{
+		Key:       directoryKey(domain, dir),
+		TTL:       10 * time.Minute,
+		StaleTime: time.Hour,
+		GetFreshValue: func() (interface{}, error) {
+			size, err := rclone.Size(ctx, dir, domain)
+			if err != nil {
+				return DirectoryStats{}, err
+			}
+			return DirectoryStats{FileCount: size.Count, TotalBytes: size.Bytes, ImageCount: size.Images}, nil
+		},
+	})
+	if err != nil {
+		utils.Debug("Failed to get directory stats", "error", err, "path", dir)
+		return nil
+	}
+	return &stats
+}
+
+// coverImage returns the cached cover of dir, nil when it has none or it can't be listed
+func coverImage(ctx context.Context, dir string, domain string, imgUtils utils.ImageUtils, rclone utils.Rclone) *directoryCover {
+	cover, err := directoryCoverCache.GetCached(utils.GetCachedOptions{
+		Key:       directoryKey(domain, dir),
+		TTL:       10 * time.Minute,
+		StaleTime: time.Hour,
+		GetFreshValue: func() (interface{}, error) {
+			return findCover(ctx, dir, domain, imgUtils, rclone)
+		},
+	})
+	if err != nil {
+		utils.Debug("Failed to get directory cover", "error", err, "path", dir)
+		return nil
+	}
+	if cover.path == "" {
+		return nil
+	}
+	return &cover
+}
+
+// findCover picks the image of dir named after coverNames, else the one captured first
+// among the maxCoverCandidates earliest modified. Images without a capture date count by
+// their modification time.
+func findCover(ctx context.Context, dir string, domain string, imgUtils utils.ImageUtils, rclone utils.Rclone) (directoryCover, error) {
+	files, err := rclone.ListPath(ctx, dir, domain)
+	if err != nil {
+		return directoryCover{}, err
+	}
+
+	var images []listEntry
+	for _, file := range files {
+		if isImage(file) {
+			images = append(images, listEntry{file: file, path: entryPath(dir, file)})
+		}
+	}
+	if len(images) == 0 {
+		return directoryCover{}, nil
+	}
+
+	var cover *listEntry
+	for _, name := range coverNames {
+		for i := range images {
+			base := path.Base(images[i].file.Path)
+			if strings.EqualFold(strings.TrimSuffix(base, path.Ext(base)), name) {
+				cover = &images[i]
+				break
+			}
+		}
+		if cover != nil {
+			break
+		}
+	}
+
+	if cover == nil {
+		if len(images) > maxCoverCandidates {
+			modified := listQuery{sort: "modtime"}
+			for i := range images {
+				images[i].key = modified.sortKey(images[i])
+			}
+			sort.Slice(images, func(i, j int) bool {
+				return modified.before(images[i].key, images[i].path, images[j].key, images[j].path)
+			})
+			images = images[:maxCoverCandidates]
+		}
+
+		captured := listQuery{sort: "captured"}
+		for i := range images {
+			images[i].metadata = imageMetadata(ctx, images[i].path, domain, imgUtils, rclone)
+			images[i].key = captured.sortKey(images[i])
+			if cover == nil || captured.before(images[i].key, images[i].path, cover.key, cover.path) {
+				cover = &images[i]
+			}
+		}
+	} else {
+		cover.metadata = imageMetadata(ctx, cover.path, domain, imgUtils, rclone)
+	}
+
+	result := directoryCover{path: cover.path}
+	if cover.metadata != nil {
+		result.width = cover.metadata.Width
+		result.height = cover.metadata.Height
+	}
+	return result, nil
+}
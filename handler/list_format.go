@@ -0,0 +1,385 @@
+package handler
+
+import (
+	"bytes"
+	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"shuto-api/config"
+	"shuto-api/security"
+	"shuto-api/utils"
+)
+
+// Output formats of listings, chosen with format= or the Accept header
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatHTML   = "html"
+)
+
+// listMediaTypes maps the media types of the Accept header to formats
+var listMediaTypes = map[string]string{
+	"application/json":     formatJSON,
+	"application/x-ndjson": formatNDJSON,
+	"application/ndjson":   formatNDJSON,
+	"text/csv":             formatCSV,
+	"text/html":            formatHTML,
+}
+
+// csvColumns are the columns CSV listings can have, by name
+var csvColumns = map[string]func(FileResponse) string{
+	"path":         func(f FileResponse) string { return f.Path },
+	"size":         func(f FileResponse) string { return strconv.FormatInt(f.Size, 10) },
+	"mimeType":     func(f FileResponse) string { return f.MimeType },
+	"isDir":        func(f FileResponse) string { return strconv.FormatBool(f.IsDir) },
+	"modTime":      func(f FileResponse) string { return f.ModTime },
+	"width":        func(f FileResponse) string { return formatDimension(f.Width) },
+	"height":       func(f FileResponse) string { return formatDimension(f.Height) },
+	"keywords":     func(f FileResponse) string { return strings.Join(f.Keywords, ";") },
+	"capturedAt":   func(f FileResponse) string { return formatTime(f.CapturedAt) },
+	"url":          func(f FileResponse) string { return f.URL },
+	"thumbnailUrl": func(f FileResponse) string { return f.ThumbnailURL },
+	"downloadUrl":  func(f FileResponse) string { return f.DownloadURL },
+	"fileCount": func(f FileResponse) string {
+		return formatStat(f.Stats, func(s DirectoryStats) int64 { return s.FileCount })
+	},
+	"totalBytes": func(f FileResponse) string {
+		return formatStat(f.Stats, func(s DirectoryStats) int64 { return s.TotalBytes })
+	},
+	"imageCount": func(f FileResponse) string {
+		return formatStat(f.Stats, func(s DirectoryStats) int64 { return s.ImageCount })
+	},
+	"coverPath": func(f FileResponse) string {
+		if f.Cover == nil {
+			return ""
+		}
+		return f.Cover.Path
+	},
+}
+
+// defaultCSVColumns are the columns of CSV listings without columns=
+var defaultCSVColumns = []string{"path", "size", "mimeType", "isDir", "modTime", "width", "height"}
+
+func formatDimension(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+func formatStat(stats *DirectoryStats, value func(DirectoryStats) int64) string {
+	if stats == nil {
+		return ""
+	}
+	return strconv.FormatInt(value(*stats), 10)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// listFormat is the output format of a listing
+type listFormat struct {
+	name    string
+	columns []string // of CSV listings
+}
+
+// parseListFormat picks the format from format=, else from the first media type of the
+// Accept header that has one, JSON by default
+func parseListFormat(r *http.Request) (listFormat, error) {
+	format := listFormat{name: r.URL.Query().Get("format")}
+	if format.name == "" {
+		format.name = formatJSON
+		for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+			if name, ok := listMediaTypes[mediaType]; err == nil && ok {
+				format.name = name
+				break
+			}
+		}
+	}
+
+	switch format.name {
+	case formatJSON, formatNDJSON, formatHTML:
+	case formatCSV:
+		format.columns = splitList(r.URL.Query().Get("columns"))
+		if len(format.columns) == 0 {
+			format.columns = defaultCSVColumns
+		}
+		for _, column := range format.columns {
+			if _, ok := csvColumns[column]; !ok {
+				return format, fmt.Errorf("unknown column %q", column)
+			}
+		}
+	default:
+		return format, fmt.Errorf("format must be one of json, ndjson, csv or html")
+	}
+	return format, nil
+}
+
+// listWriter writes the entries of a listing as they are processed
+type listWriter interface {
+	// begin starts the response, pagination is nil for listings without pagination
+	begin(pagination *Pagination)
+	write(entry listEntry, response FileResponse) error
+	// flush sends the entries written so far to the client, if the format streams
+	flush()
+	end() error
+}
+
+func newListWriter(w http.ResponseWriter, r *http.Request, format listFormat, dir string) listWriter {
+	switch format.name {
+	case formatNDJSON:
+		return &ndjsonListWriter{w: w, encoder: json.NewEncoder(w)}
+	case formatCSV:
+		return &csvListWriter{w: w, csv: csv.NewWriter(w), columns: format.columns, dir: dir}
+	case formatHTML:
+		return &htmlListWriter{w: w, r: r, dir: dir}
+	}
+	return &jsonListWriter{w: w}
+}
+
+// paginationHeaders reports the pagination of streamed formats, which have no envelope
+func paginationHeaders(w http.ResponseWriter, pagination *Pagination) {
+	if pagination == nil {
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(pagination.Total))
+	if pagination.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", pagination.NextCursor)
+	}
+}
+
+// flushResponse sends the buffered response to the client
+func flushResponse(w http.ResponseWriter) {
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		utils.Debug("Failed to flush listing", "error", err)
+	}
+}
+
+// jsonListWriter writes an array of the entries, or a ListResponse for paginated listings
+type jsonListWriter struct {
+	w          http.ResponseWriter
+	pagination *Pagination
+	files      []FileResponse
+}
+
+func (j *jsonListWriter) begin(pagination *Pagination) {
+	j.pagination = pagination
+	j.files = []FileResponse{}
+}
+
+func (j *jsonListWriter) write(entry listEntry, response FileResponse) error {
+	j.files = append(j.files, response)
+	return nil
+}
+
+func (j *jsonListWriter) flush() {}
+
+func (j *jsonListWriter) end() error {
+	var response interface{} = j.files
+	if j.pagination != nil {
+		response = ListResponse{Files: j.files, Pagination: *j.pagination}
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		utils.WriteInternalError(j.w, "Failed to encode response", err.Error())
+		return err
+	}
+	j.w.Header().Set("Content-Type", "application/json")
+	_, err = j.w.Write(data)
+	return err
+}
+
+// ndjsonListWriter streams one FileResponse per line
+type ndjsonListWriter struct {
+	w       http.ResponseWriter
+	encoder *json.Encoder
+}
+
+func (n *ndjsonListWriter) begin(pagination *Pagination) {
+	n.w.Header().Set("Content-Type", "application/x-ndjson")
+	paginationHeaders(n.w, pagination)
+	n.w.WriteHeader(http.StatusOK)
+}
+
+func (n *ndjsonListWriter) write(entry listEntry, response FileResponse) error {
+	return n.encoder.Encode(response)
+}
+
+func (n *ndjsonListWriter) flush() {
+	flushResponse(n.w)
+}
+
+func (n *ndjsonListWriter) end() error {
+	return nil
+}
+
+// csvListWriter streams the configured columns of the entries after a header row
+type csvListWriter struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer
+	columns []string
+	dir     string
+}
+
+func (c *csvListWriter) begin(pagination *Pagination) {
+	name := path.Base(c.dir)
+	if c.dir == "" {
+		name = "listing"
+	}
+	c.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	c.w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".csv"}))
+	paginationHeaders(c.w, pagination)
+	c.w.WriteHeader(http.StatusOK)
+	c.csv.Write(c.columns)
+}
+
+func (c *csvListWriter) write(entry listEntry, response FileResponse) error {
+	row := make([]string, len(c.columns))
+	for i, column := range c.columns {
+		row[i] = csvColumns[column](response)
+	}
+	return c.csv.Write(row)
+}
+
+func (c *csvListWriter) flush() {
+	c.csv.Flush()
+	flushResponse(c.w)
+}
+
+func (c *csvListWriter) end() error {
+	c.csv.Flush()
+	return c.csv.Error()
+}
+
+//go:embed templates/gallery.html
+var galleryTemplates embed.FS
+
+var galleryTemplate = template.Must(template.New("gallery.html").Funcs(template.FuncMap{
+	"size": formatSize,
+}).ParseFS(galleryTemplates, "templates/gallery.html"))
+
+// galleryPage is the data of the gallery template
+type galleryPage struct {
+	Title       string
+	Breadcrumbs []galleryLink
+	Entries     []galleryEntry
+	Total       int
+	Next        string // link to the next page, empty on the last one
+}
+
+type galleryLink struct {
+	Name string
+	Href string
+}
+
+type galleryEntry struct {
+	Name      string
+	Href      string
+	Thumbnail string
+	IsDir     bool
+	Size      int64
+	Width     int
+	Height    int
+	Stats     *DirectoryStats
+}
+
+// htmlListWriter renders a gallery page with a thumbnail grid and breadcrumbs
+type htmlListWriter struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	dir  string
+	page galleryPage
+}
+
+// listLink links to the gallery of dir, keeping the parameters of the request but its cursor
+func (h *htmlListWriter) listLink(dir string, cursor string) string {
+	query := h.r.URL.Query()
+	query.Del("cursor")
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	query.Set("format", formatHTML)
+	return "/" + config.ApiVersion + "/list/" + security.EscapePath(dir) + "?" + query.Encode()
+}
+
+func (h *htmlListWriter) begin(pagination *Pagination) {
+	h.page.Title = "/" + h.dir
+	h.page.Breadcrumbs = []galleryLink{{Name: utils.GetDomainFromRequest(h.r), Href: h.listLink("", "")}}
+	if h.dir != "" {
+		segments := strings.Split(h.dir, "/")
+		for i, segment := range segments {
+			h.page.Breadcrumbs = append(h.page.Breadcrumbs, galleryLink{Name: segment, Href: h.listLink(strings.Join(segments[:i+1], "/"), "")})
+		}
+	}
+	if pagination != nil {
+		h.page.Total = pagination.Total
+		if pagination.NextCursor != "" {
+			h.page.Next = h.listLink(h.dir, pagination.NextCursor)
+		}
+	}
+}
+
+func (h *htmlListWriter) write(entry listEntry, response FileResponse) error {
+	galleryEntry := galleryEntry{
+		Name:      response.Path,
+		Href:      response.DownloadURL,
+		Thumbnail: response.ThumbnailURL,
+		IsDir:     response.IsDir,
+		Size:      response.Size,
+		Width:     response.Width,
+		Height:    response.Height,
+		Stats:     response.Stats,
+	}
+	if response.IsDir {
+		galleryEntry.Href = h.listLink(entry.path, "")
+		if response.Cover != nil {
+			galleryEntry.Thumbnail = response.Cover.ThumbnailURL
+		}
+	} else if response.URL != "" {
+		galleryEntry.Href = response.URL
+	}
+	h.page.Entries = append(h.page.Entries, galleryEntry)
+	return nil
+}
+
+func (h *htmlListWriter) flush() {}
+
+func (h *htmlListWriter) end() error {
+	var page bytes.Buffer
+	if err := galleryTemplate.Execute(&page, h.page); err != nil {
+		utils.WriteInternalError(h.w, "Failed to render gallery", err.Error())
+		return err
+	}
+	h.w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := h.w.Write(page.Bytes())
+	return err
+}
+
+// formatSize formats a byte count for humans
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
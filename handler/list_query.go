@@ -0,0 +1,405 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"shuto-api/config"
+	"shuto-api/security"
+	"shuto-api/utils"
+)
+
+// Page sizes of listings answered with the ListResponse envelope
+const (
+	DefaultListLimit = 1000
+	MaxListLimit     = 10000
+)
+
+// listParams are the query parameters that switch a listing to the ListResponse envelope
+var listParams = []string{"recursive", "depth", "limit", "cursor", "sort", "order", "type", "ext", "min_width", "min_height", "keyword"}
+
+// ListResponse is a page of a listing with its pagination metadata
+type ListResponse struct {
+	Files      []FileResponse `json:"files"`
+	Pagination Pagination     `json:"pagination"`
+}
+
+// Pagination describes the page of a ListResponse
+type Pagination struct {
+	Limit      int    `json:"limit"`
+	Total      int    `json:"total"`                // entries matching the filters across all pages
+	NextCursor string `json:"nextCursor,omitempty"` // empty on the last page
+}
+
+// listQuery holds the tree depth, filters, sort order and page of a listing
+type listQuery struct {
+	envelope  bool // any listing parameter was given
+	tree      bool
+	depth     int // of the tree, 0 for all levels
+	limit     int
+	cursor    *listCursor
+	sort      string
+	desc      bool
+	types     []string
+	exts      []string
+	minWidth  int
+	minHeight int
+	keyword   string
+}
+
+// listCursor marks the last entry of a page by its sort key and path
+type listCursor struct {
+	Order string `json:"o"`
+	Key   int64  `json:"k,omitempty"`
+	Path  string `json:"p"`
+}
+
+// parseListQuery parses the listing parameters of query
+func parseListQuery(query url.Values) (listQuery, error) {
+	q := listQuery{limit: DefaultListLimit, sort: "name"}
+	for _, param := range listParams {
+		if query.Has(param) {
+			q.envelope = true
+		}
+	}
+
+	var err error
+	if query.Get("recursive") == "1" || query.Get("recursive") == "true" {
+		q.tree = true
+	}
+	if value := query.Get("depth"); value != "" {
+		if q.depth, err = strconv.Atoi(value); err != nil || q.depth < 1 {
+			return q, fmt.Errorf("depth must be a positive number")
+		}
+		q.tree = true
+	}
+	if value := query.Get("limit"); value != "" {
+		if q.limit, err = strconv.Atoi(value); err != nil || q.limit < 1 {
+			return q, fmt.Errorf("limit must be a positive number")
+		}
+		q.limit = min(q.limit, MaxListLimit)
+	}
+
+	if value := query.Get("sort"); value != "" {
+		switch value {
+		case "name", "size", "modtime", "captured":
+			q.sort = value
+		default:
+			return q, fmt.Errorf("sort must be one of name, size, modtime or captured")
+		}
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.desc = true
+	default:
+		return q, fmt.Errorf("order must be asc or desc")
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		if q.cursor, err = decodeCursor(value); err != nil || q.cursor.Order != q.order() {
+			return q, fmt.Errorf("cursor is invalid or belongs to another sort order")
+		}
+	}
+
+	q.types = splitList(query.Get("type"))
+	for _, ext := range splitList(strings.ToLower(query.Get("ext"))) {
+		ext = strings.TrimPrefix(ext, ".")
+		if _, err := path.Match(ext, ""); err != nil {
+			return q, fmt.Errorf("invalid extension pattern %q", ext)
+		}
+		q.exts = append(q.exts, ext)
+	}
+	if q.minWidth, err = parseDimension(query.Get("min_width")); err != nil {
+		return q, fmt.Errorf("min_width must be a positive number")
+	}
+	if q.minHeight, err = parseDimension(query.Get("min_height")); err != nil {
+		return q, fmt.Errorf("min_height must be a positive number")
+	}
+	q.keyword = strings.ToLower(strings.TrimSpace(query.Get("keyword")))
+	return q, nil
+}
+
+func parseDimension(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid dimension %q", value)
+	}
+	return n, nil
+}
+
+// splitList splits a comma separated parameter, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// order names the sort order, cursors are only valid for the order they were made for
+func (q listQuery) order() string {
+	if q.desc {
+		return q.sort + ":desc"
+	}
+	return q.sort + ":asc"
+}
+
+// filtered reports whether entries are filtered by file properties, which excludes directories
+func (q listQuery) filtered() bool {
+	return len(q.types) > 0 || len(q.exts) > 0 || q.minWidth > 0 || q.minHeight > 0 || q.keyword != ""
+}
+
+// needsMetadata reports whether filtering or sorting needs the metadata of every image,
+// not only of those on the page
+func (q listQuery) needsMetadata() bool {
+	return q.minWidth > 0 || q.minHeight > 0 || q.keyword != "" || q.sort == "captured"
+}
+
+// listEntry is a listed file with the image metadata loaded for it
+type listEntry struct {
+	file     utils.RcloneFile
+	path     string // full path of the file
+	metadata *utils.ImageMetadata
+	key      int64 // sort key, ties are broken by path
+	// aggregates of directories, when requested
+	stats *DirectoryStats
+	cover *directoryCover
+}
+
+// matchesFile applies the filters that don't need image metadata
+func (q listQuery) matchesFile(file utils.RcloneFile) bool {
+	if !q.filtered() {
+		return true
+	}
+	if file.IsDir {
+		return false
+	}
+	if len(q.types) > 0 && !allowedType(q.types, file.MimeType) {
+		return false
+	}
+	if len(q.exts) > 0 {
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(file.Path), "."))
+		matched := false
+		for _, pattern := range q.exts {
+			if ok, _ := path.Match(pattern, ext); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if (q.minWidth > 0 || q.minHeight > 0) && !isImage(file) {
+		return false
+	}
+	return true
+}
+
+// matchesMetadata applies the filters on image metadata, entries without metadata only
+// match by name
+func (q listQuery) matchesMetadata(entry listEntry) bool {
+	if q.minWidth > 0 || q.minHeight > 0 {
+		if entry.metadata == nil || entry.metadata.Width < q.minWidth || entry.metadata.Height < q.minHeight {
+			return false
+		}
+	}
+	if q.keyword != "" {
+		if strings.Contains(strings.ToLower(path.Base(entry.file.Path)), q.keyword) {
+			return true
+		}
+		if entry.metadata == nil {
+			return false
+		}
+		for _, keyword := range entry.metadata.Keywords {
+			if strings.EqualFold(keyword, q.keyword) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// sortKey returns the key entry is sorted by. Images without a capture date sort by
+// their modification time.
+func (q listQuery) sortKey(entry listEntry) int64 {
+	switch q.sort {
+	case "size":
+		return entry.file.Size
+	case "captured":
+		if entry.metadata != nil && !entry.metadata.CapturedAt.IsZero() {
+			return entry.metadata.CapturedAt.UnixNano()
+		}
+		fallthrough
+	case "modtime":
+		modTime, err := time.Parse(time.RFC3339Nano, entry.file.ModTime)
+		if err != nil {
+			return 0
+		}
+		return modTime.UnixNano()
+	}
+	return 0
+}
+
+// before reports whether an entry with key a and path pathA comes before one with key b
+// and path pathB
+func (q listQuery) before(a int64, pathA string, b int64, pathB string) bool {
+	if q.desc {
+		a, pathA, b, pathB = b, pathB, a, pathA
+	}
+	if a != b {
+		return a < b
+	}
+	return pathA < pathB
+}
+
+// paginate sorts entries and returns the page after the cursor with the cursor of the next page
+func (q listQuery) paginate(entries []listEntry) ([]listEntry, string) {
+	for i := range entries {
+		entries[i].key = q.sortKey(entries[i])
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return q.before(entries[i].key, entries[i].path, entries[j].key, entries[j].path)
+	})
+
+	start := 0
+	if q.cursor != nil {
+		start = sort.Search(len(entries), func(i int) bool {
+			return q.before(q.cursor.Key, q.cursor.Path, entries[i].key, entries[i].path)
+		})
+	}
+	end := min(start+q.limit, len(entries))
+	page := entries[start:end]
+	if end == len(entries) {
+		return page, ""
+	}
+	last := page[len(page)-1]
+	return page, encodeCursor(listCursor{Order: q.order(), Key: last.key, Path: last.path})
+}
+
+func encodeCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// thumbnailPreset names the preset of thumbnail URLs, defaultThumbnail applies when a
+// domain doesn't define it
+const (
+	thumbnailPreset  = "thumbnail"
+	defaultThumbnail = "w=256&h=256&fit=crop"
+)
+
+// transformParams are the image parameters passed on to the URLs of signed listings
+var transformParams = []string{"w", "h", "fit", "dpr", "fm", "q", "blur"}
+
+// signQuery holds the transform parameters of the URLs attached to a signed listing
+type signQuery struct {
+	image     url.Values
+	thumbnail url.Values
+}
+
+// parseSignQuery parses the URL parameters of a listing, nil when URLs aren't requested.
+// The transform parameters of the request override those of its preset.
+func parseSignQuery(query url.Values, presets map[string]string) (*signQuery, error) {
+	if query.Get("sign") != "1" && query.Get("sign") != "true" {
+		return nil, nil
+	}
+
+	preset := func(name string, fallback string) (url.Values, error) {
+		value, ok := presets[name]
+		if !ok {
+			if fallback == "" {
+				return nil, fmt.Errorf("unknown preset %q", name)
+			}
+			value = fallback
+		}
+		params, err := url.ParseQuery(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preset %q", name)
+		}
+		return params, nil
+	}
+
+	q := &signQuery{image: url.Values{}}
+	var err error
+	if name := query.Get("preset"); name != "" {
+		if q.image, err = preset(name, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, param := range transformParams {
+		if value := query.Get(param); value != "" {
+			q.image.Set(param, value)
+		}
+	}
+	if q.thumbnail, err = preset(thumbnailPreset, defaultThumbnail); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// attachURLs sets the URLs of a listed file, images get an image and a thumbnail URL and
+// directory covers a thumbnail URL
+func (q *signQuery) attachURLs(response *FileResponse, entry listEntry, cfg config.DomainConfig) error {
+	settings := cfg.SecurityFor(entry.path)
+	var err error
+	if isImage(entry.file) {
+		if response.URL, err = fileURL(settings, "image", entry.path, q.image); err != nil {
+			return err
+		}
+		if response.ThumbnailURL, err = fileURL(settings, "image", entry.path, q.thumbnail); err != nil {
+			return err
+		}
+	}
+	if response.Cover != nil {
+		if response.Cover.ThumbnailURL, err = fileURL(cfg.SecurityFor(entry.cover.path), "image", entry.cover.path, q.thumbnail); err != nil {
+			return err
+		}
+	}
+	response.DownloadURL, err = fileURL(settings, "download", entry.path, url.Values{})
+	return err
+}
+
+// fileURL returns the URL of path on an endpoint, signed with the default key when the
+// security settings require it
+func fileURL(settings config.SecuritySettings, endpoint string, path string, params url.Values) (string, error) {
+	if settings.Mode != "" {
+		signer, err := security.NewURLSignerFromConfig(settings.Secrets, settings.ValidityWindow, endpoint)
+		if err != nil {
+			return "", err
+		}
+		return signer.GenerateSignedURL(path, params)
+	}
+
+	target := "/" + config.ApiVersion + "/" + endpoint + "/" + security.EscapePath(path)
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	return target, nil
+}
@@ -1,12 +1,26 @@
 package handler
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"shuto-api/config"
+	"shuto-api/security"
 	"shuto-api/utils"
 )
 
@@ -27,6 +41,27 @@ func (m *MockUtils) ListPath(path string) ([]utils.RcloneFile, error) {
 	return m.Files, nil
 }
 
+// resetListCaches gives a test empty image metadata and directory aggregate caches, the
+// package level ones would serve what an earlier run of the test cached
+func resetListCaches(t *testing.T) {
+	t.Helper()
+	metadata, stats, covers := metadataCache, directoryStatsCache, directoryCoverCache
+	t.Cleanup(func() {
+		metadataCache, directoryStatsCache, directoryCoverCache = metadata, stats, covers
+	})
+
+	var err error
+	if metadataCache, err = utils.NewCache[utils.ImageMetadata](utils.CacheOptions{MaxSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if directoryStatsCache, err = utils.NewCache[DirectoryStats](utils.CacheOptions{MaxSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if directoryCoverCache, err = utils.NewCache[directoryCover](utils.CacheOptions{MaxSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestListHandler(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -128,21 +163,95 @@ func TestListHandler(t *testing.T) {
 			expectedStatus: http.StatusUnauthorized,
 			expectedBody: "Unauthorized\n",
 		},
+		{
+			name: "Missing directory",
+			path: "/v2/list/photos",
+			mockListError: fmt.Errorf("failed to list path: %w", utils.ErrNotFound),
+			mockDomainConfig: config.DomainConfig{},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Storage timed out",
+			path: "/v2/list/photos",
+			mockListError: fmt.Errorf("failed to list path: %w", utils.ErrTimeout),
+			mockDomainConfig: config.DomainConfig{},
+			expectedStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name: "Storage unavailable",
+			path: "/v2/list/photos",
+			mockListError: fmt.Errorf("failed to list path: %w", utils.ErrBackendUnavailable),
+			mockDomainConfig: config.DomainConfig{},
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name: "Root listing",
+			path: "/v2/list/",
+			mockFiles: []utils.RcloneFile{
+				{Path: "file1.jpg", Size: 1024, MimeType: "image/jpeg", IsDir: false},
+			},
+			mockDomainConfig: config.DomainConfig{},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Mount with its own API keys",
+			path: "/v2/list/press/2024",
+			mockDomainConfig: config.DomainConfig{
+				Mounts: []config.MountConfig{
+					{
+						Prefix: "press",
+						Security: &config.SecuritySettings{
+							APIKeys: []config.APIKey{{Key: "press-key"}},
+						},
+					},
+				},
+			},
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody: "Unauthorized\n",
+		},
+		{
+			name: "Path traversal",
+			path: "/v2/list/photos/../../etc",
+			mockDomainConfig: config.DomainConfig{},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Path traversal with encoded slashes",
+			path: "/v2/list/photos%2F..%2F..%2Fetc",
+			mockDomainConfig: config.DomainConfig{},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Absolute path",
+			path: "/v2/list//etc",
+			mockDomainConfig: config.DomainConfig{},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Unclassified storage failure",
+			path: "/v2/list/photos",
+			mockListError: fmt.Errorf("failed to list path: %w", errors.New("unexpected output")),
+			mockDomainConfig: config.DomainConfig{},
+			expectedStatus: http.StatusInternalServerError,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockRclone := &utils.MockRclone{
-				ListPathFunc: func(path string, domain string) ([]utils.RcloneFile, error) {
+				ListPathFunc: func(ctx context.Context, path string, domain string) ([]utils.RcloneFile, error) {
 					if tt.mockListError != nil {
 						return nil, tt.mockListError
 					}
 					return tt.mockFiles, nil
 				},
-				FetchImageFunc: func(path string, domain string) ([]byte, error) {
+				FetchImageFunc: func(ctx context.Context, path string, domain string) ([]byte, error) {
 					// Return dummy image data for testing
 					return []byte("mock-image-data"), nil
 				},
+				OpenRangeFunc: func(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+					return io.NopCloser(strings.NewReader("mock-image-data")), nil
+				},
 			}
 
 			mockDomainConfigManager := &config.MockDomainConfigManager{
@@ -183,4 +292,724 @@ func TestListHandler(t *testing.T) {
 			}
 		})
 	}
-} 
\ No newline at end of file
+} 
+func TestListHandler_NotModified(t *testing.T) {
+	files := []utils.RcloneFile{
+		{Path: "photos/file1.jpg", Name: "file1.jpg", Size: 1024, MimeType: "image/jpeg", ModTime: "2024-01-01T00:00:00Z"},
+		{Path: "photos/dir1", Name: "dir1", IsDir: true, ModTime: "2024-02-01T00:00:00Z"},
+	}
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]utils.RcloneFile, error) {
+			return files, nil
+		},
+		FetchImageFunc: func(ctx context.Context, path string, domain string) ([]byte, error) {
+			return []byte("mock-image-data"), nil
+		},
+		OpenRangeFunc: func(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("mock-image-data")), nil
+		},
+	}
+	mockDomainConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+	mockImageUtils := &MockImageUtils{
+		GetImageMetadataFunc: func(data []byte) (utils.ImageMetadata, error) {
+			return utils.ImageMetadata{Width: 100, Height: 100}, nil
+		},
+	}
+
+	serve := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v2/list/photos", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		ListHandler(rec, req, mockImageUtils, mockRclone, mockDomainConfigManager)
+		return rec
+	}
+
+	first := serve("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with ETag, got %d %q", first.Code, etag)
+	}
+	if got := first.Header().Get("Last-Modified"); got != "Thu, 01 Feb 2024 00:00:00 GMT" {
+		t.Errorf("expected newest ModTime as Last-Modified, got %q", got)
+	}
+
+	if rec := serve(etag); rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", rec.Code)
+	}
+
+	// A changed entry invalidates the listing
+	files[0].Size = 2048
+	if rec := serve(etag); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 after change, got %d", rec.Code)
+	}
+}
+
+func TestListHandler_Query(t *testing.T) {
+	tree := []utils.RcloneFile{
+		{Path: "b.jpg", Size: 300, MimeType: "image/jpeg", ModTime: "2024-03-01T00:00:00Z"},
+		{Path: "a.png", Size: 100, MimeType: "image/png", ModTime: "2024-01-01T00:00:00Z"},
+		{Path: "notes.txt", Size: 200, MimeType: "text/plain", ModTime: "2024-02-01T00:00:00Z"},
+		{Path: "trip", IsDir: true, MimeType: "inode/directory", ModTime: "2024-01-01T00:00:00Z"},
+		{Path: "trip/beach.JPG", Size: 400, MimeType: "image/jpeg", ModTime: "2024-04-01T00:00:00Z"},
+		{Path: "private", IsDir: true, MimeType: "inode/directory"},
+		{Path: "private/c.jpg", Size: 500, MimeType: "image/jpeg"},
+	}
+	// Image metadata by path, the mock FetchImage returns the path as data
+	metadata := map[string]utils.ImageMetadata{
+		"gallery/b.jpg":          {Width: 800, Height: 600, CapturedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"gallery/a.png":          {Width: 100, Height: 100, Keywords: []string{"Sunset"}},
+		"gallery/trip/beach.JPG": {Width: 1600, Height: 1200, CapturedAt: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	var listedDepth int
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]utils.RcloneFile, error) {
+			return tree[:4], nil
+		},
+		ListTreeFunc: func(ctx context.Context, path string, domain string, depth int) ([]utils.RcloneFile, error) {
+			listedDepth = depth
+			return tree, nil
+		},
+		FetchImageFunc: func(ctx context.Context, path string, domain string) ([]byte, error) {
+			return []byte(path), nil
+		},
+		OpenRangeFunc: func(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(path)), nil
+		},
+	}
+	mockDomainConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Mounts: []config.MountConfig{{
+					Prefix:   "gallery/private",
+					Security: &config.SecuritySettings{APIKeys: []config.APIKey{{Key: "private-key"}}},
+				}},
+			}, nil
+		},
+	}
+	mockImageUtils := &MockImageUtils{
+		GetImageMetadataFunc: func(data []byte) (utils.ImageMetadata, error) {
+			return metadata[string(data)], nil
+		},
+	}
+
+	list := func(t *testing.T, query string) (ListResponse, int) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/v2/list/gallery?"+query, nil)
+		rec := httptest.NewRecorder()
+		ListHandler(rec, req, mockImageUtils, mockRclone, mockDomainConfigManager)
+		var response ListResponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to unmarshal response body: %v", err)
+			}
+		}
+		return response, rec.Code
+	}
+	paths := func(response ListResponse) []string {
+		paths := []string{}
+		for _, file := range response.Files {
+			paths = append(paths, file.Path)
+		}
+		return paths
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{"Sorted by name", "sort=name", []string{"a.png", "b.jpg", "notes.txt", "trip"}},
+		{"Recursive hides protected subdirectories", "recursive=1", []string{"a.png", "b.jpg", "notes.txt", "trip", "trip/beach.JPG"}},
+		{"Sorted by size descending", "recursive=1&sort=size&order=desc", []string{"trip/beach.JPG", "b.jpg", "notes.txt", "a.png", "trip"}},
+		{"Sorted by modification time", "sort=modtime", []string{"a.png", "trip", "notes.txt", "b.jpg"}},
+		{"Sorted by capture date", "recursive=1&type=image/*&sort=captured", []string{"trip/beach.JPG", "b.jpg", "a.png"}},
+		{"Filtered by type", "recursive=1&type=image/png,text/plain", []string{"a.png", "notes.txt"}},
+		{"Filtered by extension", "recursive=1&ext=jp*g", []string{"b.jpg", "trip/beach.JPG"}},
+		{"Filtered by dimensions", "recursive=1&min_width=800&min_height=700", []string{"trip/beach.JPG"}},
+		{"Filtered by keyword", "recursive=1&keyword=sunset", []string{"a.png"}},
+		{"Filtered by name", "recursive=1&keyword=BEACH", []string{"trip/beach.JPG"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, status := list(t, tt.query)
+			if status != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", status)
+			}
+			if got := paths(response); fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+			if response.Pagination.Total != len(tt.expected) {
+				t.Errorf("expected total %d, got %d", len(tt.expected), response.Pagination.Total)
+			}
+		})
+	}
+
+	t.Run("Depth", func(t *testing.T) {
+		if _, status := list(t, "depth=2"); status != http.StatusOK || listedDepth != 2 {
+			t.Errorf("expected a tree of depth 2, got status %d and depth %d", status, listedDepth)
+		}
+	})
+
+	t.Run("Capture date and metadata of the page", func(t *testing.T) {
+		response, _ := list(t, "recursive=1&ext=jpg")
+		if response.Files[0].CapturedAt == nil || response.Files[0].Width != 800 || response.Files[0].ModTime == "" {
+			t.Errorf("expected metadata and dates, got %+v", response.Files[0])
+		}
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		var pages [][]string
+		query := "recursive=1&sort=size&limit=2"
+		for {
+			response, status := list(t, query)
+			if status != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", status)
+			}
+			if response.Pagination.Limit != 2 || response.Pagination.Total != 5 {
+				t.Errorf("unexpected pagination %+v", response.Pagination)
+			}
+			pages = append(pages, paths(response))
+			if response.Pagination.NextCursor == "" {
+				break
+			}
+			query = "recursive=1&sort=size&limit=2&cursor=" + response.Pagination.NextCursor
+		}
+		expected := [][]string{{"trip", "a.png"}, {"notes.txt", "b.jpg"}, {"trip/beach.JPG"}}
+		if fmt.Sprint(pages) != fmt.Sprint(expected) {
+			t.Errorf("expected pages %v, got %v", expected, pages)
+		}
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		first, _ := list(t, "sort=size&limit=1")
+		for _, query := range []string{"limit=0", "depth=-1", "sort=color", "order=up", "min_width=wide", "ext=[", "cursor=garbage", "sort=name&cursor=" + first.Pagination.NextCursor} {
+			if _, status := list(t, query); status != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", query, status)
+			}
+		}
+	})
+}
+
+func TestListHandler_HeaderMetadata(t *testing.T) {
+	resetListCaches(t)
+	var pngHeader bytes.Buffer
+	if err := png.Encode(&pngHeader, image.NewRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	// A JPEG whose EXIF segment extends past the header read
+	bigHeader := make([]byte, utils.MetadataHeaderSize)
+	copy(bigHeader, []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF})
+
+	files := []utils.RcloneFile{{Path: "big.jpg", MimeType: "image/jpeg"}}
+	for i := 0; i < 20; i++ {
+		files = append(files, utils.RcloneFile{Path: fmt.Sprintf("%02d.png", i), MimeType: "image/png"})
+	}
+
+	var mu sync.Mutex
+	var active, peak int
+	var fetched []string
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]utils.RcloneFile, error) {
+			return files, nil
+		},
+		OpenRangeFunc: func(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+			mu.Lock()
+			active++
+			peak = max(peak, active)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+
+			if offset != 0 || count != utils.MetadataHeaderSize {
+				t.Errorf("unexpected range %d-%d", offset, count)
+			}
+			if strings.HasSuffix(path, ".jpg") {
+				return io.NopCloser(bytes.NewReader(bigHeader)), nil
+			}
+			return io.NopCloser(bytes.NewReader(pngHeader.Bytes())), nil
+		},
+		FetchImageFunc: func(ctx context.Context, path string, domain string) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetched = append(fetched, path)
+			return []byte("whole-file"), nil
+		},
+	}
+	mockDomainConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+	mockImageUtils := &MockImageUtils{
+		GetImageMetadataFunc: func(data []byte) (utils.ImageMetadata, error) {
+			if string(data) != "whole-file" {
+				t.Errorf("expected metadata of the whole file, got %d bytes", len(data))
+			}
+			return utils.ImageMetadata{Width: 500, Height: 400}, nil
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/v2/list/headers", nil)
+	rec := httptest.NewRecorder()
+	ListHandler(rec, req, mockImageUtils, mockRclone, mockDomainConfigManager)
+
+	var response []FileResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if response[0].Width != 500 || response[1].Width != 40 || response[1].Height != 30 {
+		t.Errorf("unexpected dimensions %+v %+v", response[0], response[1])
+	}
+	if fmt.Sprint(fetched) != "[headers/big.jpg]" {
+		t.Errorf("expected only the file with an incomplete header to be fetched, got %v", fetched)
+	}
+	if peak < 2 || peak > maxMetadataWorkers {
+		t.Errorf("expected between 2 and %d concurrent reads, got %d", maxMetadataWorkers, peak)
+	}
+}
+
+func TestListHandler_SignedURLs(t *testing.T) {
+	secrets := []config.SecretKey{{KeyID: "k1", Secret: "s1"}}
+	domainConfig := config.DomainConfig{
+		Security: config.SecuritySettings{Mode: config.HMACTimebound, Secrets: secrets, ValidityWindow: 300},
+		Presets:  map[string]string{"large": "w=1200&fm=webp"},
+	}
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]utils.RcloneFile, error) {
+			return []utils.RcloneFile{
+				{Path: "a b.jpg", MimeType: "image/jpeg"},
+				{Path: "notes.txt", MimeType: "text/plain"},
+				{Path: "trip", IsDir: true},
+			}, nil
+		},
+		OpenRangeFunc: func(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("mock-image-data")), nil
+		},
+	}
+	mockDomainConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return domainConfig, nil
+		},
+	}
+	mockImageUtils := &MockImageUtils{
+		GetImageMetadataFunc: func(data []byte) (utils.ImageMetadata, error) {
+			return utils.ImageMetadata{Width: 100, Height: 100}, nil
+		},
+	}
+
+	list := func(query string) ([]FileResponse, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest("GET", "/v2/list/signed?"+query, nil)
+		rec := httptest.NewRecorder()
+		ListHandler(rec, req, mockImageUtils, mockRclone, mockDomainConfigManager)
+		var files []FileResponse
+		json.Unmarshal(rec.Body.Bytes(), &files)
+		return files, rec
+	}
+	// validate checks that a URL is accepted by the endpoint's signature check and returns its query
+	validate := func(t *testing.T, rawURL string, endpoint string, path string) url.Values {
+		t.Helper()
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("Failed to parse URL %q: %v", rawURL, err)
+		}
+		if parsed.Path != "/v2/"+endpoint+"/"+path {
+			t.Errorf("expected path of %s, got %q", path, parsed.Path)
+		}
+		if err := security.ValidateSignedURLFromConfig(path, parsed.Query(), secrets, 300); err != nil {
+			t.Errorf("URL %q doesn't validate: %v", rawURL, err)
+		}
+		return parsed.Query()
+	}
+
+	files, rec := list("sign=1&preset=large&q=80")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if rec.Header().Get("ETag") != "" {
+		t.Error("signed listings must not carry validators")
+	}
+	image := validate(t, files[0].URL, "image", "signed/a b.jpg")
+	if image.Get("w") != "1200" || image.Get("fm") != "webp" || image.Get("q") != "80" {
+		t.Errorf("expected the preset and transform parameters, got %v", image)
+	}
+	if thumbnail := validate(t, files[0].ThumbnailURL, "image", "signed/a b.jpg"); thumbnail.Get("w") != "256" || thumbnail.Get("fit") != "crop" {
+		t.Errorf("expected the default thumbnail, got %v", thumbnail)
+	}
+	validate(t, files[0].DownloadURL, "download", "signed/a b.jpg")
+	if files[1].URL != "" || files[1].ThumbnailURL != "" {
+		t.Errorf("expected only a download URL for other files, got %+v", files[1])
+	}
+	validate(t, files[1].DownloadURL, "download", "signed/notes.txt")
+	validate(t, files[2].DownloadURL, "download", "signed/trip")
+
+	// Without sign=1 no URLs are attached
+	if files, _ := list(""); files[0].URL != "" || files[0].DownloadURL != "" {
+		t.Errorf("expected no URLs, got %+v", files[0])
+	}
+
+	if _, rec := list("sign=1&preset=missing"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown preset, got %d", rec.Code)
+	}
+
+	// Unprotected domains get plain URLs
+	domainConfig.Security = config.SecuritySettings{}
+	files, _ = list("sign=1&w=300")
+	if files[0].URL != "/v2/image/signed/a%20b.jpg?w=300" || files[0].DownloadURL != "/v2/download/signed/a%20b.jpg" {
+		t.Errorf("unexpected unsigned URLs %+v", files[0])
+	}
+}
+
+func TestListHandler_ListingAFile(t *testing.T) {
+	// a/b is a directory holding a file b, a/c.jpg a file
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]utils.RcloneFile, error) {
+			switch path {
+			case "a/b":
+				return []utils.RcloneFile{{Path: "b"}}, nil
+			case "a/c.jpg":
+				return []utils.RcloneFile{{Path: "c.jpg"}}, nil
+			}
+			return nil, utils.ErrNotFound
+		},
+		StatFunc: func(ctx context.Context, path string, domain string) (utils.RcloneFile, error) {
+			return utils.RcloneFile{Path: path, IsDir: path == "a/b"}, nil
+		},
+	}
+	mockDomainConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "a/b", expected: "/v2/download/a/b/b"},
+		{path: "a/c.jpg", expected: "/v2/download/a/c.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/v2/list/"+tt.path+"?sign=1", nil)
+			rec := httptest.NewRecorder()
+			ListHandler(rec, req, &MockImageUtils{}, mockRclone, mockDomainConfigManager)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", rec.Code)
+			}
+			var files []FileResponse
+			json.Unmarshal(rec.Body.Bytes(), &files)
+			if len(files) != 1 || files[0].DownloadURL != tt.expected {
+				t.Errorf("expected a download URL of %s, got %+v", tt.expected, files)
+			}
+		})
+	}
+}
+
+func TestListHandler_Formats(t *testing.T) {
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]utils.RcloneFile, error) {
+			return []utils.RcloneFile{
+				{Path: "a.jpg", Size: 2048, MimeType: "image/jpeg", ModTime: "2024-01-01T00:00:00Z"},
+				{Path: "b, \"quoted\".txt", Size: 10, MimeType: "text/plain"},
+				{Path: "trip", IsDir: true, MimeType: "inode/directory"},
+			}, nil
+		},
+		OpenRangeFunc: func(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("mock-image-data")), nil
+		},
+	}
+	mockDomainConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+	mockImageUtils := &MockImageUtils{
+		GetImageMetadataFunc: func(data []byte) (utils.ImageMetadata, error) {
+			return utils.ImageMetadata{Width: 640, Height: 480}, nil
+		},
+	}
+	list := func(query string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v2/list/formats/2024?"+query, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		ListHandler(rec, req, mockImageUtils, mockRclone, mockDomainConfigManager)
+		return rec
+	}
+
+	t.Run("NDJSON", func(t *testing.T) {
+		rec := list("", "application/x-ndjson")
+		if got := rec.Header().Get("Content-Type"); got != "application/x-ndjson" {
+			t.Errorf("expected NDJSON, got %q", got)
+		}
+		lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("expected 3 lines, got %q", rec.Body.String())
+		}
+		var file FileResponse
+		if err := json.Unmarshal([]byte(lines[0]), &file); err != nil || file.Path != "a.jpg" || file.Width != 640 {
+			t.Errorf("unexpected first line %q", lines[0])
+		}
+
+		// Paginated streams report the pagination in headers
+		rec = list("format=ndjson&limit=2", "")
+		if rec.Header().Get("X-Total-Count") != "3" || rec.Header().Get("X-Next-Cursor") == "" {
+			t.Errorf("expected pagination headers, got %v", rec.Header())
+		}
+		if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); len(lines) != 2 {
+			t.Errorf("expected 2 lines, got %d", len(lines))
+		}
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		rec := list("format=csv", "")
+		if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename=2024.csv` {
+			t.Errorf("unexpected Content-Disposition %q", got)
+		}
+		expected := "path,size,mimeType,isDir,modTime,width,height\n" +
+			"a.jpg,2048,image/jpeg,false,2024-01-01T00:00:00Z,640,480\n" +
+			"\"b, \"\"quoted\"\".txt\",10,text/plain,false,,,\n" +
+			"trip,0,inode/directory,true,,,\n"
+		if rec.Body.String() != expected {
+			t.Errorf("expected %q, got %q", expected, rec.Body.String())
+		}
+
+		rec = list("columns=path,width,downloadUrl", "text/csv")
+		if !strings.HasPrefix(rec.Body.String(), "path,width,downloadUrl\na.jpg,640,\n") {
+			t.Errorf("unexpected columns %q", rec.Body.String())
+		}
+	})
+
+	t.Run("HTML gallery", func(t *testing.T) {
+		rec := list("", "text/html,application/xhtml+xml")
+		if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Fatalf("expected HTML, got %q", got)
+		}
+		body := rec.Body.String()
+		for _, expected := range []string{
+			`<a href="/v2/list/?format=html">example.com</a>`,
+			`<a href="/v2/list/formats?format=html">formats</a>`,
+			`<a class="entry" href="/v2/image/formats/2024/a.jpg">`,
+			`<img src="/v2/image/formats/2024/a.jpg?fit=crop&amp;h=256&amp;w=256"`,
+			`href="/v2/list/formats/2024/trip?format=html"`,
+			`href="/v2/download/formats/2024/b,%20%22quoted%22.txt"`,
+			`2.0 KB &middot; 640&times;480`,
+		} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("expected the gallery to contain %s, got %s", expected, body)
+			}
+		}
+	})
+
+	t.Run("HTML gallery navigation", func(t *testing.T) {
+		// Links are plain <a href>, on open domains they can be followed as they are
+		page := list("format=html&limit=1", "").Body.String()
+		links := regexp.MustCompile(`href="(/v2/list/[^"]*)"`).FindAllStringSubmatch(page, -1)
+		if len(links) < 3 {
+			t.Fatalf("expected breadcrumb and next page links, got %s", page)
+		}
+		for _, link := range links {
+			target := html.UnescapeString(link[1])
+			rec := httptest.NewRecorder()
+			ListHandler(rec, httptest.NewRequest("GET", target, nil), mockImageUtils, mockRclone, mockDomainConfigManager)
+			if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+				t.Errorf("%s: expected a gallery page, got %d %q", target, rec.Code, rec.Header().Get("Content-Type"))
+			}
+		}
+	})
+
+	t.Run("Negotiation", func(t *testing.T) {
+		if rec := list("", "*/*"); rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("expected JSON by default, got %q", rec.Header().Get("Content-Type"))
+		}
+		if rec := list("format=json", "text/html"); rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("expected format= to win over Accept, got %q", rec.Header().Get("Content-Type"))
+		}
+		if list("format=ndjson", "").Header().Get("ETag") == list("format=csv", "").Header().Get("ETag") {
+			t.Error("expected formats to have different ETags")
+		}
+		for _, query := range []string{"format=xml", "format=csv&columns=path,color"} {
+			if rec := list(query, ""); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", query, rec.Code)
+			}
+		}
+	})
+}
+
+func TestListHandler_DirectorySummaries(t *testing.T) {
+	resetListCaches(t)
+	listings := map[string][]utils.RcloneFile{
+		"albums": {
+			{Path: "a.jpg", MimeType: "image/jpeg"},
+			{Path: "dated", IsDir: true},
+			{Path: "empty", IsDir: true},
+			{Path: "named", IsDir: true},
+		},
+		"albums/named": {
+			{Path: "a.jpg", MimeType: "image/jpeg"},
+			{Path: "Folder.JPG", MimeType: "image/jpeg"},
+			{Path: "Cover.png", MimeType: "image/png"},
+		},
+		"albums/dated": {
+			{Path: "late.jpg", MimeType: "image/jpeg", ModTime: "2024-06-01T00:00:00Z"},
+			{Path: "early.jpg", MimeType: "image/jpeg", ModTime: "2024-01-01T00:00:00Z"},
+			{Path: "captured.jpg", MimeType: "image/jpeg", ModTime: "2024-12-01T00:00:00Z"},
+			{Path: "notes.txt", MimeType: "text/plain", ModTime: "2020-01-01T00:00:00Z"},
+		},
+		"albums/empty": {
+			{Path: "notes.txt", MimeType: "text/plain"},
+		},
+	}
+	var mu sync.Mutex
+	sized := map[string]int{}
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]utils.RcloneFile, error) {
+			return listings[path], nil
+		},
+		SizeFunc: func(ctx context.Context, path string, domain string) (utils.DirectorySize, error) {
+			mu.Lock()
+			sized[path]++
+			mu.Unlock()
+			if path == "albums/empty" {
+				return utils.DirectorySize{}, errors.New("size failed")
+			}
+			return utils.DirectorySize{Count: 4, Bytes: 4000, Images: 3}, nil
+		},
+		OpenRangeFunc: func(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+			// The mock metadata is looked up by the content of the image
+			return io.NopCloser(strings.NewReader(path)), nil
+		},
+	}
+	mockDomainConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{}, nil
+		},
+	}
+	mockImageUtils := &MockImageUtils{
+		GetImageMetadataFunc: func(data []byte) (utils.ImageMetadata, error) {
+			metadata := utils.ImageMetadata{Width: 640, Height: 480}
+			if string(data) == "albums/dated/captured.jpg" {
+				metadata.CapturedAt = time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+			}
+			return metadata, nil
+		},
+	}
+	list := func(query string) ([]FileResponse, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest("GET", "/v2/list/albums?"+query, nil)
+		rec := httptest.NewRecorder()
+		ListHandler(rec, req, mockImageUtils, mockRclone, mockDomainConfigManager)
+		var files []FileResponse
+		json.Unmarshal(rec.Body.Bytes(), &files)
+		return files, rec
+	}
+
+	files, rec := list("stats=1&cover=1")
+	if rec.Code != http.StatusOK || len(files) != 4 {
+		t.Fatalf("expected 4 entries, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("ETag") != "" {
+		t.Error("listings with directory aggregates must not carry validators")
+	}
+	if files[0].Stats != nil || files[0].Cover != nil {
+		t.Errorf("expected no aggregates for files, got %+v", files[0])
+	}
+
+	dated, empty, named := files[1], files[2], files[3]
+	if named.Stats == nil || *named.Stats != (DirectoryStats{FileCount: 4, TotalBytes: 4000, ImageCount: 3}) {
+		t.Errorf("unexpected stats %+v", named.Stats)
+	}
+	if named.Cover == nil || *named.Cover != (CoverImage{Path: "named/Cover.png", Width: 640, Height: 480}) {
+		t.Errorf("expected the conventional cover, got %+v", named.Cover)
+	}
+	if dated.Cover == nil || dated.Cover.Path != "dated/captured.jpg" {
+		t.Errorf("expected the image captured first, got %+v", dated.Cover)
+	}
+	if empty.Stats != nil || empty.Cover != nil {
+		t.Errorf("expected no aggregates for a failed size and no images, got %+v", empty)
+	}
+
+	// Aggregates are cached until a file below the directory changes
+	list("stats=1")
+	if sized["albums/named"] != 1 {
+		t.Errorf("expected cached stats, sized %d times", sized["albums/named"])
+	}
+	SourceChanged(utils.GetDomainFromRequest(httptest.NewRequest("GET", "/", nil)), "albums/named/new.jpg", nil)
+	list("stats=1")
+	if sized["albums/named"] != 2 || sized["albums/dated"] != 1 {
+		t.Errorf("expected only the changed directory to be sized again, got %v", sized)
+	}
+
+	// Aggregates are opt-in
+	files, _ = list("")
+	if files[3].Stats != nil || files[3].Cover != nil {
+		t.Errorf("expected no aggregates without stats= and cover=, got %+v", files[3])
+	}
+
+	// Signed listings attach a thumbnail of the cover
+	files, _ = list("cover=1&sign=1")
+	if thumbnail := files[3].Cover.ThumbnailURL; !strings.HasPrefix(thumbnail, "/v2/image/albums/named/Cover.png?") {
+		t.Errorf("expected a thumbnail URL of the cover, got %q", thumbnail)
+	}
+
+	rec = httptest.NewRecorder()
+	ListHandler(rec, httptest.NewRequest("GET", "/v2/list/albums?format=csv&columns=path,imageCount,coverPath&stats=1&cover=1", nil), mockImageUtils, mockRclone, mockDomainConfigManager)
+	if !strings.Contains(rec.Body.String(), "named,3,named/Cover.png\n") {
+		t.Errorf("expected the aggregates in CSV columns, got %q", rec.Body.String())
+	}
+}
+
+func TestFindCover_BoundsMetadataReads(t *testing.T) {
+	resetListCaches(t)
+	// The image captured first is among the earliest modified, the rest are never read
+	var files []utils.RcloneFile
+	for i := 0; i < 2*maxCoverCandidates; i++ {
+		files = append(files, utils.RcloneFile{
+			Path:     fmt.Sprintf("%02d.jpg", i),
+			MimeType: "image/jpeg",
+			ModTime:  time.Date(2024, 1, 1, 0, 2*maxCoverCandidates-i, 0, 0, time.UTC).Format(time.RFC3339),
+		})
+	}
+	var mu sync.Mutex
+	read := map[string]bool{}
+	mockRclone := &utils.MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]utils.RcloneFile, error) {
+			return files, nil
+		},
+		OpenRangeFunc: func(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+			mu.Lock()
+			read[path] = true
+			mu.Unlock()
+			return io.NopCloser(strings.NewReader(path)), nil
+		},
+	}
+	mockImageUtils := &MockImageUtils{
+		GetImageMetadataFunc: func(data []byte) (utils.ImageMetadata, error) {
+			metadata := utils.ImageMetadata{Width: 640, Height: 480}
+			if string(data) == "bounded/40.jpg" {
+				metadata.CapturedAt = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			}
+			return metadata, nil
+		},
+	}
+
+	cover, err := findCover(context.Background(), "bounded", "bounded.com", mockImageUtils, mockRclone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cover.path != "bounded/40.jpg" {
+		t.Errorf("expected the image captured first, got %q", cover.path)
+	}
+	if len(read) != maxCoverCandidates || read["bounded/00.jpg"] {
+		t.Errorf("expected only the %d earliest modified images to be read, read %d", maxCoverCandidates, len(read))
+	}
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"shuto-api/utils"
+)
+
+// MetricsResponse exposes runtime state for monitoring
+type MetricsResponse struct {
+	Transform       utils.SchedulerStats        `json:"transform"`
+	DerivativeCache *utils.DerivativeCacheStats `json:"derivativeCache,omitempty"`
+}
+
+// MetricsHandler reports the transform queue and derivative cache state
+// @Summary Runtime metrics
+// @Description Get the current transform queue depth, scheduler and cache counters
+// @Tags metrics
+// @Produce  json
+// @Success 200 {object} MetricsResponse "Current runtime metrics"
+// @Failure 400 {object} utils.ErrorResponse "Invalid request parameters"
+// @Router /metrics [get]
+func MetricsHandler(w http.ResponseWriter, r *http.Request, scheduler *utils.TransformScheduler, derivativeCache utils.DerivativeCache) {
+	if r.Method != http.MethodGet {
+		utils.WriteInvalidRequestError(w, "Method not allowed", r.Method)
+		return
+	}
+
+	response := MetricsResponse{
+		Transform: scheduler.Stats(),
+	}
+	if derivativeCache != nil {
+		stats := derivativeCache.Stats()
+		response.DerivativeCache = &stats
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		utils.WriteInternalError(w, "Failed to encode response", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
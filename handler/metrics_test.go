@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"shuto-api/utils"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	scheduler, err := utils.NewTransformScheduler(utils.SchedulerOptions{
+		MaxConcurrent: 2,
+		MaxQueue:      10,
+		QueueTimeout:  time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create scheduler: %v", err)
+	}
+
+	release, err := scheduler.Acquire(context.Background(), utils.PriorityInteractive)
+	if err != nil {
+		t.Fatalf("failed to acquire slot: %v", err)
+	}
+	defer release()
+
+	req := httptest.NewRequest("GET", "/v2/metrics", nil)
+	rr := httptest.NewRecorder()
+	MetricsHandler(rr, req, scheduler, nil)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var response MetricsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if response.Transform.Running != 1 || response.Transform.MaxConcurrent != 2 || response.Transform.MaxQueue != 10 {
+		t.Errorf("unexpected transform stats: %+v", response.Transform)
+	}
+	if response.DerivativeCache != nil {
+		t.Errorf("expected no derivative cache stats, got %+v", response.DerivativeCache)
+	}
+}
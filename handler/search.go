@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"shuto-api/config"
+	"shuto-api/utils"
+)
+
+// searchQuery holds the filters of a search on top of those shared with listings
+type searchQuery struct {
+	listQuery
+	name      string // lower case substring or glob of file names
+	from      time.Time
+	to        time.Time // exclusive
+	maxWidth  int
+	maxHeight int
+}
+
+// dateLayouts are the layouts of from= and to=, from the coarsest to the finest
+var dateLayouts = []string{"2006", "2006-01", "2006-01-02", time.RFC3339}
+
+// parseSearchQuery parses the parameters of a search, which is always paginated
+func parseSearchQuery(query url.Values) (searchQuery, error) {
+	list, err := parseListQuery(query)
+	if err != nil {
+		return searchQuery{}, err
+	}
+	q := searchQuery{listQuery: list}
+	q.envelope = true
+
+	q.name = strings.ToLower(strings.TrimSpace(query.Get("name")))
+	if _, err := path.Match(q.name, ""); err != nil {
+		return q, fmt.Errorf("invalid name pattern %q", q.name)
+	}
+	if q.from, err = parseSearchDate(query.Get("from"), false); err != nil {
+		return q, fmt.Errorf("from must be a year, month, date or RFC 3339 time")
+	}
+	if q.to, err = parseSearchDate(query.Get("to"), true); err != nil {
+		return q, fmt.Errorf("to must be a year, month, date or RFC 3339 time")
+	}
+	if q.maxWidth, err = parseDimension(query.Get("max_width")); err != nil {
+		return q, fmt.Errorf("max_width must be a positive number")
+	}
+	if q.maxHeight, err = parseDimension(query.Get("max_height")); err != nil {
+		return q, fmt.Errorf("max_height must be a positive number")
+	}
+	return q, nil
+}
+
+// parseSearchDate parses a date bound. The end of a range includes the whole year,
+// month or day it names.
+func parseSearchDate(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for i, layout := range dateLayouts {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		if !end {
+			return t, nil
+		}
+		switch i {
+		case 0:
+			return t.AddDate(1, 0, 0), nil
+		case 1:
+			return t.AddDate(0, 1, 0), nil
+		case 2:
+			return t.AddDate(0, 0, 1), nil
+		}
+		return t.Add(time.Nanosecond), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// matches applies the filters of the search to an indexed file. Dates are capture
+// dates, falling back to the modification time like the captured sort order.
+func (q searchQuery) matches(entry listEntry) bool {
+	if !q.matchesFile(entry.file) || !q.matchesMetadata(entry) {
+		return false
+	}
+	if q.name != "" {
+		base := strings.ToLower(path.Base(entry.path))
+		if strings.ContainsAny(q.name, "*?[") {
+			if ok, _ := path.Match(q.name, base); !ok {
+				return false
+			}
+		} else if !strings.Contains(base, q.name) {
+			return false
+		}
+	}
+	if q.maxWidth > 0 || q.maxHeight > 0 {
+		if entry.metadata == nil || entry.metadata.Width == 0 {
+			return false
+		}
+		if (q.maxWidth > 0 && entry.metadata.Width > q.maxWidth) || (q.maxHeight > 0 && entry.metadata.Height > q.maxHeight) {
+			return false
+		}
+	}
+	if !q.from.IsZero() || !q.to.IsZero() {
+		date := listQuery{sort: "captured"}.sortKey(entry)
+		if (!q.from.IsZero() && date < q.from.UnixNano()) || (!q.to.IsZero() && date >= q.to.UnixNano()) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexedEntry returns the listing entry of an indexed file, with its metadata when
+// it's an image
+func indexedEntry(file utils.IndexedFile) listEntry {
+	entry := listEntry{
+		file: utils.RcloneFile{Path: file.Path, Name: path.Base(file.Path), Size: file.Size, ModTime: file.ModTime, MimeType: file.MimeType},
+		path: file.Path,
+	}
+	if isImage(entry.file) {
+		entry.metadata = &utils.ImageMetadata{Width: file.Width, Height: file.Height, CapturedAt: file.CapturedAt, Keywords: file.Keywords}
+	}
+	return entry
+}
+
+// SearchHandler handles searches of the index of a domain
+// @Summary Search the files of a domain
+// @Description Search the index of a domain, or of a folder of it, by keyword, capture date, dimensions
+// @Description and file name. Domains are indexed in the background when their search.index is set,
+// @Description results reflect the last crawl and the changes seen since. Result paths are full paths.
+// @Tags search
+// @Produce  json
+// @Security ApiKeyAuth
+// @Param   path       path    string  false  "Folder to search in, empty for the whole domain"
+// @Param   keyword    query   string  false  "Only files whose name contains the keyword or that are tagged with it"
+// @Param   name       query   string  false  "Only files whose name contains this text, or matches it as a glob such as IMG_*.jpg"
+// @Param   from       query   string  false  "Only files captured (else modified) from this year, month, date or RFC 3339 time on, e.g. 2024"
+// @Param   to         query   string  false  "Only files captured (else modified) up to and including this year, month, date or time"
+// @Param   min_width  query   int     false  "Only images at least this wide"
+// @Param   min_height query   int     false  "Only images at least this high"
+// @Param   max_width  query   int     false  "Only images at most this wide"
+// @Param   max_height query   int     false  "Only images at most this high"
+// @Param   type       query   string  false  "Comma separated MIME types to include, e.g. image/*"
+// @Param   ext        query   string  false  "Comma separated extension globs to include, e.g. jp*g,png"
+// @Param   sort       query   string  false  "Sort by name, size, modtime or captured (EXIF capture date, else modtime)" Enums(name, size, modtime, captured)
+// @Param   order      query   string  false  "Sort order" Enums(asc, desc)
+// @Param   limit      query   int     false  "Results per page, 1000 by default and at most 10000"
+// @Param   cursor     query   string  false  "nextCursor of the previous page"
+// @Param   sign       query   bool    false  "Attach url, thumbnailUrl and downloadUrl to the results, signed for protected paths"
+// @Success 200 {object} ListResponse "Page of matching files"
+// @Header  200 {string} X-Indexed-At "When the last crawl of the domain finished"
+// @Failure 400 {object} utils.ErrorResponse "Invalid request parameters"
+// @Failure 401 {object} utils.ErrorResponse "Unauthorized - Invalid or missing API key"
+// @Failure 404 {object} utils.ErrorResponse "Search isn't enabled for the domain"
+// @Failure 503 {object} utils.ErrorResponse "The domain hasn't been indexed yet"
+// @Router /search/{path} [get]
+func SearchHandler(w http.ResponseWriter, r *http.Request, index utils.SearchIndex, domainConfig config.DomainConfigManager) {
+	domain := utils.GetDomainFromRequest(r)
+	scope := ""
+	if r.URL.Path != "/"+config.ApiVersion+"/search" {
+		var err error
+		if scope, err = utils.RequestDir(r, "search"); err != nil {
+			utils.WriteInvalidPathError(w, err.Error())
+			return
+		}
+	}
+
+	cfg, err := domainConfig.GetDomainConfig(domain)
+	if err != nil {
+		utils.WriteInvalidDomainError(w, domain)
+		return
+	}
+
+	if !validateAPIKey(cfg.SecurityFor(scope).APIKeys, r.Header.Get("Authorization")) {
+		utils.WriteInvalidAPIKeyError(w)
+		return
+	}
+
+	if !cfg.Search.Index {
+		utils.WriteNotFoundError(w, "Search is not enabled for this domain", domain)
+		return
+	}
+	query, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		utils.WriteInvalidRequestError(w, "Invalid search parameters", err.Error())
+		return
+	}
+	signing, err := parseSignQuery(r.URL.Query(), cfg.Presets)
+	if err != nil {
+		utils.WriteInvalidRequestError(w, "Invalid URL parameters", err.Error())
+		return
+	}
+
+	files, indexedAt, ok := index.Files(domain)
+	if !ok {
+		utils.WriteServiceUnavailableError(w, 60, "The domain is being indexed")
+		return
+	}
+
+	var entries []listEntry
+	for _, file := range files {
+		if scope != "" && !strings.HasPrefix(file.Path, scope+"/") {
+			continue
+		}
+		entry := indexedEntry(file)
+		// Folders below the scope may be protected by keys of their own
+		if !validateAPIKey(cfg.SecurityFor(entry.path).APIKeys, r.Header.Get("Authorization")) {
+			continue
+		}
+		if query.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	total := len(entries)
+	page, nextCursor := query.paginate(entries)
+	response := ListResponse{
+		Files:      make([]FileResponse, 0, len(page)),
+		Pagination: Pagination{Limit: query.limit, Total: total, NextCursor: nextCursor},
+	}
+	for _, entry := range page {
+		file := newFileResponse(entry)
+		if signing != nil {
+			if err := signing.attachURLs(&file, entry, cfg); err != nil {
+				utils.WriteInternalError(w, "Failed to sign URLs", err.Error())
+				return
+			}
+		}
+		response.Files = append(response.Files, file)
+	}
+
+	w.Header().Set("X-Indexed-At", indexedAt.UTC().Format(time.RFC3339))
+	writeJSON(w, http.StatusOK, response)
+
+	utils.Debug("Domain searched", "domain", domain, "path", scope, "matches", total)
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"shuto-api/config"
+	"shuto-api/utils"
+)
+
+func TestSearchHandler(t *testing.T) {
+	march := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	indexedAt := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	files := []utils.IndexedFile{
+		{Path: "2023/IMG_0001.jpg", Size: 100, MimeType: "image/jpeg", ModTime: "2024-01-05T00:00:00Z", Width: 3000, Height: 2000,
+			CapturedAt: time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC), Keywords: []string{"Launch"}},
+		{Path: "2023/launch-party.png", Size: 200, MimeType: "image/png", ModTime: "2023-06-01T00:00:00Z", Width: 1200, Height: 800},
+		{Path: "2024/launch/crowd.jpg", Size: 300, MimeType: "image/jpeg", ModTime: "2024-03-02T00:00:00Z", Width: 800, Height: 600,
+			CapturedAt: march, Keywords: []string{"launch"}},
+		{Path: "2024/launch/rocket.jpg", Size: 400, MimeType: "image/jpeg", ModTime: "2024-03-02T00:00:00Z", Width: 4000, Height: 3000,
+			CapturedAt: march.Add(time.Hour), Keywords: []string{"launch", "rocket"}},
+		{Path: "docs/launch.pdf", Size: 500, MimeType: "application/pdf", ModTime: "2024-05-01T00:00:00Z"},
+		{Path: "private/launch.jpg", Size: 600, MimeType: "image/jpeg", ModTime: "2024-03-02T00:00:00Z", CapturedAt: march, Keywords: []string{"launch"}},
+	}
+	indexed := map[string]bool{"example.com": true}
+	mockIndex := &utils.MockSearchIndex{
+		FilesFunc: func(domain string) ([]utils.IndexedFile, time.Time, bool) {
+			return files, indexedAt, indexed[domain]
+		},
+	}
+	mockDomainConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Search: config.SearchSettings{Index: domain != "disabled.com"},
+				Mounts: []config.MountConfig{{
+					Prefix:   "private",
+					Security: &config.SecuritySettings{APIKeys: []config.APIKey{{Key: "private-key"}}},
+				}},
+			}, nil
+		},
+	}
+	search := func(target string, authorization string) (ListResponse, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest("GET", target, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		SearchHandler(rec, req, mockIndex, mockDomainConfigManager)
+		var response ListResponse
+		json.Unmarshal(rec.Body.Bytes(), &response)
+		return response, rec
+	}
+	paths := func(response ListResponse) []string {
+		paths := []string{}
+		for _, file := range response.Files {
+			paths = append(paths, file.Path)
+		}
+		return paths
+	}
+
+	tests := []struct {
+		name          string
+		target        string
+		authorization string
+		expected      []string
+	}{
+		{"Keyword and year", "/v2/search?keyword=launch&from=2024&to=2024&type=image/*", "", []string{"2024/launch/crowd.jpg", "2024/launch/rocket.jpg"}},
+		{"Keyword matches names and tags", "/v2/search?keyword=launch&to=2023", "", []string{"2023/IMG_0001.jpg", "2023/launch-party.png"}},
+		{"Date range by day", "/v2/search?from=2024-03-01&to=2024-03-01", "", []string{"2024/launch/crowd.jpg", "2024/launch/rocket.jpg"}},
+		{"Date range by time", "/v2/search?from=2024-03-01T10:30:00Z", "", []string{"2024/launch/rocket.jpg", "docs/launch.pdf"}},
+		{"Name glob", "/v2/search?name=img_*.jpg", "", []string{"2023/IMG_0001.jpg"}},
+		{"Name substring", "/v2/search?name=party", "", []string{"2023/launch-party.png"}},
+		{"Dimensions", "/v2/search?min_width=1000&max_width=3000", "", []string{"2023/IMG_0001.jpg", "2023/launch-party.png"}},
+		{"Sorted", "/v2/search?type=image/*&sort=size&order=desc&limit=2", "", []string{"2024/launch/rocket.jpg", "2024/launch/crowd.jpg"}},
+		{"Folder", "/v2/search/2024/launch?name=rocket", "", []string{"2024/launch/rocket.jpg"}},
+		{"Protected folders need their key", "/v2/search?keyword=launch&from=2024-03&to=2024-03", "Bearer private-key",
+			[]string{"2024/launch/crowd.jpg", "2024/launch/rocket.jpg", "private/launch.jpg"}},
+		{"No matches", "/v2/search?keyword=sunset", "", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, rec := search(tt.target, tt.authorization)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if got := paths(response); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		first, rec := search("/v2/search?keyword=launch&limit=2", "")
+		if rec.Header().Get("X-Indexed-At") != "2024-06-01T00:00:00Z" {
+			t.Errorf("expected the crawl time, got %q", rec.Header().Get("X-Indexed-At"))
+		}
+		if first.Pagination.Total != 5 || first.Pagination.NextCursor == "" {
+			t.Fatalf("unexpected pagination %+v", first.Pagination)
+		}
+		var all []string
+		all = append(all, paths(first)...)
+		cursor := first.Pagination.NextCursor
+		for cursor != "" {
+			page, _ := search("/v2/search?keyword=launch&limit=2&cursor="+cursor, "")
+			all = append(all, paths(page)...)
+			cursor = page.Pagination.NextCursor
+		}
+		expected := []string{"2023/IMG_0001.jpg", "2023/launch-party.png", "2024/launch/crowd.jpg", "2024/launch/rocket.jpg", "docs/launch.pdf"}
+		if !reflect.DeepEqual(all, expected) {
+			t.Errorf("expected %v across pages, got %v", expected, all)
+		}
+	})
+
+	t.Run("Metadata and URLs", func(t *testing.T) {
+		response, _ := search("/v2/search?name=rocket&sign=1", "")
+		file := response.Files[0]
+		if file.Width != 4000 || file.CapturedAt == nil || !reflect.DeepEqual(file.Keywords, []string{"launch", "rocket"}) {
+			t.Errorf("expected the indexed metadata, got %+v", file)
+		}
+		if file.URL != "/v2/image/2024/launch/rocket.jpg" || file.DownloadURL != "/v2/download/2024/launch/rocket.jpg" {
+			t.Errorf("expected URLs of the file, got %q and %q", file.URL, file.DownloadURL)
+		}
+	})
+
+	errorTests := []struct {
+		name          string
+		target        string
+		authorization string
+		status        int
+	}{
+		{"Invalid date", "http://example.com/v2/search?from=yesterday", "", http.StatusBadRequest},
+		{"Invalid name pattern", "http://example.com/v2/search?name=[", "", http.StatusBadRequest},
+		{"Protected folder without key", "http://example.com/v2/search/private", "", http.StatusUnauthorized},
+		{"Invalid path", "http://example.com/v2/search/../etc", "", http.StatusBadRequest},
+		{"Search disabled", "http://disabled.com/v2/search?keyword=launch", "", http.StatusNotFound},
+		{"Not indexed yet", "http://other.com/v2/search?keyword=launch", "", http.StatusServiceUnavailable},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, rec := search(tt.target, tt.authorization); rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
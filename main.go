@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"runtime"
+	"time"
 
 	"shuto-api/config"
 	"shuto-api/handler"
@@ -58,18 +61,125 @@ func main() {
 	imageUtils := utils.NewImageUtils()
 	executor := utils.NewCommandExecutor()
 	configManager := config.NewDomainConfigManager(&config.FileConfigLoader{}, "config/domains.yaml")
-	rclone := utils.NewRclone(executor, configManager)
+	// rclone rcd is only started once a domain with backend: rcd is used
+	rcd, err := utils.NewRcdSupervisor(utils.RcdOptions{
+		Addr:         utils.GetEnv("RCLONE_RCD_ADDR", "127.0.0.1:5572"),
+		StartTimeout: utils.GetEnvDuration("RCLONE_RCD_START_TIMEOUT", 10*time.Second),
+	})
+	if err != nil {
+		utils.Fatal("Failed to initialize rclone rcd", "error", err)
+	}
+	defer rcd.Close()
 
-	// Wrap handlers with CORS middleware
-	http.HandleFunc("/"+config.ApiVersion+"/image/", utils.CORSMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		handler.ImageHandler(w, r, imageUtils, rclone, configManager)
-	}))
-	http.HandleFunc("/"+config.ApiVersion+"/list/", utils.CORSMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	// Only waiting for response headers is bounded, bodies are streamed for as long as downloads take
+	s3Transport := http.DefaultTransport.(*http.Transport).Clone()
+	s3Transport.ResponseHeaderTimeout = utils.GetEnvDuration("S3_RESPONSE_TIMEOUT", 30*time.Second)
+	s3Client := &http.Client{Transport: s3Transport}
+
+	// newStorage creates the storage for a view of the domain configs, selecting the backend per domain
+	newStorage := func(configManager config.DomainConfigManager) utils.Rclone {
+		return utils.NewBackendRouter(configManager, map[string]utils.Rclone{
+			config.BackendExec:  utils.NewRclone(executor, configManager),
+			config.BackendRcd:   utils.NewRcdRclone(rcd, configManager),
+			config.BackendLocal: utils.NewLocalRclone(configManager),
+			config.BackendS3:    utils.NewS3Rclone(configManager, s3Client),
+		})
+	}
+	// Reads fail over to a domain's replicas while its primary remote is unavailable
+	failoverOptions := utils.FailoverOptions{
+		FailureThreshold: utils.GetEnvInt("FAILOVER_FAILURE_THRESHOLD", 3),
+		Backoff:          utils.GetEnvDuration("FAILOVER_BACKOFF", 10*time.Second),
+		MaxBackoff:       utils.GetEnvDuration("FAILOVER_MAX_BACKOFF", 5*time.Minute),
+	}
+	// Paths below a domain's mounts are served from the mount's remote
+	rclone := utils.NewMountRclone(configManager, func(configManager config.DomainConfigManager) utils.Rclone {
+		return utils.NewFailoverRclone(configManager, newStorage, failoverOptions)
+	})
+
+	scheduler, err := utils.NewTransformScheduler(utils.SchedulerOptions{
+		MaxConcurrent: utils.GetEnvInt("TRANSFORM_CONCURRENCY", runtime.NumCPU()),
+		MaxQueue:      utils.GetEnvInt("TRANSFORM_QUEUE_SIZE", 100),
+		QueueTimeout:  utils.GetEnvDuration("TRANSFORM_QUEUE_TIMEOUT", 10*time.Second),
+	})
+	if err != nil {
+		utils.Fatal("Invalid transform scheduler configuration", "error", err)
+	}
+	// Rendered outputs are cached on local disk first, then on the domain's derivative_cache remote
+	derivativeCacheTiers := []utils.DerivativeCache{}
+	if maxMB := utils.GetEnvInt("DERIVATIVE_CACHE_MAX_MB", 1024); maxMB > 0 {
+		diskCache, err := utils.NewDiskCache(utils.DiskCacheOptions{
+			Dir:           utils.GetEnv("DERIVATIVE_CACHE_DIR", "cache/derivatives"),
+			MaxBytes:      int64(maxMB) * 1024 * 1024,
+			ConfigManager: configManager,
+		})
+		if err != nil {
+			utils.Fatal("Failed to initialize derivative cache", "error", err)
+		}
+		derivativeCacheTiers = append(derivativeCacheTiers, diskCache)
+	} else {
+		utils.Info("Local derivative cache disabled")
+	}
+	derivativeCacheRclone := newStorage(config.NewDerivativeCacheConfigManager(configManager))
+	derivativeCacheTiers = append(derivativeCacheTiers, utils.NewRemoteDerivativeCache(derivativeCacheRclone))
+	derivativeCache := utils.NewTieredDerivativeCache(derivativeCacheTiers...)
+
+	interactiveImageUtils := utils.NewScheduledImageUtils(imageUtils, scheduler, utils.PriorityInteractive)
+	bulkImageUtils := utils.NewScheduledImageUtils(imageUtils, scheduler, utils.PriorityBulk)
+
+	// Domains with search.index set are crawled into an index on disk for /v2/search,
+	// bypassing the listing cache so crawls don't evict the listings of requests
+	searchIndex, err := utils.NewMetadataIndex(utils.GetEnv("SEARCH_INDEX_DIR", "cache/index"))
+	if err != nil {
+		utils.Fatal("Failed to initialize search index", "error", err)
+	}
+	storage := rclone
+	indexer := utils.NewIndexer(searchIndex, storage, configManager, configManager.(config.DomainLister), utils.IndexerOptions{
+		Workers: utils.GetEnvInt("INDEX_CONCURRENCY", utils.DefaultIndexWorkers),
+		ReadMetadata: func(ctx context.Context, path string, domain string) (utils.ImageMetadata, error) {
+			return utils.ReadImageMetadata(ctx, path, domain, bulkImageUtils, storage)
+		},
+	})
+	defer indexer.Close()
+
+	// Listings are cached in memory and polled for changes made outside the API, which
+	// drop the metadata and rendered outputs of the changed files and update the index
+	listingCache, err := utils.NewListingCache(configManager, rclone, utils.ListingCacheOptions{
+		MaxEntries:      utils.GetEnvInt("LISTING_CACHE_SIZE", utils.DefaultListingCacheSize),
+		PollInterval:    utils.GetEnvDuration("LISTING_POLL_INTERVAL", time.Minute),
+		PollConcurrency: utils.GetEnvInt("LISTING_POLL_CONCURRENCY", utils.DefaultPollConcurrency),
+		PollBudget:      utils.GetEnvInt("LISTING_POLL_BUDGET", utils.DefaultPollBudget),
+		OnChange: func(domain string, path string) {
+			handler.SourceChanged(domain, path, derivativeCache)
+			indexer.Changed(domain, path)
+		},
+	})
+	if err != nil {
+		utils.Fatal("Failed to initialize listing cache", "error", err)
+	}
+	defer listingCache.Close()
+	rclone = listingCache
+
+	// Wrap handlers with CORS middleware and report the remote that served them
+	http.HandleFunc("/"+config.ApiVersion+"/image/", utils.CORSMiddleware(utils.StorageRemoteMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handler.ImageHandler(w, r, interactiveImageUtils, rclone, configManager, derivativeCache)
+	})))
+	http.HandleFunc("/"+config.ApiVersion+"/list/", utils.CORSMiddleware(utils.StorageRemoteMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		handler.ListHandler(w, r, imageUtils, rclone, configManager)
+	})))
+	http.HandleFunc("/"+config.ApiVersion+"/download/", utils.CORSMiddleware(utils.StorageRemoteMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handler.DownloadHandler(w, r, bulkImageUtils, rclone, configManager)
+	})))
+	http.HandleFunc("/"+config.ApiVersion+"/files/", utils.CORSMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handler.FilesHandler(w, r, bulkImageUtils, rclone, configManager, derivativeCache, indexer)
 	}))
-	http.HandleFunc("/"+config.ApiVersion+"/download/", utils.CORSMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		handler.DownloadHandler(w, r, imageUtils, rclone, configManager)
-	}))
+	searchHandler := utils.CORSMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handler.SearchHandler(w, r, searchIndex, configManager)
+	})
+	http.HandleFunc("/"+config.ApiVersion+"/search", searchHandler)
+	http.HandleFunc("/"+config.ApiVersion+"/search/", searchHandler)
+	http.HandleFunc("/"+config.ApiVersion+"/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handler.MetricsHandler(w, r, scheduler, derivativeCache)
+	})
 
 	// Serve Swagger UI with CORS
 	http.HandleFunc("/docs/", utils.CORSMiddleware(httpSwagger.Handler(
@@ -100,7 +100,7 @@ func (s *URLSigner) generateTimeboundURL(path string, params url.Values) (string
 	signedParams.Set("ts", fmt.Sprintf("%d", timestamp))
 	signedParams.Set("sig", signature)
 	
-	return fmt.Sprintf("/v2/%s/%s?%s", s.endpoint, path, signedParams.Encode()), nil
+	return fmt.Sprintf("/v2/%s/%s?%s", s.endpoint, EscapePath(path), signedParams.Encode()), nil
 }
 
 func (s *URLSigner) generateTimelessURL(path string, params url.Values) (string, error) {
@@ -120,7 +120,7 @@ func (s *URLSigner) generateTimelessURL(path string, params url.Values) (string,
 	signedParams.Set("kid", key.ID)
 	signedParams.Set("sig", signature)
 	
-	return fmt.Sprintf("/v2/%s/%s?%s", s.endpoint, path, signedParams.Encode()), nil
+	return fmt.Sprintf("/v2/%s/%s?%s", s.endpoint, EscapePath(path), signedParams.Encode()), nil
 }
 
 // ValidateSignedURL validates a signed URL
@@ -194,6 +194,24 @@ func (s *URLSigner) validateTimelessURL(path string, params url.Values, provided
 	return nil
 }
 
+// EscapePath escapes the segments of a path for use in a URL, keeping its slashes
+func EscapePath(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+// NewURLSignerFromConfig creates a URLSigner for an endpoint signing with the first of
+// the configured secrets
+func NewURLSignerFromConfig(secrets []config.SecretKey, validityWindow int, endpoint string) (*URLSigner, error) {
+	keys := make([]SecretKey, len(secrets))
+	for i, secret := range secrets {
+		keys[i] = SecretKey{
+			ID:     secret.KeyID,
+			Secret: []byte(secret.Secret),
+		}
+	}
+	return NewURLSigner(keys, validityWindow, "", endpoint)
+}
+
 // ValidateSignedURLFromConfig validates a signed URL using the provided security configuration
 func ValidateSignedURLFromConfig(path string, query url.Values, secrets []config.SecretKey, validityWindow int) error {
 	// Convert config secrets to security.SecretKey
@@ -4,6 +4,8 @@ import (
 	"net/url"
 	"testing"
 	"time"
+
+	"shuto-api/config"
 )
 
 func createTestKeys() []SecretKey {
@@ -255,4 +257,27 @@ func TestURLSigner_TimelessURL(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to validate timeless URL: %v", err)
 	}
-} 
\ No newline at end of file
+} 
+func TestURLSigner_EscapesPath(t *testing.T) {
+	signer, err := NewURLSignerFromConfig([]config.SecretKey{{KeyID: "v1", Secret: "test-secret-1"}}, 0, "download")
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	path := "photos/summer 2024/a#1.jpg"
+	signedURL, err := signer.GenerateSignedURL(path, url.Values{})
+	if err != nil {
+		t.Fatalf("Failed to generate signed URL: %v", err)
+	}
+
+	parsedURL, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	if parsedURL.Path != "/v2/download/"+path {
+		t.Errorf("Expected the path to survive parsing, got %q", parsedURL.Path)
+	}
+	if err := signer.ValidateSignedURL(path, parsedURL.Query()); err != nil {
+		t.Errorf("Failed to validate signed URL: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"hash/fnv"
 	"os"
 	"sync"
 	"time"
@@ -17,9 +18,21 @@ type CacheEntry[T any] struct {
     IsStale    bool
 }
 
+// cacheGenerations is the number of invalidation counters keys are spread over
+const cacheGenerations = 256
+
 type Cache[T any] struct {
     cache *lru.Cache[string, *CacheEntry[T]]
-    mu    sync.Mutex // Mutex for background updates
+    mu    sync.Mutex // Guards refreshing
+    // refreshing holds the keys refreshed in the background, one refresh runs per key
+    refreshing map[string]bool
+    // fetches coalesces concurrent fetches of a key
+    fetches CallGroup[T]
+
+    // generations counts the invalidations of the keys hashing to each slot. A value
+    // fetched while its key was invalidated may predate the change and isn't stored.
+    genMu       sync.Mutex
+    generations [cacheGenerations]uint64
 }
 
 type CacheOptions struct {
@@ -31,6 +44,8 @@ type GetCachedOptions struct {
     TTL           time.Duration
     StaleTime     time.Duration
     GetFreshValue func() (interface{}, error)
+    // Cacheable reports whether a fresh value is stored, every value is when nil
+    Cacheable     func(value interface{}) bool
 }
 
 func NewCache[T any](opts CacheOptions) (*Cache[T], error) {
@@ -58,7 +73,7 @@ func (c *Cache[T]) GetCached(opts GetCachedOptions) (T, error) {
 
         // If the data is stale but not completely expired, return it and refresh in background
         if !entry.IsStale && now.Before(entry.StaleAt) {
-            go c.refreshInBackground(opts)
+            c.refreshInBackground(opts)
             return entry.Value, nil
         }
     }
@@ -72,51 +87,125 @@ func (c *Cache[T]) GetCached(opts GetCachedOptions) (T, error) {
     return value, nil
 }
 
+// Invalidate drops the entry for key, the next lookup fetches a fresh value. Values
+// being fetched for key when it's invalidated are returned but not stored.
+func (c *Cache[T]) Invalidate(key string) {
+    c.genMu.Lock()
+    defer c.genMu.Unlock()
+    c.generations[generationSlot(key)]++
+    c.cache.Remove(key)
+}
+
+// Generation returns the invalidation count of key, see SetIfCurrent
+func (c *Cache[T]) Generation(key string) uint64 {
+    c.genMu.Lock()
+    defer c.genMu.Unlock()
+    return c.generations[generationSlot(key)]
+}
+
+// SetIfCurrent stores value for key like Set, unless key was invalidated since
+// generation was taken from Generation before fetching value
+func (c *Cache[T]) SetIfCurrent(key string, generation uint64, value T, ttl time.Duration, staleTime time.Duration) bool {
+    c.genMu.Lock()
+    defer c.genMu.Unlock()
+    if c.generations[generationSlot(key)] != generation {
+        return false
+    }
+    c.Set(key, value, ttl, staleTime)
+    return true
+}
+
+// Get returns the cached value for key unless it expired, without fetching one
+func (c *Cache[T]) Get(key string) (T, bool) {
+    entry, ok := c.cache.Get(key)
+    if !ok || !time.Now().Before(entry.ExpiresAt) {
+        var empty T
+        return empty, false
+    }
+    return entry.Value, true
+}
+
+// Set stores value for key as if it had just been fetched
+func (c *Cache[T]) Set(key string, value T, ttl time.Duration, staleTime time.Duration) {
+    now := time.Now()
+    c.cache.Add(key, &CacheEntry[T]{
+        Value:     value,
+        CreatedAt: now,
+        ExpiresAt: now.Add(ttl),
+        StaleAt:   now.Add(staleTime),
+    })
+}
+
+// Peek returns the cached value for key, even if expired, without affecting its recency
+func (c *Cache[T]) Peek(key string) (T, bool) {
+    entry, ok := c.cache.Peek(key)
+    if !ok {
+        var empty T
+        return empty, false
+    }
+    return entry.Value, true
+}
+
+// Keys returns the keys of all entries, the least recently used first
+func (c *Cache[T]) Keys() []string {
+    return c.cache.Keys()
+}
+
+// refreshInBackground fetches a fresh value for opts.Key unless a refresh of the key is
+// already running. A failed refresh leaves the entry to the next request.
 func (c *Cache[T]) refreshInBackground(opts GetCachedOptions) {
     c.mu.Lock()
     defer c.mu.Unlock()
-
-    // Double-check if someone else already updated the cache
-    if entry, ok := c.cache.Get(opts.Key); ok {
-        if !entry.IsStale {
-            return
-        }
+    if c.refreshing[opts.Key] {
+        return
     }
-
-    // Mark as stale while updating
-    if entry, ok := c.cache.Get(opts.Key); ok {
-        entry.IsStale = true
-        c.cache.Add(opts.Key, entry)
+    if c.refreshing == nil {
+        c.refreshing = make(map[string]bool)
     }
+    c.refreshing[opts.Key] = true
 
-    // Get fresh value
-    _, _ = c.getFreshValue(opts) // Ignore errors in background refresh
+    go func() {
+        defer func() {
+            c.mu.Lock()
+            delete(c.refreshing, opts.Key)
+            c.mu.Unlock()
+        }()
+
+        // Double-check if someone else already refreshed the entry
+        if entry, ok := c.cache.Peek(opts.Key); ok && time.Now().Before(entry.ExpiresAt) {
+            return
+        }
+        _, _ = c.getFreshValue(opts) // Ignore errors in background refresh
+    }()
 }
 
 func (c *Cache[T]) getFreshValue(opts GetCachedOptions) (T, error) {
-    var empty T
+    value, err, _ := c.fetches.Do(opts.Key, func() (T, error) {
+        var empty T
 
-    value, err := opts.GetFreshValue()
-    if err != nil {
-        return empty, err
-    }
+        generation := c.Generation(opts.Key)
+        value, err := opts.GetFreshValue()
+        if err != nil {
+            return empty, err
+        }
 
-    typedValue, ok := value.(T)
-    if !ok {
-        return empty, fmt.Errorf("value type assertion failed")
-    }
+        typedValue, ok := value.(T)
+        if !ok {
+            return empty, fmt.Errorf("value type assertion failed")
+        }
 
-    now := time.Now()
-    entry := &CacheEntry[T]{
-        Value:     typedValue,
-        CreatedAt: now,
-        ExpiresAt: now.Add(opts.TTL),
-        StaleAt:   now.Add(opts.StaleTime),
-        IsStale:   false,
-    }
-    c.cache.Add(opts.Key, entry)
+        if opts.Cacheable == nil || opts.Cacheable(value) {
+            c.SetIfCurrent(opts.Key, generation, typedValue, opts.TTL, opts.StaleTime)
+        }
+        return typedValue, nil
+    })
+    return value, err
+}
 
-    return typedValue, nil
+func generationSlot(key string) int {
+    hash := fnv.New32a()
+    hash.Write([]byte(key))
+    return int(hash.Sum32() % cacheGenerations)
 }
 
 func (c *Cache[T]) getDirectValue(opts GetCachedOptions) (T, error) {
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_RefreshesInBackgroundOncePerKey(t *testing.T) {
+	cache, err := NewCache[string](CacheOptions{MaxSize: 10})
+	require.NoError(t, err)
+	cache.Set("slow", "old", 0, time.Hour)
+	cache.Set("fast", "old", 0, time.Hour)
+
+	var refreshes int32
+	release := make(chan struct{})
+	get := func(key string, fetch func() (interface{}, error)) string {
+		value, err := cache.GetCached(GetCachedOptions{Key: key, TTL: time.Hour, StaleTime: time.Hour, GetFreshValue: fetch})
+		require.NoError(t, err)
+		return value
+	}
+
+	// Stale hits are served while a single refresh per key runs
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, "old", get("slow", func() (interface{}, error) {
+				atomic.AddInt32(&refreshes, 1)
+				<-release
+				return "new", nil
+			}))
+		}()
+	}
+	wg.Wait()
+
+	// A slow refresh doesn't hold up those of other keys
+	get("fast", func() (interface{}, error) { return "new", nil })
+	assert.Eventually(t, func() bool {
+		value, _ := cache.Peek("fast")
+		return value == "new"
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		value, _ := cache.Peek("slow")
+		return value == "new"
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+}
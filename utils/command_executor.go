@@ -2,24 +2,48 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"time"
 )
 
 // Mock for CommandExecutor
 type MockCommandExecutor struct {
-	ExecuteFunc func(command string, args ...string) ([]byte, error)
+	ExecuteFunc          func(ctx context.Context, env []string, command string, args ...string) ([]byte, error)
+	ExecuteWithInputFunc func(ctx context.Context, env []string, input io.Reader, command string, args ...string) ([]byte, error)
+	StreamFunc           func(ctx context.Context, env []string, command string, args ...string) (io.ReadCloser, error)
 }
 
-func (m *MockCommandExecutor) Execute(command string, args ...string) ([]byte, error) {
-	return m.ExecuteFunc(command, args...)
+func (m *MockCommandExecutor) Execute(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+	return m.ExecuteFunc(ctx, env, command, args...)
 }
 
-// CommandExecutor defines an interface for executing commands
+func (m *MockCommandExecutor) ExecuteWithInput(ctx context.Context, env []string, input io.Reader, command string, args ...string) ([]byte, error) {
+	return m.ExecuteWithInputFunc(ctx, env, input, command, args...)
+}
+
+func (m *MockCommandExecutor) Stream(ctx context.Context, env []string, command string, args ...string) (io.ReadCloser, error) {
+	return m.StreamFunc(ctx, env, command, args...)
+}
+
+// CommandExecutor defines an interface for executing commands. Cancelling ctx kills
+// the command together with any processes it started. env holds KEY=value pairs
+// added to the environment of the server, use it for anything secret.
 type CommandExecutor interface {
-	Execute(command string, args ...string) ([]byte, error)
+	Execute(ctx context.Context, env []string, command string, args ...string) ([]byte, error)
+	// ExecuteWithInput runs the command with input connected to its stdin
+	ExecuteWithInput(ctx context.Context, env []string, input io.Reader, command string, args ...string) ([]byte, error)
+	// Stream starts the command and returns its stdout as it is produced. A failing
+	// command is reported by Read, closing the stream early kills the command.
+	Stream(ctx context.Context, env []string, command string, args ...string) (io.ReadCloser, error)
 }
 
+// commandWaitDelay bounds how long a killed command may keep its output pipes open
+const commandWaitDelay = 5 * time.Second
+
 // execCommand is the default implementation of CommandExecutor
 type execCommand struct{}
 
@@ -28,17 +52,40 @@ func NewCommandExecutor() CommandExecutor {
 }
 
 // Execute runs the command and returns the output
-func (e *execCommand) Execute(command string, args ...string) ([]byte, error) {
-	cmd := exec.Command(command, args...)
+func (e *execCommand) Execute(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+	return e.run(ctx, newCommand(ctx, env, command, args...))
+}
+
+// ExecuteWithInput runs the command with input as stdin and returns the output
+func (e *execCommand) ExecuteWithInput(ctx context.Context, env []string, input io.Reader, command string, args ...string) ([]byte, error) {
+	cmd := newCommand(ctx, env, command, args...)
+	cmd.Stdin = input
+	return e.run(ctx, cmd)
+}
+
+// newCommand creates a command that runs in its own process group, which is killed
+// as a whole when ctx is done
+func newCommand(ctx context.Context, env []string, command string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, command, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
+
+func (e *execCommand) run(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	command := cmd.Args[0]
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	if err := cmd.Run(); err != nil {
-		if stderr.Len() > 0 {
-			return nil, fmt.Errorf("command failed: %w: %s", err, stderr.String())
-		}
-		return nil, fmt.Errorf("command failed: %w", err)
+		return nil, commandError(ctx, err, &stderr)
 	}
 
 	if stderr.Len() > 0 {
@@ -46,4 +93,76 @@ func (e *execCommand) Execute(command string, args ...string) ([]byte, error) {
 	}
 
 	return stdout.Bytes(), nil
-} 
\ No newline at end of file
+}
+
+// Stream starts the command and returns a reader of its stdout
+func (e *execCommand) Stream(ctx context.Context, env []string, command string, args ...string) (io.ReadCloser, error) {
+	cmd := newCommand(ctx, env, command, args...)
+	stream := &commandStream{ctx: ctx, cmd: cmd}
+	cmd.Stderr = &stream.stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("command failed: %w", err)
+	}
+	stream.stdout = stdout
+	return stream, nil
+}
+
+// commandStream reads the stdout of a running command
+type commandStream struct {
+	ctx    context.Context
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+
+	done bool
+	err  error
+}
+
+func (s *commandStream) Read(p []byte) (int, error) {
+	n, err := s.stdout.Read(p)
+	if err == io.EOF {
+		// Only report the end of the stream once the command has succeeded
+		if waitErr := s.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (s *commandStream) Close() error {
+	if s.done {
+		return s.err
+	}
+
+	// The reader stopped early, there is no point in letting the command finish
+	killProcessGroup(s.cmd)
+	s.wait()
+	return nil
+}
+
+func (s *commandStream) wait() error {
+	if !s.done {
+		s.done = true
+		if err := s.cmd.Wait(); err != nil {
+			s.err = commandError(s.ctx, err, &s.stderr)
+		}
+	}
+	return s.err
+}
+
+// commandError describes a failed command. Commands killed because ctx is done
+// report why, so timeouts can be told apart from failures.
+func commandError(ctx context.Context, err error, stderr *bytes.Buffer) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("command failed: %w: %w", ctxErr, err)
+	}
+	if stderr.Len() > 0 {
+		return fmt.Errorf("command failed: %w: %s", err, stderr.String())
+	}
+	return fmt.Errorf("command failed: %w", err)
+}
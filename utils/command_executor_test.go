@@ -2,18 +2,23 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Test for MockCommandExecutor
 func TestMockCommandExecutor(t *testing.T) {
 	mock := &MockCommandExecutor{
-		ExecuteFunc: func(command string, args ...string) ([]byte, error) {
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
 			return []byte("mock output"), nil
 		},
 	}
 
-	output, err := mock.Execute("mockCommand", "arg1", "arg2")
+	output, err := mock.Execute(context.Background(), nil, "mockCommand", "arg1", "arg2")
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -27,7 +32,7 @@ func TestExecCommand(t *testing.T) {
 	e := &execCommand{}
 
 	// This test will fail if the command is not available on the system
-	output, err := e.Execute("echo", "Hello, World!")
+	output, err := e.Execute(context.Background(), nil, "echo", "Hello, World!")
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -40,8 +45,93 @@ func TestExecCommand(t *testing.T) {
 func TestExecCommandInvalid(t *testing.T) {
 	e := &execCommand{}
 
-	_, err := e.Execute("invalidCommand")
+	_, err := e.Execute(context.Background(), nil, "invalidCommand")
 	if err == nil {
 		t.Fatal("expected an error for invalid command, got none")
 	}
-} 
\ No newline at end of file
+} 
+// Test for execCommand with stdin input
+func TestExecCommandWithInput(t *testing.T) {
+	e := &execCommand{}
+
+	output, err := e.ExecuteWithInput(context.Background(), nil, bytes.NewReader([]byte("piped input")), "cat")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(output) != "piped input" {
+		t.Fatalf("expected output to be 'piped input', got %s", output)
+	}
+}
+
+// Test for execCommand streaming stdout
+func TestExecCommandStream(t *testing.T) {
+	e := &execCommand{}
+
+	stream, err := e.Stream(context.Background(), nil, "echo", "streamed")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	output, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(output) != "streamed\n" {
+		t.Fatalf("expected output to be 'streamed', got %q", output)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("expected no error on close, got %v", err)
+	}
+
+	// A failing command is reported instead of a clean end of stream
+	stream, err = e.Stream(context.Background(), nil, "sh", "-c", "echo partial; echo broken >&2; exit 3")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	_, err = io.ReadAll(stream)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected the command error, got %v", err)
+	}
+	stream.Close()
+
+	// Closing early stops a command that would never finish
+	stream, err = e.Stream(context.Background(), nil, "yes")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("expected no error on early close, got %v", err)
+	}
+}
+
+// Test for execCommand killing the whole process group once the context is done
+func TestExecCommandContext(t *testing.T) {
+	e := &execCommand{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The child sleep keeps stdout open, only killing the group ends the command early
+	start := time.Now()
+	_, err := e.Execute(ctx, nil, "sh", "-c", "sleep 10; echo done")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the command to be killed promptly, took %s", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	stream, err := e.Stream(ctx, nil, "sh", "-c", "sleep 10; echo done")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	cancel()
+	if _, err := io.ReadAll(stream); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancellation error, got %v", err)
+	}
+	stream.Close()
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileETag builds a strong ETag for a single source file. The variant distinguishes
+// different representations of the same file, e.g. canonical transform options.
+func FileETag(file RcloneFile, variant string) string {
+	return ListingETag([]RcloneFile{file}, variant)
+}
+
+// ListingETag builds a strong ETag for a set of source files, independent of their order
+func ListingETag(files []RcloneFile, variant string) string {
+	parts := make([]string, 0, len(files))
+	for _, file := range files {
+		parts = append(parts, fileFingerprint(file))
+	}
+	sort.Strings(parts)
+
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{'\n'})
+	}
+	hash.Write([]byte(variant))
+
+	return `"` + hex.EncodeToString(hash.Sum(nil))[:32] + `"`
+}
+
+// fileFingerprint identifies the version of a file, preferring a content hash reported by rclone
+func fileFingerprint(file RcloneFile) string {
+	if len(file.Hashes) > 0 {
+		names := make([]string, 0, len(file.Hashes))
+		for name := range file.Hashes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return file.Path + "|" + names[0] + ":" + file.Hashes[names[0]]
+	}
+	return strings.Join([]string{file.Path, file.ModTime, strconv.FormatInt(file.Size, 10), strconv.FormatBool(file.IsDir)}, "|")
+}
+
+// LastModified returns the most recent ModTime of the given files
+func LastModified(files ...RcloneFile) (time.Time, bool) {
+	var latest time.Time
+	for _, file := range files {
+		modTime, err := time.Parse(time.RFC3339Nano, file.ModTime)
+		if err != nil {
+			continue
+		}
+		if modTime.After(latest) {
+			latest = modTime
+		}
+	}
+	return latest, !latest.IsZero()
+}
+
+// CheckNotModified sets the ETag and Last-Modified validators on the response and
+// answers with 304 Not Modified when the conditional request headers match.
+// It returns true when the response has been written.
+func CheckNotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if !isNotModified(r, etag, lastModified) {
+		return false
+	}
+
+	// A 304 must not carry a body or headers describing one
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func isNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etag != "" && etagMatches(ifNoneMatch, etag)
+	}
+
+	ifModifiedSince := r.Header.Get("If-Modified-Since")
+	if ifModifiedSince == "" || lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a one second resolution
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// etagMatches performs the weak comparison required for If-None-Match
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
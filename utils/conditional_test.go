@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListingETag(t *testing.T) {
+	a := RcloneFile{Path: "a.jpg", Size: 10, ModTime: "2024-01-01T00:00:00Z"}
+	b := RcloneFile{Path: "b.jpg", Size: 20, ModTime: "2024-01-02T00:00:00Z"}
+
+	etag := ListingETag([]RcloneFile{a, b}, "list")
+	assert.Equal(t, etag, ListingETag([]RcloneFile{b, a}, "list"), "order must not matter")
+	assert.NotEqual(t, etag, ListingETag([]RcloneFile{a, b}, "zip"), "variant must change the ETag")
+	assert.Len(t, etag, 34)
+
+	changed := b
+	changed.ModTime = "2024-01-03T00:00:00Z"
+	assert.NotEqual(t, etag, ListingETag([]RcloneFile{a, changed}, "list"))
+
+	// Content hashes take precedence over ModTime and size
+	hashed := a
+	hashed.Hashes = map[string]string{"md5": "abc"}
+	touched := hashed
+	touched.ModTime = "2025-01-01T00:00:00Z"
+	assert.Equal(t, FileETag(hashed, ""), FileETag(touched, ""))
+}
+
+func TestLastModified(t *testing.T) {
+	latest, ok := LastModified(
+		RcloneFile{ModTime: "2024-01-01T00:00:00Z"},
+		RcloneFile{ModTime: "2024-03-01T12:30:00.123456789+01:00"},
+		RcloneFile{ModTime: "invalid"},
+	)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2024, 3, 1, 11, 30, 0, 123456789, time.UTC), latest.UTC())
+
+	_, ok = LastModified(RcloneFile{})
+	assert.False(t, ok)
+}
+
+func TestCheckNotModified(t *testing.T) {
+	etag := `"abc"`
+	lastModified := time.Date(2024, 1, 1, 12, 0, 0, 500, time.UTC)
+
+	tests := []struct {
+		name     string
+		method   string
+		headers  map[string]string
+		expected bool
+	}{
+		{name: "No conditional headers", expected: false},
+		{name: "Matching If-None-Match", headers: map[string]string{"If-None-Match": `"abc"`}, expected: true},
+		{name: "Weak If-None-Match in list", headers: map[string]string{"If-None-Match": `"xyz", W/"abc"`}, expected: true},
+		{name: "Wildcard If-None-Match", headers: map[string]string{"If-None-Match": "*"}, expected: true},
+		{name: "Mismatching If-None-Match", headers: map[string]string{"If-None-Match": `"xyz"`}, expected: false},
+		{name: "If-None-Match takes precedence", headers: map[string]string{"If-None-Match": `"xyz"`, "If-Modified-Since": "Tue, 01 Jan 2030 00:00:00 GMT"}, expected: false},
+		{name: "If-Modified-Since equal", headers: map[string]string{"If-Modified-Since": "Mon, 01 Jan 2024 12:00:00 GMT"}, expected: true},
+		{name: "If-Modified-Since older", headers: map[string]string{"If-Modified-Since": "Mon, 01 Jan 2024 11:59:59 GMT"}, expected: false},
+		{name: "Invalid If-Modified-Since", headers: map[string]string{"If-Modified-Since": "yesterday"}, expected: false},
+		{name: "Non GET method", method: http.MethodPost, headers: map[string]string{"If-None-Match": `"abc"`}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			rec.Header().Set("Content-Type", "image/jpeg")
+
+			assert.Equal(t, tt.expected, CheckNotModified(rec, req, etag, lastModified))
+			assert.Equal(t, etag, rec.Header().Get("ETag"))
+			assert.Equal(t, "Mon, 01 Jan 2024 12:00:00 GMT", rec.Header().Get("Last-Modified"))
+			if tt.expected {
+				assert.Equal(t, http.StatusNotModified, rec.Code)
+				assert.Empty(t, rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
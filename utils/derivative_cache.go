@@ -0,0 +1,428 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"shuto-api/config"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// DerivativeCache stores rendered image outputs so they don't have to be
+// fetched and transformed again
+type DerivativeCache interface {
+	Get(ctx context.Context, domain string, key string) (data []byte, mimeType string, ok bool)
+	Set(ctx context.Context, domain string, key string, data []byte, mimeType string) error
+	// Delete removes the output stored under key, missing outputs are not an error
+	Delete(domain string, key string) error
+	Stats() DerivativeCacheStats
+}
+
+// DerivativeCacheStats is a point in time snapshot of a derivative cache
+type DerivativeCacheStats struct {
+	Name      string                 `json:"name"`
+	Entries   int                    `json:"entries"`
+	Bytes     int64                  `json:"bytes"`
+	MaxBytes  int64                  `json:"maxBytes"`
+	Hits      uint64                 `json:"hits"`
+	Misses    uint64                 `json:"misses"`
+	Evictions uint64                 `json:"evictions"`
+	Errors    uint64                 `json:"errors"`
+	Skipped   uint64                 `json:"skipped,omitempty"`
+	Tiers     []DerivativeCacheStats `json:"tiers,omitempty"`
+}
+
+// DerivativeCacheKey identifies a rendered output. The source ModTime and size are
+// part of the key, so a changed source never serves an outdated derivative.
+func DerivativeCacheKey(domain string, path string, source RcloneFile, opts ImageTransformOptions) string {
+	raw := strings.Join([]string{
+		domain,
+		path,
+		source.ModTime,
+		strconv.FormatInt(source.Size, 10),
+		opts.CacheKey(),
+	}, "|")
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// DerivativeSources remembers the derivative cache keys rendered from each source file,
+// so that its outputs can be deleted once it changed. It's bounded, the outputs of
+// forgotten sources stay until they are evicted.
+type DerivativeSources struct {
+	mu      sync.Mutex
+	sources *lru.Cache[string, []string]
+}
+
+func NewDerivativeSources(maxSources int) (*DerivativeSources, error) {
+	sources, err := lru.New[string, []string](maxSources)
+	if err != nil {
+		return nil, err
+	}
+	return &DerivativeSources{sources: sources}, nil
+}
+
+// Add records that key was rendered from path
+func (s *DerivativeSources) Add(domain string, path string, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, _ := s.sources.Get(domain + "|" + path)
+	for _, existing := range keys {
+		if existing == key {
+			return
+		}
+	}
+	s.sources.Add(domain+"|"+path, append(keys, key))
+}
+
+// Evict deletes the outputs rendered from path from cache and forgets them
+func (s *DerivativeSources) Evict(cache DerivativeCache, domain string, path string) {
+	s.mu.Lock()
+	keys, _ := s.sources.Get(domain + "|" + path)
+	s.sources.Remove(domain + "|" + path)
+	s.mu.Unlock()
+
+	for _, key := range keys {
+		if err := cache.Delete(domain, key); err != nil {
+			Warn("Failed to delete derivative of changed source", "domain", domain, "path", path, "error", err)
+		}
+	}
+}
+
+var derivativeExtensions = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/webp": "webp",
+	"image/avif": "avif",
+}
+
+func mimeTypeForExtension(ext string) (string, bool) {
+	for mimeType, candidate := range derivativeExtensions {
+		if candidate == ext {
+			return mimeType, true
+		}
+	}
+	return "", false
+}
+
+type DiskCacheOptions struct {
+	Dir      string
+	MaxBytes int64
+	// ConfigManager is used to honour the per-domain cache.disable_disk opt-out, optional
+	ConfigManager config.DomainConfigManager
+}
+
+// DiskCache is a size capped, LRU evicted derivative cache on the local disk.
+// Entries are stored as <dir>/<key[:2]>/<key>.<ext> and the in-memory index is
+// rebuilt from the directory on startup, using file ModTimes as access times.
+type DiskCache struct {
+	dir           string
+	maxBytes      int64
+	configManager config.DomainConfigManager
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element // key -> element holding *diskCacheEntry
+	lru       *list.List               // most recently used entries at the front
+	size      int64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	errors    uint64
+}
+
+type diskCacheEntry struct {
+	key  string
+	ext  string
+	size int64
+}
+
+func NewDiskCache(opts DiskCacheOptions) (*DiskCache, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("cache directory is required")
+	}
+	if opts.MaxBytes <= 0 {
+		return nil, fmt.Errorf("max cache size must be positive, got %d", opts.MaxBytes)
+	}
+	if err := os.MkdirAll(filepath.Join(opts.Dir, "tmp"), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	c := &DiskCache{
+		dir:           opts.Dir,
+		maxBytes:      opts.MaxBytes,
+		configManager: opts.ConfigManager,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+	}
+	if err := c.rebuildIndex(); err != nil {
+		return nil, fmt.Errorf("failed to rebuild cache index: %w", err)
+	}
+
+	Info("Derivative cache ready", "dir", c.dir, "entries", c.lru.Len(), "bytes", c.size, "max_bytes", c.maxBytes)
+	return c, nil
+}
+
+func (c *DiskCache) Get(ctx context.Context, domain string, key string) ([]byte, string, bool) {
+	if !c.enabledFor(domain) {
+		return nil, "", false
+	}
+
+	c.mu.Lock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		c.mu.Unlock()
+		return nil, "", false
+	}
+	c.lru.MoveToFront(element)
+	entry := element.Value.(*diskCacheEntry)
+	c.mu.Unlock()
+
+	filePath := c.entryPath(entry.key, entry.ext)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		// The file disappeared underneath us, forget about it unless a concurrent Set
+		// replaced the entry meanwhile
+		var stale string
+		c.mu.Lock()
+		if current, ok := c.entries[key]; ok && current == element {
+			stale = c.removeLocked(key)
+		}
+		c.misses++
+		c.errors++
+		c.mu.Unlock()
+		removeCacheFiles(stale)
+		Warn("Failed to read cached derivative", "key", key, "error", err)
+		return nil, "", false
+	}
+
+	// Persist the access time so the LRU order survives restarts
+	now := time.Now()
+	_ = os.Chtimes(filePath, now, now)
+
+	mimeType, _ := mimeTypeForExtension(entry.ext)
+
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+	return data, mimeType, true
+}
+
+func (c *DiskCache) Set(ctx context.Context, domain string, key string, data []byte, mimeType string) error {
+	if !c.enabledFor(domain) {
+		return nil
+	}
+
+	ext, ok := derivativeExtensions[mimeType]
+	if !ok {
+		return fmt.Errorf("unsupported derivative mime type: %s", mimeType)
+	}
+	if int64(len(data)) > c.maxBytes {
+		return fmt.Errorf("derivative of %d bytes exceeds cache size of %d bytes", len(data), c.maxBytes)
+	}
+
+	if err := c.writeAtomic(c.entryPath(key, ext), data); err != nil {
+		c.mu.Lock()
+		c.errors++
+		c.mu.Unlock()
+		return err
+	}
+
+	var stale []string
+	c.mu.Lock()
+	if element, exists := c.entries[key]; exists {
+		previous := element.Value.(*diskCacheEntry)
+		if previous.ext != ext {
+			stale = append(stale, c.removeLocked(key))
+		} else {
+			c.size -= previous.size
+			c.lru.Remove(element)
+		}
+	}
+	c.entries[key] = c.lru.PushFront(&diskCacheEntry{key: key, ext: ext, size: int64(len(data))})
+	c.size += int64(len(data))
+	stale = append(stale, c.evictLocked()...)
+	c.mu.Unlock()
+
+	removeCacheFiles(stale...)
+	return nil
+}
+
+func (c *DiskCache) Delete(domain string, key string) error {
+	c.mu.Lock()
+	stale := c.removeLocked(key)
+	c.mu.Unlock()
+	removeCacheFiles(stale)
+	return nil
+}
+
+func (c *DiskCache) Stats() DerivativeCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return DerivativeCacheStats{
+		Name:      "disk",
+		Entries:   c.lru.Len(),
+		Bytes:     c.size,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Errors:    c.errors,
+	}
+}
+
+// enabledFor reports whether the domain has not opted out of the disk cache
+func (c *DiskCache) enabledFor(domain string) bool {
+	if c.configManager == nil {
+		return true
+	}
+	cfg, err := c.configManager.GetDomainConfig(domain)
+	return err == nil && !cfg.Cache.DisableDisk
+}
+
+// writeAtomic writes to a temporary file first, so readers never see partial files
+func (c *DiskCache) writeAtomic(filePath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache shard: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), "derivative-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to move cache file into place: %w", err)
+	}
+	return nil
+}
+
+// evictLocked drops the least recently used entries until the cache fits, returning the
+// files to remove
+func (c *DiskCache) evictLocked() []string {
+	var stale []string
+	for c.size > c.maxBytes {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		entry := oldest.Value.(*diskCacheEntry)
+		stale = append(stale, c.removeLocked(entry.key))
+		c.evictions++
+		Debug("Evicted cached derivative", "key", entry.key, "size", entry.size)
+	}
+	return stale
+}
+
+// removeLocked drops key from the index and returns the path of its file, which the
+// caller removes with removeCacheFiles once c.mu is released. A Set of the same key in
+// between may lose its file, which the next Get counts as a miss.
+func (c *DiskCache) removeLocked(key string) string {
+	element, ok := c.entries[key]
+	if !ok {
+		return ""
+	}
+	entry := element.Value.(*diskCacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	c.size -= entry.size
+	return c.entryPath(entry.key, entry.ext)
+}
+
+func removeCacheFiles(paths ...string) {
+	for _, filePath := range paths {
+		if filePath == "" {
+			continue
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			Warn("Failed to remove cached derivative", "path", filePath, "error", err)
+		}
+	}
+}
+
+// rebuildIndex restores the index from disk, oldest entries ending up at the back of the LRU list
+func (c *DiskCache) rebuildIndex() error {
+	type foundEntry struct {
+		entry   *diskCacheEntry
+		modTime time.Time
+	}
+	var found []foundEntry
+
+	tmpDir := filepath.Join(c.dir, "tmp")
+	err := filepath.WalkDir(c.dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		// Leftovers of writes interrupted by a crash or restart
+		if filepath.Dir(filePath) == tmpDir {
+			return os.Remove(filePath)
+		}
+
+		name := d.Name()
+		ext := strings.TrimPrefix(filepath.Ext(name), ".")
+		if _, ok := mimeTypeForExtension(ext); !ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		found = append(found, foundEntry{
+			entry:   &diskCacheEntry{key: strings.TrimSuffix(name, "."+ext), ext: ext, size: info.Size()},
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].modTime.After(found[j].modTime)
+	})
+
+	c.mu.Lock()
+	for _, f := range found {
+		c.entries[f.entry.key] = c.lru.PushBack(f.entry)
+		c.size += f.entry.size
+	}
+	stale := c.evictLocked()
+	c.mu.Unlock()
+
+	removeCacheFiles(stale...)
+	return nil
+}
+
+func (c *DiskCache) entryPath(key string, ext string) string {
+	shard := key
+	if len(shard) > 2 {
+		shard = shard[:2]
+	}
+	return filepath.Join(c.dir, shard, key+"."+ext)
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDerivativeCacheKey(t *testing.T) {
+	source := RcloneFile{ModTime: "2024-01-01T00:00:00Z", Size: 1024}
+	opts := ImageTransformOptions{Width: 100, Fit: "clip", Format: "jpg", Quality: 75, Dpr: 1}
+
+	key := DerivativeCacheKey("example.com", "photos/a.jpg", source, opts)
+	assert.Len(t, key, 64)
+	assert.Equal(t, key, DerivativeCacheKey("example.com", "photos/a.jpg", source, opts))
+
+	// jpeg and jpg produce the same output
+	jpegOpts := opts
+	jpegOpts.Format = "jpeg"
+	assert.Equal(t, key, DerivativeCacheKey("example.com", "photos/a.jpg", source, jpegOpts))
+
+	changed := source
+	changed.ModTime = "2024-01-02T00:00:00Z"
+	assert.NotEqual(t, key, DerivativeCacheKey("example.com", "photos/a.jpg", changed, opts))
+	assert.NotEqual(t, key, DerivativeCacheKey("other.com", "photos/a.jpg", source, opts))
+
+	wider := opts
+	wider.Width = 200
+	assert.NotEqual(t, key, DerivativeCacheKey("example.com", "photos/a.jpg", source, wider))
+}
+
+func TestDiskCache_SetAndGet(t *testing.T) {
+	cache, err := NewDiskCache(DiskCacheOptions{Dir: t.TempDir(), MaxBytes: 1024})
+	require.NoError(t, err)
+
+	_, _, ok := cache.Get(context.Background(), "example.com", "missing")
+	assert.False(t, ok)
+
+	require.NoError(t, cache.Set(context.Background(), "example.com", "abcdef", []byte("webp-data"), "image/webp"))
+
+	data, mimeType, ok := cache.Get(context.Background(), "example.com", "abcdef")
+	require.True(t, ok)
+	assert.Equal(t, []byte("webp-data"), data)
+	assert.Equal(t, "image/webp", mimeType)
+
+	stats := cache.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, int64(9), stats.Bytes)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+
+	assert.Error(t, cache.Set(context.Background(), "example.com", "gif", []byte("data"), "image/gif"))
+}
+
+func TestDiskCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := NewDiskCache(DiskCacheOptions{Dir: t.TempDir(), MaxBytes: 10})
+	require.NoError(t, err)
+
+	require.NoError(t, cache.Set(context.Background(), "example.com", "aa1", []byte("1234"), "image/jpeg"))
+	require.NoError(t, cache.Set(context.Background(), "example.com", "bb2", []byte("1234"), "image/jpeg"))
+
+	// Touch the first entry so the second one becomes the eviction candidate
+	_, _, ok := cache.Get(context.Background(), "example.com", "aa1")
+	require.True(t, ok)
+
+	require.NoError(t, cache.Set(context.Background(), "example.com", "cc3", []byte("1234"), "image/jpeg"))
+
+	_, _, ok = cache.Get(context.Background(), "example.com", "bb2")
+	assert.False(t, ok)
+	_, _, ok = cache.Get(context.Background(), "example.com", "aa1")
+	assert.True(t, ok)
+	_, _, ok = cache.Get(context.Background(), "example.com", "cc3")
+	assert.True(t, ok)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, int64(8), stats.Bytes)
+}
+
+func TestDiskCache_RebuildsIndexOnStartup(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewDiskCache(DiskCacheOptions{Dir: dir, MaxBytes: 1024})
+	require.NoError(t, err)
+	require.NoError(t, cache.Set(context.Background(), "example.com", "old111", []byte("old"), "image/png"))
+	require.NoError(t, cache.Set(context.Background(), "example.com", "new222", []byte("new"), "image/jpeg"))
+
+	// Make the first entry the least recently used one on disk
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(cache.entryPath("old111", "png"), past, past))
+
+	// Simulate a write interrupted by a crash
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tmp", "derivative-123"), []byte("partial"), 0o644))
+
+	restarted, err := NewDiskCache(DiskCacheOptions{Dir: dir, MaxBytes: 4})
+	require.NoError(t, err)
+
+	stats := restarted.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, uint64(1), stats.Evictions)
+
+	data, mimeType, ok := restarted.Get(context.Background(), "example.com", "new222")
+	require.True(t, ok)
+	assert.Equal(t, []byte("new"), data)
+	assert.Equal(t, "image/jpeg", mimeType)
+
+	_, err = os.Stat(filepath.Join(dir, "tmp", "derivative-123"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDerivativeSources_Evict(t *testing.T) {
+	cache, err := NewDiskCache(DiskCacheOptions{Dir: t.TempDir(), MaxBytes: 1024})
+	require.NoError(t, err)
+	sources, err := NewDerivativeSources(10)
+	require.NoError(t, err)
+
+	for _, key := range []string{"aa01", "aa02", "bb01"} {
+		require.NoError(t, cache.Set(context.Background(), "test", key, []byte(key), "image/jpeg"))
+	}
+	sources.Add("test", "a.jpg", "aa01")
+	sources.Add("test", "a.jpg", "aa02")
+	sources.Add("test", "a.jpg", "aa02")
+	sources.Add("test", "b.jpg", "bb01")
+	sources.Add("other", "a.jpg", "bb01")
+
+	sources.Evict(cache, "test", "a.jpg")
+	_, _, ok := cache.Get(context.Background(), "test", "aa01")
+	assert.False(t, ok)
+	_, _, ok = cache.Get(context.Background(), "test", "aa02")
+	assert.False(t, ok)
+	_, _, ok = cache.Get(context.Background(), "test", "bb01")
+	assert.True(t, ok)
+	assert.Equal(t, 1, cache.Stats().Entries)
+
+	// Deleting missing outputs is fine
+	sources.Evict(cache, "test", "a.jpg")
+	require.NoError(t, cache.Delete("test", "missing"))
+}
+
+func TestNewDiskCache_InvalidOptions(t *testing.T) {
+	_, err := NewDiskCache(DiskCacheOptions{MaxBytes: 1})
+	assert.Error(t, err)
+
+	_, err = NewDiskCache(DiskCacheOptions{Dir: t.TempDir()})
+	assert.Error(t, err)
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// GetEnv reads an environment variable, falling back to the default when unset
+func GetEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// GetEnvInt reads an integer environment variable, falling back to the default when unset or invalid
+func GetEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		Warn("Invalid integer environment variable, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// GetEnvDuration reads a duration environment variable (e.g. "10s"), falling back to the default when unset or invalid
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		Warn("Invalid duration environment variable, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
@@ -1,9 +1,13 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type ErrorResponse struct {
@@ -27,8 +31,21 @@ const (
 	ErrCodeInvalidAPIKey     = "INVALID_API_KEY"
 	ErrCodeExpiredToken      = "EXPIRED_TOKEN"
 	ErrCodeInvalidSignature  = "INVALID_SIGNATURE"
+	ErrCodeServiceUnavailable = "SERVICE_UNAVAILABLE"
+	ErrCodeRangeNotSatisfiable = "RANGE_NOT_SATISFIABLE"
+	ErrCodeBadGateway         = "BAD_GATEWAY"
+	ErrCodeGatewayTimeout     = "GATEWAY_TIMEOUT"
+	ErrCodeClientClosedRequest = "CLIENT_CLOSED_REQUEST"
+	ErrCodeMethodNotAllowed   = "METHOD_NOT_ALLOWED"
+	ErrCodeConflict           = "CONFLICT"
+	ErrCodePayloadTooLarge    = "PAYLOAD_TOO_LARGE"
+	ErrCodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
 )
 
+// StatusClientClosedRequest is recorded when the client went away before the response,
+// following the nginx convention
+const StatusClientClosedRequest = 499
+
 func WriteError(w http.ResponseWriter, status int, code string, message string, details string) {
 	resp := ErrorResponse{
 		Error: message,
@@ -40,6 +57,11 @@ func WriteError(w http.ResponseWriter, status int, code string, message string,
 		resp.Details = details
 	}
 
+	// Validators and caching headers set earlier describe the success response only
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+	w.Header().Del("X-Cache")
+	w.Header().Set("Cache-Control", "no-store")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(resp)
@@ -90,4 +112,57 @@ func WriteExpiredTokenError(w http.ResponseWriter) {
 
 func WriteInvalidSignatureError(w http.ResponseWriter) {
 	WriteError(w, http.StatusForbidden, ErrCodeInvalidSignature, "Invalid signature", "")
-} 
\ No newline at end of file
+} 
+
+func WriteServiceUnavailableError(w http.ResponseWriter, retryAfterSeconds int, details string) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds))
+	WriteError(w, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Service is busy, please retry later", details)
+}
+
+func WriteRangeNotSatisfiableError(w http.ResponseWriter, size int64) {
+	w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+	WriteError(w, http.StatusRequestedRangeNotSatisfiable, ErrCodeRangeNotSatisfiable, "Requested range not satisfiable", "")
+}
+
+func WriteMethodNotAllowedError(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	WriteError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed", "")
+}
+
+func WriteConflictError(w http.ResponseWriter, message string, details string) {
+	WriteError(w, http.StatusConflict, ErrCodeConflict, message, details)
+}
+
+func WritePayloadTooLargeError(w http.ResponseWriter, maxSize int64) {
+	WriteError(w, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, "Payload too large", "maximum size is "+strconv.FormatInt(maxSize, 10)+" bytes")
+}
+
+func WriteUnsupportedMediaTypeError(w http.ResponseWriter, mimeType string) {
+	WriteError(w, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "Unsupported media type", mimeType)
+}
+
+// WriteStorageError answers a failed storage operation with the status matching its
+// kind: 404 for missing paths, 403 for denied access, 504 for timeouts, 502 when the
+// backend can't be reached, 400 for directories and invalid paths and 499 when the
+// client went away.
+// Anything else is a 500 with message.
+func WriteStorageError(w http.ResponseWriter, message string, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		WriteError(w, StatusClientClosedRequest, ErrCodeClientClosedRequest, "Client closed request", err.Error())
+	case errors.Is(err, ErrNotFound):
+		WriteError(w, http.StatusNotFound, ErrCodeNotFound, "Not found", err.Error())
+	case errors.Is(err, ErrPermission):
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Access to storage denied", err.Error())
+	case errors.Is(err, ErrTimeout):
+		WriteError(w, http.StatusGatewayTimeout, ErrCodeGatewayTimeout, "Storage backend timed out", err.Error())
+	case errors.Is(err, ErrBackendUnavailable):
+		WriteError(w, http.StatusBadGateway, ErrCodeBadGateway, "Storage backend unavailable", err.Error())
+	case errors.Is(err, ErrIsDirectory):
+		WriteError(w, http.StatusBadRequest, ErrCodeInvalidPath, "Path is a directory", err.Error())
+	case errors.Is(err, ErrInvalidPath):
+		WriteError(w, http.StatusBadRequest, ErrCodeInvalidPath, "Invalid path", err.Error())
+	default:
+		WriteInternalError(w, message, err.Error())
+	}
+}
@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"shuto-api/config"
+)
+
+// StorageRemoteHeader names the remote that served the storage reads of a response
+const StorageRemoteHeader = "X-Storage-Remote"
+
+// FailoverOptions configures when a failing remote is skipped
+type FailoverOptions struct {
+	// FailureThreshold is the number of consecutive failures that open a remote's circuit
+	FailureThreshold int
+	// Backoff is how long an opened circuit skips the remote, doubled for every further failure
+	Backoff time.Duration
+	// MaxBackoff caps the doubled backoff
+	MaxBackoff time.Duration
+}
+
+func (o FailoverOptions) withDefaults() FailoverOptions {
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = 3
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 10 * time.Second
+	}
+	if o.MaxBackoff < o.Backoff {
+		o.MaxBackoff = 5 * time.Minute
+	}
+	return o
+}
+
+// failoverRclone reads from the first healthy remote of a domain: its primary rclone
+// config followed by its replicas. Writes always go to the primary.
+type failoverRclone struct {
+	configManager config.DomainConfigManager
+	newStorage    func(config.DomainConfigManager) Rclone
+	options       FailoverOptions
+	now           func() time.Time
+
+	mu       sync.Mutex
+	remotes  []Rclone // primary first, replicas are created on first use
+	breakers map[string]*circuitBreaker
+}
+
+// NewFailoverRclone creates a Rclone failing over to the replicas of a domain while its
+// primary is unavailable. newStorage creates the storage for a view of the domain configs.
+func NewFailoverRclone(configManager config.DomainConfigManager, newStorage func(config.DomainConfigManager) Rclone, options FailoverOptions) Rclone {
+	return &failoverRclone{
+		configManager: configManager,
+		newStorage:    newStorage,
+		options:       options.withDefaults(),
+		now:           time.Now,
+		remotes:       []Rclone{newStorage(configManager)},
+		breakers:      make(map[string]*circuitBreaker),
+	}
+}
+
+func (f *failoverRclone) storage(index int) Rclone {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.remotes) <= index {
+		f.remotes = append(f.remotes, f.newStorage(config.NewReplicaConfigManager(f.configManager, len(f.remotes)-1)))
+	}
+	return f.remotes[index]
+}
+
+func (f *failoverRclone) breaker(domain string, index int) *circuitBreaker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := domain + "|" + strconv.Itoa(index)
+	b, ok := f.breakers[key]
+	if !ok {
+		b = &circuitBreaker{}
+		f.breakers[key] = b
+	}
+	return b
+}
+
+// failover runs op against the remotes of domain in order until one of them is healthy.
+// Remotes with an open circuit are only tried once all others failed.
+func failover[T any](f *failoverRclone, ctx context.Context, domain string, path string, op func(Rclone) (T, error)) (T, error) {
+	cfg, err := f.configManager.GetDomainConfig(domain)
+	if err != nil || len(cfg.Replicas) == 0 {
+		result, err := op(f.storage(0))
+		if err == nil {
+			recordStorageRemote(ctx, remoteLabel(cfg.Rclone))
+			Debug("Served from primary", "domain", domain, "path", path, "remote", remoteLabel(cfg.Rclone))
+		}
+		return result, err
+	}
+
+	remotes := append([]config.RcloneConfig{cfg.Rclone}, cfg.Replicas...)
+	now := f.now()
+	order := make([]int, 0, len(remotes))
+	var open []int
+	for i := range remotes {
+		if f.breaker(domain, i).allows(now) {
+			order = append(order, i)
+		} else {
+			open = append(open, i)
+		}
+	}
+	order = append(order, open...)
+
+	var zero T
+	for attempt, i := range order {
+		label := remoteLabel(remotes[i])
+		result, err := op(f.storage(i))
+		if err == nil || !isUnhealthy(err) {
+			f.breaker(domain, i).succeeded()
+			if err == nil {
+				recordStorageRemote(ctx, label)
+				if i > 0 {
+					Info("Served from replica", "domain", domain, "path", path, "remote", label)
+				} else {
+					Debug("Served from primary", "domain", domain, "path", path, "remote", label)
+				}
+			}
+			return result, err
+		}
+
+		if backoff := f.breaker(domain, i).failed(f.now(), f.options); backoff > 0 {
+			Warn("Storage remote unhealthy, skipping it", "domain", domain, "remote", label, "backoff", backoff, "error", err)
+		}
+		if ctx.Err() != nil || attempt == len(order)-1 {
+			return zero, err
+		}
+		Warn("Storage remote failed, trying next", "domain", domain, "path", path, "remote", label, "error", err)
+	}
+	return zero, nil
+}
+
+// isUnhealthy reports failures of the remote itself, as opposed to the requested path
+func isUnhealthy(err error) bool {
+	return errors.Is(err, ErrBackendUnavailable) || errors.Is(err, ErrTimeout)
+}
+
+// remoteLabel names a remote in headers and logs
+func remoteLabel(cfg config.RcloneConfig) string {
+	if cfg.Remote == "" && cfg.S3 != nil {
+		return cfg.S3.Bucket
+	}
+	return cfg.Remote
+}
+
+func (f *failoverRclone) FetchImage(ctx context.Context, path string, domain string) ([]byte, error) {
+	return failover(f, ctx, domain, path, func(remote Rclone) ([]byte, error) {
+		return remote.FetchImage(ctx, path, domain)
+	})
+}
+
+func (f *failoverRclone) Open(ctx context.Context, path string, domain string) (*FileStream, error) {
+	return failover(f, ctx, domain, path, func(remote Rclone) (*FileStream, error) {
+		return remote.Open(ctx, path, domain)
+	})
+}
+
+func (f *failoverRclone) OpenRange(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+	return failover(f, ctx, domain, path, func(remote Rclone) (io.ReadCloser, error) {
+		return remote.OpenRange(ctx, path, domain, offset, count)
+	})
+}
+
+func (f *failoverRclone) ListPath(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+	return failover(f, ctx, domain, path, func(remote Rclone) ([]RcloneFile, error) {
+		return remote.ListPath(ctx, path, domain)
+	})
+}
+
+func (f *failoverRclone) ListTree(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error) {
+	return failover(f, ctx, domain, path, func(remote Rclone) ([]RcloneFile, error) {
+		return remote.ListTree(ctx, path, domain, depth)
+	})
+}
+
+func (f *failoverRclone) Size(ctx context.Context, path string, domain string) (DirectorySize, error) {
+	return failover(f, ctx, domain, path, func(remote Rclone) (DirectorySize, error) {
+		return remote.Size(ctx, path, domain)
+	})
+}
+
+func (f *failoverRclone) Stat(ctx context.Context, path string, domain string) (RcloneFile, error) {
+	return failover(f, ctx, domain, path, func(remote Rclone) (RcloneFile, error) {
+		return remote.Stat(ctx, path, domain)
+	})
+}
+
+// Replicas are read-only copies, writes only go to the primary
+func (f *failoverRclone) WriteFile(ctx context.Context, path string, domain string, data io.Reader) error {
+	return f.storage(0).WriteFile(ctx, path, domain, data)
+}
+
+func (f *failoverRclone) DeleteFile(ctx context.Context, path string, domain string) error {
+	return f.storage(0).DeleteFile(ctx, path, domain)
+}
+
+func (f *failoverRclone) MoveFile(ctx context.Context, src string, dst string, domain string) error {
+	return f.storage(0).MoveFile(ctx, src, dst, domain)
+}
+
+func (f *failoverRclone) CopyFile(ctx context.Context, src string, dst string, domain string) error {
+	return f.storage(0).CopyFile(ctx, src, dst, domain)
+}
+
+func (f *failoverRclone) Mkdir(ctx context.Context, path string, domain string) error {
+	return f.storage(0).Mkdir(ctx, path, domain)
+}
+
+// circuitBreaker opens after consecutive failures of a remote, skipping it for a
+// backoff that doubles with every failure while open
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	backoff   time.Duration // of the last time the circuit opened
+}
+
+// allows reports whether the remote should be tried. Once the backoff of an open circuit
+// expired, one caller probes the remote while the others keep skipping it until the
+// probe reports back, or for another backoff when it never does.
+func (b *circuitBreaker) allows(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	if !b.openUntil.IsZero() {
+		b.openUntil = now.Add(b.backoff)
+	}
+	return true
+}
+
+func (b *circuitBreaker) succeeded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.backoff = 0
+}
+
+// failed records a failure and returns the backoff when it opened the circuit
+func (b *circuitBreaker) failed(now time.Time, options FailoverOptions) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures < options.FailureThreshold {
+		return 0
+	}
+
+	backoff := options.Backoff
+	for i := options.FailureThreshold; i < b.failures && backoff < options.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, options.MaxBackoff)
+	b.openUntil = now.Add(backoff)
+	b.backoff = backoff
+	return backoff
+}
+
+type storageRemoteKey struct{}
+
+// storageRemote holds the remote that served the reads of a request
+type storageRemote struct {
+	mu     sync.Mutex
+	remote string
+}
+
+func recordStorageRemote(ctx context.Context, remote string) {
+	if recorder, ok := ctx.Value(storageRemoteKey{}).(*storageRemote); ok && remote != "" {
+		recorder.mu.Lock()
+		recorder.remote = remote
+		recorder.mu.Unlock()
+	}
+}
+
+func (s *storageRemote) get() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote
+}
+
+// StorageRemoteMiddleware reports the remote that served a request's storage reads in
+// the X-Storage-Remote header
+func StorageRemoteMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &storageRemote{}
+		ctx := context.WithValue(r.Context(), storageRemoteKey{}, recorder)
+		next(&storageRemoteWriter{ResponseWriter: w, recorder: recorder}, r.WithContext(ctx))
+	}
+}
+
+// storageRemoteWriter adds the header once the response starts
+type storageRemoteWriter struct {
+	http.ResponseWriter
+	recorder    *storageRemote
+	wroteHeader bool
+}
+
+func (w *storageRemoteWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if remote := w.recorder.get(); remote != "" {
+			w.Header().Set(StorageRemoteHeader, remote)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *storageRemoteWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *storageRemoteWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
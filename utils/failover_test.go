@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shuto-api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failoverConfig is a domain with two replicas
+var failoverConfig = config.DomainConfig{
+	Rclone:   config.RcloneConfig{Remote: "primary"},
+	Replicas: []config.RcloneConfig{{Remote: "replica"}, {Remote: "archive"}},
+}
+
+func newFailoverFixture(options FailoverOptions) (*remoteFixture, *failoverRclone) {
+	fixture := newRemoteFixture(failoverConfig)
+	return fixture, NewFailoverRclone(fixture.configManager, fixture.newStorage, options).(*failoverRclone)
+}
+
+func unavailable(remote string) error {
+	return storageError(ErrBackendUnavailable, fmt.Errorf("%s: connection refused", remote))
+}
+
+func TestFailover_TriesRemotesInOrder(t *testing.T) {
+	fixture, storage := newFailoverFixture(FailoverOptions{})
+
+	data, err := storage.FetchImage(context.Background(), "a.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "primary", string(data))
+
+	fixture.errors["primary"] = unavailable("primary")
+	fixture.errors["replica"] = storageError(ErrTimeout, context.DeadlineExceeded)
+	fixture.calls = nil
+	data, err = storage.FetchImage(context.Background(), "a.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "archive", string(data))
+	assert.Equal(t, []string{"primary:a.jpg", "replica:a.jpg", "archive:a.jpg"}, fixture.calls)
+
+	fixture.errors["archive"] = unavailable("archive")
+	_, err = storage.FetchImage(context.Background(), "a.jpg", "test")
+	assert.ErrorIs(t, err, ErrBackendUnavailable)
+	assert.EqualError(t, err, "archive: connection refused")
+}
+
+func TestFailover_PathErrorsDontFailOver(t *testing.T) {
+	fixture, storage := newFailoverFixture(FailoverOptions{})
+	fixture.errors["primary"] = storageError(ErrNotFound, fmt.Errorf("object not found"))
+
+	_, err := storage.FetchImage(context.Background(), "missing.jpg", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, []string{"primary:missing.jpg"}, fixture.calls)
+}
+
+func TestFailover_CircuitBreaker(t *testing.T) {
+	fixture, storage := newFailoverFixture(FailoverOptions{FailureThreshold: 2, Backoff: time.Minute, MaxBackoff: 3 * time.Minute})
+	now := time.Now()
+	storage.now = func() time.Time { return now }
+	fixture.errors["primary"] = unavailable("primary")
+
+	fetch := func() []string {
+		fixture.calls = nil
+		data, err := storage.FetchImage(context.Background(), "a.jpg", "test")
+		require.NoError(t, err)
+		assert.Equal(t, "replica", string(data))
+		return fixture.calls
+	}
+
+	// The primary is tried until the threshold opens its circuit
+	assert.Equal(t, []string{"primary:a.jpg", "replica:a.jpg"}, fetch())
+	assert.Equal(t, []string{"primary:a.jpg", "replica:a.jpg"}, fetch())
+	assert.Equal(t, []string{"replica:a.jpg"}, fetch())
+
+	// An expired backoff lets one retry through, failing again doubles it
+	now = now.Add(time.Minute)
+	assert.Equal(t, []string{"primary:a.jpg", "replica:a.jpg"}, fetch())
+	now = now.Add(time.Minute)
+	assert.Equal(t, []string{"replica:a.jpg"}, fetch())
+	now = now.Add(time.Minute)
+	assert.Equal(t, []string{"primary:a.jpg", "replica:a.jpg"}, fetch())
+
+	// The backoff is capped
+	now = now.Add(3 * time.Minute)
+	assert.Equal(t, []string{"primary:a.jpg", "replica:a.jpg"}, fetch())
+
+	// Open remotes are still tried when nothing else is left
+	fixture.errors["replica"] = unavailable("replica")
+	fixture.errors["archive"] = unavailable("archive")
+	fixture.calls = nil
+	_, err := storage.FetchImage(context.Background(), "a.jpg", "test")
+	assert.ErrorIs(t, err, ErrBackendUnavailable)
+	assert.Equal(t, []string{"replica:a.jpg", "archive:a.jpg", "primary:a.jpg"}, fixture.calls)
+
+	// A recovered primary closes its circuit
+	delete(fixture.errors, "primary")
+	now = now.Add(3 * time.Minute)
+	assert.Equal(t, []string{"primary:a.jpg"}, func() []string {
+		fixture.calls = nil
+		_, err := storage.FetchImage(context.Background(), "a.jpg", "test")
+		require.NoError(t, err)
+		return fixture.calls
+	}())
+	assert.True(t, storage.breaker("test", 0).allows(now))
+}
+
+func TestCircuitBreaker_SingleProbe(t *testing.T) {
+	options := FailoverOptions{FailureThreshold: 1, Backoff: time.Minute, MaxBackoff: time.Hour}
+	breaker := &circuitBreaker{}
+	now := time.Now()
+	breaker.failed(now, options)
+	assert.False(t, breaker.allows(now))
+
+	// Once the backoff expired a single caller probes the remote
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allows(now))
+	assert.False(t, breaker.allows(now))
+
+	// A probe that never reports back lets the next one through after another backoff
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allows(now))
+	breaker.succeeded()
+	assert.True(t, breaker.allows(now))
+	assert.True(t, breaker.allows(now))
+}
+
+func TestFailover_WritesGoToPrimary(t *testing.T) {
+	fixture, storage := newFailoverFixture(FailoverOptions{})
+	fixture.errors["primary"] = unavailable("primary")
+
+	require.NoError(t, storage.WriteFile(context.Background(), "a.jpg", "test", strings.NewReader("data")))
+	assert.Equal(t, []string{"primary"}, fixture.writes)
+}
+
+func TestStorageRemoteMiddleware(t *testing.T) {
+	fixture, storage := newFailoverFixture(FailoverOptions{})
+	fixture.errors["primary"] = unavailable("primary")
+
+	handler := StorageRemoteMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		data, err := storage.FetchImage(r.Context(), "a.jpg", "test")
+		if err != nil {
+			WriteStorageError(w, "Failed to fetch", err)
+			return
+		}
+		w.Write(data)
+	})
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/v2/image/a.jpg", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "replica", rec.Header().Get(StorageRemoteHeader))
+
+	// Failed reads don't name a remote
+	fixture.errors["replica"] = unavailable("replica")
+	fixture.errors["archive"] = unavailable("archive")
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/v2/image/a.jpg", nil))
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Empty(t, rec.Header().Get(StorageRemoteHeader))
+}
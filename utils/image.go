@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/davidbyttow/govips/v2/vips"
 )
@@ -22,18 +24,38 @@ type ImageTransformOptions struct {
 	Dpr          float64   // 1.0-3.0
 	Blur         int       // 0-100
 	ForceDownload bool
+	Strip        bool      // drop metadata such as EXIF, not part of the cache key
+}
+
+// CacheKey returns a canonical representation of the options, so that requests
+// resulting in the same output share the same key regardless of parameter order
+func (o ImageTransformOptions) CacheKey() string {
+	fit := o.Fit
+	if fit == "" {
+		fit = "clip"
+	}
+	format := o.Format
+	if format == "jpeg" {
+		format = "jpg"
+	}
+	return fmt.Sprintf("w=%d&h=%d&fit=%s&fm=%s&q=%d&dpr=%s&blur=%d",
+		o.Width, o.Height, fit, format, o.Quality, strconv.FormatFloat(o.Dpr, 'f', -1, 64), o.Blur)
 }
 
 type ImageMetadata struct {
-	Width    int
-	Height   int
-	Keywords []string
+	Width      int
+	Height     int
+	Keywords   []string
+	CapturedAt time.Time // zero when the image has no EXIF capture date
 }
 
+// exifDateTimeOriginal is the libvips field of the EXIF capture date
+const exifDateTimeOriginal = "exif-ifd2-DateTimeOriginal"
+
 // ImageUtils interface for image operations
 type ImageUtils interface {
 	GetMimeType(data []byte) (string, error)
-	TransformImage(imgData []byte, opts ImageTransformOptions) ([]byte, error)
+	TransformImage(ctx context.Context, imgData []byte, opts ImageTransformOptions) ([]byte, error)
 	GetImageMetadata(data []byte) (ImageMetadata, error)
 }
 
@@ -69,7 +91,7 @@ func (iu *imageUtils) GetMimeType(data []byte) (string, error) {
 }
 
 // New function to transform images
-func (iu *imageUtils) TransformImage(imgData []byte, opts ImageTransformOptions) ([]byte, error) {
+func (iu *imageUtils) TransformImage(ctx context.Context, imgData []byte, opts ImageTransformOptions) ([]byte, error) {
 	image, err := vips.NewImageFromBuffer(imgData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read image: %w", err)
@@ -126,13 +148,13 @@ func (iu *imageUtils) TransformImage(imgData []byte, opts ImageTransformOptions)
 
 	switch opts.Format {
 	case "jpg", "jpeg":
-		modifiedImg, _, exportErr = image.ExportJpeg(&vips.JpegExportParams{Quality: opts.Quality})
+		modifiedImg, _, exportErr = image.ExportJpeg(&vips.JpegExportParams{Quality: opts.Quality, StripMetadata: opts.Strip})
 	case "png":
-		modifiedImg, _, exportErr = image.ExportPng(&vips.PngExportParams{})
+		modifiedImg, _, exportErr = image.ExportPng(&vips.PngExportParams{StripMetadata: opts.Strip})
 	case "webp":
-		modifiedImg, _, exportErr = image.ExportWebp(&vips.WebpExportParams{Quality: opts.Quality})
+		modifiedImg, _, exportErr = image.ExportWebp(&vips.WebpExportParams{Quality: opts.Quality, StripMetadata: opts.Strip})
 	default:
-		modifiedImg, _, exportErr = image.ExportJpeg(&vips.JpegExportParams{Quality: opts.Quality})
+		modifiedImg, _, exportErr = image.ExportJpeg(&vips.JpegExportParams{Quality: opts.Quality, StripMetadata: opts.Strip})
 	}
 
 	if exportErr != nil {
@@ -169,11 +191,27 @@ func (iu *imageUtils) GetImageMetadata(data []byte) (ImageMetadata, error) {
 	}
 	defer image.Close()
 
-	return ImageMetadata{
+	metadata := ImageMetadata{
 		Width:    image.Width(),
 		Height:   image.Height(),
 		Keywords: nil, // VIPS doesn't support reading IPTC keywords
-	}, nil
+	}
+	for _, field := range image.ImageFields() {
+		if field == exifDateTimeOriginal {
+			metadata.CapturedAt, _ = parseExifDate(image.GetString(field))
+			break
+		}
+	}
+	return metadata, nil
+}
+
+// parseExifDate parses an EXIF date as formatted by libvips, which follows it with
+// its type in parentheses
+func parseExifDate(value string) (time.Time, error) {
+	if len(value) > 19 {
+		value = value[:19]
+	}
+	return time.Parse("2006:01:02 15:04:05", value)
 }
 
 // IsImageFile checks if a file is an image based on its extension
@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/png"
+	"io"
+)
+
+// ErrIncompleteHeader is returned when the metadata of an image can't be read from the
+// start of its file, either because the header extends past it or the format isn't known
+var ErrIncompleteHeader = errors.New("image header incomplete")
+
+var (
+	jpegSignature = []byte{0xFF, 0xD8}
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	exifSignature = []byte("Exif\x00\x00")
+	psSignature   = []byte("Photoshop 3.0\x00")
+)
+
+// MetadataHeaderSize is the number of bytes read from the start of an image to parse its
+// metadata, enough for the EXIF and IPTC headers of most photos
+const MetadataHeaderSize = 128 * 1024
+
+// ReadImageMetadata parses the metadata from the first MetadataHeaderSize bytes of an
+// image, fetching the whole file only when they don't hold it
+func ReadImageMetadata(ctx context.Context, path string, domain string, imgUtils ImageUtils, rclone Rclone) (ImageMetadata, error) {
+	header, err := readHeader(ctx, path, domain, rclone)
+	if err == nil {
+		metadata, err := ParseImageHeader(header)
+		if err == nil {
+			return metadata, nil
+		}
+		if len(header) < MetadataHeaderSize {
+			// The header is the whole file
+			return imgUtils.GetImageMetadata(header)
+		}
+		Debug("Image header insufficient, fetching the whole file", "path", path, "error", err)
+	} else if errors.Is(err, ErrNotFound) {
+		return ImageMetadata{}, err
+	}
+
+	imgData, err := rclone.FetchImage(ctx, path, domain)
+	if err != nil {
+		return ImageMetadata{}, err
+	}
+	return imgUtils.GetImageMetadata(imgData)
+}
+
+func readHeader(ctx context.Context, path string, domain string, rclone Rclone) ([]byte, error) {
+	stream, err := rclone.OpenRange(ctx, path, domain, 0, MetadataHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(io.LimitReader(stream, MetadataHeaderSize))
+}
+
+// ParseImageHeader reads the dimensions of an image from the first bytes of its file
+// without decoding it, along with the EXIF capture date and IPTC keywords of JPEG files.
+// JPEG, PNG, GIF and WebP are supported, other formats return ErrIncompleteHeader.
+func ParseImageHeader(data []byte) (ImageMetadata, error) {
+	switch {
+	case bytes.HasPrefix(data, jpegSignature):
+		return parseJPEGHeader(data)
+	case bytes.HasPrefix(data, pngSignature), bytes.HasPrefix(data, []byte("GIF8")):
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return ImageMetadata{}, fmt.Errorf("%w: %v", ErrIncompleteHeader, err)
+		}
+		return ImageMetadata{Width: config.Width, Height: config.Height}, nil
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return parseWebPHeader(data)
+	}
+	return ImageMetadata{}, fmt.Errorf("%w: unsupported format", ErrIncompleteHeader)
+}
+
+// parseJPEGHeader walks the segments up to the frame header, reading EXIF from APP1 and
+// IPTC from APP13
+func parseJPEGHeader(data []byte) (ImageMetadata, error) {
+	var metadata ImageMetadata
+	offset := 2
+	for {
+		// Markers may be padded with any number of 0xFF bytes
+		for offset+1 < len(data) && data[offset] == 0xFF && data[offset+1] == 0xFF {
+			offset++
+		}
+		if offset+4 > len(data) {
+			return metadata, ErrIncompleteHeader
+		}
+		if data[offset] != 0xFF {
+			return metadata, fmt.Errorf("%w: invalid JPEG marker", ErrIncompleteHeader)
+		}
+		marker := data[offset+1]
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 {
+			return metadata, fmt.Errorf("%w: invalid JPEG segment", ErrIncompleteHeader)
+		}
+		end := offset + 2 + length
+		if end > len(data) {
+			return metadata, ErrIncompleteHeader
+		}
+		segment := data[offset+4 : end]
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(segment, exifSignature):
+			metadata.CapturedAt, _ = parseExifDate(exifDateTimeOriginalValue(segment[len(exifSignature):]))
+		case marker == 0xED && bytes.HasPrefix(segment, psSignature):
+			metadata.Keywords = iptcKeywords(segment[len(psSignature):])
+		case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			// Start of frame: precision, height, width
+			if len(segment) < 5 {
+				return metadata, fmt.Errorf("%w: invalid JPEG frame header", ErrIncompleteHeader)
+			}
+			metadata.Height = int(binary.BigEndian.Uint16(segment[1:]))
+			metadata.Width = int(binary.BigEndian.Uint16(segment[3:]))
+			return metadata, nil
+		case marker == 0xDA:
+			return metadata, fmt.Errorf("%w: no JPEG frame header", ErrIncompleteHeader)
+		}
+		offset = end
+	}
+}
+
+// exifDateTimeOriginalValue returns the DateTimeOriginal tag of the EXIF sub-IFD of a
+// TIFF structure, empty when it's missing
+func exifDateTimeOriginalValue(tiff []byte) string {
+	if len(tiff) < 8 {
+		return ""
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return ""
+	}
+
+	// entry returns the value offset field of a tag in the IFD at offset
+	entry := func(ifd uint32, tag uint16) ([]byte, bool) {
+		if int(ifd)+2 > len(tiff) {
+			return nil, false
+		}
+		count := int(order.Uint16(tiff[ifd:]))
+		for i := 0; i < count; i++ {
+			start := int(ifd) + 2 + i*12
+			if start+12 > len(tiff) {
+				return nil, false
+			}
+			if order.Uint16(tiff[start:]) == tag {
+				return tiff[start : start+12], true
+			}
+		}
+		return nil, false
+	}
+
+	pointer, ok := entry(order.Uint32(tiff[4:]), 0x8769)
+	if !ok {
+		return ""
+	}
+	value, ok := entry(order.Uint32(pointer[8:]), 0x9003)
+	if !ok {
+		return ""
+	}
+	count := int(order.Uint32(value[4:]))
+	offset := int(order.Uint32(value[8:]))
+	if count <= 4 || offset+count > len(tiff) {
+		return ""
+	}
+	return string(bytes.TrimRight(tiff[offset:offset+count], "\x00"))
+}
+
+// iptcKeywords returns the keywords of the IPTC resource of Photoshop image resources
+func iptcKeywords(resources []byte) []string {
+	var keywords []string
+	for len(resources) >= 12 && string(resources[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(resources[4:])
+		// Pascal string name, padded to an even length including its length byte
+		nameLength := int(resources[6]) + 1
+		nameLength += nameLength % 2
+		if 6+nameLength+4 > len(resources) {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(resources[6+nameLength:]))
+		start := 6 + nameLength + 4
+		if start+size > len(resources) {
+			break
+		}
+		if id == 0x0404 {
+			keywords = append(keywords, iimKeywords(resources[start:start+size])...)
+		}
+		resources = resources[min(start+size+size%2, len(resources)):]
+	}
+	return keywords
+}
+
+// iimKeywords returns the keywords (dataset 2:25) of IPTC IIM records
+func iimKeywords(records []byte) []string {
+	var keywords []string
+	for len(records) >= 5 && records[0] == 0x1C {
+		size := int(binary.BigEndian.Uint16(records[3:]))
+		if size&0x8000 != 0 || 5+size > len(records) {
+			break // extended datasets aren't used for keywords
+		}
+		if records[1] == 2 && records[2] == 25 {
+			keywords = append(keywords, string(records[5:5+size]))
+		}
+		records = records[5+size:]
+	}
+	return keywords
+}
+
+// parseWebPHeader reads the canvas size from the first chunk of a WebP file
+func parseWebPHeader(data []byte) (ImageMetadata, error) {
+	if len(data) < 30 {
+		return ImageMetadata{}, ErrIncompleteHeader
+	}
+	chunk := data[12:]
+	payload := chunk[8:]
+	switch string(chunk[:4]) {
+	case "VP8X":
+		// 24 bit canvas width and height minus one
+		width := int(payload[4]) | int(payload[5])<<8 | int(payload[6])<<16
+		height := int(payload[7]) | int(payload[8])<<8 | int(payload[9])<<16
+		return ImageMetadata{Width: width + 1, Height: height + 1}, nil
+	case "VP8 ":
+		// Key frame start code followed by 14 bit width and height
+		if !bytes.Equal(payload[3:6], []byte{0x9D, 0x01, 0x2A}) {
+			return ImageMetadata{}, fmt.Errorf("%w: invalid VP8 frame", ErrIncompleteHeader)
+		}
+		width := int(binary.LittleEndian.Uint16(payload[6:])) & 0x3FFF
+		height := int(binary.LittleEndian.Uint16(payload[8:])) & 0x3FFF
+		return ImageMetadata{Width: width, Height: height}, nil
+	case "VP8L":
+		// Signature byte followed by 14 bit width and height minus one
+		if payload[0] != 0x2F {
+			return ImageMetadata{}, fmt.Errorf("%w: invalid VP8L header", ErrIncompleteHeader)
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:])
+		return ImageMetadata{Width: int(bits&0x3FFF) + 1, Height: int(bits>>14&0x3FFF) + 1}, nil
+	}
+	return ImageMetadata{}, fmt.Errorf("%w: unknown WebP chunk", ErrIncompleteHeader)
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jpegSegment encodes a JPEG marker segment
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// exifSegment builds an APP1 segment whose EXIF sub-IFD holds a DateTimeOriginal
+func exifSegment(order binary.ByteOrder, date string) []byte {
+	tiff := make([]byte, 44)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	// IFD0 pointing to the EXIF sub-IFD
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x8769)
+	order.PutUint16(tiff[12:], 4)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint32(tiff[18:], 26)
+	// EXIF sub-IFD with DateTimeOriginal
+	order.PutUint16(tiff[26:], 1)
+	order.PutUint16(tiff[28:], 0x9003)
+	order.PutUint16(tiff[30:], 2)
+	order.PutUint32(tiff[32:], uint32(len(date)+1))
+	order.PutUint32(tiff[36:], 44)
+	tiff = append(tiff, date...)
+	tiff = append(tiff, 0)
+	return jpegSegment(0xE1, append([]byte("Exif\x00\x00"), tiff...))
+}
+
+// iptcSegment builds an APP13 segment with IPTC keywords and a caption
+func iptcSegment(keywords ...string) []byte {
+	var records []byte
+	dataset := func(number byte, value string) {
+		records = append(records, 0x1C, 2, number, byte(len(value)>>8), byte(len(value)))
+		records = append(records, value...)
+	}
+	dataset(120, "A caption")
+	for _, keyword := range keywords {
+		dataset(25, keyword)
+	}
+
+	resources := []byte("Photoshop 3.0\x00")
+	// An unrelated resource with a name, then the IPTC resource
+	resources = append(resources, "8BIM\x04\x0c\x03abc\x00\x00\x00\x01x\x00"...)
+	resources = append(resources, "8BIM\x04\x04\x00\x00"...)
+	resources = binary.BigEndian.AppendUint32(resources, uint32(len(records)))
+	resources = append(resources, records...)
+	return jpegSegment(0xED, resources)
+}
+
+func encodedImage(t *testing.T, encode func(*bytes.Buffer, image.Image) error) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30))))
+	return buf.Bytes()
+}
+
+func TestParseImageHeader(t *testing.T) {
+	plainJPEG := encodedImage(t, func(buf *bytes.Buffer, img image.Image) error { return jpeg.Encode(buf, img, nil) })
+	withSegments := func(segments ...[]byte) []byte {
+		data := append([]byte{}, plainJPEG[:2]...)
+		for _, segment := range segments {
+			data = append(data, segment...)
+		}
+		return append(data, plainJPEG[2:]...)
+	}
+
+	webp := func(chunk string, payload []byte) []byte {
+		data := []byte("RIFF\x00\x00\x00\x00WEBP" + chunk)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(payload)))
+		return append(data, append(payload, make([]byte, 16)...)...)
+	}
+	vp8l := binary.LittleEndian.AppendUint32([]byte{0x2F}, 39|29<<14)
+	vp8 := []byte{0, 0, 0, 0x9D, 0x01, 0x2A, 40, 0, 30, 0}
+	vp8x := []byte{0, 0, 0, 0, 39, 0, 0, 29, 0, 0}
+
+	captured := time.Date(2024, 5, 17, 14, 3, 21, 0, time.UTC)
+	tests := []struct {
+		name     string
+		data     []byte
+		expected ImageMetadata
+	}{
+		{"JPEG", plainJPEG, ImageMetadata{Width: 40, Height: 30}},
+		{"JPEG with EXIF and IPTC", withSegments(exifSegment(binary.LittleEndian, "2024:05:17 14:03:21"), iptcSegment("sunset", "beach")),
+			ImageMetadata{Width: 40, Height: 30, CapturedAt: captured, Keywords: []string{"sunset", "beach"}}},
+		{"JPEG with big endian EXIF", withSegments(exifSegment(binary.BigEndian, "2024:05:17 14:03:21")), ImageMetadata{Width: 40, Height: 30, CapturedAt: captured}},
+		{"PNG", encodedImage(t, func(buf *bytes.Buffer, img image.Image) error { return png.Encode(buf, img) }), ImageMetadata{Width: 40, Height: 30}},
+		{"GIF", encodedImage(t, func(buf *bytes.Buffer, img image.Image) error { return gif.Encode(buf, img, nil) }), ImageMetadata{Width: 40, Height: 30}},
+		{"Lossless WebP", webp("VP8L", vp8l), ImageMetadata{Width: 40, Height: 30}},
+		{"Lossy WebP", webp("VP8 ", vp8), ImageMetadata{Width: 40, Height: 30}},
+		{"Extended WebP", webp("VP8X", vp8x), ImageMetadata{Width: 40, Height: 30}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata, err := ParseImageHeader(tt.data)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, metadata)
+		})
+	}
+
+	// Headers cut before the frame header and unknown formats need the whole file
+	big := withSegments(jpegSegment(0xE1, make([]byte, 60000)))
+	for _, data := range [][]byte{big[:1000], plainJPEG[:10], []byte("BM\x00\x00\x00\x00"), webp("VP8L", vp8l)[:20]} {
+		_, err := ParseImageHeader(data)
+		assert.ErrorIs(t, err, ErrIncompleteHeader)
+	}
+}
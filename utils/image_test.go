@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestGetMimeType(t *testing.T) {
@@ -62,7 +64,7 @@ func TestTransformImage(t *testing.T) {
 				t.Fatalf("failed to read image file: %v", err)
 			}
 			
-			modifiedImg, err := imageUtils.TransformImage(imgData, tt.opts)
+			modifiedImg, err := imageUtils.TransformImage(context.Background(), imgData, tt.opts)
 			if (err != nil) != tt.expectError {
 				t.Fatalf("TransformImage() returned an error: %v, expected error: %v", err, tt.expectError)
 			}
@@ -114,3 +116,28 @@ func TestGetImageDimensions(t *testing.T) {
 		})
 	}
 }
+
+func TestParseExifDate(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    time.Time
+		expectError bool
+	}{
+		{"2024:05:17 14:03:21 (2024:05:17 14:03:21, ASCII, 20 components, 20 bytes)", time.Date(2024, 5, 17, 14, 3, 21, 0, time.UTC), false},
+		{"2024:05:17 14:03:21", time.Date(2024, 5, 17, 14, 3, 21, 0, time.UTC), false},
+		{"    :  :     :  :   ", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseExifDate(tt.value)
+			if (err != nil) != tt.expectError {
+				t.Fatalf("parseExifDate() returned an error: %v, expected error: %v", err, tt.expectError)
+			}
+			if !got.Equal(tt.expected) {
+				t.Errorf("parseExifDate() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"shuto-api/config"
+)
+
+// Defaults of IndexerOptions
+const (
+	DefaultIndexWorkers       = 4
+	DefaultIndexCheckInterval = time.Minute
+)
+
+// IndexerOptions configures an Indexer
+type IndexerOptions struct {
+	// Workers bounds the images whose metadata is read at the same time
+	Workers int
+	// CheckInterval is how often the domains are checked for a due crawl and changes
+	// are saved
+	CheckInterval time.Duration
+	// ReadMetadata reads the metadata of an image
+	ReadMetadata func(ctx context.Context, path string, domain string) (ImageMetadata, error)
+}
+
+// indexChange is a path reported to Changed
+type indexChange struct {
+	domain string
+	path   string
+}
+
+// Indexer crawls the domains with search.index set into a MetadataIndex. Domains are
+// crawled again once their interval passed, reading the metadata of new and changed
+// images only, and changes reported in between are applied as they come in.
+type Indexer struct {
+	index         *MetadataIndex
+	rclone        Rclone
+	configManager config.DomainConfigManager
+	domains       config.DomainLister
+	options       IndexerOptions
+
+	changes   chan indexChange
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewIndexer creates an Indexer listing the domains' remotes through rclone, crawling
+// in the background until it's closed
+func NewIndexer(index *MetadataIndex, rclone Rclone, configManager config.DomainConfigManager, domains config.DomainLister, options IndexerOptions) *Indexer {
+	if options.Workers <= 0 {
+		options.Workers = DefaultIndexWorkers
+	}
+	if options.CheckInterval <= 0 {
+		options.CheckInterval = DefaultIndexCheckInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i := &Indexer{
+		index:         index,
+		rclone:        rclone,
+		configManager: configManager,
+		domains:       domains,
+		options:       options,
+		changes:       make(chan indexChange, 1000),
+		cancel:        cancel,
+	}
+	i.wg.Add(2)
+	go i.crawlLoop(ctx)
+	go i.changeLoop(ctx)
+	return i
+}
+
+// Close stops crawling and saves the index
+func (i *Indexer) Close() {
+	i.closeOnce.Do(func() {
+		i.cancel()
+		i.wg.Wait()
+		if err := i.index.Save(); err != nil {
+			Error("Failed to save search index", "error", err)
+		}
+	})
+}
+
+// Changed reports a file that changed or disappeared. Changes are dropped when too
+// many are pending, the next crawl catches up with them.
+func (i *Indexer) Changed(domain string, path string) {
+	select {
+	case i.changes <- indexChange{domain: domain, path: path}:
+	default:
+		Debug("Search index change dropped", "domain", domain, "path", path)
+	}
+}
+
+func (i *Indexer) crawlLoop(ctx context.Context) {
+	defer i.wg.Done()
+	ticker := time.NewTicker(i.options.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		i.crawlDue(ctx)
+		if err := i.index.Save(); err != nil {
+			Error("Failed to save search index", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (i *Indexer) changeLoop(ctx context.Context) {
+	defer i.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-i.changes:
+			i.apply(ctx, change)
+		}
+	}
+}
+
+// settings returns the search settings of domain, false when it isn't indexed
+func (i *Indexer) settings(domain string) (config.DomainConfig, config.SearchSettings, bool) {
+	cfg, err := i.configManager.GetDomainConfig(domain)
+	if err != nil || !cfg.Search.Index {
+		return cfg, config.SearchSettings{}, false
+	}
+	return cfg, cfg.Search.WithDefaults(), true
+}
+
+// crawlDue crawls the indexed domains whose interval passed since their last crawl
+func (i *Indexer) crawlDue(ctx context.Context) {
+	domains, err := i.domains.Domains()
+	if err != nil {
+		Error("Failed to list domains to index", "error", err)
+		return
+	}
+	for _, domain := range domains {
+		if ctx.Err() != nil {
+			return
+		}
+		_, settings, ok := i.settings(domain)
+		if !ok || time.Since(i.index.IndexedAt(domain)) < settings.Interval {
+			continue
+		}
+		if err := i.Crawl(ctx, domain); err != nil {
+			Error("Failed to index domain", "domain", domain, "error", err)
+		}
+	}
+}
+
+// Crawl lists every directory of domain and replaces its index with the files found.
+// The metadata of files whose ModTime and size are unchanged is kept, and changes applied
+// while crawling are kept over what the crawl found. A failed crawl leaves the index as
+// it was.
+func (i *Indexer) Crawl(ctx context.Context, domain string) error {
+	cfg, err := i.configManager.GetDomainConfig(domain)
+	if err != nil {
+		return err
+	}
+	trash := strings.Trim(cfg.Uploads.Trash, "/")
+
+	i.index.startCrawl(domain)
+	defer i.index.endCrawl(domain)
+
+	started := time.Now()
+	var files []IndexedFile
+	var unread []int // files whose metadata is read
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		listed, err := i.rclone.ListPath(ctx, dir, domain)
+		if errors.Is(err, ErrNotFound) && dir != "" {
+			continue // removed while crawling
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, file := range listed {
+			path := listedPath(dir, file)
+			if file.IsDir {
+				if path != trash {
+					dirs = append(dirs, path)
+				}
+				continue
+			}
+			indexed, ok := i.index.File(domain, path)
+			if ok && indexed.ModTime == file.ModTime && indexed.Size == file.Size {
+				files = append(files, indexed)
+				continue
+			}
+			files = append(files, IndexedFile{Path: path, Size: file.Size, ModTime: file.ModTime, MimeType: file.MimeType})
+			if strings.HasPrefix(file.MimeType, "image/") {
+				unread = append(unread, len(files)-1)
+			}
+		}
+	}
+
+	i.readMetadata(ctx, domain, files, unread)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	i.index.Replace(domain, files, time.Now())
+
+	Info("Domain indexed", "domain", domain, "files", len(files), "read", len(unread), "duration", time.Since(started))
+	return nil
+}
+
+// readMetadata reads the metadata of the files at the indices unread with a bounded pool
+// of workers. Files whose metadata can't be read are indexed without it.
+func (i *Indexer) readMetadata(ctx context.Context, domain string, files []IndexedFile, unread []int) {
+	jobs := make(chan *IndexedFile)
+	var wg sync.WaitGroup
+	for w := 0; w < i.options.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				withMetadata(file, i.readFileMetadata(ctx, domain, file.Path))
+			}
+		}()
+	}
+
+	for _, n := range unread {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- &files[n]
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (i *Indexer) readFileMetadata(ctx context.Context, domain string, path string) *ImageMetadata {
+	metadata, err := i.options.ReadMetadata(ctx, path, domain)
+	if err != nil {
+		Debug("Failed to read metadata to index", "domain", domain, "path", path, "error", err)
+		return nil
+	}
+	return &metadata
+}
+
+func withMetadata(file *IndexedFile, metadata *ImageMetadata) {
+	if metadata == nil {
+		return
+	}
+	file.Width = metadata.Width
+	file.Height = metadata.Height
+	file.CapturedAt = metadata.CapturedAt
+	file.Keywords = metadata.Keywords
+}
+
+// apply updates the index of a changed file, dropping it and anything below it when
+// it's gone. Directories are left to the next crawl, and domains that haven't been
+// crawled yet to their first crawl unless it's running.
+func (i *Indexer) apply(ctx context.Context, change indexChange) {
+	if _, _, ok := i.settings(change.domain); !ok || (i.index.IndexedAt(change.domain).IsZero() && !i.index.crawling(change.domain)) {
+		return
+	}
+
+	file, err := i.rclone.Stat(ctx, change.path, change.domain)
+	if errors.Is(err, ErrNotFound) {
+		i.index.Remove(change.domain, change.path)
+		return
+	}
+	if err != nil {
+		Debug("Failed to stat changed file to index", "domain", change.domain, "path", change.path, "error", err)
+		return
+	}
+	if file.IsDir {
+		return
+	}
+
+	indexed, ok := i.index.File(change.domain, change.path)
+	if ok && indexed.ModTime == file.ModTime && indexed.Size == file.Size {
+		return
+	}
+	indexed = IndexedFile{Path: change.path, Size: file.Size, ModTime: file.ModTime, MimeType: file.MimeType}
+	if strings.HasPrefix(file.MimeType, "image/") {
+		withMetadata(&indexed, i.readFileMetadata(ctx, change.domain, change.path))
+	}
+	i.index.Put(change.domain, indexed)
+}
@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shuto-api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// indexerFixture is a remote of one domain whose files can be changed between crawls
+type indexerFixture struct {
+	mu    sync.Mutex
+	files map[string]RcloneFile // full path -> file
+	reads []string
+}
+
+func (f *indexerFixture) rclone() *MockRclone {
+	return &MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			var listed []RcloneFile
+			dirs := map[string]bool{}
+			for filePath, file := range f.files {
+				rel := filePath
+				if path != "" {
+					var ok bool
+					if rel, ok = strings.CutPrefix(filePath, path+"/"); !ok {
+						continue
+					}
+				}
+				if name, _, nested := strings.Cut(rel, "/"); nested {
+					if !dirs[name] {
+						dirs[name] = true
+						listed = append(listed, RcloneFile{Path: name, Name: name, IsDir: true})
+					}
+					continue
+				}
+				file.Path = rel
+				listed = append(listed, file)
+			}
+			if len(listed) == 0 && path != "" {
+				return nil, storageError(ErrNotFound, fmt.Errorf("directory not found"))
+			}
+			return listed, nil
+		},
+		StatFunc: func(ctx context.Context, path string, domain string) (RcloneFile, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			file, ok := f.files[path]
+			if !ok {
+				return RcloneFile{}, storageError(ErrNotFound, fmt.Errorf("object not found"))
+			}
+			return file, nil
+		},
+	}
+}
+
+func (f *indexerFixture) readMetadata(ctx context.Context, path string, domain string) (ImageMetadata, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reads = append(f.reads, path)
+	return ImageMetadata{Width: 40, Height: 30, Keywords: []string{"launch"}}, nil
+}
+
+func (f *indexerFixture) takeReads() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reads := f.reads
+	f.reads = nil
+	return reads
+}
+
+func TestIndexer(t *testing.T) {
+	fixture := &indexerFixture{files: map[string]RcloneFile{
+		"a.jpg":              {Size: 1, ModTime: "2024-01-01T00:00:00Z", MimeType: "image/jpeg"},
+		"notes.txt":          {Size: 2, ModTime: "2024-01-01T00:00:00Z", MimeType: "text/plain"},
+		"2024/launch.jpg":    {Size: 3, ModTime: "2024-01-01T00:00:00Z", MimeType: "image/jpeg"},
+		"2024/may/b.png":     {Size: 4, ModTime: "2024-01-01T00:00:00Z", MimeType: "image/png"},
+		".trash/deleted.jpg": {Size: 5, ModTime: "2024-01-01T00:00:00Z", MimeType: "image/jpeg"},
+	}}
+	configManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Search:  config.SearchSettings{Index: domain == "example.com", Interval: time.Hour},
+				Uploads: config.UploadSettings{Trash: ".trash"},
+			}, nil
+		},
+		DomainsFunc: func() ([]string, error) {
+			return []string{"example.com", "other.com"}, nil
+		},
+	}
+	index, err := NewMetadataIndex(t.TempDir())
+	require.NoError(t, err)
+	indexer := NewIndexer(index, fixture.rclone(), configManager, configManager, IndexerOptions{
+		CheckInterval: time.Hour,
+		ReadMetadata:  fixture.readMetadata,
+	})
+	defer indexer.Close()
+
+	// The first check crawls the indexed domains right away
+	require.Eventually(t, func() bool {
+		_, _, ok := index.Files("example.com")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	_, _, ok := index.Files("other.com")
+	assert.False(t, ok, "domains without search.index aren't crawled")
+
+	files, _, _ := index.Files("example.com")
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	assert.Equal(t, []string{"2024/launch.jpg", "2024/may/b.png", "a.jpg", "notes.txt"}, paths, "the trash isn't indexed")
+	assert.Equal(t, IndexedFile{Path: "2024/launch.jpg", Size: 3, ModTime: "2024-01-01T00:00:00Z", MimeType: "image/jpeg", Width: 40, Height: 30, Keywords: []string{"launch"}}, files[0])
+	assert.ElementsMatch(t, []string{"2024/launch.jpg", "2024/may/b.png", "a.jpg"}, fixture.takeReads())
+
+	// Crawling again only reads new and changed images
+	fixture.mu.Lock()
+	fixture.files["a.jpg"] = RcloneFile{Size: 10, ModTime: "2024-02-01T00:00:00Z", MimeType: "image/jpeg"}
+	fixture.files["2024/new.jpg"] = RcloneFile{Size: 6, ModTime: "2024-02-01T00:00:00Z", MimeType: "image/jpeg"}
+	delete(fixture.files, "notes.txt")
+	fixture.mu.Unlock()
+	require.NoError(t, indexer.Crawl(context.Background(), "example.com"))
+	assert.ElementsMatch(t, []string{"a.jpg", "2024/new.jpg"}, fixture.takeReads())
+	_, ok = index.File("example.com", "notes.txt")
+	assert.False(t, ok)
+	file, _ := index.File("example.com", "a.jpg")
+	assert.Equal(t, int64(10), file.Size)
+
+	// Changes are applied between crawls
+	fixture.mu.Lock()
+	fixture.files["2024/may/c.jpg"] = RcloneFile{Size: 7, ModTime: "2024-03-01T00:00:00Z", MimeType: "image/jpeg"}
+	delete(fixture.files, "2024/launch.jpg")
+	fixture.mu.Unlock()
+	indexer.Changed("example.com", "2024/may/c.jpg")
+	indexer.Changed("example.com", "2024/launch.jpg")
+	indexer.Changed("other.com", "2024/may/c.jpg")
+	require.Eventually(t, func() bool {
+		_, added := index.File("example.com", "2024/may/c.jpg")
+		_, kept := index.File("example.com", "2024/launch.jpg")
+		return added && !kept
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"2024/may/c.jpg"}, fixture.takeReads())
+
+	// A failed crawl keeps the index
+	failing := fixture.rclone()
+	failing.ListPathFunc = func(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+		return nil, fmt.Errorf("remote unavailable")
+	}
+	broken := NewIndexer(index, failing, configManager, configManager, IndexerOptions{CheckInterval: time.Hour, ReadMetadata: fixture.readMetadata})
+	defer broken.Close()
+	assert.Error(t, broken.Crawl(context.Background(), "example.com"))
+	_, ok = index.File("example.com", "2024/may/c.jpg")
+	assert.True(t, ok)
+}
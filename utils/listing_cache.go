@@ -0,0 +1,414 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"shuto-api/config"
+)
+
+// DefaultListingCacheSize is the number of listings cached when no size is given
+const DefaultListingCacheSize = 10000
+
+const (
+	// DefaultPollConcurrency is the number of listings polled at once when none is given
+	DefaultPollConcurrency = 4
+	// DefaultPollBudget is the number of listings polled per cycle when none is given
+	DefaultPollBudget = 1000
+)
+
+// ListingCacheOptions configures a ListingCache
+type ListingCacheOptions struct {
+	// MaxEntries bounds the number of cached listings of all domains
+	MaxEntries int
+	// PollInterval is how often cached listings are listed again to detect changes
+	// made outside the API, 0 disables polling
+	PollInterval time.Duration
+	// PollConcurrency bounds the number of listings polled at once
+	PollConcurrency int
+	// PollBudget bounds the number of listings polled per cycle, the most recently used
+	// are polled first
+	PollBudget int
+	// OnChange is called with the paths of files found changed or gone by polling, to
+	// drop what was derived from them. Writers report their own changes.
+	OnChange func(domain string, path string)
+}
+
+// ListingCache serves directory listings from memory for the listing TTL of a domain,
+// and past it for the domain's stale time while they are refreshed in the background.
+// Writes through it drop the listings they affect. Listings of single files aren't
+// cached, Stat answers from the cached listing of the parent directory instead. Cached
+// listings are shared, callers must not modify them.
+type ListingCache struct {
+	next          Rclone
+	configManager config.DomainConfigManager
+	options       ListingCacheOptions
+	cache         *Cache[[]RcloneFile]
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListingCache creates a ListingCache over next, polling for changes in the
+// background until it's closed
+func NewListingCache(configManager config.DomainConfigManager, next Rclone, options ListingCacheOptions) (*ListingCache, error) {
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = DefaultListingCacheSize
+	}
+	if options.PollConcurrency <= 0 {
+		options.PollConcurrency = DefaultPollConcurrency
+	}
+	if options.PollBudget <= 0 {
+		options.PollBudget = DefaultPollBudget
+	}
+	cache, err := NewCache[[]RcloneFile](CacheOptions{MaxSize: options.MaxEntries})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &ListingCache{
+		next:          next,
+		configManager: configManager,
+		options:       options,
+		cache:         cache,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if options.PollInterval > 0 {
+		go l.pollLoop()
+	} else {
+		close(l.done)
+	}
+	return l, nil
+}
+
+// Close stops the poller
+func (l *ListingCache) Close() {
+	l.closeOnce.Do(func() { close(l.stop) })
+	<-l.done
+}
+
+func listingKey(domain string, path string) string {
+	return domain + "|" + path
+}
+
+// treeKey keys the tree of path listed down to depth
+func treeKey(domain string, path string, depth int) string {
+	return listingKey(domain, path) + "\x00" + strconv.Itoa(depth)
+}
+
+// parseKey returns the domain, path and tree depth of a key, depth is -1 for listings
+func parseKey(key string) (string, string, int) {
+	domain, path, _ := strings.Cut(key, "|")
+	path, depth, ok := strings.Cut(path, "\x00")
+	if !ok {
+		return domain, path, -1
+	}
+	n, _ := strconv.Atoi(depth)
+	return domain, path, n
+}
+
+// settings returns the cache settings of domain, false when its listings aren't cached
+func (l *ListingCache) settings(domain string) (config.CacheSettings, bool) {
+	cfg, err := l.configManager.GetDomainConfig(domain)
+	if err != nil || cfg.Cache.DisableListing {
+		return config.CacheSettings{}, false
+	}
+	return cfg.Cache.WithDefaults(), true
+}
+
+func (l *ListingCache) ListPath(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+	settings, ok := l.settings(domain)
+	if !ok {
+		return l.next.ListPath(ctx, path, domain)
+	}
+
+	// The listing outlives the request in the cache, don't let a disconnect abort it
+	listCtx := context.WithoutCancel(ctx)
+	return l.cache.GetCached(GetCachedOptions{
+		Key:       listingKey(domain, path),
+		TTL:       settings.ListingTTL,
+		StaleTime: settings.ListingTTL + settings.ListingStale,
+		GetFreshValue: func() (interface{}, error) {
+			return l.next.ListPath(listCtx, path, domain)
+		},
+		Cacheable: func(value interface{}) bool {
+			return !IsFileListing(path, value.([]RcloneFile))
+		},
+	})
+}
+
+// IsFileListing reports whether files may be the listing of the file at path rather
+// than of a directory holding a single file of the same name, only a Stat tells
+func IsFileListing(path string, files []RcloneFile) bool {
+	return len(files) == 1 && !files[0].IsDir && files[0].Path == baseName(path)
+}
+
+func (l *ListingCache) ListTree(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error) {
+	settings, ok := l.settings(domain)
+	if !ok {
+		return l.next.ListTree(ctx, path, domain, depth)
+	}
+
+	listCtx := context.WithoutCancel(ctx)
+	return l.cache.GetCached(GetCachedOptions{
+		Key:       treeKey(domain, path, depth),
+		TTL:       settings.ListingTTL,
+		StaleTime: settings.ListingTTL + settings.ListingStale,
+		GetFreshValue: func() (interface{}, error) {
+			return l.next.ListTree(listCtx, path, domain, depth)
+		},
+		Cacheable: func(value interface{}) bool {
+			return !IsFileListing(path, value.([]RcloneFile))
+		},
+	})
+}
+
+func (l *ListingCache) FetchImage(ctx context.Context, path string, domain string) ([]byte, error) {
+	return l.next.FetchImage(ctx, path, domain)
+}
+
+func (l *ListingCache) Open(ctx context.Context, path string, domain string) (*FileStream, error) {
+	return l.next.Open(ctx, path, domain)
+}
+
+func (l *ListingCache) OpenRange(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+	return l.next.OpenRange(ctx, path, domain, offset, count)
+}
+
+// Size isn't cached, callers cache the aggregates they compute from it
+func (l *ListingCache) Size(ctx context.Context, path string, domain string) (DirectorySize, error) {
+	return l.next.Size(ctx, path, domain)
+}
+
+func (l *ListingCache) Stat(ctx context.Context, path string, domain string) (RcloneFile, error) {
+	if _, ok := l.settings(domain); ok && path != "" {
+		if files, ok := l.cache.Get(listingKey(domain, parentDir(path))); ok {
+			name := baseName(path)
+			for _, file := range files {
+				if file.Path == name {
+					file.Path = path
+					return file, nil
+				}
+			}
+		}
+	}
+	return l.next.Stat(ctx, path, domain)
+}
+
+// Failed writes may still have changed the remote, so they drop the listings too
+func (l *ListingCache) WriteFile(ctx context.Context, path string, domain string, data io.Reader) error {
+	err := l.next.WriteFile(ctx, path, domain, data)
+	l.changed(domain, path)
+	return err
+}
+
+func (l *ListingCache) DeleteFile(ctx context.Context, path string, domain string) error {
+	err := l.next.DeleteFile(ctx, path, domain)
+	l.changed(domain, path)
+	return err
+}
+
+func (l *ListingCache) MoveFile(ctx context.Context, src string, dst string, domain string) error {
+	err := l.next.MoveFile(ctx, src, dst, domain)
+	l.changed(domain, src, dst)
+	return err
+}
+
+func (l *ListingCache) CopyFile(ctx context.Context, src string, dst string, domain string) error {
+	err := l.next.CopyFile(ctx, src, dst, domain)
+	l.changed(domain, dst)
+	return err
+}
+
+func (l *ListingCache) Mkdir(ctx context.Context, path string, domain string) error {
+	err := l.next.Mkdir(ctx, path, domain)
+	l.changed(domain, path)
+	return err
+}
+
+// changed drops the listings of paths and of all their parents, which may have gained
+// a directory, and the trees containing them
+func (l *ListingCache) changed(domain string, paths ...string) {
+	for _, path := range paths {
+		l.cache.Invalidate(listingKey(domain, path))
+		for dir := path; dir != ""; {
+			dir = parentDir(dir)
+			l.cache.Invalidate(listingKey(domain, dir))
+		}
+		l.invalidateTrees(domain, path, "")
+	}
+}
+
+// invalidateTrees drops the cached trees of domain containing path, except keep
+func (l *ListingCache) invalidateTrees(domain string, path string, keep string) {
+	for _, key := range l.cache.Keys() {
+		keyDomain, dir, depth := parseKey(key)
+		if key != keep && depth >= 0 && keyDomain == domain && (dir == "" || dir == path || strings.HasPrefix(path, dir+"/")) {
+			l.cache.Invalidate(key)
+		}
+	}
+}
+
+func (l *ListingCache) reportChange(domain string, path string) {
+	if l.options.OnChange != nil {
+		l.options.OnChange(domain, path)
+	}
+}
+
+func (l *ListingCache) pollLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.options.PollInterval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-l.stop
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			// A slow cycle gives up rather than running into the next one
+			cycleCtx, cancelCycle := context.WithTimeout(ctx, l.options.PollInterval)
+			l.Poll(cycleCtx)
+			cancelCycle()
+		}
+	}
+}
+
+// Poll lists the cached directories and bounded trees again, at most PollBudget of
+// them, the most recently used first, PollConcurrency at a time. Changed listings are
+// replaced, files whose ModTime or size changed and files that disappeared are reported
+// to OnChange. Unbounded trees are never polled, they expire or are dropped when a change
+// is detected in them through a polled listing.
+func (l *ListingCache) Poll(ctx context.Context) {
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < l.options.PollConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				l.pollKey(ctx, key)
+			}
+		}()
+	}
+	defer func() {
+		close(keys)
+		wg.Wait()
+	}()
+
+	cached := l.cache.Keys()
+	budget := l.options.PollBudget
+	for i := len(cached) - 1; i >= 0 && budget > 0; i-- {
+		if _, _, depth := parseKey(cached[i]); depth == 0 {
+			continue
+		}
+		select {
+		case keys <- cached[i]:
+			budget--
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *ListingCache) pollKey(ctx context.Context, key string) {
+	if ctx.Err() != nil {
+		return
+	}
+	generation := l.cache.Generation(key)
+	cached, ok := l.cache.Peek(key)
+	if !ok {
+		return
+	}
+	domain, dir, depth := parseKey(key)
+	settings, ok := l.settings(domain)
+	if !ok {
+		l.cache.Invalidate(key)
+		return
+	}
+
+	var fresh []RcloneFile
+	var err error
+	if depth >= 0 {
+		fresh, err = l.next.ListTree(ctx, dir, domain, depth)
+	} else {
+		fresh, err = l.next.ListPath(ctx, dir, domain)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		Debug("Failed to poll listing", "domain", domain, "path", dir, "error", err)
+		return
+	}
+
+	// A write invalidating the key while it was listed wins over the polled listing
+	changedFiles, listingChanged := diffListings(dir, cached, fresh)
+	if errors.Is(err, ErrNotFound) {
+		l.cache.Invalidate(key)
+	} else if listingChanged {
+		l.cache.SetIfCurrent(key, generation, fresh, settings.ListingTTL, settings.ListingTTL+settings.ListingStale)
+	}
+	for _, path := range changedFiles {
+		Info("Detected changed file", "domain", domain, "path", path)
+		if path != dir {
+			l.cache.Invalidate(listingKey(domain, path))
+		}
+		l.invalidateTrees(domain, path, key)
+		l.reportChange(domain, path)
+	}
+}
+
+// diffListings returns the paths of the files of cached that changed or are missing from
+// fresh, and whether the listings differ at all
+func diffListings(dir string, cached []RcloneFile, fresh []RcloneFile) ([]string, bool) {
+	current := make(map[string]RcloneFile, len(fresh))
+	for _, file := range fresh {
+		current[file.Path] = file
+	}
+
+	var changed []string
+	listingChanged := len(cached) != len(fresh)
+	for _, file := range cached {
+		now, ok := current[file.Path]
+		if ok && now.IsDir == file.IsDir && now.ModTime == file.ModTime && now.Size == file.Size {
+			continue
+		}
+		listingChanged = true
+		if !file.IsDir {
+			changed = append(changed, listedPath(dir, file))
+		}
+	}
+	return changed, listingChanged
+}
+
+// listedPath returns the path of an entry listed in dir. Listings of files aren't
+// cached, so dir is always a directory.
+func listedPath(dir string, file RcloneFile) string {
+	if dir == "" {
+		return file.Path
+	}
+	return dir + "/" + file.Path
+}
+
+func parentDir(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+func baseName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
@@ -0,0 +1,342 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shuto-api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listingFixture serves the listings in dirs, counting the listings and stats per path.
+// onList is called before a listing is returned.
+type listingFixture struct {
+	mu      sync.Mutex
+	dirs    map[string][]RcloneFile
+	lists   map[string]int
+	stats   map[string]int
+	changed []string
+	onList  func(path string)
+}
+
+func (f *listingFixture) set(path string, files ...RcloneFile) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dirs[path] = files
+}
+
+func (f *listingFixture) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists[path]
+}
+
+func (f *listingFixture) statCount(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats[path]
+}
+
+func newListingFixture(t *testing.T, settings config.CacheSettings) (*listingFixture, *ListingCache) {
+	t.Helper()
+	fixture := &listingFixture{dirs: map[string][]RcloneFile{}, lists: map[string]int{}, stats: map[string]int{}}
+	next := &MockRclone{
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+			fixture.mu.Lock()
+			fixture.lists[path]++
+			files, ok := fixture.dirs[path]
+			onList := fixture.onList
+			fixture.mu.Unlock()
+			if onList != nil {
+				onList(path)
+			}
+			if !ok {
+				return nil, storageError(ErrNotFound, fmt.Errorf("directory not found"))
+			}
+			return files, nil
+		},
+		StatFunc: func(ctx context.Context, path string, domain string) (RcloneFile, error) {
+			fixture.mu.Lock()
+			defer fixture.mu.Unlock()
+			fixture.stats[path]++
+			for _, file := range fixture.dirs[parentDir(path)] {
+				if file.Path == baseName(path) {
+					file.Path = path
+					return file, nil
+				}
+			}
+			return RcloneFile{}, storageError(ErrNotFound, fmt.Errorf("file not found"))
+		},
+		WriteFileFunc: func(ctx context.Context, path string, domain string, data io.Reader) error {
+			return nil
+		},
+		MoveFileFunc: func(ctx context.Context, src string, dst string, domain string) error {
+			return nil
+		},
+	}
+	next.ListTreeFunc = func(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error) {
+		return walkTree(ctx, next.ListPath, path, domain, depth)
+	}
+	configManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			if domain == "uncached" {
+				return config.DomainConfig{Cache: config.CacheSettings{DisableListing: true}}, nil
+			}
+			return config.DomainConfig{Cache: settings}, nil
+		},
+	}
+
+	cache, err := NewListingCache(configManager, next, ListingCacheOptions{
+		OnChange: func(domain string, path string) {
+			fixture.changed = append(fixture.changed, domain+":"+path)
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(cache.Close)
+	return fixture, cache
+}
+
+func TestListingCache_ServesCachedListings(t *testing.T) {
+	fixture, cache := newListingFixture(t, config.CacheSettings{})
+	fixture.set("photos", RcloneFile{Path: "a.jpg", ModTime: "2024-01-01T00:00:00Z"})
+
+	for i := 0; i < 3; i++ {
+		files, err := cache.ListPath(context.Background(), "photos", "test")
+		require.NoError(t, err)
+		assert.Len(t, files, 1)
+	}
+	assert.Equal(t, 1, fixture.count("photos"))
+
+	// Errors aren't cached
+	for i := 0; i < 2; i++ {
+		_, err := cache.ListPath(context.Background(), "missing", "test")
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	assert.Equal(t, 2, fixture.count("missing"))
+
+	// Domains can opt out
+	for i := 0; i < 2; i++ {
+		_, err := cache.ListPath(context.Background(), "photos", "uncached")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3, fixture.count("photos"))
+
+	// Listings of single files aren't cached
+	fixture.set("photos/a.jpg", RcloneFile{Path: "a.jpg"})
+	for i := 0; i < 2; i++ {
+		_, err := cache.ListPath(context.Background(), "photos/a.jpg", "test")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, fixture.count("photos/a.jpg"))
+}
+
+func TestListingCache_StatFromParentListing(t *testing.T) {
+	fixture, cache := newListingFixture(t, config.CacheSettings{})
+	fixture.set("photos", RcloneFile{Path: "a.jpg", Size: 1})
+
+	// Without a cached listing of the directory the file is stat'ed
+	file, err := cache.Stat(context.Background(), "photos/a.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "photos/a.jpg", file.Path)
+	assert.Equal(t, 1, fixture.statCount("photos/a.jpg"))
+
+	_, err = cache.ListPath(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	file, err = cache.Stat(context.Background(), "photos/a.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, RcloneFile{Path: "photos/a.jpg", Size: 1}, file)
+	assert.Equal(t, 1, fixture.statCount("photos/a.jpg"))
+
+	// Files missing from the listing are stat'ed in case they were just created
+	_, err = cache.Stat(context.Background(), "photos/b.jpg", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, 1, fixture.statCount("photos/b.jpg"))
+}
+
+func TestListingCache_InvalidateDuringList(t *testing.T) {
+	fixture, cache := newListingFixture(t, config.CacheSettings{})
+	fixture.set("photos", RcloneFile{Path: "a.jpg"})
+	listing := make(chan struct{})
+	release := make(chan struct{})
+	fixture.onList = func(path string) {
+		close(listing)
+		<-release
+	}
+
+	// A write lands while the listing from before it is in flight
+	done := make(chan []RcloneFile)
+	go func() {
+		files, _ := cache.ListPath(context.Background(), "photos", "test")
+		done <- files
+	}()
+	<-listing
+	fixture.mu.Lock()
+	fixture.onList = nil
+	fixture.mu.Unlock()
+	require.NoError(t, cache.WriteFile(context.Background(), "photos/b.jpg", "test", strings.NewReader("b")))
+	fixture.set("photos", RcloneFile{Path: "a.jpg"}, RcloneFile{Path: "b.jpg"})
+	close(release)
+	assert.Len(t, <-done, 1)
+
+	// The outdated listing wasn't stored
+	files, err := cache.ListPath(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	assert.Equal(t, 2, fixture.count("photos"))
+}
+
+func TestListingCache_StaleWhileRevalidate(t *testing.T) {
+	fixture, cache := newListingFixture(t, config.CacheSettings{ListingTTL: time.Millisecond, ListingStale: time.Hour})
+	fixture.set("photos", RcloneFile{Path: "a.jpg"})
+
+	_, err := cache.ListPath(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	fixture.set("photos", RcloneFile{Path: "a.jpg"}, RcloneFile{Path: "b.jpg"})
+	time.Sleep(5 * time.Millisecond)
+
+	// The expired listing is served while it's refreshed in the background
+	files, err := cache.ListPath(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Eventually(t, func() bool {
+		files, err := cache.ListPath(context.Background(), "photos", "test")
+		return err == nil && len(files) == 2
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestListingCache_WritesInvalidate(t *testing.T) {
+	fixture, cache := newListingFixture(t, config.CacheSettings{})
+	fixture.set("", RcloneFile{Path: "photos", IsDir: true})
+	fixture.set("photos", RcloneFile{Path: "a.jpg"})
+	fixture.set("archive", RcloneFile{Path: "b.jpg"})
+	list := func(path string) {
+		_, err := cache.ListPath(context.Background(), path, "test")
+		require.NoError(t, err)
+	}
+	for _, path := range []string{"", "photos", "archive"} {
+		list(path)
+	}
+
+	require.NoError(t, cache.WriteFile(context.Background(), "photos/2024/c.jpg", "test", strings.NewReader("c")))
+	for _, path := range []string{"", "photos", "archive"} {
+		list(path)
+	}
+	assert.Equal(t, 2, fixture.count(""))
+	assert.Equal(t, 2, fixture.count("photos"))
+	assert.Equal(t, 1, fixture.count("archive"))
+
+	require.NoError(t, cache.MoveFile(context.Background(), "photos/a.jpg", "archive/a.jpg", "test"))
+	list("archive")
+	assert.Equal(t, 2, fixture.count("archive"))
+	assert.Empty(t, fixture.changed, "writers report their own changes")
+}
+
+func TestListingCache_Trees(t *testing.T) {
+	fixture, cache := newListingFixture(t, config.CacheSettings{})
+	fixture.set("", RcloneFile{Path: "photos", IsDir: true})
+	fixture.set("photos", RcloneFile{Path: "a.jpg", Size: 1})
+	fixture.set("archive", RcloneFile{Path: "b.jpg"})
+	tree := func(path string, depth int) []RcloneFile {
+		files, err := cache.ListTree(context.Background(), path, "test", depth)
+		require.NoError(t, err)
+		return files
+	}
+
+	assert.Len(t, tree("", 0), 2)
+	assert.Len(t, tree("", 0), 2)
+	assert.Len(t, tree("", 1), 1)
+	tree("archive", 0)
+	assert.Equal(t, 2, fixture.count(""), "trees of different depths are cached apart")
+
+	// Writes drop the trees containing them
+	require.NoError(t, cache.WriteFile(context.Background(), "photos/c.jpg", "test", strings.NewReader("c")))
+	tree("", 0)
+	tree("archive", 0)
+	assert.Equal(t, 3, fixture.count(""))
+	assert.Equal(t, 1, fixture.count("archive"))
+
+	// Polling detects changes deep in bounded trees and drops the unbounded trees
+	// containing them, which are never polled themselves
+	tree("", 2)
+	fixture.changed = nil
+	fixture.set("photos", RcloneFile{Path: "a.jpg", Size: 2})
+	cache.Poll(context.Background())
+	assert.Equal(t, []string{"test:photos/a.jpg"}, fixture.changed)
+	assert.Equal(t, 1, fixture.count("archive"))
+	assert.Equal(t, int64(2), tree("", 2)[1].Size)
+	assert.Equal(t, int64(2), tree("", 0)[1].Size)
+}
+
+func TestListingCache_Poll(t *testing.T) {
+	fixture, cache := newListingFixture(t, config.CacheSettings{})
+	fixture.set("photos",
+		RcloneFile{Path: "a.jpg", Size: 1, ModTime: "2024-01-01T00:00:00Z"},
+		RcloneFile{Path: "b.jpg", Size: 1, ModTime: "2024-01-01T00:00:00Z"},
+		RcloneFile{Path: "c.jpg", Size: 1, ModTime: "2024-01-01T00:00:00Z"},
+		RcloneFile{Path: "old", IsDir: true},
+	)
+	fixture.set("gone", RcloneFile{Path: "d.jpg"})
+	for _, path := range []string{"photos", "gone"} {
+		_, err := cache.ListPath(context.Background(), path, "test")
+		require.NoError(t, err)
+	}
+
+	// Unchanged listings are kept
+	cache.Poll(context.Background())
+	assert.Empty(t, fixture.changed)
+
+	// a.jpg was modified, b.jpg replaced with another size, c.jpg and old removed
+	fixture.set("photos",
+		RcloneFile{Path: "a.jpg", Size: 1, ModTime: "2024-02-01T00:00:00Z"},
+		RcloneFile{Path: "b.jpg", Size: 2, ModTime: "2024-01-01T00:00:00Z"},
+		RcloneFile{Path: "new.jpg", Size: 1, ModTime: "2024-02-01T00:00:00Z"},
+	)
+	delete(fixture.dirs, "gone")
+	cache.Poll(context.Background())
+	assert.ElementsMatch(t, []string{"test:photos/a.jpg", "test:photos/b.jpg", "test:photos/c.jpg", "test:gone/d.jpg"}, fixture.changed)
+
+	// The polled listing replaced the cached one
+	lists := fixture.count("photos")
+	files, err := cache.ListPath(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	assert.Equal(t, lists, fixture.count("photos"))
+	assert.Len(t, files, 3)
+}
+
+func TestListingCache_PollBudget(t *testing.T) {
+	fixture, cache := newListingFixture(t, config.CacheSettings{})
+	cache.options.PollBudget = 2
+	for _, path := range []string{"a", "b", "c"} {
+		fixture.set(path, RcloneFile{Path: "x.jpg"})
+		_, err := cache.ListPath(context.Background(), path, "test")
+		require.NoError(t, err)
+	}
+	_, err := cache.ListPath(context.Background(), "a", "test")
+	require.NoError(t, err)
+
+	// The most recently used listings are polled first
+	cache.Poll(context.Background())
+	assert.Equal(t, 2, fixture.count("a"))
+	assert.Equal(t, 1, fixture.count("b"))
+	assert.Equal(t, 2, fixture.count("c"))
+
+	// A cancelled cycle polls nothing more
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cache.Poll(ctx)
+	assert.Equal(t, 2, fixture.count("a"))
+}
+
+func TestListedPath(t *testing.T) {
+	assert.Equal(t, "a.jpg", listedPath("", RcloneFile{Path: "a.jpg"}))
+	assert.Equal(t, "photos/a.jpg", listedPath("photos", RcloneFile{Path: "a.jpg"}))
+	assert.Equal(t, "photos/a.jpg/a.jpg", listedPath("photos/a.jpg", RcloneFile{Path: "a.jpg"}))
+	assert.Equal(t, "photos/2024", listedPath("photos", RcloneFile{Path: "2024", IsDir: true}))
+}
@@ -72,25 +72,29 @@ func createLoggerConfig(level zapcore.Level, isDevelopment bool) zap.Config {
 
 // Debug logs a message at debug level with structured context
 func Debug(msg string, fields ...interface{}) {
-	sugar.Debugw(msg, fields...)
+	// Skip redacting when debug output is disabled, it runs on hot paths
+	if !sugar.Level().Enabled(zapcore.DebugLevel) {
+		return
+	}
+	sugar.Debugw(msg, redactFields(fields)...)
 }
 
 // Info logs a message at info level with structured context
 func Info(msg string, fields ...interface{}) {
-	sugar.Infow(msg, fields...)
+	sugar.Infow(msg, redactFields(fields)...)
 }
 
 // Warn logs a message at warn level with structured context
 func Warn(msg string, fields ...interface{}) {
-	sugar.Warnw(msg, fields...)
+	sugar.Warnw(msg, redactFields(fields)...)
 }
 
 // Error logs a message at error level with structured context
 func Error(msg string, fields ...interface{}) {
-	sugar.Errorw(msg, fields...)
+	sugar.Errorw(msg, redactFields(fields)...)
 }
 
 // Fatal logs a message at fatal level with structured context and then exits
 func Fatal(msg string, fields ...interface{}) {
-	sugar.Fatalw(msg, fields...)
+	sugar.Fatalw(msg, redactFields(fields)...)
 }
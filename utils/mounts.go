@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"shuto-api/config"
+)
+
+// mountRclone serves the mounts of a domain from storages of their own, resolved by
+// longest prefix match, and everything else from the domain's storage
+type mountRclone struct {
+	configManager config.DomainConfigManager
+	newStorage    func(config.DomainConfigManager) Rclone
+
+	mu       sync.Mutex
+	storages map[string]Rclone // by mount prefix, "" is the domain's own storage
+}
+
+// NewMountRclone creates a Rclone dispatching paths below a domain's mounts to the
+// mount's remote. newStorage creates the storage for a view of the domain configs.
+func NewMountRclone(configManager config.DomainConfigManager, newStorage func(config.DomainConfigManager) Rclone) Rclone {
+	return &mountRclone{
+		configManager: configManager,
+		newStorage:    newStorage,
+		storages:      map[string]Rclone{"": newStorage(configManager)},
+	}
+}
+
+func (m *mountRclone) storage(prefix string) Rclone {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	storage, ok := m.storages[prefix]
+	if !ok {
+		storage = m.newStorage(config.NewMountConfigManager(m.configManager, prefix))
+		m.storages[prefix] = storage
+	}
+	return storage
+}
+
+// resolve returns the storage serving path and the path relative to it. Invalid paths
+// are left to the storage to reject.
+func (m *mountRclone) resolve(cfg config.DomainConfig, path string) (Rclone, string) {
+	cleaned, err := canonicalPath(path)
+	if err != nil {
+		return m.storage(""), path
+	}
+	mount, relative := cfg.MountFor(cleaned)
+	if mount == nil {
+		return m.storage(""), path
+	}
+	return m.storage(strings.Trim(mount.Prefix, "/")), relative
+}
+
+func (m *mountRclone) route(domain string, path string) (Rclone, string) {
+	cfg, err := m.configManager.GetDomainConfig(domain)
+	if err != nil || len(cfg.Mounts) == 0 {
+		return m.storage(""), path
+	}
+	return m.resolve(cfg, path)
+}
+
+func (m *mountRclone) FetchImage(ctx context.Context, path string, domain string) ([]byte, error) {
+	storage, path := m.route(domain, path)
+	return storage.FetchImage(ctx, path, domain)
+}
+
+func (m *mountRclone) Open(ctx context.Context, path string, domain string) (*FileStream, error) {
+	storage, path := m.route(domain, path)
+	return storage.Open(ctx, path, domain)
+}
+
+func (m *mountRclone) OpenRange(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+	storage, path := m.route(domain, path)
+	return storage.OpenRange(ctx, path, domain, offset, count)
+}
+
+func (m *mountRclone) Stat(ctx context.Context, path string, domain string) (RcloneFile, error) {
+	storage, path := m.route(domain, path)
+	return storage.Stat(ctx, path, domain)
+}
+
+func (m *mountRclone) WriteFile(ctx context.Context, path string, domain string, data io.Reader) error {
+	storage, path := m.route(domain, path)
+	return storage.WriteFile(ctx, path, domain, data)
+}
+
+func (m *mountRclone) DeleteFile(ctx context.Context, path string, domain string) error {
+	storage, path := m.route(domain, path)
+	return storage.DeleteFile(ctx, path, domain)
+}
+
+func (m *mountRclone) MoveFile(ctx context.Context, src string, dst string, domain string) error {
+	storage, src, dst, err := m.transfer(domain, src, dst)
+	if err != nil {
+		return err
+	}
+	return storage.MoveFile(ctx, src, dst, domain)
+}
+
+func (m *mountRclone) CopyFile(ctx context.Context, src string, dst string, domain string) error {
+	storage, src, dst, err := m.transfer(domain, src, dst)
+	if err != nil {
+		return err
+	}
+	return storage.CopyFile(ctx, src, dst, domain)
+}
+
+// transfer resolves both paths of a move or copy, which can't cross mounts
+func (m *mountRclone) transfer(domain string, src string, dst string) (Rclone, string, string, error) {
+	srcStorage, srcPath := m.route(domain, src)
+	dstStorage, dstPath := m.route(domain, dst)
+	if srcStorage != dstStorage {
+		return nil, "", "", fmt.Errorf("%w: %s and %s are on different mounts", ErrInvalidPath, src, dst)
+	}
+	return srcStorage, srcPath, dstPath, nil
+}
+
+func (m *mountRclone) Mkdir(ctx context.Context, path string, domain string) error {
+	storage, path := m.route(domain, path)
+	return storage.Mkdir(ctx, path, domain)
+}
+
+// ListPath adds the mount points inside the listed directory as virtual directories,
+// hiding entries of the same name
+func (m *mountRclone) ListPath(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+	cfg, err := m.configManager.GetDomainConfig(domain)
+	if err != nil || len(cfg.Mounts) == 0 {
+		return m.storage("").ListPath(ctx, path, domain)
+	}
+
+	storage, relative := m.resolve(cfg, path)
+	cleaned, err := canonicalPath(path)
+	if err != nil {
+		return storage.ListPath(ctx, relative, domain)
+	}
+	mountPoints := childMountPoints(cfg.Mounts, cleaned)
+	if len(mountPoints) == 0 {
+		return storage.ListPath(ctx, relative, domain)
+	}
+
+	var files []RcloneFile
+	mount, _ := cfg.MountFor(cleaned)
+	if mount != nil || hasRemote(cfg.Rclone) {
+		// A directory may only exist through the mounts inside it
+		files, err = storage.ListPath(ctx, relative, domain)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	listed := make([]RcloneFile, 0, len(files)+len(mountPoints))
+	for _, file := range files {
+		if _, ok := mountPoints[file.Name]; !ok {
+			listed = append(listed, file)
+		}
+	}
+	names := make([]string, 0, len(mountPoints))
+	for name := range mountPoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		listed = append(listed, RcloneFile{Path: name, Name: name, MimeType: "inode/directory", IsDir: true})
+	}
+	return listed, nil
+}
+
+// ListTree walks the directories level by level when the domain has mounts, so that
+// the tree includes the mount points and their contents
+func (m *mountRclone) ListTree(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error) {
+	cfg, err := m.configManager.GetDomainConfig(domain)
+	if err != nil || len(cfg.Mounts) == 0 {
+		return m.storage("").ListTree(ctx, path, domain, depth)
+	}
+	return walkTree(ctx, m.ListPath, path, domain, depth)
+}
+
+// Size sums up the tree when the domain has mounts, which rclone size wouldn't descend into
+func (m *mountRclone) Size(ctx context.Context, path string, domain string) (DirectorySize, error) {
+	cfg, err := m.configManager.GetDomainConfig(domain)
+	if err != nil || len(cfg.Mounts) == 0 {
+		return m.storage("").Size(ctx, path, domain)
+	}
+	return treeSize(ctx, m.ListTree, path, domain)
+}
+
+// childMountPoints returns the names of the entries of dir leading to a mount
+func childMountPoints(mounts []config.MountConfig, dir string) map[string]struct{} {
+	names := make(map[string]struct{})
+	for _, mount := range mounts {
+		prefix := strings.Trim(mount.Prefix, "/")
+		rest := prefix
+		if dir != "" {
+			if !strings.HasPrefix(prefix, dir+"/") {
+				continue
+			}
+			rest = prefix[len(dir)+1:]
+		}
+		if rest == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(rest, "/")
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+// hasRemote reports whether cfg names a remote, a domain may be served by mounts only
+func hasRemote(cfg config.RcloneConfig) bool {
+	return cfg.Remote != "" || cfg.S3 != nil
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"shuto-api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMountFixture(rclone config.RcloneConfig) (*remoteFixture, Rclone) {
+	fixture := newRemoteFixture(config.DomainConfig{
+		Rclone: rclone,
+		Mounts: []config.MountConfig{
+			{Prefix: "products", Rclone: config.RcloneConfig{Remote: "s3"}},
+			{Prefix: "press/", Rclone: config.RcloneConfig{Remote: "nextcloud"}},
+			{Prefix: "archive/2020", Rclone: config.RcloneConfig{Remote: "disk"}},
+		},
+	})
+	return fixture, NewMountRclone(fixture.configManager, fixture.newStorage)
+}
+
+func TestMountRclone_Routing(t *testing.T) {
+	fixture, storage := newMountFixture(config.RcloneConfig{Remote: "primary"})
+
+	for _, path := range []string{"products/a.jpg", "press/2024/b.jpg", "archive/2020/c.jpg", "archive/2019/d.jpg", "productsx/e.jpg", "products/../f.jpg"} {
+		_, err := storage.FetchImage(context.Background(), path, "test")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{
+		"s3:a.jpg",
+		"nextcloud:2024/b.jpg",
+		"disk:c.jpg",
+		"primary:archive/2019/d.jpg",
+		"primary:productsx/e.jpg",
+		// Invalid paths are left to the domain's storage to reject
+		"primary:products/../f.jpg",
+	}, fixture.calls)
+}
+
+func TestMountRclone_ListsMountPoints(t *testing.T) {
+	fixture, storage := newMountFixture(config.RcloneConfig{Remote: "primary"})
+	fixture.listing["primary:"] = []RcloneFile{
+		{Path: "a.jpg", Name: "a.jpg", MimeType: "image/jpeg"},
+		{Path: "press", Name: "press", IsDir: true, ModTime: "2024-01-01T00:00:00Z"},
+	}
+
+	files, err := storage.ListPath(context.Background(), "", "test")
+	require.NoError(t, err)
+	assert.Equal(t, []RcloneFile{
+		{Path: "a.jpg", Name: "a.jpg", MimeType: "image/jpeg"},
+		{Path: "archive", Name: "archive", MimeType: "inode/directory", IsDir: true},
+		{Path: "press", Name: "press", MimeType: "inode/directory", IsDir: true},
+		{Path: "products", Name: "products", MimeType: "inode/directory", IsDir: true},
+	}, files)
+
+	// Directories only existing through a mount are listed too
+	files, err = storage.ListPath(context.Background(), "archive", "test")
+	require.NoError(t, err)
+	assert.Equal(t, []RcloneFile{{Path: "2020", Name: "2020", MimeType: "inode/directory", IsDir: true}}, files)
+
+	fixture.listing["s3:"] = []RcloneFile{{Path: "b.jpg", Name: "b.jpg"}}
+	files, err = storage.ListPath(context.Background(), "products/", "test")
+	require.NoError(t, err)
+	assert.Equal(t, []RcloneFile{{Path: "b.jpg", Name: "b.jpg"}}, files)
+}
+
+func TestMountRclone_MountsOnly(t *testing.T) {
+	fixture, storage := newMountFixture(config.RcloneConfig{})
+
+	files, err := storage.ListPath(context.Background(), "", "test")
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+	assert.Empty(t, fixture.calls)
+}
+
+func TestMountRclone_ListTree(t *testing.T) {
+	fixture, storage := newMountFixture(config.RcloneConfig{Remote: "primary"})
+	fixture.listing["primary:"] = []RcloneFile{{Path: "a.jpg", Name: "a.jpg"}}
+	fixture.listing["s3:"] = []RcloneFile{{Path: "2024", Name: "2024", IsDir: true}}
+	fixture.listing["s3:2024"] = []RcloneFile{{Path: "b.jpg", Name: "b.jpg"}}
+	fixture.listing["disk:"] = []RcloneFile{{Path: "c.jpg", Name: "c.jpg"}}
+
+	// The tree descends into the mounts
+	files, err := storage.ListTree(context.Background(), "", "test", 0)
+	require.NoError(t, err)
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	assert.Equal(t, []string{"a.jpg", "archive", "archive/2020", "archive/2020/c.jpg", "press", "products", "products/2024", "products/2024/b.jpg"}, paths)
+}
+
+func TestMountRclone_MovesWithinMounts(t *testing.T) {
+	fixture, storage := newMountFixture(config.RcloneConfig{Remote: "primary"})
+
+	require.NoError(t, storage.MoveFile(context.Background(), "products/a.jpg", "products/old/a.jpg", "test"))
+	require.NoError(t, storage.MoveFile(context.Background(), "a.jpg", "archive/2019/a.jpg", "test"))
+	assert.Equal(t, []string{"s3:a.jpg->old/a.jpg", "primary:a.jpg->archive/2019/a.jpg"}, fixture.calls)
+
+	err := storage.MoveFile(context.Background(), "products/a.jpg", "press/a.jpg", "test")
+	assert.ErrorIs(t, err, ErrInvalidPath)
+	assert.Len(t, fixture.calls, 2)
+}
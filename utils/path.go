@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"shuto-api/config"
+)
+
+// ErrInvalidPath marks request paths that could leave the domain's root
+var ErrInvalidPath = errors.New("invalid path")
+
+// RequestPath returns the canonical path of a request to /<version>/<route>/<path>
+func RequestPath(r *http.Request, route string) (string, error) {
+	return CleanPath(strings.TrimPrefix(r.URL.Path, "/"+config.ApiVersion+"/"+route+"/"))
+}
+
+// RequestDir is RequestPath allowing the root, the empty path
+func RequestDir(r *http.Request, route string) (string, error) {
+	return canonicalPath(strings.TrimPrefix(r.URL.Path, "/"+config.ApiVersion+"/"+route+"/"))
+}
+
+// CleanPath canonicalises a path relative to a domain's root: empty and "." segments
+// are dropped, absolute paths, ".." segments, backslashes, control characters and invalid UTF-8 are
+// rejected with ErrInvalidPath. The result has no leading or trailing slash.
+func CleanPath(p string) (string, error) {
+	cleaned, err := canonicalPath(p)
+	if err != nil {
+		return "", err
+	}
+	if cleaned == "" {
+		return "", fmt.Errorf("%w: path is required", ErrInvalidPath)
+	}
+	return cleaned, nil
+}
+
+// canonicalPath is CleanPath allowing the root itself, the empty path
+func canonicalPath(p string) (string, error) {
+	if strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("%w: absolute path %q", ErrInvalidPath, p)
+	}
+	if !utf8.ValidString(p) {
+		return "", fmt.Errorf("%w: %q is not valid UTF-8", ErrInvalidPath, p)
+	}
+	for _, r := range p {
+		if r == '\\' || unicode.IsControl(r) {
+			return "", fmt.Errorf("%w: unsupported character in %q", ErrInvalidPath, p)
+		}
+	}
+
+	segments := make([]string, 0, strings.Count(p, "/")+1)
+	for _, segment := range strings.Split(p, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			return "", fmt.Errorf("%w: %q leaves the root", ErrInvalidPath, p)
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// rootedPath places a path below root, both relative to the remote
+func rootedPath(root string, p string) (string, error) {
+	cleaned, err := canonicalPath(p)
+	if err != nil {
+		return "", err
+	}
+	root = strings.Trim(root, "/")
+	switch {
+	case root == "":
+		return cleaned, nil
+	case cleaned == "":
+		return root, nil
+	default:
+		return root + "/" + cleaned, nil
+	}
+}
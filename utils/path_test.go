@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+		invalid  bool
+	}{
+		{path: "photos/a.jpg", expected: "photos/a.jpg"},
+		{path: "photos/", expected: "photos"},
+		{path: "photos//2024/./a.jpg", expected: "photos/2024/a.jpg"},
+		{path: "./photos", expected: "photos"},
+		{path: "photos/..jpg", expected: "photos/..jpg"},
+		{path: "photos/%2e%2e/a.jpg", expected: "photos/%2e%2e/a.jpg"},
+		{path: "Fotos/Überblick.jpg", expected: "Fotos/Überblick.jpg"},
+		{path: "", invalid: true},
+		{path: "./", invalid: true},
+		{path: "/etc/passwd", invalid: true},
+		{path: "..", invalid: true},
+		{path: "photos/../a.jpg", invalid: true},
+		{path: "photos/../../other", invalid: true},
+		{path: `photos\..\..\other`, invalid: true},
+		{path: "photos/a\x00.jpg", invalid: true},
+		{path: "photos/a\n.jpg", invalid: true},
+		{path: "photos/\xff.jpg", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			cleaned, err := CleanPath(tt.path)
+			if tt.invalid {
+				assert.ErrorIs(t, err, ErrInvalidPath)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, cleaned)
+		})
+	}
+}
+
+func TestRequestPath(t *testing.T) {
+	path, err := RequestPath(httptest.NewRequest("GET", "/v2/image/photos//a.jpg", nil), "image")
+	require.NoError(t, err)
+	assert.Equal(t, "photos/a.jpg", path)
+
+	// Encoded slashes are decoded before the path is checked
+	_, err = RequestPath(httptest.NewRequest("GET", "/v2/image/photos%2F..%2F..%2Fetc%2Fpasswd", nil), "image")
+	assert.ErrorIs(t, err, ErrInvalidPath)
+}
+
+func TestRootedPath(t *testing.T) {
+	tests := []struct {
+		root     string
+		path     string
+		expected string
+	}{
+		{root: "", path: "photos", expected: "photos"},
+		{root: "", path: "", expected: ""},
+		{root: "example.com", path: "photos/a.jpg", expected: "example.com/photos/a.jpg"},
+		{root: "/example.com/", path: "photos/", expected: "example.com/photos"},
+		{root: "example.com", path: "", expected: "example.com"},
+	}
+
+	for _, tt := range tests {
+		rooted, err := rootedPath(tt.root, tt.path)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, rooted)
+	}
+
+	_, err := rootedPath("example.com", "../other.com")
+	assert.ErrorIs(t, err, ErrInvalidPath)
+}
+
+func FuzzCleanPath(f *testing.F) {
+	for _, seed := range []string{"photos/a.jpg", "a//b/./c/", "../etc/passwd", "/abs", `a\..\b`, "a/..", "..a/b..", "%2e%2e/x", "a\x00b", "\xff"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		cleaned, err := CleanPath(path)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrInvalidPath)
+			return
+		}
+
+		require.NotEmpty(t, cleaned)
+		assert.True(t, utf8.ValidString(cleaned))
+		assert.False(t, strings.HasPrefix(cleaned, "/"), "leading slash in %q", cleaned)
+		assert.False(t, strings.HasSuffix(cleaned, "/"), "trailing slash in %q", cleaned)
+		assert.NotContains(t, cleaned, `\`)
+		for _, segment := range strings.Split(cleaned, "/") {
+			assert.NotContains(t, []string{"", ".", ".."}, segment, "segment of %q", cleaned)
+		}
+
+		// Canonical paths are stable and stay below any root
+		again, err := CleanPath(cleaned)
+		require.NoError(t, err)
+		assert.Equal(t, cleaned, again)
+		rooted, err := rootedPath("root", cleaned)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(rooted, "root/"))
+	})
+}
@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRanges limits the number of ranges served from a single request
+const maxRanges = 16
+
+var (
+	// ErrInvalidRange is returned for malformed Range headers, which are ignored
+	ErrInvalidRange = errors.New("invalid range")
+	// ErrRangeNotSatisfiable is returned when none of the requested ranges overlap the content
+	ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+)
+
+// ByteRange is a resolved range of Length bytes starting at Start
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// ContentRange formats the range as a Content-Range header value
+func (br ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.Start, br.Start+br.Length-1, size)
+}
+
+// ParseRange resolves a "bytes=" Range header against content of the given size.
+// Unsatisfiable ranges are dropped, ErrRangeNotSatisfiable is only returned when none remain.
+func ParseRange(header string, size int64) ([]ByteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, ErrInvalidRange
+	}
+
+	specs := strings.Split(spec, ",")
+	if len(specs) > maxRanges {
+		return nil, ErrInvalidRange
+	}
+
+	var ranges []ByteRange
+	var total int64
+	for _, part := range specs {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		startText, endText, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, ErrInvalidRange
+		}
+		startText, endText = strings.TrimSpace(startText), strings.TrimSpace(endText)
+
+		var br ByteRange
+		if startText == "" {
+			// Suffix range, the last n bytes
+			n, err := strconv.ParseInt(endText, 10, 64)
+			if err != nil || n < 0 {
+				return nil, ErrInvalidRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = ByteRange{Start: size - n, Length: n}
+		} else {
+			start, err := strconv.ParseInt(startText, 10, 64)
+			if err != nil || start < 0 {
+				return nil, ErrInvalidRange
+			}
+			end := size - 1
+			if endText != "" {
+				end, err = strconv.ParseInt(endText, 10, 64)
+				if err != nil || end < start {
+					return nil, ErrInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			br = ByteRange{Start: start, Length: end - start + 1}
+		}
+
+		ranges = append(ranges, br)
+		total += br.Length
+	}
+
+	if len(ranges) == 0 {
+		return nil, ErrRangeNotSatisfiable
+	}
+	// Overlapping ranges asking for more than the whole content are ignored
+	if total > size {
+		return nil, ErrInvalidRange
+	}
+	return ranges, nil
+}
+
+// IfRangeMatches reports whether the Range header may be honoured. A missing If-Range
+// always matches; otherwise the ETag must match strongly or the date exactly.
+func IfRangeMatches(r *http.Request, etag string, lastModified time.Time) bool {
+	ifRange := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etag != "" && !strings.HasPrefix(ifRange, "W/") && ifRange == etag
+	}
+
+	date, err := http.ParseTime(ifRange)
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+	return lastModified.Truncate(time.Second).Equal(date)
+}
+
+// ServeRanges writes a 206 Partial Content response, using multipart/byteranges when
+// more than one range is requested. open streams the bytes of a single range. Only
+// failing to open the first range is returned, later errors truncate the response.
+func ServeRanges(w http.ResponseWriter, ranges []ByteRange, size int64, contentType string, open func(offset int64, count int64) (io.ReadCloser, error)) error {
+	first, err := open(ranges[0].Start, ranges[0].Length)
+	if err != nil {
+		return err
+	}
+
+	if len(ranges) == 1 {
+		defer first.Close()
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Range", ranges[0].ContentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].Length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if _, err := io.CopyN(w, first, ranges[0].Length); err != nil {
+			Warn("Failed to stream range", "range", ranges[0].ContentRange(size), "error", err)
+		}
+		return nil
+	}
+
+	parts := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+parts.Boundary())
+	w.Header().Set("Content-Length", strconv.FormatInt(multipartRangesLength(ranges, size, contentType, parts.Boundary()), 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	for i, br := range ranges {
+		reader := first
+		if i > 0 {
+			if reader, err = open(br.Start, br.Length); err != nil {
+				Warn("Failed to open range", "range", br.ContentRange(size), "error", err)
+				return nil
+			}
+		}
+
+		part, err := parts.CreatePart(rangePartHeader(br, size, contentType))
+		if err == nil {
+			_, err = io.CopyN(part, reader, br.Length)
+		}
+		reader.Close()
+		if err != nil {
+			Warn("Failed to stream range", "range", br.ContentRange(size), "error", err)
+			return nil
+		}
+	}
+	parts.Close()
+	return nil
+}
+
+func rangePartHeader(br ByteRange, size int64, contentType string) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {br.ContentRange(size)},
+	}
+}
+
+// multipartRangesLength computes the length of a multipart/byteranges body up front,
+// so it can be announced in Content-Length while the parts are streamed
+func multipartRangesLength(ranges []ByteRange, size int64, contentType string, boundary string) int64 {
+	var counter countingWriter
+	parts := multipart.NewWriter(&counter)
+	parts.SetBoundary(boundary)
+
+	var length int64
+	for _, br := range ranges {
+		parts.CreatePart(rangePartHeader(br, size, contentType))
+		length += br.Length
+	}
+	parts.Close()
+	return length + int64(counter)
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
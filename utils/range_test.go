@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		size     int64
+		expected []ByteRange
+		err      error
+	}{
+		{name: "Single range", header: "bytes=0-499", size: 1000, expected: []ByteRange{{Start: 0, Length: 500}}},
+		{name: "Open ended range", header: "bytes=500-", size: 1000, expected: []ByteRange{{Start: 500, Length: 500}}},
+		{name: "Suffix range", header: "bytes=-100", size: 1000, expected: []ByteRange{{Start: 900, Length: 100}}},
+		{name: "Suffix longer than content", header: "bytes=-5000", size: 1000, expected: []ByteRange{{Start: 0, Length: 1000}}},
+		{name: "End clamped to size", header: "bytes=900-5000", size: 1000, expected: []ByteRange{{Start: 900, Length: 100}}},
+		{name: "Multiple ranges", header: "bytes=0-9, 20-29", size: 1000, expected: []ByteRange{{Start: 0, Length: 10}, {Start: 20, Length: 10}}},
+		{name: "Unsatisfiable ranges are dropped", header: "bytes=0-9,2000-3000", size: 1000, expected: []ByteRange{{Start: 0, Length: 10}}},
+		{name: "Start beyond size", header: "bytes=1000-", size: 1000, err: ErrRangeNotSatisfiable},
+		{name: "Empty content", header: "bytes=-10", size: 0, err: ErrRangeNotSatisfiable},
+		{name: "Wrong unit", header: "items=0-1", size: 1000, err: ErrInvalidRange},
+		{name: "End before start", header: "bytes=10-5", size: 1000, err: ErrInvalidRange},
+		{name: "Not a number", header: "bytes=a-b", size: 1000, err: ErrInvalidRange},
+		{name: "Overlapping ranges exceeding size", header: "bytes=0-999,0-999", size: 1000, err: ErrInvalidRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := ParseRange(tt.header, tt.size)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.expected, ranges)
+		})
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	lastModified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		ifRange  string
+		expected bool
+	}{
+		{name: "No If-Range", expected: true},
+		{name: "Matching ETag", ifRange: `"abc"`, expected: true},
+		{name: "Other ETag", ifRange: `"xyz"`, expected: false},
+		{name: "Weak ETag never matches", ifRange: `W/"abc"`, expected: false},
+		{name: "Matching date", ifRange: "Mon, 01 Jan 2024 00:00:00 GMT", expected: true},
+		{name: "Other date", ifRange: "Tue, 02 Jan 2024 00:00:00 GMT", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.ifRange != "" {
+				req.Header.Set("If-Range", tt.ifRange)
+			}
+			assert.Equal(t, tt.expected, IfRangeMatches(req, `"abc"`, lastModified))
+		})
+	}
+}
+
+func TestServeRanges(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	open := func(offset int64, count int64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content[offset : offset+count])), nil
+	}
+
+	rec := httptest.NewRecorder()
+	err := ServeRanges(rec, []ByteRange{{Start: 2, Length: 4}}, 16, "text/plain", open)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "bytes 2-5/16", rec.Header().Get("Content-Range"))
+	assert.Equal(t, "4", rec.Header().Get("Content-Length"))
+	assert.Equal(t, "2345", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	err = ServeRanges(rec, []ByteRange{{Start: 0, Length: 2}, {Start: 10, Length: 6}}, 16, "text/plain", open)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	reader := multipart.NewReader(rec.Body, params["boundary"])
+	expected := []struct{ contentRange, body string }{
+		{"bytes 0-1/16", "01"},
+		{"bytes 10-15/16", "abcdef"},
+	}
+	for _, want := range expected {
+		part, err := reader.NextPart()
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+		assert.Equal(t, want.contentRange, part.Header.Get("Content-Range"))
+		body, _ := io.ReadAll(part)
+		assert.Equal(t, want.body, string(body))
+	}
+	_, err = reader.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// Failing to open the first range is reported before anything is written
+	rec = httptest.NewRecorder()
+	err = ServeRanges(rec, []ByteRange{{Start: 0, Length: 4}}, 16, "text/plain", func(int64, int64) (io.ReadCloser, error) {
+		return nil, errors.New("not found")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 0, rec.Body.Len())
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RcdConnector provides a client for a running rclone rcd
+type RcdConnector interface {
+	Client() (*RcdClient, error)
+}
+
+// RcdClient talks to the remote control API of an rclone rcd started with --rc-serve
+type RcdClient struct {
+	baseURL    string
+	user       string
+	pass       string
+	httpClient *http.Client
+}
+
+// NewRcdClient creates a client for the rc API at baseURL, user and pass may be empty
+func NewRcdClient(baseURL string, user string, pass string, httpClient *http.Client) *RcdClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &RcdClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		user:       user,
+		pass:       pass,
+		httpClient: httpClient,
+	}
+}
+
+// Client returns the client itself, so a fixed rcd address can be used as a connector
+func (c *RcdClient) Client() (*RcdClient, error) {
+	return c, nil
+}
+
+// Call invokes an rc method such as operations/list and decodes the JSON response into result
+func (c *RcdClient) Call(ctx context.Context, method string, params map[string]any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to encode rc parameters: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create rc request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return classifyTransportError(fmt.Errorf("rc %s failed: %w", method, err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return rcdError(method, resp)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to parse rc %s response: %w", method, err)
+	}
+	return nil
+}
+
+// Serve requests a file of fs through the --rc-serve endpoint. The caller closes the body.
+func (c *RcdClient) Serve(ctx context.Context, fs string, path string, header http.Header) (*http.Response, error) {
+	target := &url.URL{Path: "/[" + fs + "]/" + strings.TrimPrefix(path, "/")}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+target.EscapedPath(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rc request: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, classifyTransportError(fmt.Errorf("rc serve failed: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, rcdError("serve", resp)
+	}
+	return resp, nil
+}
+
+// Upload stores data as dir/name on fs using operations/uploadfile
+func (c *RcdClient) Upload(ctx context.Context, fs string, dir string, name string, data io.Reader) error {
+	source, ctx := newUploadSource(ctx, data)
+	defer source.cancel()
+
+	// The form is streamed, a failing read of data aborts the request
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		part, err := form.CreateFormFile("file0", name)
+		if err == nil {
+			_, err = io.Copy(part, source)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	query := url.Values{"fs": {fs}, "remote": {dir}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/operations/uploadfile?"+query.Encode(), body)
+	if err != nil {
+		body.Close()
+		<-written
+		return fmt.Errorf("failed to create rc request: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := c.do(req)
+	body.CloseWithError(io.ErrClosedPipe) // unblocks the writer when the request ended early
+	<-written
+	if source.err != nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return source.err
+	}
+	if err != nil {
+		return classifyTransportError(fmt.Errorf("rc operations/uploadfile failed: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return rcdError("operations/uploadfile", resp)
+	}
+	return nil
+}
+
+func (c *RcdClient) do(req *http.Request) (*http.Response, error) {
+	if c.user != "" || c.pass != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+	return c.httpClient.Do(req)
+}
+
+// rcdError turns an rc error response into an error classified by its status
+func rcdError(operation string, resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var rcErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &rcErr); err != nil || rcErr.Error == "" {
+		rcErr.Error = strings.TrimSpace(string(data))
+	}
+	if resp.StatusCode == http.StatusNotFound && !strings.Contains(rcErr.Error, "not found") {
+		rcErr.Error = "object not found: " + rcErr.Error
+	}
+	return storageError(classifyStatus(resp.StatusCode), fmt.Errorf("rc %s failed with status %d: %s", operation, resp.StatusCode, rcErr.Error))
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const maxRcdRestartDelay = 30 * time.Second
+
+type RcdOptions struct {
+	Binary       string        // rclone binary, defaults to "rclone"
+	Addr         string        // listen address of the rc API, defaults to 127.0.0.1:5572
+	Args         []string      // extra arguments, e.g. --config
+	StartTimeout time.Duration // how long the first request waits for rcd to come up
+	RestartDelay time.Duration // initial delay before restarting a crashed rcd, doubled on every crash
+}
+
+// RcdSupervisor runs a long-lived rclone rcd, restarting it whenever it exits.
+// The process is started on first use, credentials are generated per process
+// and passed through the environment so they don't show up in the process list.
+type RcdSupervisor struct {
+	opts   RcdOptions
+	client *RcdClient
+
+	startOnce sync.Once
+	ready     chan struct{}
+	stop      chan struct{}
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	restarts uint64
+	closed   bool
+}
+
+func NewRcdSupervisor(opts RcdOptions) (*RcdSupervisor, error) {
+	if opts.Binary == "" {
+		opts.Binary = "rclone"
+	}
+	if opts.Addr == "" {
+		opts.Addr = "127.0.0.1:5572"
+	}
+	if opts.StartTimeout <= 0 {
+		opts.StartTimeout = 10 * time.Second
+	}
+	if opts.RestartDelay <= 0 {
+		opts.RestartDelay = time.Second
+	}
+
+	pass := make([]byte, 16)
+	if _, err := rand.Read(pass); err != nil {
+		return nil, fmt.Errorf("failed to generate rcd credentials: %w", err)
+	}
+
+	return &RcdSupervisor{
+		opts:   opts,
+		client: NewRcdClient("http://"+opts.Addr, "shuto", hex.EncodeToString(pass), &http.Client{}),
+		ready:  make(chan struct{}),
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// Client starts rcd if needed and waits until it answers, up to StartTimeout
+func (s *RcdSupervisor) Client() (*RcdClient, error) {
+	s.startOnce.Do(func() {
+		go s.run()
+		go s.waitReady()
+	})
+
+	select {
+	case <-s.ready:
+		return s.client, nil
+	case <-time.After(s.opts.StartTimeout):
+		return nil, storageError(ErrBackendUnavailable, fmt.Errorf("rclone rcd did not become ready within %s", s.opts.StartTimeout))
+	}
+}
+
+// Restarts reports how often the process has been restarted
+func (s *RcdSupervisor) Restarts() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restarts
+}
+
+// Close stops the process and the supervision
+func (s *RcdSupervisor) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.stop)
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+}
+
+func (s *RcdSupervisor) run() {
+	delay := s.opts.RestartDelay
+	for {
+		started := time.Now()
+		err := s.runOnce()
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		// A process that ran for a while crashed, rather than failing to start
+		if time.Since(started) > time.Minute {
+			delay = s.opts.RestartDelay
+		}
+		s.mu.Lock()
+		s.restarts++
+		s.mu.Unlock()
+		Warn("rclone rcd exited, restarting", "error", err, "delay", delay)
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRcdRestartDelay)
+	}
+}
+
+func (s *RcdSupervisor) runOnce() error {
+	args := append([]string{"rcd", "--rc-addr", s.opts.Addr, "--rc-serve"}, s.opts.Args...)
+	cmd := exec.Command(s.opts.Binary, args...)
+	cmd.Env = append(os.Environ(), "RCLONE_RC_USER="+s.client.user, "RCLONE_RC_PASS="+s.client.pass)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.cmd = cmd
+	s.mu.Unlock()
+
+	Info("Started rclone rcd", "addr", s.opts.Addr, "pid", cmd.Process.Pid)
+	return cmd.Wait()
+}
+
+// waitReady polls rc/noop until rcd answers for the first time
+func (s *RcdSupervisor) waitReady() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if err := s.client.Call(context.Background(), "rc/noop", map[string]any{}, nil); err == nil {
+			close(s.ready)
+			return
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
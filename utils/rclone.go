@@ -1,8 +1,14 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 
 	"shuto-api/config"
 )
@@ -15,32 +21,141 @@ type RcloneFile struct {
 	MimeType string `json:"MimeType"`
 	ModTime  string `json:"ModTime"`
 	IsDir    bool   `json:"IsDir"`
+	Hashes   map[string]string `json:"Hashes,omitempty"` // only present when listed with --hash
+}
+
+// DirectorySize is the number of files below a directory and their total size, of which
+// Images are images
+type DirectorySize struct {
+	Count  int64 `json:"count"`
+	Bytes  int64 `json:"bytes"`
+	Images int64 `json:"-"`
+}
+
+// imageFilter is the rclone include rule matching the files DirectorySize counts as images
+const imageFilter = "*.{jpg,jpeg,png,webp,gif,avif,heic,heif,tif,tiff,bmp}"
+
+// isImageName reports whether imageFilter matches the name of a file
+func isImageName(name string) bool {
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 || strings.Contains(name[dot:], "/") {
+		return false
+	}
+	switch strings.ToLower(name[dot+1:]) {
+	case "jpg", "jpeg", "png", "webp", "gif", "avif", "heic", "heif", "tif", "tiff", "bmp":
+		return true
+	}
+	return false
+}
+
+// FileStream is an open file on a remote, read as it is transferred
+type FileStream struct {
+	io.ReadCloser
+	Size    int64 // -1 when unknown
+	ModTime time.Time
 }
 
 // Define the interface first
 type Rclone interface {
-	FetchImage(path string, domain string) ([]byte, error)
-	ListPath(path string, domain string) ([]RcloneFile, error)
+	// FetchImage reads a whole file into memory, only use it where the full buffer is needed (e.g. vips)
+	FetchImage(ctx context.Context, path string, domain string) ([]byte, error)
+	// Open streams a file
+	Open(ctx context.Context, path string, domain string) (*FileStream, error)
+	// OpenRange streams count bytes starting at offset without transferring the whole file
+	OpenRange(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error)
+	ListPath(ctx context.Context, path string, domain string) ([]RcloneFile, error)
+	// ListTree lists path and its subdirectories down to depth levels, 0 for all of them.
+	// Entry paths are relative to path, like those of ListPath.
+	ListTree(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error)
+	// Size counts the files below path and their bytes, like rclone size
+	Size(ctx context.Context, path string, domain string) (DirectorySize, error)
+	// Stat returns the metadata of a single file or directory
+	Stat(ctx context.Context, path string, domain string) (RcloneFile, error)
+	// WriteFile streams data to path, replacing any existing file. A failing read of
+	// data aborts the upload and is returned as is.
+	WriteFile(ctx context.Context, path string, domain string, data io.Reader) error
+	// DeleteFile removes a single file, never a directory
+	DeleteFile(ctx context.Context, path string, domain string) error
+	// MoveFile moves a file to dst, replacing any existing file
+	MoveFile(ctx context.Context, src string, dst string, domain string) error
+	// CopyFile copies a file to dst, replacing any existing file
+	CopyFile(ctx context.Context, src string, dst string, domain string) error
+	// Mkdir creates a directory and its parents, existing directories are no error
+	Mkdir(ctx context.Context, path string, domain string) error
 }
 
 // MockRclone implements Rclone interface
 type MockRclone struct {
-	FetchImageFunc func(path string, domain string) ([]byte, error)
-	ListPathFunc   func(path string, domain string) ([]RcloneFile, error)
+	FetchImageFunc func(ctx context.Context, path string, domain string) ([]byte, error)
+	OpenFunc       func(ctx context.Context, path string, domain string) (*FileStream, error)
+	OpenRangeFunc  func(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error)
+	ListPathFunc   func(ctx context.Context, path string, domain string) ([]RcloneFile, error)
+	ListTreeFunc   func(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error)
+	SizeFunc       func(ctx context.Context, path string, domain string) (DirectorySize, error)
+	StatFunc       func(ctx context.Context, path string, domain string) (RcloneFile, error)
+	WriteFileFunc  func(ctx context.Context, path string, domain string, data io.Reader) error
+	DeleteFileFunc func(ctx context.Context, path string, domain string) error
+	MoveFileFunc   func(ctx context.Context, src string, dst string, domain string) error
+	CopyFileFunc   func(ctx context.Context, src string, dst string, domain string) error
+	MkdirFunc      func(ctx context.Context, path string, domain string) error
 }
 
 // Implement the interface methods
-func (m *MockRclone) FetchImage(path string, domain string) ([]byte, error) {
-	return m.FetchImageFunc(path, domain)
+func (m *MockRclone) FetchImage(ctx context.Context, path string, domain string) ([]byte, error) {
+	return m.FetchImageFunc(ctx, path, domain)
+}
+
+func (m *MockRclone) Open(ctx context.Context, path string, domain string) (*FileStream, error) {
+	return m.OpenFunc(ctx, path, domain)
+}
+
+func (m *MockRclone) OpenRange(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+	return m.OpenRangeFunc(ctx, path, domain, offset, count)
+}
+
+func (m *MockRclone) ListPath(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+	return m.ListPathFunc(ctx, path, domain)
+}
+
+func (m *MockRclone) ListTree(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error) {
+	return m.ListTreeFunc(ctx, path, domain, depth)
+}
+
+func (m *MockRclone) Size(ctx context.Context, path string, domain string) (DirectorySize, error) {
+	return m.SizeFunc(ctx, path, domain)
+}
+
+func (m *MockRclone) Stat(ctx context.Context, path string, domain string) (RcloneFile, error) {
+	return m.StatFunc(ctx, path, domain)
+}
+
+func (m *MockRclone) WriteFile(ctx context.Context, path string, domain string, data io.Reader) error {
+	return m.WriteFileFunc(ctx, path, domain, data)
+}
+
+func (m *MockRclone) DeleteFile(ctx context.Context, path string, domain string) error {
+	return m.DeleteFileFunc(ctx, path, domain)
+}
+
+func (m *MockRclone) MoveFile(ctx context.Context, src string, dst string, domain string) error {
+	return m.MoveFileFunc(ctx, src, dst, domain)
+}
+
+func (m *MockRclone) CopyFile(ctx context.Context, src string, dst string, domain string) error {
+	return m.CopyFileFunc(ctx, src, dst, domain)
 }
 
-func (m *MockRclone) ListPath(path string, domain string) ([]RcloneFile, error) {
-	return m.ListPathFunc(path, domain)
+func (m *MockRclone) Mkdir(ctx context.Context, path string, domain string) error {
+	return m.MkdirFunc(ctx, path, domain)
 }
 
 type rcloneImpl struct {
 	executor      CommandExecutor
 	configManager config.DomainConfigManager
+
+	// Concurrent identical reads share a single rclone invocation
+	fetchGroup CallGroup[[]byte]
+	listGroup  CallGroup[[]RcloneFile]
 }
 
 // NewRclone creates a new instance of rcloneImpl
@@ -61,44 +176,298 @@ func (r *rcloneImpl) getRcloneConfig(domain string) (*config.RcloneConfig, error
 }
 
 // rcloneCmd now uses the instance method
-func (r *rcloneImpl) rcloneCmd(command string, path string, domain string) ([]byte, error) {
-	config, err := r.getRcloneConfig(domain)
+func (r *rcloneImpl) rcloneCmd(ctx context.Context, command string, path string, domain string, extraArgs ...string) ([]byte, error) {
+	args, env, err := r.rcloneArgs(command, path, domain, extraArgs...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get rclone config: %w", err)
+		return nil, err
 	}
-
-	args := append([]string{command, config.Remote + ":" + path}, config.Flags...)
-	Debug("Executing rclone", "command", command, "path", path, "args", args)
 	
-	output, err := r.executor.Execute("rclone", args...)
+	output, err := r.executor.Execute(ctx, env, "rclone", args...)
 	if err != nil {
-		return nil, fmt.Errorf("rclone command failed: %w", err)
+		return nil, fmt.Errorf("rclone command failed: %w", classifyRcloneError(err))
 	}
 	
 	return output, nil
 }
 
-func (r *rcloneImpl) FetchImage(path string, domain string) ([]byte, error) {
-	output, err := r.rcloneCmd("cat", path, domain)
+// rcloneStream starts a command and returns its output as it is produced
+func (r *rcloneImpl) rcloneStream(ctx context.Context, command string, path string, domain string, extraArgs ...string) (io.ReadCloser, error) {
+	args, env, err := r.rcloneArgs(command, path, domain, extraArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := r.executor.Stream(ctx, env, "rclone", args...)
+	if err != nil {
+		return nil, fmt.Errorf("rclone command failed: %w", classifyRcloneError(err))
+	}
+	return &classifyingReader{reader: reader}, nil
+}
+
+// rcloneArgs builds the command line of an rclone invocation and the environment
+// carrying the remote's options
+func (r *rcloneImpl) rcloneArgs(command string, path string, domain string, extraArgs ...string) ([]string, []string, error) {
+	config, err := r.getRcloneConfig(domain)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get rclone config: %w", err)
+	}
+	env, err := rcloneEnv(*config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args := append([]string{command, config.Remote + ":" + path}, extraArgs...)
+	args = append(args, config.Flags...)
+	Debug("Executing rclone", "command", command, "path", path, "args", args)
+	return args, env, nil
+}
+
+func (r *rcloneImpl) FetchImage(ctx context.Context, path string, domain string) ([]byte, error) {
+	output, err, shared := r.fetchGroup.DoContext(ctx, coalesceKey(path, domain), func(ctx context.Context) ([]byte, error) {
+		return r.rcloneCmd(ctx, "cat", path, domain)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch image: %w", err)
 	}
-	
-	Debug("Image fetched successfully", "path", path, "size", len(output))
+
+	Debug("Image fetched successfully", "path", path, "size", len(output), "coalesced", shared)
 	return output, nil
 }
 
-func (r *rcloneImpl) ListPath(path string, domain string) ([]RcloneFile, error) {
-	output, err := r.rcloneCmd("lsjson", path, domain)
+func (r *rcloneImpl) Open(ctx context.Context, path string, domain string) (*FileStream, error) {
+	// cat reports nothing about the file, stat it first so that missing files and
+	// directories fail before anything is streamed
+	file, err := r.Stat(ctx, path, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if file.IsDir {
+		return nil, storageError(ErrIsDirectory, fmt.Errorf("failed to open file: %s is a directory", path))
+	}
+
+	reader, err := r.rcloneStream(ctx, "cat", path, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	modTime, _ := time.Parse(time.RFC3339Nano, file.ModTime)
+	return &FileStream{ReadCloser: reader, Size: file.Size, ModTime: modTime}, nil
+}
+
+func (r *rcloneImpl) OpenRange(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+	reader, err := r.rcloneStream(ctx, "cat", path, domain,
+		"--offset", strconv.FormatInt(offset, 10),
+		"--count", strconv.FormatInt(count, 10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open range: %w", err)
+	}
+	return reader, nil
+}
+
+func (r *rcloneImpl) ListPath(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+	files, err, shared := r.listGroup.DoContext(ctx, coalesceKey(path, domain), func(ctx context.Context) ([]RcloneFile, error) {
+		output, err := r.rcloneCmd(ctx, "lsjson", path, domain)
+		if err != nil {
+			return nil, err
+		}
+
+		var files []RcloneFile
+		if err := json.Unmarshal(output, &files); err != nil {
+			return nil, fmt.Errorf("failed to parse rclone output: %w", err)
+		}
+		return files, nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to list path: %w", err)
 	}
 
-	var files []RcloneFile
-	if err := json.Unmarshal(output, &files); err != nil {
-		return nil, fmt.Errorf("failed to parse rclone output: %w", err)
+	Debug("Path listed successfully", "path", path, "count", len(files), "coalesced", shared)
+	return files, nil
+}
+
+func (r *rcloneImpl) ListTree(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error) {
+	args := []string{"-R"}
+	if depth > 0 {
+		args = append(args, "--max-depth", strconv.Itoa(depth))
+	}
+	key := coalesceKey(path, domain) + "|" + strings.Join(args, " ")
+	files, err, shared := r.listGroup.DoContext(ctx, key, func(ctx context.Context) ([]RcloneFile, error) {
+		output, err := r.rcloneCmd(ctx, "lsjson", path, domain, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		var files []RcloneFile
+		if err := json.Unmarshal(output, &files); err != nil {
+			return nil, fmt.Errorf("failed to parse rclone output: %w", err)
+		}
+		return files, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tree: %w", err)
 	}
 
-	Debug("Path listed successfully", "path", path, "count", len(files))
+	Debug("Tree listed successfully", "path", path, "depth", depth, "count", len(files), "coalesced", shared)
 	return files, nil
-}
\ No newline at end of file
+}
+
+// Size runs rclone size twice, the second time only including images
+func (r *rcloneImpl) Size(ctx context.Context, path string, domain string) (DirectorySize, error) {
+	var size, images DirectorySize
+	for _, run := range []struct {
+		result *DirectorySize
+		args   []string
+	}{
+		{&size, []string{"--json"}},
+		{&images, []string{"--json", "--include", imageFilter, "--ignore-case"}},
+	} {
+		output, err := r.rcloneCmd(ctx, "size", path, domain, run.args...)
+		if err != nil {
+			return DirectorySize{}, fmt.Errorf("failed to size path: %w", err)
+		}
+		if err := json.Unmarshal(output, run.result); err != nil {
+			return DirectorySize{}, fmt.Errorf("failed to parse rclone output: %w", err)
+		}
+	}
+	size.Images = images.Count
+
+	Debug("Path sized successfully", "path", path, "count", size.Count, "bytes", size.Bytes)
+	return size, nil
+}
+
+func (r *rcloneImpl) Stat(ctx context.Context, path string, domain string) (RcloneFile, error) {
+	output, err := r.rcloneCmd(ctx, "lsjson", path, domain, "--stat")
+	if err != nil {
+		return RcloneFile{}, fmt.Errorf("failed to stat path: %w", err)
+	}
+
+	var file RcloneFile
+	if err := json.Unmarshal(output, &file); err != nil {
+		return RcloneFile{}, fmt.Errorf("failed to parse rclone output: %w", err)
+	}
+	return file, nil
+}
+
+func (r *rcloneImpl) WriteFile(ctx context.Context, path string, domain string, data io.Reader) error {
+	args, env, err := r.rcloneArgs("rcat", path, domain)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	source, ctx := newUploadSource(ctx, data)
+	defer source.cancel()
+	if _, err := r.executor.ExecuteWithInput(ctx, env, source, "rclone", args...); err != nil {
+		if source.err != nil {
+			return fmt.Errorf("failed to write file: %w", source.err)
+		}
+		return fmt.Errorf("failed to write file: rclone command failed: %w", classifyRcloneError(err))
+	}
+
+	Debug("File written successfully", "path", path, "size", source.n)
+	return nil
+}
+
+func (r *rcloneImpl) DeleteFile(ctx context.Context, path string, domain string) error {
+	if _, err := r.rcloneCmd(ctx, "deletefile", path, domain); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	Debug("File deleted successfully", "path", path)
+	return nil
+}
+
+func (r *rcloneImpl) MoveFile(ctx context.Context, src string, dst string, domain string) error {
+	if err := r.transfer(ctx, "moveto", src, dst, domain); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+
+	Debug("File moved successfully", "src", src, "dst", dst)
+	return nil
+}
+
+func (r *rcloneImpl) CopyFile(ctx context.Context, src string, dst string, domain string) error {
+	if err := r.transfer(ctx, "copyto", src, dst, domain); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	Debug("File copied successfully", "src", src, "dst", dst)
+	return nil
+}
+
+// transfer runs moveto or copyto between two paths of the domain's remote
+func (r *rcloneImpl) transfer(ctx context.Context, command string, src string, dst string, domain string) error {
+	config, err := r.getRcloneConfig(domain)
+	if err != nil {
+		return fmt.Errorf("failed to get rclone config: %w", err)
+	}
+	_, err = r.rcloneCmd(ctx, command, src, domain, config.Remote+":"+dst)
+	return err
+}
+
+func (r *rcloneImpl) Mkdir(ctx context.Context, path string, domain string) error {
+	if _, err := r.rcloneCmd(ctx, "mkdir", path, domain); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	Debug("Directory created successfully", "path", path)
+	return nil
+}
+
+func coalesceKey(path string, domain string) string {
+	return domain + "|" + path
+}
+
+// treeSize sums up the files of a tree listing, for backends without a size operation
+func treeSize(ctx context.Context, listTree func(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error), path string, domain string) (DirectorySize, error) {
+	files, err := listTree(ctx, path, domain, 0)
+	if err != nil {
+		return DirectorySize{}, fmt.Errorf("failed to size path: %w", err)
+	}
+
+	var size DirectorySize
+	for _, file := range files {
+		if file.IsDir {
+			continue
+		}
+		size.Count++
+		size.Bytes += file.Size
+		if isImageName(file.Path) {
+			size.Images++
+		}
+	}
+	return size, nil
+}
+
+// walkTree lists path and its subdirectories down to depth levels with list, for
+// backends without recursive listings
+func walkTree(ctx context.Context, list func(ctx context.Context, path string, domain string) ([]RcloneFile, error), path string, domain string, depth int) ([]RcloneFile, error) {
+	files, err := list(ctx, path, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := make([]RcloneFile, 0, len(files))
+	for _, file := range files {
+		tree = append(tree, file)
+		if !file.IsDir || depth == 1 {
+			continue
+		}
+
+		dir := file.Path
+		if path != "" {
+			dir = path + "/" + file.Path
+		}
+		children, err := walkTree(ctx, list, dir, domain, max(depth-1, 0))
+		if errors.Is(err, ErrNotFound) {
+			continue // removed while listing
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			child.Path = file.Path + "/" + child.Path
+			tree = append(tree, child)
+		}
+	}
+	return tree, nil
+}
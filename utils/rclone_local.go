@@ -0,0 +1,380 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"shuto-api/config"
+)
+
+// localRclone implements Rclone directly on the filesystem for domains with
+// backend: local, serving the directory named by their remote. Paths are confined
+// to that directory, including through symlinks.
+type localRclone struct {
+	configManager config.DomainConfigManager
+}
+
+// NewLocalRclone creates a Rclone reading local directories without spawning rclone
+func NewLocalRclone(configManager config.DomainConfigManager) Rclone {
+	return &localRclone{configManager: configManager}
+}
+
+// resolve maps a remote path of the domain to a path on disk inside its root. Filesystem
+// calls can't be interrupted, a done ctx is only honoured before starting.
+func (l *localRclone) resolve(ctx context.Context, filePath string, domain string) (string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	domainConfig, err := l.configManager.GetDomainConfig(domain)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get rclone config: failed to get domain config: %w", err)
+	}
+	if domainConfig.Rclone.Remote == "" {
+		return "", "", fmt.Errorf("local backend requires remote to name a directory, domain: %s", domain)
+	}
+
+	root, err := filepath.Abs(domainConfig.Rclone.Remote)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid local root: %w", err)
+	}
+
+	// Cleaning against "/" drops any ".." that would climb above the root
+	return root, filepath.Join(root, filepath.FromSlash(path.Clean("/"+filePath))), nil
+}
+
+// confine checks that a path which exists stays inside root once symlinks are resolved
+func confine(root string, fullPath string) error {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return localError(err)
+	}
+	resolved, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		return localError(err)
+	}
+	if resolved != resolvedRoot && !strings.HasPrefix(resolved, resolvedRoot+string(filepath.Separator)) {
+		return storageError(ErrPermission, fmt.Errorf("permission denied: path escapes the local root"))
+	}
+	return nil
+}
+
+func (l *localRclone) open(ctx context.Context, filePath string, domain string) (*os.File, os.FileInfo, error) {
+	root, fullPath, err := l.resolve(ctx, filePath, domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := confine(root, fullPath); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, nil, localError(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, localError(err)
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, nil, storageError(ErrIsDirectory, fmt.Errorf("%s is a directory", filePath))
+	}
+	return file, info, nil
+}
+
+func (l *localRclone) FetchImage(ctx context.Context, filePath string, domain string) ([]byte, error) {
+	file, _, err := l.open(ctx, filePath, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+	return data, nil
+}
+
+func (l *localRclone) Open(ctx context.Context, filePath string, domain string) (*FileStream, error) {
+	file, info, err := l.open(ctx, filePath, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return &FileStream{ReadCloser: file, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *localRclone) OpenRange(ctx context.Context, filePath string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+	file, _, err := l.open(ctx, filePath, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open range: %w", err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, offset, count), file}, nil
+}
+
+func (l *localRclone) ListTree(ctx context.Context, filePath string, domain string, depth int) ([]RcloneFile, error) {
+	return walkTree(ctx, l.ListPath, filePath, domain, depth)
+}
+
+func (l *localRclone) Size(ctx context.Context, filePath string, domain string) (DirectorySize, error) {
+	return treeSize(ctx, l.ListTree, filePath, domain)
+}
+
+func (l *localRclone) ListPath(ctx context.Context, filePath string, domain string) ([]RcloneFile, error) {
+	root, fullPath, err := l.resolve(ctx, filePath, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list path: %w", err)
+	}
+	if err := confine(root, fullPath); err != nil {
+		return nil, fmt.Errorf("failed to list path: %w", err)
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list path: %w", localError(err))
+	}
+	// Like lsjson, listing a file returns the file itself
+	if !info.IsDir() {
+		return []RcloneFile{localFile(info.Name(), fullPath, info)}, nil
+	}
+
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list path: %w", localError(err))
+	}
+
+	files := make([]RcloneFile, 0, len(entries))
+	for _, entry := range entries {
+		entryPath := filepath.Join(fullPath, entry.Name())
+		// Symlinks are followed, but only when they stay inside the root
+		if confine(root, entryPath) != nil {
+			continue
+		}
+		info, err := os.Stat(entryPath)
+		if err != nil {
+			continue
+		}
+		files = append(files, localFile(entry.Name(), entryPath, info))
+	}
+	return files, nil
+}
+
+func (l *localRclone) Stat(ctx context.Context, filePath string, domain string) (RcloneFile, error) {
+	root, fullPath, err := l.resolve(ctx, filePath, domain)
+	if err != nil {
+		return RcloneFile{}, fmt.Errorf("failed to stat path: %w", err)
+	}
+	if err := confine(root, fullPath); err != nil {
+		return RcloneFile{}, fmt.Errorf("failed to stat path: %w", err)
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return RcloneFile{}, fmt.Errorf("failed to stat path: %w", localError(err))
+	}
+	file := localFile(info.Name(), fullPath, info)
+	file.Path = strings.TrimPrefix(path.Clean("/"+filePath), "/")
+	return file, nil
+}
+
+func (l *localRclone) WriteFile(ctx context.Context, filePath string, domain string, data io.Reader) error {
+	root, fullPath, err := l.resolve(ctx, filePath, domain)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := createFile(root, fullPath, data); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	Debug("File written successfully", "path", filePath)
+	return nil
+}
+
+func (l *localRclone) DeleteFile(ctx context.Context, filePath string, domain string) error {
+	root, fullPath, err := l.resolve(ctx, filePath, domain)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	if err := confine(root, fullPath); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
+		return fmt.Errorf("failed to delete file: %w", storageError(ErrIsDirectory, fmt.Errorf("%s is a directory", filePath)))
+	}
+	if err := os.Remove(fullPath); err != nil {
+		return fmt.Errorf("failed to delete file: %w", localError(err))
+	}
+
+	Debug("File deleted successfully", "path", filePath)
+	return nil
+}
+
+func (l *localRclone) MoveFile(ctx context.Context, src string, dst string, domain string) error {
+	root, srcPath, err := l.resolve(ctx, src, domain)
+	if err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	if err := confine(root, srcPath); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	if info, err := os.Stat(srcPath); err != nil {
+		return fmt.Errorf("failed to move file: %w", localError(err))
+	} else if info.IsDir() {
+		return fmt.Errorf("failed to move file: %w", storageError(ErrIsDirectory, fmt.Errorf("%s is a directory", src)))
+	}
+
+	_, dstPath, err := l.resolve(ctx, dst, domain)
+	if err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	if err := createDir(root, filepath.Dir(dstPath)); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		return fmt.Errorf("failed to move file: %w", localError(err))
+	}
+
+	Debug("File moved successfully", "src", src, "dst", dst)
+	return nil
+}
+
+func (l *localRclone) CopyFile(ctx context.Context, src string, dst string, domain string) error {
+	file, _, err := l.open(ctx, src, domain)
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	defer file.Close()
+
+	root, dstPath, err := l.resolve(ctx, dst, domain)
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err := createFile(root, dstPath, file); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	Debug("File copied successfully", "src", src, "dst", dst)
+	return nil
+}
+
+func (l *localRclone) Mkdir(ctx context.Context, dirPath string, domain string) error {
+	root, fullPath, err := l.resolve(ctx, dirPath, domain)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := createDir(root, fullPath); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	Debug("Directory created successfully", "path", dirPath)
+	return nil
+}
+
+// createDir creates dir and its missing parents inside root
+func createDir(root string, dir string) error {
+	// Check the deepest existing directory before creating anything, so that a
+	// symlink can't be used to create directories outside the root
+	existing := dir
+	for existing != root {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	if err := confine(root, existing); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return localError(err)
+	}
+	return nil
+}
+
+// createFile writes the content of r to fullPath inside root, replacing any existing file
+func createFile(root string, fullPath string, r io.Reader) error {
+	dir := filepath.Dir(fullPath)
+	if err := createDir(root, dir); err != nil {
+		return err
+	}
+
+	// Write next to the target and rename, so readers never see partial files
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return localError(err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		return localError(err)
+	}
+	return nil
+}
+
+// localFile describes a file the way rclone lsjson does
+func localFile(name string, fullPath string, info os.FileInfo) RcloneFile {
+	file := RcloneFile{
+		Path:    name,
+		Name:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime().Format(time.RFC3339Nano),
+		IsDir:   info.IsDir(),
+	}
+	if info.IsDir() {
+		file.Size = -1
+		file.MimeType = "inode/directory"
+		return file
+	}
+	file.MimeType = localMimeType(fullPath)
+	return file
+}
+
+// localMimeType detects the MIME type by extension, sniffing the content of unknown extensions
+func localMimeType(fullPath string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(fullPath)); mimeType != "" {
+		return mimeType
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	if n == 0 {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(head[:n])
+}
+
+// localError phrases filesystem errors the way rclone reports them
+func localError(err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return storageError(ErrNotFound, fmt.Errorf("object not found: %w", err))
+	case os.IsPermission(err):
+		return storageError(ErrPermission, fmt.Errorf("permission denied: %w", err))
+	default:
+		return err
+	}
+}
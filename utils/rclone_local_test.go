@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"shuto-api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLocalTestRclone(t *testing.T) (Rclone, string) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "photos"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "photos", "a.jpg"), []byte("0123456789"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "photos", "noext"), []byte("\x89PNG\r\n\x1a\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "secret.txt"), []byte("secret"), 0o644))
+
+	configManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Rclone: config.RcloneConfig{Remote: root, Backend: config.BackendLocal},
+			}, nil
+		},
+	}
+	return NewLocalRclone(configManager), base
+}
+
+func TestLocalRclone_ListAndStat(t *testing.T) {
+	rclone, _ := newLocalTestRclone(t)
+
+	files, err := rclone.ListPath(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, "a.jpg", files[0].Path)
+	assert.Equal(t, "image/jpeg", files[0].MimeType)
+	assert.Equal(t, int64(10), files[0].Size)
+	assert.Equal(t, "image/png", files[1].MimeType, "unknown extensions are sniffed")
+
+	root, err := rclone.ListPath(context.Background(), "", "test")
+	require.NoError(t, err)
+	require.Len(t, root, 1)
+	assert.True(t, root[0].IsDir)
+	assert.Equal(t, "inode/directory", root[0].MimeType)
+
+	files, err = rclone.ListPath(context.Background(), "photos/a.jpg", "test")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "a.jpg", files[0].Path)
+	_, ok := LastModified(files[0])
+	assert.True(t, ok, "ModTime must be RFC 3339")
+
+	file, err := rclone.Stat(context.Background(), "photos/a.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "photos/a.jpg", file.Path)
+
+	_, err = rclone.ListPath(context.Background(), "missing", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestLocalRclone_ListTree(t *testing.T) {
+	rclone, base := newLocalTestRclone(t)
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "root", "photos", "2024", "may"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "root", "photos", "2024", "b.jpg"), []byte("b"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "root", "photos", "2024", "may", "c.jpg"), []byte("c"), 0o644))
+
+	paths := func(files []RcloneFile) []string {
+		var paths []string
+		for _, file := range files {
+			paths = append(paths, file.Path)
+		}
+		return paths
+	}
+
+	files, err := rclone.ListTree(context.Background(), "photos", "test", 0)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"2024", "2024/b.jpg", "2024/may", "2024/may/c.jpg", "a.jpg", "noext"}, paths(files))
+
+	files, err = rclone.ListTree(context.Background(), "photos", "test", 2)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"2024", "2024/b.jpg", "2024/may", "a.jpg", "noext"}, paths(files))
+
+	files, err = rclone.ListTree(context.Background(), "", "test", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"photos"}, paths(files))
+}
+
+func TestLocalRclone_Size(t *testing.T) {
+	rclone, base := newLocalTestRclone(t)
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "root", "photos", "2024"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "root", "photos", "2024", "B.JPG"), []byte("b"), 0o644))
+
+	// noext is sniffed as an image when listed but only counted as one by name, like rclone size
+	size, err := rclone.Size(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	assert.Equal(t, DirectorySize{Count: 3, Bytes: 19, Images: 2}, size)
+
+	_, err = rclone.Size(context.Background(), "missing", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestLocalRclone_Reads(t *testing.T) {
+	rclone, _ := newLocalTestRclone(t)
+
+	data, err := rclone.FetchImage(context.Background(), "photos/a.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+
+	stream, err := rclone.Open(context.Background(), "photos/a.jpg", "test")
+	require.NoError(t, err)
+	data, _ = io.ReadAll(stream)
+	stream.Close()
+	assert.Equal(t, "0123456789", string(data))
+	assert.Equal(t, int64(10), stream.Size)
+
+	reader, err := rclone.OpenRange(context.Background(), "photos/a.jpg", "test", 3, 4)
+	require.NoError(t, err)
+	data, _ = io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "3456", string(data))
+
+	_, err = rclone.Open(context.Background(), "photos", "test")
+	assert.EqualError(t, err, "failed to open file: photos is a directory")
+}
+
+func TestLocalRclone_WriteFile(t *testing.T) {
+	rclone, base := newLocalTestRclone(t)
+
+	require.NoError(t, rclone.WriteFile(context.Background(), "out/nested/b.jpg", "test", strings.NewReader("payload")))
+	data, err := os.ReadFile(filepath.Join(base, "root", "out", "nested", "b.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	// Failed uploads leave nothing behind
+	err = rclone.WriteFile(context.Background(), "out/nested/c.jpg", "test", failingSource())
+	assert.ErrorIs(t, err, errSourceFailed)
+	entries, err := os.ReadDir(filepath.Join(base, "root", "out", "nested"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestLocalRclone_FileOperations(t *testing.T) {
+	rclone, base := newLocalTestRclone(t)
+	root := filepath.Join(base, "root")
+	ctx := context.Background()
+
+	require.NoError(t, rclone.CopyFile(ctx, "photos/a.jpg", "copies/a.jpg", "test"))
+	require.NoError(t, rclone.MoveFile(ctx, "photos/a.jpg", "moved/nested/a.jpg", "test"))
+	data, err := os.ReadFile(filepath.Join(root, "moved", "nested", "a.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+	data, err = os.ReadFile(filepath.Join(root, "copies", "a.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+	_, err = rclone.Stat(ctx, "photos/a.jpg", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, rclone.DeleteFile(ctx, "copies/a.jpg", "test"))
+	_, err = os.Stat(filepath.Join(root, "copies", "a.jpg"))
+	assert.True(t, os.IsNotExist(err))
+	assert.ErrorIs(t, rclone.DeleteFile(ctx, "copies/a.jpg", "test"), ErrNotFound)
+	assert.ErrorIs(t, rclone.DeleteFile(ctx, "photos", "test"), ErrIsDirectory)
+	assert.ErrorIs(t, rclone.MoveFile(ctx, "photos", "elsewhere", "test"), ErrIsDirectory)
+
+	require.NoError(t, rclone.Mkdir(ctx, "empty/nested", "test"))
+	file, err := rclone.Stat(ctx, "empty/nested", "test")
+	require.NoError(t, err)
+	assert.True(t, file.IsDir)
+}
+
+func TestLocalRclone_ConfinedToRoot(t *testing.T) {
+	rclone, base := newLocalTestRclone(t)
+	root := filepath.Join(base, "root")
+
+	// ".." can't climb above the root, it resolves to root/secret.txt
+	_, err := rclone.FetchImage(context.Background(), "../secret.txt", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = rclone.FetchImage(context.Background(), "photos/../../secret.txt", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Symlinks pointing outside the root are refused and hidden from listings
+	require.NoError(t, os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "link.txt")))
+	require.NoError(t, os.Symlink(base, filepath.Join(root, "linkdir")))
+
+	_, err = rclone.FetchImage(context.Background(), "link.txt", "test")
+	assert.ErrorIs(t, err, ErrPermission)
+	_, err = rclone.ListPath(context.Background(), "linkdir", "test")
+	assert.ErrorIs(t, err, ErrPermission)
+
+	files, err := rclone.ListPath(context.Background(), "", "test")
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	err = rclone.WriteFile(context.Background(), "linkdir/escaped/file.txt", "test", strings.NewReader("x"))
+	assert.ErrorIs(t, err, ErrPermission)
+	_, err = os.Stat(filepath.Join(base, "escaped"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.ErrorIs(t, rclone.MoveFile(context.Background(), "photos/noext", "linkdir/moved", "test"), ErrPermission)
+	assert.ErrorIs(t, rclone.CopyFile(context.Background(), "link.txt", "copy.txt", "test"), ErrPermission)
+	assert.ErrorIs(t, rclone.DeleteFile(context.Background(), "linkdir/secret.txt", "test"), ErrPermission)
+	assert.ErrorIs(t, rclone.Mkdir(context.Background(), "linkdir/escaped", "test"), ErrPermission)
+	_, err = os.Stat(filepath.Join(base, "secret.txt"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"shuto-api/config"
+)
+
+// rcloneObscureKey is the fixed key rclone obscures config passwords with
+var rcloneObscureKey = []byte{
+	0x9c, 0x93, 0x5b, 0x48, 0x73, 0x0a, 0x55, 0x4d,
+	0x6b, 0xfd, 0x7c, 0x63, 0xc8, 0x86, 0xa9, 0x2b,
+	0xd3, 0x90, 0x19, 0x8e, 0xb8, 0x12, 0x8a, 0xfb,
+	0xf4, 0xde, 0x16, 0x2b, 0x8b, 0x95, 0xf6, 0x38,
+}
+
+// ObscurePassword obscures a secret the way `rclone obscure` does. This keeps it from
+// being read at a glance, it is not encryption.
+func ObscurePassword(plain string) (string, error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", fmt.Errorf("failed to obscure password: %w", err)
+	}
+	return obscureWithIV(plain, iv)
+}
+
+// obscuredOptions keeps the obscured form of every secret by its hash. Obscuring uses a
+// random IV, so the first result is reused: rcd caches backends by their fs string,
+// which would otherwise change on every call.
+var obscuredOptions sync.Map
+
+// obscureOption obscures an option value once and returns the same result afterwards
+func obscureOption(plain string) (string, error) {
+	sum := sha256.Sum256([]byte(plain))
+	if obscured, ok := obscuredOptions.Load(sum); ok {
+		return obscured.(string), nil
+	}
+	obscured, err := ObscurePassword(plain)
+	if err != nil {
+		return "", err
+	}
+	actual, _ := obscuredOptions.LoadOrStore(sum, obscured)
+	return actual.(string), nil
+}
+
+func obscureWithIV(plain string, iv []byte) (string, error) {
+	block, err := aes.NewCipher(rcloneObscureKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to obscure password: %w", err)
+	}
+	obscured := make([]byte, aes.BlockSize+len(plain))
+	copy(obscured, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(obscured[aes.BlockSize:], []byte(plain))
+	return base64.RawURLEncoding.EncodeToString(obscured), nil
+}
+
+type rcloneOption struct {
+	name  string
+	value string
+}
+
+// rcloneOptions returns the options of a remote sorted by name, with the options
+// listed in Obscure obscured
+func rcloneOptions(cfg config.RcloneConfig) ([]rcloneOption, error) {
+	names := make([]string, 0, len(cfg.Options))
+	for name := range cfg.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := make([]rcloneOption, 0, len(names))
+	for _, name := range names {
+		value := cfg.Options[name]
+		if slices.Contains(cfg.Obscure, name) {
+			obscured, err := obscureOption(value)
+			if err != nil {
+				return nil, err
+			}
+			value = obscured
+		}
+		options = append(options, rcloneOption{name: name, value: value})
+	}
+	return options, nil
+}
+
+// rcloneEnv turns the options of a remote into RCLONE_CONFIG_<REMOTE>_<OPTION>
+// variables, which rclone reads as if they were in the remote's rclone.conf section
+func rcloneEnv(cfg config.RcloneConfig) ([]string, error) {
+	options, err := rcloneOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make([]string, 0, len(options))
+	for _, option := range options {
+		env = append(env, rcloneConfigEnvName(cfg.Remote, option.name)+"="+option.value)
+	}
+	return env, nil
+}
+
+// rcloneConfigEnvName follows rclone's naming of config environment variables
+func rcloneConfigEnvName(remote string, option string) string {
+	remote = strings.ToUpper(strings.ReplaceAll(remote, "-", "_"))
+	option = strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+	return "RCLONE_CONFIG_" + remote + "_" + option
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"shuto-api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// revealPassword undoes ObscurePassword, like `rclone reveal`
+func revealPassword(t *testing.T, obscured string) string {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(obscured)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(data), aes.BlockSize)
+	block, err := aes.NewCipher(rcloneObscureKey)
+	require.NoError(t, err)
+	plain := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCTR(block, data[:aes.BlockSize]).XORKeyStream(plain, data[aes.BlockSize:])
+	return string(plain)
+}
+
+func TestObscurePassword(t *testing.T) {
+	// Known outputs of rclone's own implementation
+	tests := []struct {
+		plain string
+		iv    string
+		want  string
+	}{
+		{"", "aaaaaaaaaaaaaaaa", "YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"potato", "aaaaaaaaaaaaaaaa", "YWFhYWFhYWFhYWFhYWFhYXMaGgIlEQ"},
+		{"potato", "bbbbbbbbbbbbbbbb", "YmJiYmJiYmJiYmJiYmJiYp3gcEWbAw"},
+	}
+	for _, tt := range tests {
+		got, err := obscureWithIV(tt.plain, []byte(tt.iv))
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+
+	obscured, err := ObscurePassword("s3cret")
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", revealPassword(t, obscured))
+}
+
+func TestRcloneEnv(t *testing.T) {
+	env, err := rcloneEnv(config.RcloneConfig{
+		Remote:  "my-server",
+		Options: map[string]string{"url": "https://dav.example.com", "pass": "s3cret", "bearer-token": "abc"},
+		Obscure: []string{"pass"},
+	})
+	require.NoError(t, err)
+	require.Len(t, env, 3)
+	assert.Equal(t, "RCLONE_CONFIG_MY_SERVER_BEARER_TOKEN=abc", env[0])
+	assert.Equal(t, "RCLONE_CONFIG_MY_SERVER_URL=https://dav.example.com", env[2])
+
+	name, obscured, _ := strings.Cut(env[1], "=")
+	assert.Equal(t, "RCLONE_CONFIG_MY_SERVER_PASS", name)
+	assert.NotEqual(t, "s3cret", obscured)
+	assert.Equal(t, "s3cret", revealPassword(t, obscured))
+}
+
+func TestOptionsReachRcloneThroughEnvironment(t *testing.T) {
+	var gotEnv, gotArgs []string
+	executor := &MockCommandExecutor{
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+			gotEnv, gotArgs = env, args
+			return []byte("[]"), nil
+		},
+	}
+	configManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{Rclone: config.RcloneConfig{
+				Remote:  "server",
+				Options: map[string]string{"type": "webdav", "pass": "s3cret"},
+			}}, nil
+		},
+	}
+
+	_, err := NewRclone(executor, configManager).ListPath(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lsjson", "server:photos"}, gotArgs)
+	assert.Equal(t, []string{"RCLONE_CONFIG_SERVER_PASS=s3cret", "RCLONE_CONFIG_SERVER_TYPE=webdav"}, gotEnv)
+}
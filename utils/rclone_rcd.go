@@ -0,0 +1,329 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"shuto-api/config"
+)
+
+// rcdRclone implements Rclone on top of a long-lived rclone rcd, so that
+// no process is spawned and no configuration re-read per operation
+type rcdRclone struct {
+	connector     RcdConnector
+	configManager config.DomainConfigManager
+
+	// Concurrent identical reads share a single rc call
+	fetchGroup CallGroup[[]byte]
+	listGroup  CallGroup[[]RcloneFile]
+}
+
+// NewRcdRclone creates a Rclone backed by the rc API of the connected rcd
+func NewRcdRclone(connector RcdConnector, configManager config.DomainConfigManager) Rclone {
+	return &rcdRclone{
+		connector:     connector,
+		configManager: configManager,
+	}
+}
+
+// remote resolves the rcd client and the fs string of the domain's remote
+func (r *rcdRclone) remote(domain string) (*RcdClient, string, error) {
+	domainConfig, err := r.configManager.GetDomainConfig(domain)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get rclone config: failed to get domain config: %w", err)
+	}
+	fs, err := rcdFs(domainConfig.Rclone)
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := r.connector.Client()
+	if err != nil {
+		return nil, "", err
+	}
+	return client, fs, nil
+}
+
+// rcdFs builds the fs string of a remote. Flags can't be passed per call, so backend
+// flags such as --webdav-url=... become connection string parameters (url="..."),
+// as do the remote's options.
+func rcdFs(cfg config.RcloneConfig) (string, error) {
+	options, err := rcloneOptions(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// A remote only defined by its options is created on the fly
+	var fs strings.Builder
+	if backendType, ok := cfg.Options["type"]; ok {
+		fs.WriteString(":" + backendType)
+	} else {
+		fs.WriteString(cfg.Remote)
+	}
+	for _, option := range options {
+		if option.name != "type" {
+			fs.WriteString("," + option.name + "=" + rcdQuote(option.value))
+		}
+	}
+	for _, flag := range cfg.Flags {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+		_, option, hasBackend := strings.Cut(name, "-")
+		if !hasValue || !hasBackend {
+			Debug("Ignoring rclone flag that can't be passed to rcd", "flag", name)
+			continue
+		}
+		fs.WriteString("," + strings.ReplaceAll(option, "-", "_") + "=" + rcdQuote(value))
+	}
+	fs.WriteString(":")
+	return fs.String(), nil
+}
+
+// rcdQuote quotes a connection string parameter value
+func rcdQuote(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+}
+
+func (r *rcdRclone) FetchImage(ctx context.Context, path string, domain string) ([]byte, error) {
+	output, err, shared := r.fetchGroup.DoContext(ctx, coalesceKey(path, domain), func(ctx context.Context) ([]byte, error) {
+		client, fs, err := r.remote(domain)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Serve(ctx, fs, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+
+	Debug("Image fetched successfully", "path", path, "size", len(output), "coalesced", shared)
+	return output, nil
+}
+
+func (r *rcdRclone) Open(ctx context.Context, path string, domain string) (*FileStream, error) {
+	file, err := r.Stat(ctx, path, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if file.IsDir {
+		return nil, storageError(ErrIsDirectory, fmt.Errorf("failed to open file: %s is a directory", path))
+	}
+
+	client, fs, err := r.remote(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	resp, err := client.Serve(ctx, fs, path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	modTime, _ := time.Parse(time.RFC3339Nano, file.ModTime)
+	return &FileStream{ReadCloser: resp.Body, Size: file.Size, ModTime: modTime}, nil
+}
+
+func (r *rcdRclone) OpenRange(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+	client, fs, err := r.remote(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open range: %w", err)
+	}
+
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+count-1)}}
+	resp, err := client.Serve(ctx, fs, path, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open range: %w", err)
+	}
+
+	// The range was ignored, skip to it
+	if resp.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to open range: %w", err)
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, count), resp.Body}, nil
+}
+
+func (r *rcdRclone) ListPath(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+	files, err, shared := r.listGroup.DoContext(ctx, coalesceKey(path, domain), func(ctx context.Context) ([]RcloneFile, error) {
+		client, fs, err := r.remote(domain)
+		if err != nil {
+			return nil, err
+		}
+
+		// Listing below the path keeps entry paths relative to it, as with lsjson
+		var result struct {
+			List []RcloneFile `json:"list"`
+		}
+		listErr := client.Call(ctx, "operations/list", map[string]any{"fs": fs + path, "remote": ""}, &result)
+		if listErr == nil {
+			return result.List, nil
+		}
+
+		// lsjson of a file lists the file itself, the rc API only lists directories
+		file, err := r.Stat(ctx, path, domain)
+		if err != nil || file.IsDir {
+			return nil, listErr
+		}
+		file.Path = file.Name
+		return []RcloneFile{file}, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list path: %w", err)
+	}
+
+	Debug("Path listed successfully", "path", path, "count", len(files), "coalesced", shared)
+	return files, nil
+}
+
+func (r *rcdRclone) ListTree(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error) {
+	key := coalesceKey(path, domain) + "|R" + strconv.Itoa(depth)
+	files, err, shared := r.listGroup.DoContext(ctx, key, func(ctx context.Context) ([]RcloneFile, error) {
+		client, fs, err := r.remote(domain)
+		if err != nil {
+			return nil, err
+		}
+
+		params := map[string]any{"fs": fs + path, "remote": "", "opt": map[string]any{"recurse": true}}
+		if depth > 0 {
+			params["_config"] = map[string]any{"MaxDepth": depth}
+		}
+		var result struct {
+			List []RcloneFile `json:"list"`
+		}
+		if err := client.Call(ctx, "operations/list", params, &result); err != nil {
+			return nil, err
+		}
+		return result.List, nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		// The tree of a file is the file itself
+		return r.ListPath(ctx, path, domain)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tree: %w", err)
+	}
+
+	Debug("Tree listed successfully", "path", path, "depth", depth, "count", len(files), "coalesced", shared)
+	return files, nil
+}
+
+// Size calls operations/size twice, the second time with a filter only including images
+func (r *rcdRclone) Size(ctx context.Context, path string, domain string) (DirectorySize, error) {
+	client, fs, err := r.remote(domain)
+	if err != nil {
+		return DirectorySize{}, fmt.Errorf("failed to size path: %w", err)
+	}
+
+	var size, images DirectorySize
+	if err := client.Call(ctx, "operations/size", map[string]any{"fs": fs + path}, &size); err != nil {
+		return DirectorySize{}, fmt.Errorf("failed to size path: %w", err)
+	}
+	params := map[string]any{"fs": fs + path, "_filter": map[string]any{"IncludeRule": []string{imageFilter}, "IgnoreCase": true}}
+	if err := client.Call(ctx, "operations/size", params, &images); err != nil {
+		return DirectorySize{}, fmt.Errorf("failed to size path: %w", err)
+	}
+	size.Images = images.Count
+
+	Debug("Path sized successfully", "path", path, "count", size.Count, "bytes", size.Bytes)
+	return size, nil
+}
+
+func (r *rcdRclone) Stat(ctx context.Context, path string, domain string) (RcloneFile, error) {
+	client, fs, err := r.remote(domain)
+	if err != nil {
+		return RcloneFile{}, fmt.Errorf("failed to stat path: %w", err)
+	}
+
+	var result struct {
+		Item *RcloneFile `json:"item"`
+	}
+	if err := client.Call(ctx, "operations/stat", map[string]any{"fs": fs, "remote": path}, &result); err != nil {
+		return RcloneFile{}, fmt.Errorf("failed to stat path: %w", err)
+	}
+	if result.Item == nil {
+		return RcloneFile{}, storageError(ErrNotFound, fmt.Errorf("failed to stat path: object not found: %s", path))
+	}
+	return *result.Item, nil
+}
+
+func (r *rcdRclone) WriteFile(ctx context.Context, filePath string, domain string, data io.Reader) error {
+	client, fs, err := r.remote(domain)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	dir, name := path.Split(filePath)
+	if err := client.Upload(ctx, fs, strings.TrimSuffix(dir, "/"), name, data); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	Debug("File written successfully", "path", filePath)
+	return nil
+}
+
+func (r *rcdRclone) DeleteFile(ctx context.Context, filePath string, domain string) error {
+	client, fs, err := r.remote(domain)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	if err := client.Call(ctx, "operations/deletefile", map[string]any{"fs": fs, "remote": filePath}, nil); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	Debug("File deleted successfully", "path", filePath)
+	return nil
+}
+
+func (r *rcdRclone) MoveFile(ctx context.Context, src string, dst string, domain string) error {
+	if err := r.transfer(ctx, "operations/movefile", src, dst, domain); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+
+	Debug("File moved successfully", "src", src, "dst", dst)
+	return nil
+}
+
+func (r *rcdRclone) CopyFile(ctx context.Context, src string, dst string, domain string) error {
+	if err := r.transfer(ctx, "operations/copyfile", src, dst, domain); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	Debug("File copied successfully", "src", src, "dst", dst)
+	return nil
+}
+
+// transfer calls movefile or copyfile between two paths of the domain's remote
+func (r *rcdRclone) transfer(ctx context.Context, method string, src string, dst string, domain string) error {
+	client, fs, err := r.remote(domain)
+	if err != nil {
+		return err
+	}
+	return client.Call(ctx, method, map[string]any{"srcFs": fs, "srcRemote": src, "dstFs": fs, "dstRemote": dst}, nil)
+}
+
+func (r *rcdRclone) Mkdir(ctx context.Context, dirPath string, domain string) error {
+	client, fs, err := r.remote(domain)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := client.Call(ctx, "operations/mkdir", map[string]any{"fs": fs, "remote": dirPath}, nil); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	Debug("Directory created successfully", "path", dirPath)
+	return nil
+}
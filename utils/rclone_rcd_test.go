@@ -0,0 +1,427 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shuto-api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rcdStandIn mimics the parts of the rclone rc API used by rcdRclone, serving the
+// files of a single remote named "test"
+type rcdStandIn struct {
+	mu    sync.Mutex
+	files map[string][]byte // path -> content
+	calls []string
+}
+
+func (s *rcdStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, r.Method+" "+r.URL.Path)
+
+	if strings.HasPrefix(r.URL.Path, "/[") {
+		fs, filePath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/["), "]/")
+		content, ok := s.files[strings.TrimPrefix(fs, "test:")+filePath]
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, filePath, time.Time{}, bytes.NewReader(content))
+		return
+	}
+
+	if r.URL.Path == "/operations/uploadfile" {
+		file, header, err := r.FormFile("file0")
+		if err != nil {
+			http.Error(w, `{"error":"no file"}`, http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		s.files[r.URL.Query().Get("remote")+"/"+header.Filename] = data
+		w.Write([]byte("{}"))
+		return
+	}
+
+	var params struct {
+		Fs        string `json:"fs"`
+		Remote    string `json:"remote"`
+		SrcRemote string `json:"srcRemote"`
+		DstRemote string `json:"dstRemote"`
+		Opt       struct {
+			Recurse bool `json:"recurse"`
+		} `json:"opt"`
+		Config struct {
+			MaxDepth int `json:"MaxDepth"`
+		} `json:"_config"`
+		Filter struct {
+			IncludeRule []string `json:"IncludeRule"`
+		} `json:"_filter"`
+	}
+	json.NewDecoder(r.Body).Decode(&params)
+	root := strings.TrimPrefix(params.Fs, "test:")
+
+	switch r.URL.Path {
+	case "/operations/stat":
+		var item *RcloneFile
+		if content, ok := s.files[params.Remote]; ok {
+			item = &RcloneFile{Path: params.Remote, Name: filepath.Base(params.Remote), Size: int64(len(content)), ModTime: "2024-01-01T00:00:00Z"}
+		} else if s.isDir(params.Remote) {
+			item = &RcloneFile{Path: params.Remote, Name: filepath.Base(params.Remote), Size: -1, IsDir: true}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"item": item})
+	case "/operations/list":
+		if !s.isDir(root) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"directory not found","status":404}`))
+			return
+		}
+		list := []RcloneFile{}
+		for name, content := range s.files {
+			rel, ok := strings.CutPrefix(name, root+"/")
+			levels := strings.Count(rel, "/") + 1
+			if ok && (levels == 1 || params.Opt.Recurse && (params.Config.MaxDepth == 0 || levels <= params.Config.MaxDepth)) {
+				list = append(list, RcloneFile{Path: rel, Name: rel, Size: int64(len(content))})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"list": list})
+	case "/operations/size":
+		var size DirectorySize
+		for name, content := range s.files {
+			// The only include rule used is imageFilter
+			if strings.HasPrefix(name, root+"/") && (len(params.Filter.IncludeRule) == 0 || isImageName(name)) {
+				size.Count++
+				size.Bytes += int64(len(content))
+			}
+		}
+		json.NewEncoder(w).Encode(size)
+	case "/operations/deletefile", "/operations/movefile", "/operations/copyfile":
+		src := params.Remote + params.SrcRemote
+		content, ok := s.files[src]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"object not found","status":404}`))
+			return
+		}
+		if r.URL.Path != "/operations/copyfile" {
+			delete(s.files, src)
+		}
+		if params.DstRemote != "" {
+			s.files[params.DstRemote] = content
+		}
+		w.Write([]byte("{}"))
+	case "/operations/mkdir":
+		w.Write([]byte("{}"))
+	default:
+		http.Error(w, `{"error":"unknown method"}`, http.StatusNotFound)
+	}
+}
+
+func (s *rcdStandIn) isDir(dir string) bool {
+	for name := range s.files {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func newRcdTestRclone(t *testing.T) (Rclone, *rcdStandIn) {
+	standIn := &rcdStandIn{files: map[string][]byte{
+		"photos/a.jpg": []byte("0123456789"),
+		"photos/b.jpg": []byte("bbb"),
+	}}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	configManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Rclone: config.RcloneConfig{Remote: "test", Backend: config.BackendRcd},
+			}, nil
+		},
+	}
+	return NewRcdRclone(NewRcdClient(server.URL, "user", "pass", server.Client()), configManager), standIn
+}
+
+func TestRcdRclone_ListAndStat(t *testing.T) {
+	rclone, _ := newRcdTestRclone(t)
+
+	files, err := rclone.ListPath(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a.jpg", "b.jpg"}, []string{files[0].Path, files[1].Path})
+
+	// Listing a file returns the file itself, as lsjson does
+	files, err = rclone.ListPath(context.Background(), "photos/a.jpg", "test")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "a.jpg", files[0].Path)
+	assert.Equal(t, int64(10), files[0].Size)
+
+	_, err = rclone.ListPath(context.Background(), "missing", "test")
+	assert.ErrorContains(t, err, "not found")
+
+	file, err := rclone.Stat(context.Background(), "photos/b.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), file.Size)
+
+	_, err = rclone.Stat(context.Background(), "photos/missing.jpg", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRcdRclone_ListTree(t *testing.T) {
+	rclone, standIn := newRcdTestRclone(t)
+	standIn.files["photos/2024/c.jpg"] = []byte("c")
+	standIn.files["photos/2024/may/d.jpg"] = []byte("d")
+
+	paths := func(depth int) []string {
+		files, err := rclone.ListTree(context.Background(), "photos", "test", depth)
+		require.NoError(t, err)
+		var paths []string
+		for _, file := range files {
+			paths = append(paths, file.Path)
+		}
+		return paths
+	}
+	assert.ElementsMatch(t, []string{"a.jpg", "b.jpg", "2024/c.jpg", "2024/may/d.jpg"}, paths(0))
+	assert.ElementsMatch(t, []string{"a.jpg", "b.jpg", "2024/c.jpg"}, paths(2))
+
+	// The tree of a file is the file itself
+	files, err := rclone.ListTree(context.Background(), "photos/a.jpg", "test", 0)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "a.jpg", files[0].Path)
+}
+
+func TestRcdRclone_Size(t *testing.T) {
+	rclone, standIn := newRcdTestRclone(t)
+	standIn.files["photos/2024/c.jpg"] = []byte("c")
+	standIn.files["photos/notes.txt"] = []byte("notes")
+
+	size, err := rclone.Size(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	assert.Equal(t, DirectorySize{Count: 4, Bytes: 19, Images: 3}, size)
+}
+
+func TestRcdRclone_Streams(t *testing.T) {
+	rclone, _ := newRcdTestRclone(t)
+
+	data, err := rclone.FetchImage(context.Background(), "photos/a.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+
+	stream, err := rclone.Open(context.Background(), "photos/a.jpg", "test")
+	require.NoError(t, err)
+	data, _ = io.ReadAll(stream)
+	stream.Close()
+	assert.Equal(t, "0123456789", string(data))
+	assert.Equal(t, int64(10), stream.Size)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), stream.ModTime)
+
+	reader, err := rclone.OpenRange(context.Background(), "photos/a.jpg", "test", 3, 4)
+	require.NoError(t, err)
+	data, _ = io.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "3456", string(data))
+
+	_, err = rclone.FetchImage(context.Background(), "photos/missing.jpg", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = rclone.Open(context.Background(), "photos", "test")
+	assert.EqualError(t, err, "failed to open file: photos is a directory")
+	assert.ErrorIs(t, err, ErrIsDirectory)
+}
+
+func TestRcdRclone_WriteFile(t *testing.T) {
+	rclone, standIn := newRcdTestRclone(t)
+
+	require.NoError(t, rclone.WriteFile(context.Background(), "out/c.jpg", "test", strings.NewReader("payload")))
+	assert.Equal(t, []byte("payload"), standIn.files["out/c.jpg"])
+
+	err := rclone.WriteFile(context.Background(), "out/d.jpg", "test", failingSource())
+	assert.ErrorIs(t, err, errSourceFailed)
+	assert.NotContains(t, standIn.files, "out/d.jpg")
+}
+
+func TestRcdRclone_FileOperations(t *testing.T) {
+	rclone, standIn := newRcdTestRclone(t)
+	ctx := context.Background()
+
+	require.NoError(t, rclone.CopyFile(ctx, "photos/a.jpg", "copies/a.jpg", "test"))
+	require.NoError(t, rclone.MoveFile(ctx, "photos/b.jpg", "moved/b.jpg", "test"))
+	require.NoError(t, rclone.DeleteFile(ctx, "photos/a.jpg", "test"))
+	require.NoError(t, rclone.Mkdir(ctx, "empty", "test"))
+	assert.Equal(t, map[string][]byte{
+		"copies/a.jpg": []byte("0123456789"),
+		"moved/b.jpg":  []byte("bbb"),
+	}, standIn.files)
+
+	assert.ErrorIs(t, rclone.DeleteFile(ctx, "photos/a.jpg", "test"), ErrNotFound)
+}
+
+func TestRcdFs(t *testing.T) {
+	fs, err := rcdFs(config.RcloneConfig{
+		Remote: "webdav",
+		Flags:  []string{"--webdav-url=https://dav.example.com/a,b", `--webdav-pass=se"cret`, "--fast-list"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `webdav,url="https://dav.example.com/a,b",pass="se""cret":`, fs)
+
+	// Remotes defined by their options alone are created on the fly
+	fs, err = rcdFs(config.RcloneConfig{
+		Remote:  "server",
+		Options: map[string]string{"type": "webdav", "url": "https://dav.example.com", "user": "me"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `:webdav,url="https://dav.example.com",user="me":`, fs)
+
+	// rcd caches backends by fs string, obscured options must not change it between calls
+	obscured := config.RcloneConfig{
+		Remote:  "server",
+		Options: map[string]string{"type": "webdav", "url": "https://dav.example.com", "pass": "s3cret"},
+		Obscure: []string{"pass"},
+	}
+	first, err := rcdFs(obscured)
+	require.NoError(t, err)
+	second, err := rcdFs(obscured)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.NotContains(t, first, "s3cret")
+}
+
+func TestBackendRouter(t *testing.T) {
+	backend := ""
+	configManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{Rclone: config.RcloneConfig{Remote: "test", Backend: backend}}, nil
+		},
+	}
+	backendFor := func(name string) Rclone {
+		return &MockRclone{FetchImageFunc: func(ctx context.Context, path string, domain string) ([]byte, error) {
+			return []byte(name), nil
+		}}
+	}
+	router := NewBackendRouter(configManager, map[string]Rclone{
+		config.BackendExec: backendFor("exec"),
+		config.BackendRcd:  backendFor("rcd"),
+	})
+
+	data, err := router.FetchImage(context.Background(), "a.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "exec", string(data))
+
+	backend = config.BackendRcd
+	data, err = router.FetchImage(context.Background(), "a.jpg", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "rcd", string(data))
+
+	backend = "ftp"
+	_, err = router.FetchImage(context.Background(), "a.jpg", "test")
+	assert.EqualError(t, err, `unknown storage backend "ftp" for domain: test`)
+}
+
+func TestBackendRouter_Timeouts(t *testing.T) {
+	configManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Rclone:   config.RcloneConfig{Remote: "test"},
+				Timeouts: config.TimeoutSettings{List: 50 * time.Millisecond},
+			}, nil
+		},
+	}
+	var deadline time.Time
+	router := NewBackendRouter(configManager, map[string]Rclone{
+		config.BackendExec: &MockRclone{
+			ListPathFunc: func(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			FetchImageFunc: func(ctx context.Context, path string, domain string) ([]byte, error) {
+				deadline, _ = ctx.Deadline()
+				return nil, nil
+			},
+		},
+	})
+
+	start := time.Now()
+	_, err := router.ListPath(context.Background(), "photos", "test")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Unset timeouts fall back to the defaults
+	_, err = router.FetchImage(context.Background(), "a.jpg", "test")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(config.DefaultFetchTimeout), deadline, time.Second)
+}
+
+func TestBackendRouter_Root(t *testing.T) {
+	root := "shared/example.com/"
+	configManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{Rclone: config.RcloneConfig{Remote: "test"}, Root: root}, nil
+		},
+	}
+	var listed []string
+	router := NewBackendRouter(configManager, map[string]Rclone{
+		config.BackendExec: &MockRclone{
+			ListPathFunc: func(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+				listed = append(listed, path)
+				return nil, nil
+			},
+		},
+	})
+
+	for _, path := range []string{"photos", "photos//2024/", ""} {
+		_, err := router.ListPath(context.Background(), path, "test")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"shared/example.com/photos", "shared/example.com/photos/2024", "shared/example.com"}, listed)
+
+	_, err := router.ListPath(context.Background(), "photos/../../other.com", "test")
+	assert.ErrorIs(t, err, ErrInvalidPath)
+
+	root = ""
+	listed = nil
+	_, err = router.ListPath(context.Background(), "photos", "test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"photos"}, listed)
+}
+
+func TestRcdSupervisor_RestartsCrashedProcess(t *testing.T) {
+	binary := filepath.Join(t.TempDir(), "rclone")
+	require.NoError(t, os.WriteFile(binary, []byte("#!/bin/sh\nexit 1\n"), 0o755))
+
+	supervisor, err := NewRcdSupervisor(RcdOptions{
+		Binary:       binary,
+		Addr:         "127.0.0.1:1",
+		StartTimeout: 50 * time.Millisecond,
+		RestartDelay: 5 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer supervisor.Close()
+
+	_, err = supervisor.Client()
+	assert.ErrorContains(t, err, "did not become ready")
+
+	assert.Eventually(t, func() bool {
+		return supervisor.Restarts() >= 2
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"shuto-api/config"
+)
+
+// backendRouter dispatches every operation to the storage backend selected by the
+// domain's rclone.backend setting, confined to the domain's root and bounded by its
+// timeouts
+type backendRouter struct {
+	configManager config.DomainConfigManager
+	backends      map[string]Rclone
+}
+
+// NewBackendRouter creates a Rclone that selects one of the given backends per domain.
+// Domains without a backend setting use config.BackendExec.
+func NewBackendRouter(configManager config.DomainConfigManager, backends map[string]Rclone) Rclone {
+	return &backendRouter{
+		configManager: configManager,
+		backends:      backends,
+	}
+}
+
+func (b *backendRouter) backend(domain string, path string) (Rclone, string, config.TimeoutSettings, error) {
+	domainConfig, err := b.configManager.GetDomainConfig(domain)
+	if err != nil {
+		return nil, "", config.TimeoutSettings{}, fmt.Errorf("failed to get rclone config: failed to get domain config: %w", err)
+	}
+	path, err = rootedPath(domainConfig.Root, path)
+	if err != nil {
+		return nil, "", config.TimeoutSettings{}, err
+	}
+
+	name := domainConfig.Rclone.Backend
+	if name == "" {
+		name = config.BackendExec
+	}
+	backend, ok := b.backends[name]
+	if !ok {
+		return nil, "", config.TimeoutSettings{}, fmt.Errorf("unknown storage backend %q for domain: %s", name, domain)
+	}
+	return backend, path, domainConfig.Timeouts.WithDefaults(), nil
+}
+
+func (b *backendRouter) FetchImage(ctx context.Context, path string, domain string) ([]byte, error) {
+	backend, path, timeouts, err := b.backend(domain, path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Fetch)
+	defer cancel()
+	return backend.FetchImage(ctx, path, domain)
+}
+
+// Streams are bound to ctx only, a long download is not a hung backend
+func (b *backendRouter) Open(ctx context.Context, path string, domain string) (*FileStream, error) {
+	backend, path, _, err := b.backend(domain, path)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Open(ctx, path, domain)
+}
+
+func (b *backendRouter) OpenRange(ctx context.Context, path string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+	backend, path, _, err := b.backend(domain, path)
+	if err != nil {
+		return nil, err
+	}
+	return backend.OpenRange(ctx, path, domain, offset, count)
+}
+
+func (b *backendRouter) ListTree(ctx context.Context, path string, domain string, depth int) ([]RcloneFile, error) {
+	backend, path, timeouts, err := b.backend(domain, path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.List)
+	defer cancel()
+	return backend.ListTree(ctx, path, domain, depth)
+}
+
+func (b *backendRouter) Size(ctx context.Context, path string, domain string) (DirectorySize, error) {
+	backend, path, timeouts, err := b.backend(domain, path)
+	if err != nil {
+		return DirectorySize{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.List)
+	defer cancel()
+	return backend.Size(ctx, path, domain)
+}
+
+func (b *backendRouter) ListPath(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+	backend, path, timeouts, err := b.backend(domain, path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.List)
+	defer cancel()
+	return backend.ListPath(ctx, path, domain)
+}
+
+func (b *backendRouter) Stat(ctx context.Context, path string, domain string) (RcloneFile, error) {
+	backend, path, timeouts, err := b.backend(domain, path)
+	if err != nil {
+		return RcloneFile{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.List)
+	defer cancel()
+	return backend.Stat(ctx, path, domain)
+}
+
+func (b *backendRouter) WriteFile(ctx context.Context, path string, domain string, data io.Reader) error {
+	backend, path, timeouts, err := b.backend(domain, path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+	return backend.WriteFile(ctx, path, domain, data)
+}
+
+func (b *backendRouter) DeleteFile(ctx context.Context, path string, domain string) error {
+	backend, path, timeouts, err := b.backend(domain, path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+	return backend.DeleteFile(ctx, path, domain)
+}
+
+func (b *backendRouter) MoveFile(ctx context.Context, src string, dst string, domain string) error {
+	backend, src, dst, timeouts, err := b.transfer(domain, src, dst)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+	return backend.MoveFile(ctx, src, dst, domain)
+}
+
+func (b *backendRouter) CopyFile(ctx context.Context, src string, dst string, domain string) error {
+	backend, src, dst, timeouts, err := b.transfer(domain, src, dst)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+	return backend.CopyFile(ctx, src, dst, domain)
+}
+
+// transfer resolves both paths of a move or copy
+func (b *backendRouter) transfer(domain string, src string, dst string) (Rclone, string, string, config.TimeoutSettings, error) {
+	backend, src, timeouts, err := b.backend(domain, src)
+	if err != nil {
+		return nil, "", "", config.TimeoutSettings{}, err
+	}
+	_, dst, _, err = b.backend(domain, dst)
+	if err != nil {
+		return nil, "", "", config.TimeoutSettings{}, err
+	}
+	return backend, src, dst, timeouts, nil
+}
+
+func (b *backendRouter) Mkdir(ctx context.Context, path string, domain string) error {
+	backend, path, timeouts, err := b.backend(domain, path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+	return backend.Mkdir(ctx, path, domain)
+}
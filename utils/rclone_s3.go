@@ -0,0 +1,462 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"shuto-api/config"
+)
+
+// s3Rclone implements Rclone against S3-compatible object storage without rclone,
+// for domains with backend: s3. Directories are emulated with "/" delimited prefixes.
+type s3Rclone struct {
+	configManager config.DomainConfigManager
+	httpClient    *http.Client
+	now           func() time.Time
+
+	// Concurrent identical reads share a single request
+	fetchGroup CallGroup[[]byte]
+	listGroup  CallGroup[[]RcloneFile]
+}
+
+// NewS3Rclone creates a Rclone talking to the S3 endpoint configured per domain
+func NewS3Rclone(configManager config.DomainConfigManager, httpClient *http.Client) Rclone {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &s3Rclone{
+		configManager: configManager,
+		httpClient:    httpClient,
+		now:           time.Now,
+	}
+}
+
+func (s *s3Rclone) s3Config(domain string) (*config.S3Config, error) {
+	domainConfig, err := s.configManager.GetDomainConfig(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rclone config: failed to get domain config: %w", err)
+	}
+	cfg := domainConfig.Rclone.S3
+	if cfg == nil || cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 backend requires s3.endpoint and s3.bucket, domain: %s", domain)
+	}
+	return cfg, nil
+}
+
+// do sends a signed request for key, query holds sub-resource parameters such as list-type
+func (s *s3Rclone) do(ctx context.Context, domain string, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	payloadHash := s3EmptyPayloadHash
+	if len(body) > 0 {
+		payloadHash = sha256Hex(body)
+	}
+	return s.send(ctx, domain, method, key, query, header, bytes.NewReader(body), int64(len(body)), payloadHash)
+}
+
+// send sends a signed request with a body of size bytes hashing to payloadHash
+func (s *s3Rclone) send(ctx context.Context, domain string, method string, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	cfg, err := s.s3Config(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	target := *endpoint
+	if cfg.PathStyle {
+		target.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + cfg.Bucket + "/" + key
+	} else {
+		target.Host = cfg.Bucket + "." + endpoint.Host
+		target.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + key
+	}
+	// Send the path and query exactly as they were signed
+	target.RawQuery = s3CanonicalQuery(query)
+	target.RawPath = s3CanonicalURI(&target)
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 request: %w", err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if cfg.AccessKeyID != "" {
+		signS3Request(req, payloadHash, cfg.AccessKeyID, cfg.SecretAccessKey, cfg.Region, s.now())
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, classifyTransportError(fmt.Errorf("s3 %s failed: %w", method, err))
+	}
+	return resp, nil
+}
+
+func (s *s3Rclone) getObject(ctx context.Context, key string, domain string, header http.Header) (*http.Response, error) {
+	resp, err := s.do(ctx, domain, http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, s3Error("GetObject", key, resp)
+	}
+	return resp, nil
+}
+
+func (s *s3Rclone) FetchImage(ctx context.Context, filePath string, domain string) ([]byte, error) {
+	key := s3Key(filePath)
+	output, err, shared := s.fetchGroup.DoContext(ctx, coalesceKey(key, domain), func(ctx context.Context) ([]byte, error) {
+		resp, err := s.getObject(ctx, key, domain, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+
+	Debug("Image fetched successfully", "path", filePath, "size", len(output), "coalesced", shared)
+	return output, nil
+}
+
+func (s *s3Rclone) Open(ctx context.Context, filePath string, domain string) (*FileStream, error) {
+	resp, err := s.getObject(ctx, s3Key(filePath), domain, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &FileStream{ReadCloser: resp.Body, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3Rclone) OpenRange(ctx context.Context, filePath string, domain string, offset int64, count int64) (io.ReadCloser, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+count-1)}}
+	resp, err := s.getObject(ctx, s3Key(filePath), domain, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open range: %w", err)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to open range: s3 ignored the requested range")
+	}
+	return resp.Body, nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response we use
+type s3ListResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Rclone) listObjects(ctx context.Context, prefix string, domain string, maxKeys int, continuationToken string) (*s3ListResult, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"delimiter": {"/"},
+		"prefix":    {prefix},
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if continuationToken != "" {
+		query.Set("continuation-token", continuationToken)
+	}
+
+	resp, err := s.do(ctx, domain, http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("ListObjectsV2", prefix, resp)
+	}
+
+	var result s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse s3 listing: %w", err)
+	}
+	return &result, nil
+}
+
+// Listing without a delimiter would return every key below the path at once, but
+// depth limits and directory entries are simpler to get level by level
+func (s *s3Rclone) ListTree(ctx context.Context, filePath string, domain string, depth int) ([]RcloneFile, error) {
+	return walkTree(ctx, s.ListPath, filePath, domain, depth)
+}
+
+func (s *s3Rclone) Size(ctx context.Context, filePath string, domain string) (DirectorySize, error) {
+	return treeSize(ctx, s.ListTree, filePath, domain)
+}
+
+func (s *s3Rclone) ListPath(ctx context.Context, filePath string, domain string) ([]RcloneFile, error) {
+	key := s3Key(filePath)
+	files, err, shared := s.listGroup.DoContext(ctx, coalesceKey(key, domain), func(ctx context.Context) ([]RcloneFile, error) {
+		prefix := ""
+		if key != "" {
+			prefix = key + "/"
+		}
+
+		files := []RcloneFile{}
+		token := ""
+		for {
+			result, err := s.listObjects(ctx, prefix, domain, 0, token)
+			if err != nil {
+				return nil, err
+			}
+			for _, dir := range result.CommonPrefixes {
+				name := strings.TrimSuffix(strings.TrimPrefix(dir.Prefix, prefix), "/")
+				files = append(files, RcloneFile{Path: name, Name: name, Size: -1, MimeType: "inode/directory", IsDir: true})
+			}
+			for _, object := range result.Contents {
+				name := strings.TrimPrefix(object.Key, prefix)
+				// Skip directory marker objects
+				if name == "" || strings.HasSuffix(name, "/") {
+					continue
+				}
+				files = append(files, s3File(name, object.Size, object.LastModified, object.ETag))
+			}
+			if !result.IsTruncated || result.NextContinuationToken == "" {
+				break
+			}
+			token = result.NextContinuationToken
+		}
+
+		if len(files) > 0 || key == "" {
+			return files, nil
+		}
+
+		// Like lsjson, listing a file returns the file itself. A directory holding only
+		// its marker object is empty.
+		file, err := s.Stat(ctx, filePath, domain)
+		if err != nil {
+			return nil, err
+		}
+		if file.IsDir {
+			return files, nil
+		}
+		file.Path = file.Name
+		return []RcloneFile{file}, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list path: %w", err)
+	}
+
+	Debug("Path listed successfully", "path", filePath, "count", len(files), "coalesced", shared)
+	return files, nil
+}
+
+func (s *s3Rclone) Stat(ctx context.Context, filePath string, domain string) (RcloneFile, error) {
+	key := s3Key(filePath)
+	if key == "" {
+		if _, err := s.s3Config(domain); err != nil {
+			return RcloneFile{}, fmt.Errorf("failed to stat path: %w", err)
+		}
+		return RcloneFile{Size: -1, MimeType: "inode/directory", IsDir: true}, nil
+	}
+
+	resp, err := s.do(ctx, domain, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return RcloneFile{}, fmt.Errorf("failed to stat path: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		file := s3File(key, resp.ContentLength, "", resp.Header.Get("ETag"))
+		if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			file.ModTime = modTime.Format(time.RFC3339Nano)
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+			file.MimeType = contentType
+		}
+		return file, nil
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return RcloneFile{}, fmt.Errorf("failed to stat path: %w", s3Error("HeadObject", key, resp))
+	}
+
+	// Not an object, but possibly a directory
+	result, err := s.listObjects(ctx, key+"/", domain, 1, "")
+	if err != nil {
+		return RcloneFile{}, fmt.Errorf("failed to stat path: %w", err)
+	}
+	if len(result.Contents) == 0 && len(result.CommonPrefixes) == 0 {
+		return RcloneFile{}, storageError(ErrNotFound, fmt.Errorf("failed to stat path: object not found: %s", key))
+	}
+	return RcloneFile{Path: key, Name: path.Base(key), Size: -1, MimeType: "inode/directory", IsDir: true}, nil
+}
+
+// WriteFile spools data to a temporary file first, PutObject needs the length and hash
+// of the body before sending it
+func (s *s3Rclone) WriteFile(ctx context.Context, filePath string, domain string, data io.Reader) error {
+	key := s3Key(filePath)
+	header := http.Header{}
+	if mimeType := mime.TypeByExtension(path.Ext(key)); mimeType != "" {
+		header.Set("Content-Type", mimeType)
+	}
+
+	spool, err := os.CreateTemp("", "s3-upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), data)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	resp, err := s.send(ctx, domain, http.MethodPut, key, nil, header, spool, size, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to write file: %w", s3Error("PutObject", key, resp))
+	}
+
+	Debug("File written successfully", "path", filePath, "size", size)
+	return nil
+}
+
+func (s *s3Rclone) DeleteFile(ctx context.Context, filePath string, domain string) error {
+	key := s3Key(filePath)
+	resp, err := s.do(ctx, domain, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to delete file: %w", s3Error("DeleteObject", key, resp))
+	}
+
+	Debug("File deleted successfully", "path", filePath)
+	return nil
+}
+
+// S3 has no rename, objects are copied server side and the source deleted
+func (s *s3Rclone) MoveFile(ctx context.Context, src string, dst string, domain string) error {
+	if err := s.copyObject(ctx, src, dst, domain); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	if err := s.DeleteFile(ctx, src, domain); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+
+	Debug("File moved successfully", "src", src, "dst", dst)
+	return nil
+}
+
+func (s *s3Rclone) CopyFile(ctx context.Context, src string, dst string, domain string) error {
+	if err := s.copyObject(ctx, src, dst, domain); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	Debug("File copied successfully", "src", src, "dst", dst)
+	return nil
+}
+
+func (s *s3Rclone) copyObject(ctx context.Context, src string, dst string, domain string) error {
+	cfg, err := s.s3Config(domain)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", s3CanonicalURI(&url.URL{Path: "/" + cfg.Bucket + "/" + s3Key(src)}))
+
+	key := s3Key(dst)
+	resp, err := s.do(ctx, domain, http.MethodPut, key, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("CopyObject", s3Key(src), resp)
+	}
+	return nil
+}
+
+// Directories only exist as prefixes of the objects inside them
+func (s *s3Rclone) Mkdir(ctx context.Context, dirPath string, domain string) error {
+	return ctx.Err()
+}
+
+// s3Key turns a path into an object key without leading or duplicate slashes
+func s3Key(filePath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filePath), "/")
+}
+
+// s3File describes an object the way rclone lsjson does. Single part uploads have
+// the MD5 of the content as ETag, which is reported as hash.
+func s3File(name string, size int64, lastModified string, etag string) RcloneFile {
+	file := RcloneFile{
+		Path:     name,
+		Name:     path.Base(name),
+		Size:     size,
+		MimeType: "application/octet-stream",
+		ModTime:  lastModified,
+	}
+	if mimeType := mime.TypeByExtension(path.Ext(name)); mimeType != "" {
+		file.MimeType = mimeType
+	}
+	if etag = strings.Trim(etag, `"`); len(etag) == 32 && !strings.Contains(etag, "-") {
+		file.Hashes = map[string]string{"md5": etag}
+	}
+	return file
+}
+
+// s3Error turns an S3 error response into an error, phrased like rclone's for missing
+// objects and denied access
+func s3Error(operation string, key string, resp *http.Response) error {
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	xml.Unmarshal(data, &s3Err)
+	if s3Err.Code == "" {
+		s3Err.Code = http.StatusText(resp.StatusCode)
+	}
+
+	kind := classifyStatus(resp.StatusCode)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return storageError(kind, fmt.Errorf("object not found: %s: %s", key, s3Err.Code))
+	case http.StatusForbidden:
+		return storageError(kind, fmt.Errorf("permission denied: %s: %s", key, s3Err.Code))
+	default:
+		return storageError(kind, fmt.Errorf("s3 %s failed with status %d: %s %s", operation, resp.StatusCode, s3Err.Code, s3Err.Message))
+	}
+}
@@ -1,8 +1,16 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"shuto-api/config"
 
@@ -11,7 +19,7 @@ import (
 
 func TestFetchImage(t *testing.T) {
 	mockExecutor := &MockCommandExecutor{
-		ExecuteFunc: func(command string, args ...string) ([]byte, error) {
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
 			return nil, fmt.Errorf("mock error")
 		},
 	}
@@ -29,7 +37,7 @@ func TestFetchImage(t *testing.T) {
 
 	rclone := NewRclone(mockExecutor, mockConfigManager)
 
-	imageData, err := rclone.FetchImage("mock/path", "test")
+	imageData, err := rclone.FetchImage(context.Background(), "mock/path", "test")
 	assert.Error(t, err)
 	assert.Equal(t, "failed to fetch image: rclone command failed: mock error", err.Error())
 	assert.Nil(t, imageData)
@@ -39,7 +47,7 @@ func TestFetchImage(t *testing.T) {
 		return config.DomainConfig{}, fmt.Errorf("config error")
 	}
 
-	imageData, err = rclone.FetchImage("mock/path", "test")
+	imageData, err = rclone.FetchImage(context.Background(), "mock/path", "test")
 	assert.Error(t, err)
 	assert.NotNil(t, err)
 	assert.Nil(t, imageData)
@@ -48,7 +56,7 @@ func TestFetchImage(t *testing.T) {
 func TestListPath(t *testing.T) {
 	// Test successful case
 	mockExecutor := &MockCommandExecutor{
-		ExecuteFunc: func(command string, args ...string) ([]byte, error) {
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
 			return []byte(`[
 				{"Path":"file1.jpg","Name":"file1.jpg","Size":1024,"MimeType":"image/jpeg"},
 				{"Path":"file2.png","Name":"file2.png","Size":2048,"MimeType":"image/png"},
@@ -71,7 +79,7 @@ func TestListPath(t *testing.T) {
 	rclone := NewRclone(mockExecutor, mockConfigManager)
 
 	// Test successful listing
-	files, err := rclone.ListPath("mock/path", "test")
+	files, err := rclone.ListPath(context.Background(), "mock/path", "test")
 	assert.NoError(t, err)
 	expectedFiles := []RcloneFile{
 		{Path: "file1.jpg", Name: "file1.jpg", Size: 1024, MimeType: "image/jpeg"},
@@ -81,11 +89,11 @@ func TestListPath(t *testing.T) {
 	assert.Equal(t, expectedFiles, files)
 
 	// Test executor error
-	mockExecutor.ExecuteFunc = func(command string, args ...string) ([]byte, error) {
+	mockExecutor.ExecuteFunc = func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
 		return nil, fmt.Errorf("mock error")
 	}
 
-	files, err = rclone.ListPath("mock/path", "test")
+	files, err = rclone.ListPath(context.Background(), "mock/path", "test")
 	assert.Error(t, err)
 	assert.Equal(t, "failed to list path: rclone command failed: mock error", err.Error())
 	assert.Nil(t, files)
@@ -95,10 +103,247 @@ func TestListPath(t *testing.T) {
 		return config.DomainConfig{}, fmt.Errorf("config error")
 	}
 
-	files, err = rclone.ListPath("mock/path", "test")
+	files, err = rclone.ListPath(context.Background(), "mock/path", "test")
 	assert.Error(t, err)
 	assert.NotNil(t, err)
 	assert.Nil(t, files)
 }
 
+func TestListTree(t *testing.T) {
+	var executedArgs [][]string
+	mockExecutor := &MockCommandExecutor{
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+			executedArgs = append(executedArgs, args)
+			return []byte(`[
+				{"Path":"2024","Name":"2024","IsDir":true},
+				{"Path":"2024/a.jpg","Name":"a.jpg","Size":1024,"MimeType":"image/jpeg"}
+			]`), nil
+		},
+	}
+	mockConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Rclone: config.RcloneConfig{Remote: "test", Flags: []string{"--flag1"}},
+			}, nil
+		},
+	}
+	rclone := NewRclone(mockExecutor, mockConfigManager)
+
+	files, err := rclone.ListTree(context.Background(), "photos", "test", 0)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	assert.Equal(t, "2024/a.jpg", files[1].Path)
+
+	_, err = rclone.ListTree(context.Background(), "photos", "test", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"lsjson", "test:photos", "-R", "--flag1"},
+		{"lsjson", "test:photos", "-R", "--max-depth", "2", "--flag1"},
+	}, executedArgs)
+}
+
+
+func TestSize(t *testing.T) {
+	var executedArgs [][]string
+	mockExecutor := &MockCommandExecutor{
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+			executedArgs = append(executedArgs, args)
+			if len(executedArgs) == 1 {
+				return []byte(`{"count":12,"bytes":4096,"sizeless":0}`), nil
+			}
+			return []byte(`{"count":5,"bytes":3000,"sizeless":0}`), nil
+		},
+	}
+	mockConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Rclone: config.RcloneConfig{Remote: "test", Flags: []string{"--flag1"}},
+			}, nil
+		},
+	}
+	rclone := NewRclone(mockExecutor, mockConfigManager)
+
+	size, err := rclone.Size(context.Background(), "photos", "test")
+	assert.NoError(t, err)
+	assert.Equal(t, DirectorySize{Count: 12, Bytes: 4096, Images: 5}, size)
+	assert.Equal(t, [][]string{
+		{"size", "test:photos", "--json", "--flag1"},
+		{"size", "test:photos", "--json", "--include", imageFilter, "--ignore-case", "--flag1"},
+	}, executedArgs)
+}
+
+
+func TestFetchImage_CoalescesConcurrentRequests(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+
+	mockExecutor := &MockCommandExecutor{
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return []byte("image-data"), nil
+		},
+	}
+
+	mockConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{Rclone: config.RcloneConfig{Remote: "test"}}, nil
+		},
+	}
+
+	rclone := NewRclone(mockExecutor, mockConfigManager).(*rcloneImpl)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := rclone.FetchImage(context.Background(), "mock/path.jpg", "test")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("image-data"), data)
+		}()
+	}
+
+	// Wait until the first fetch is running, then give the others time to join it
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestStatAndWriteFile(t *testing.T) {
+	var executedArgs []string
+	var writtenData []byte
+
+	mockExecutor := &MockCommandExecutor{
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+			executedArgs = args
+			return []byte(`{"Path":"file1.jpg","Name":"file1.jpg","Size":1024,"MimeType":"image/jpeg","ModTime":"2024-01-01T00:00:00Z"}`), nil
+		},
+		ExecuteWithInputFunc: func(ctx context.Context, env []string, input io.Reader, command string, args ...string) ([]byte, error) {
+			executedArgs = args
+			writtenData, _ = io.ReadAll(input)
+			return nil, nil
+		},
+	}
 
+	mockConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Rclone: config.RcloneConfig{Remote: "test", Flags: []string{"--flag1"}},
+			}, nil
+		},
+	}
+
+	rclone := NewRclone(mockExecutor, mockConfigManager)
+
+	file, err := rclone.Stat(context.Background(), "file1.jpg", "test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lsjson", "test:file1.jpg", "--stat", "--flag1"}, executedArgs)
+	assert.Equal(t, RcloneFile{Path: "file1.jpg", Name: "file1.jpg", Size: 1024, MimeType: "image/jpeg", ModTime: "2024-01-01T00:00:00Z"}, file)
+
+	err = rclone.WriteFile(context.Background(), "out/file2.jpg", "test", strings.NewReader("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rcat", "test:out/file2.jpg", "--flag1"}, executedArgs)
+	assert.Equal(t, []byte("payload"), writtenData)
+
+	mockExecutor.ExecuteWithInputFunc = func(ctx context.Context, env []string, input io.Reader, command string, args ...string) ([]byte, error) {
+		return nil, fmt.Errorf("mock error")
+	}
+	err = rclone.WriteFile(context.Background(), "out/file2.jpg", "test", strings.NewReader("payload"))
+	assert.EqualError(t, err, "failed to write file: rclone command failed: mock error")
+
+	// A failing source kills rcat and is reported instead of its exit
+	var cancelled bool
+	mockExecutor.ExecuteWithInputFunc = func(ctx context.Context, env []string, input io.Reader, command string, args ...string) ([]byte, error) {
+		io.ReadAll(input)
+		cancelled = ctx.Err() != nil
+		return nil, fmt.Errorf("signal: killed")
+	}
+	err = rclone.WriteFile(context.Background(), "out/file2.jpg", "test", failingSource())
+	assert.ErrorIs(t, err, errSourceFailed)
+	assert.True(t, cancelled)
+}
+
+var errSourceFailed = errors.New("source failed")
+
+// failingSource returns a few bytes of an upload, then fails
+func failingSource() io.Reader {
+	return io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errSourceFailed))
+}
+
+func TestFileOperations(t *testing.T) {
+	var executedArgs [][]string
+	mockExecutor := &MockCommandExecutor{
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+			executedArgs = append(executedArgs, args)
+			return nil, nil
+		},
+	}
+	mockConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Rclone: config.RcloneConfig{Remote: "test", Flags: []string{"--flag1"}},
+			}, nil
+		},
+	}
+	rclone := NewRclone(mockExecutor, mockConfigManager)
+
+	assert.NoError(t, rclone.DeleteFile(context.Background(), "a.jpg", "test"))
+	assert.NoError(t, rclone.MoveFile(context.Background(), "a.jpg", "old/a.jpg", "test"))
+	assert.NoError(t, rclone.CopyFile(context.Background(), "b.jpg", "old/b.jpg", "test"))
+	assert.NoError(t, rclone.Mkdir(context.Background(), "new", "test"))
+	assert.Equal(t, [][]string{
+		{"deletefile", "test:a.jpg", "--flag1"},
+		{"moveto", "test:a.jpg", "test:old/a.jpg", "--flag1"},
+		{"copyto", "test:b.jpg", "test:old/b.jpg", "--flag1"},
+		{"mkdir", "test:new", "--flag1"},
+	}, executedArgs)
+}
+
+func TestOpenAndOpenRange(t *testing.T) {
+	var streamedArgs []string
+	mockExecutor := &MockCommandExecutor{
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+			return []byte(`{"Path":"big.raw","Name":"big.raw","Size":4,"ModTime":"2024-01-01T00:00:00Z"}`), nil
+		},
+		StreamFunc: func(ctx context.Context, env []string, command string, args ...string) (io.ReadCloser, error) {
+			streamedArgs = args
+			return io.NopCloser(strings.NewReader("part")), nil
+		},
+	}
+
+	mockConfigManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{
+				Rclone: config.RcloneConfig{Remote: "test", Flags: []string{"--flag1"}},
+			}, nil
+		},
+	}
+
+	rclone := NewRclone(mockExecutor, mockConfigManager)
+
+	stream, err := rclone.Open(context.Background(), "big.raw", "test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cat", "test:big.raw", "--flag1"}, streamedArgs)
+	assert.Equal(t, int64(4), stream.Size)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), stream.ModTime)
+	data, _ := io.ReadAll(stream)
+	assert.Equal(t, "part", string(data))
+
+	reader, err := rclone.OpenRange(context.Background(), "big.raw", "test", 100, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cat", "test:big.raw", "--offset", "100", "--count", "4", "--flag1"}, streamedArgs)
+	reader.Close()
+
+	// Directories can't be streamed
+	mockExecutor.ExecuteFunc = func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+		return []byte(`{"Path":"dir","Name":"dir","Size":-1,"IsDir":true}`), nil
+	}
+	_, err = rclone.Open(context.Background(), "dir", "test")
+	assert.EqualError(t, err, "failed to open file: dir is a directory")
+}
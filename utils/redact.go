@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+const redacted = "***"
+
+// secretNamePattern matches option names that carry credentials
+var secretNamePattern = regexp.MustCompile(`(?i)pass|secret|token|bearer|key`)
+
+var secretPatterns = []*regexp.Regexp{
+	// --webdav-pass=value
+	regexp.MustCompile(`(?i)(--[\w-]*(?:pass|secret|token|bearer|key)[\w-]*=)("[^"]*"|\S+)`),
+	// connection string parameters, e.g. :webdav,pass="value":
+	regexp.MustCompile(`(?i)([,{]\w*(?:pass|secret|token|bearer|key)\w*=)("(?:[^"]|"")*"|[^,:}]*)`),
+	// RCLONE_CONFIG_SERVER_PASS=value
+	regexp.MustCompile(`(?i)(RCLONE_\w*(?:PASS|SECRET|TOKEN|BEARER|KEY)\w*=)(\S+)`),
+}
+
+// redactArgs hides the values of secret-bearing flags in a command line, both as
+// --flag=value and as --flag value
+func redactArgs(args []string) []string {
+	safe := make([]string, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		safe[i] = redactSecrets(arg)
+		if !strings.HasPrefix(arg, "--") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(arg, "=")
+		if !secretNamePattern.MatchString(name) {
+			continue
+		}
+		if hasValue {
+			safe[i] = name + "=" + redacted
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			i++
+			safe[i] = redacted
+		}
+	}
+	return safe
+}
+
+// redactSecrets hides credentials that ended up in free text such as error messages
+func redactSecrets(text string) string {
+	for _, pattern := range secretPatterns {
+		text = pattern.ReplaceAllString(text, "${1}"+redacted)
+	}
+	return text
+}
+
+// redactFields applies redactSecrets to the values of structured log fields, the log
+// functions pass their fields through it so credentials never reach the logs
+func redactFields(fields []interface{}) []interface{} {
+	safe := make([]interface{}, len(fields))
+	copy(safe, fields)
+	for i := 1; i < len(safe); i += 2 {
+		switch value := safe[i].(type) {
+		case string:
+			safe[i] = redactSecrets(value)
+		case []string:
+			safe[i] = redactArgs(value)
+		case error:
+			if text := value.Error(); redactSecrets(text) != text {
+				safe[i] = redactSecrets(text)
+			}
+		}
+	}
+	return safe
+}
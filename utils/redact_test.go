@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactArgs(t *testing.T) {
+	args := []string{"lsjson", "webdav:photos", "--webdav-url=https://dav.example.com", "--webdav-pass=s3cret", "--s3-secret-access-key", "abc", "--fast-list"}
+	assert.Equal(t, []string{"lsjson", "webdav:photos", "--webdav-url=https://dav.example.com", "--webdav-pass=***", "--s3-secret-access-key", "***", "--fast-list"}, redactArgs(args))
+	// The original is left alone
+	assert.Equal(t, "--webdav-pass=s3cret", args[3])
+}
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"exec rclone cat --webdav-pass=s3cret webdav:a.jpg", "exec rclone cat --webdav-pass=*** webdav:a.jpg"},
+		{`failed to create file system for ":webdav,url=\"https://x\",pass=\"s3\"\"cret\":": 401`, `failed to create file system for ":webdav,url=\"https://x\",pass=***:": 401`},
+		{"RCLONE_CONFIG_SERVER_PASS=s3cret", "RCLONE_CONFIG_SERVER_PASS=***"},
+		{"object not found: photos/a.jpg", "object not found: photos/a.jpg"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, redactSecrets(tt.in))
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	err := errors.New(`rc operations/list failed: fs ":webdav,pass=\"s3cret\":"`)
+	fields := redactFields([]interface{}{"args", []string{"--webdav-pass=s3cret"}, "error", err, "count", 3})
+	assert.Equal(t, []string{"--webdav-pass=***"}, fields[1])
+	assert.Equal(t, `rc operations/list failed: fs ":webdav,pass=***:"`, fields[3])
+	assert.Equal(t, 3, fields[5])
+}
@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"shuto-api/config"
+)
+
+// remoteDerivativeUploads bounds the uploads of a RemoteDerivativeCache in flight,
+// outputs rendered while all of them are busy aren't uploaded
+const remoteDerivativeUploads = 8
+
+// remoteDerivativeHeader starts the stored objects, followed by the MIME type of the
+// output and a newline. Content sniffing can't tell every output format apart, objects
+// stored without it are sniffed.
+const remoteDerivativeHeader = "derivative:"
+
+// RemoteDerivativeCache stores rendered outputs on the derivative_cache remote of a
+// domain, so that every instance of a multi-instance deployment can reuse them.
+// Objects are stored as <domain>/<key[:2]>/<key>; use an rclone alias remote to
+// place them below a bucket or folder.
+type RemoteDerivativeCache struct {
+	rclone  Rclone
+	uploads chan struct{}
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	hits    uint64
+	misses  uint64
+	errors  uint64
+	skipped uint64
+}
+
+// NewRemoteDerivativeCache creates a remote cache. The given Rclone must resolve
+// domains to their derivative cache remote, see config.NewDerivativeCacheConfigManager.
+func NewRemoteDerivativeCache(rclone Rclone) *RemoteDerivativeCache {
+	return &RemoteDerivativeCache{rclone: rclone, uploads: make(chan struct{}, remoteDerivativeUploads)}
+}
+
+// Get fetches the output stored under key, a missing object is a miss
+func (c *RemoteDerivativeCache) Get(ctx context.Context, domain string, key string) ([]byte, string, bool) {
+	data, err := c.rclone.FetchImage(ctx, remoteDerivativePath(domain, key), domain)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.countMiss(err)
+		}
+		return nil, "", false
+	}
+
+	data, mimeType := parseRemoteDerivative(data)
+	if _, ok := derivativeExtensions[mimeType]; !ok {
+		c.countMiss(errors.New("unexpected derivative content type: " + mimeType))
+		return nil, "", false
+	}
+
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+	return data, mimeType, true
+}
+
+// Set uploads the output in the background, so that rendering doesn't wait for the
+// remote. Uploads outlive the request that rendered the output.
+func (c *RemoteDerivativeCache) Set(ctx context.Context, domain string, key string, data []byte, mimeType string) error {
+	select {
+	case c.uploads <- struct{}{}:
+	default:
+		c.mu.Lock()
+		c.skipped++
+		c.mu.Unlock()
+		Warn("Remote derivative upload skipped, too many in flight", "domain", domain, "key", key)
+		return nil
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	c.wg.Add(1)
+	go func() {
+		defer func() {
+			<-c.uploads
+			c.wg.Done()
+		}()
+		object := io.MultiReader(strings.NewReader(remoteDerivativeHeader+mimeType+"\n"), bytes.NewReader(data))
+		err := c.rclone.WriteFile(ctx, remoteDerivativePath(domain, key), domain, object)
+		if err != nil && !errors.Is(err, config.ErrNoDerivativeCache) {
+			c.mu.Lock()
+			c.errors++
+			c.mu.Unlock()
+			Warn("Failed to upload remote derivative", "domain", domain, "key", key, "error", err)
+		}
+	}()
+	return nil
+}
+
+// Wait blocks until the uploads in flight are done
+func (c *RemoteDerivativeCache) Wait() {
+	c.wg.Wait()
+}
+
+func (c *RemoteDerivativeCache) Delete(domain string, key string) error {
+	err := c.rclone.DeleteFile(context.Background(), remoteDerivativePath(domain, key), domain)
+	if errors.Is(err, config.ErrNoDerivativeCache) || errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (c *RemoteDerivativeCache) Stats() DerivativeCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return DerivativeCacheStats{
+		Name:    "remote",
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Errors:  c.errors,
+		Skipped: c.skipped,
+	}
+}
+
+// countMiss records a miss, only counting it as an error when the lookup itself failed
+func (c *RemoteDerivativeCache) countMiss(err error) {
+	if errors.Is(err, config.ErrNoDerivativeCache) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.misses++
+	if !errors.Is(err, ErrNotFound) {
+		c.errors++
+		Warn("Failed to read remote derivative", "error", err)
+	}
+}
+
+// parseRemoteDerivative splits a stored object into the output and its MIME type
+func parseRemoteDerivative(object []byte) ([]byte, string) {
+	if rest, ok := bytes.CutPrefix(object, []byte(remoteDerivativeHeader)); ok {
+		if mimeType, data, ok := bytes.Cut(rest, []byte("\n")); ok {
+			return data, string(mimeType)
+		}
+	}
+	return object, http.DetectContentType(object)
+}
+
+func remoteDerivativePath(domain string, key string) string {
+	shard := key
+	if len(shard) > 2 {
+		shard = shard[:2]
+	}
+	return domain + "/" + shard + "/" + key
+}
+
+// TieredDerivativeCache consults its tiers in order and writes through to all of them,
+// the remote tier uploading in the background. Hits on a later tier are copied back
+// into the earlier ones.
+type TieredDerivativeCache struct {
+	tiers []DerivativeCache
+
+	mu     sync.Mutex
+	hits   uint64
+	misses uint64
+}
+
+func NewTieredDerivativeCache(tiers ...DerivativeCache) *TieredDerivativeCache {
+	return &TieredDerivativeCache{tiers: tiers}
+}
+
+func (c *TieredDerivativeCache) Get(ctx context.Context, domain string, key string) ([]byte, string, bool) {
+	for i, tier := range c.tiers {
+		data, mimeType, ok := tier.Get(ctx, domain, key)
+		if !ok {
+			continue
+		}
+
+		for _, earlier := range c.tiers[:i] {
+			if err := earlier.Set(ctx, domain, key, data, mimeType); err != nil {
+				Warn("Failed to backfill derivative cache", "domain", domain, "key", key, "error", err)
+			}
+		}
+
+		c.mu.Lock()
+		c.hits++
+		c.mu.Unlock()
+		return data, mimeType, true
+	}
+
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+	return nil, "", false
+}
+
+func (c *TieredDerivativeCache) Set(ctx context.Context, domain string, key string, data []byte, mimeType string) error {
+	var errs []error
+	for _, tier := range c.tiers {
+		if err := tier.Set(ctx, domain, key, data, mimeType); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *TieredDerivativeCache) Delete(domain string, key string) error {
+	var errs []error
+	for _, tier := range c.tiers {
+		if err := tier.Delete(domain, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *TieredDerivativeCache) Stats() DerivativeCacheStats {
+	c.mu.Lock()
+	stats := DerivativeCacheStats{
+		Name:   "tiered",
+		Hits:   c.hits,
+		Misses: c.misses,
+	}
+	c.mu.Unlock()
+
+	for _, tier := range c.tiers {
+		tierStats := tier.Stats()
+		stats.Entries += tierStats.Entries
+		stats.Bytes += tierStats.Bytes
+		stats.MaxBytes += tierStats.MaxBytes
+		stats.Evictions += tierStats.Evictions
+		stats.Errors += tierStats.Errors
+		stats.Skipped += tierStats.Skipped
+		stats.Tiers = append(stats.Tiers, tierStats)
+	}
+	return stats
+}
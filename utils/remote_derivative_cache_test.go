@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"shuto-api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// PNG signature, enough for content sniffing
+var pngData = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A, 0x00}
+
+// memoryRemote is a derivative cache remote kept in memory, uploads may run concurrently
+type memoryRemote struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	fetches int
+}
+
+func (m *memoryRemote) object(path string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[path]
+	return data, ok
+}
+
+func newMemoryRclone() (*MockRclone, *memoryRemote) {
+	remote := &memoryRemote{objects: map[string][]byte{}}
+	return &MockRclone{
+		FetchImageFunc: func(ctx context.Context, path string, domain string) ([]byte, error) {
+			if domain == "uncached.com" {
+				return nil, fmt.Errorf("failed to fetch image: %w", config.ErrNoDerivativeCache)
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			remote.mu.Lock()
+			defer remote.mu.Unlock()
+			remote.fetches++
+			data, ok := remote.objects[path]
+			if !ok {
+				return nil, storageError(ErrNotFound, fmt.Errorf("failed to fetch image: object not found"))
+			}
+			return data, nil
+		},
+		WriteFileFunc: func(ctx context.Context, path string, domain string, data io.Reader) error {
+			if domain == "uncached.com" {
+				return fmt.Errorf("failed to write file: %w", config.ErrNoDerivativeCache)
+			}
+			content, err := io.ReadAll(data)
+			if err != nil {
+				return err
+			}
+			remote.mu.Lock()
+			defer remote.mu.Unlock()
+			remote.objects[path] = content
+			return nil
+		},
+		DeleteFileFunc: func(ctx context.Context, path string, domain string) error {
+			if domain == "uncached.com" {
+				return fmt.Errorf("failed to delete file: %w", config.ErrNoDerivativeCache)
+			}
+			remote.mu.Lock()
+			defer remote.mu.Unlock()
+			if _, ok := remote.objects[path]; !ok {
+				return fmt.Errorf("failed to delete file: %w", ErrNotFound)
+			}
+			delete(remote.objects, path)
+			return nil
+		},
+	}, remote
+}
+
+func TestRemoteDerivativeCache(t *testing.T) {
+	rclone, remote := newMemoryRclone()
+	cache := NewRemoteDerivativeCache(rclone)
+
+	_, _, ok := cache.Get(context.Background(), "example.com", "abcdef")
+	assert.False(t, ok)
+
+	require.NoError(t, cache.Set(context.Background(), "example.com", "abcdef", pngData, "image/png"))
+	cache.Wait()
+	_, ok = remote.object("example.com/ab/abcdef")
+	assert.True(t, ok)
+
+	// A hit is a single fetch
+	data, mimeType, ok := cache.Get(context.Background(), "example.com", "abcdef")
+	require.True(t, ok)
+	assert.Equal(t, pngData, data)
+	assert.Equal(t, "image/png", mimeType)
+	assert.Equal(t, 2, remote.fetches)
+
+	// The MIME type is stored with the output, AVIF isn't recognized by its content
+	require.NoError(t, cache.Set(context.Background(), "example.com", "avif01", []byte("avif-data"), "image/avif"))
+	cache.Wait()
+	data, mimeType, ok = cache.Get(context.Background(), "example.com", "avif01")
+	require.True(t, ok)
+	assert.Equal(t, []byte("avif-data"), data)
+	assert.Equal(t, "image/avif", mimeType)
+
+	// Domains without a derivative cache remote are skipped silently
+	assert.NoError(t, cache.Set(context.Background(), "uncached.com", "abcdef", pngData, "image/png"))
+	cache.Wait()
+	_, _, ok = cache.Get(context.Background(), "uncached.com", "abcdef")
+	assert.False(t, ok)
+
+	// Lookups of gone clients are neither misses nor errors
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, ok = cache.Get(ctx, "example.com", "abcdef")
+	assert.False(t, ok)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(0), stats.Errors)
+
+	require.NoError(t, cache.Delete("example.com", "abcdef"))
+	_, ok = remote.object("example.com/ab/abcdef")
+	assert.False(t, ok)
+	assert.NoError(t, cache.Delete("example.com", "abcdef"))
+	assert.NoError(t, cache.Delete("uncached.com", "abcdef"))
+}
+
+func TestRemoteDerivativeCache_Uploads(t *testing.T) {
+	rclone, remote := newMemoryRclone()
+	started := make(chan struct{}, remoteDerivativeUploads)
+	unblock := make(chan struct{})
+	write := rclone.WriteFileFunc
+	rclone.WriteFileFunc = func(ctx context.Context, path string, domain string, data io.Reader) error {
+		started <- struct{}{}
+		<-unblock
+		return write(ctx, path, domain, data)
+	}
+	cache := NewRemoteDerivativeCache(rclone)
+
+	// Set returns before the upload finished, and the upload outlives the request
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < remoteDerivativeUploads; i++ {
+		require.NoError(t, cache.Set(ctx, "example.com", fmt.Sprintf("key%d", i), pngData, "image/png"))
+	}
+	for i := 0; i < remoteDerivativeUploads; i++ {
+		<-started
+	}
+	cancel()
+
+	// Outputs rendered while every upload is busy are skipped
+	require.NoError(t, cache.Set(context.Background(), "example.com", "skipped", pngData, "image/png"))
+	assert.Equal(t, uint64(1), cache.Stats().Skipped)
+
+	close(unblock)
+	cache.Wait()
+	_, ok := remote.object("example.com/ke/key0")
+	assert.True(t, ok)
+	_, ok = remote.object("example.com/sk/skipped")
+	assert.False(t, ok)
+	assert.Equal(t, uint64(0), cache.Stats().Errors)
+}
+
+func TestTieredDerivativeCache(t *testing.T) {
+	disk, err := NewDiskCache(DiskCacheOptions{Dir: t.TempDir(), MaxBytes: 1024})
+	require.NoError(t, err)
+
+	rclone, memory := newMemoryRclone()
+	remote := NewRemoteDerivativeCache(rclone)
+	cache := NewTieredDerivativeCache(disk, remote)
+
+	// Write-through stores the derivative in every tier
+	require.NoError(t, cache.Set(context.Background(), "example.com", "abc123", pngData, "image/png"))
+	remote.Wait()
+	_, ok := memory.object("example.com/ab/abc123")
+	assert.True(t, ok)
+	_, _, ok = disk.Get(context.Background(), "example.com", "abc123")
+	assert.True(t, ok)
+
+	// A derivative rendered by another instance is backfilled into the local tier
+	memory.objects["example.com/de/def456"] = pngData
+	data, mimeType, ok := cache.Get(context.Background(), "example.com", "def456")
+	require.True(t, ok)
+	assert.Equal(t, pngData, data)
+	assert.Equal(t, "image/png", mimeType)
+
+	_, _, ok = disk.Get(context.Background(), "example.com", "def456")
+	assert.True(t, ok)
+
+	_, _, ok = cache.Get(context.Background(), "example.com", "missing")
+	assert.False(t, ok)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Len(t, stats.Tiers, 2)
+	assert.Equal(t, "disk", stats.Tiers[0].Name)
+	assert.Equal(t, "remote", stats.Tiers[1].Name)
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"shuto-api/config"
+)
+
+// remoteFixture serves every remote of a domain from a MockRclone, recording calls as
+// remote:path. Remotes fail with the error set for their name, and list the files set
+// for remote:path.
+type remoteFixture struct {
+	configManager *config.MockDomainConfigManager
+	errors        map[string]error
+	listing       map[string][]RcloneFile
+	calls         []string
+	writes        []string
+}
+
+func newRemoteFixture(cfg config.DomainConfig) *remoteFixture {
+	return &remoteFixture{
+		configManager: &config.MockDomainConfigManager{
+			GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+				return cfg, nil
+			},
+		},
+		errors:  map[string]error{},
+		listing: map[string][]RcloneFile{},
+	}
+}
+
+// newStorage is the storage factory of NewFailoverRclone and NewMountRclone
+func (f *remoteFixture) newStorage(configManager config.DomainConfigManager) Rclone {
+	remote := func(domain string) string {
+		cfg, err := configManager.GetDomainConfig(domain)
+		if err != nil {
+			return err.Error()
+		}
+		return cfg.Rclone.Remote
+	}
+	call := func(domain string, path string) (string, error) {
+		name := remote(domain)
+		f.calls = append(f.calls, name+":"+path)
+		return name, f.errors[name]
+	}
+	return &MockRclone{
+		FetchImageFunc: func(ctx context.Context, path string, domain string) ([]byte, error) {
+			name, err := call(domain, path)
+			if err != nil {
+				return nil, err
+			}
+			return []byte(name), nil
+		},
+		ListPathFunc: func(ctx context.Context, path string, domain string) ([]RcloneFile, error) {
+			name, err := call(domain, path)
+			if err != nil {
+				return nil, err
+			}
+			files, ok := f.listing[name+":"+path]
+			if !ok {
+				return nil, storageError(ErrNotFound, fmt.Errorf("directory not found"))
+			}
+			return files, nil
+		},
+		WriteFileFunc: func(ctx context.Context, path string, domain string, data io.Reader) error {
+			f.writes = append(f.writes, remote(domain))
+			return nil
+		},
+		MoveFileFunc: func(ctx context.Context, src string, dst string, domain string) error {
+			_, err := call(domain, src+"->"+dst)
+			return err
+		},
+	}
+}
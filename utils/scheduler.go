@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// TransformPriority determines the order in which queued transforms are started
+type TransformPriority int
+
+const (
+	// PriorityInteractive is used for requests a user is actively waiting on, e.g. /v2/image/
+	PriorityInteractive TransformPriority = iota
+	// PriorityBulk is used for background style work such as zip downloads
+	PriorityBulk
+)
+
+var (
+	ErrTransformQueueFull    = errors.New("transform queue is full")
+	ErrTransformQueueTimeout = errors.New("timed out waiting for a transform slot")
+)
+
+// SchedulerBusyError is returned when a transform could not be started, either because
+// the wait queue is full or because the request waited longer than its deadline
+type SchedulerBusyError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *SchedulerBusyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SchedulerBusyError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfterSeconds returns the Retry-After hint rounded up to whole seconds
+func (e *SchedulerBusyError) RetryAfterSeconds() int {
+	return int(math.Max(1, math.Ceil(e.RetryAfter.Seconds())))
+}
+
+type SchedulerOptions struct {
+	MaxConcurrent int           // number of transforms allowed to run at the same time
+	MaxQueue      int           // number of transforms allowed to wait for a slot
+	QueueTimeout  time.Duration // how long a single transform may wait for a slot
+}
+
+// SchedulerStats is a point in time snapshot of the scheduler state
+type SchedulerStats struct {
+	Running           int    `json:"running"`
+	MaxConcurrent     int    `json:"maxConcurrent"`
+	QueueDepth        int    `json:"queueDepth"`
+	InteractiveQueued int    `json:"interactiveQueued"`
+	BulkQueued        int    `json:"bulkQueued"`
+	MaxQueue          int    `json:"maxQueue"`
+	Completed         uint64 `json:"completed"`
+	Rejected          uint64 `json:"rejected"`
+	TimedOut          uint64 `json:"timedOut"`
+}
+
+// TransformScheduler bounds the number of concurrently running image transforms.
+// Transforms that cannot start immediately wait in a bounded queue, interactive
+// requests are always started before bulk ones.
+type TransformScheduler struct {
+	opts SchedulerOptions
+
+	mu        sync.Mutex
+	running   int
+	queues    [2]*list.List // one FIFO of *schedulerWaiter per priority
+	completed uint64
+	rejected  uint64
+	timedOut  uint64
+}
+
+type schedulerWaiter struct {
+	ready chan struct{}
+}
+
+func NewTransformScheduler(opts SchedulerOptions) (*TransformScheduler, error) {
+	if opts.MaxConcurrent <= 0 {
+		return nil, fmt.Errorf("max concurrent transforms must be positive, got %d", opts.MaxConcurrent)
+	}
+	if opts.MaxQueue < 0 {
+		return nil, fmt.Errorf("max queue size must not be negative, got %d", opts.MaxQueue)
+	}
+	if opts.QueueTimeout <= 0 {
+		return nil, fmt.Errorf("queue timeout must be positive, got %s", opts.QueueTimeout)
+	}
+
+	return &TransformScheduler{
+		opts:   opts,
+		queues: [2]*list.List{list.New(), list.New()},
+	}, nil
+}
+
+// Run executes fn once a transform slot is available
+func (s *TransformScheduler) Run(ctx context.Context, priority TransformPriority, fn func() error) error {
+	release, err := s.Acquire(ctx, priority)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return fn()
+}
+
+// Acquire blocks until a transform slot is available, the queue deadline passes or ctx
+// is done. The returned release function must be called when the work is done, calls
+// after the first are ignored.
+func (s *TransformScheduler) Acquire(ctx context.Context, priority TransformPriority) (func(), error) {
+	queue := s.queue(priority)
+
+	s.mu.Lock()
+	if s.running < s.opts.MaxConcurrent && s.queuedLocked() == 0 {
+		s.running++
+		s.mu.Unlock()
+		return s.releaseOnce(), nil
+	}
+
+	if s.queuedLocked() >= s.opts.MaxQueue {
+		s.rejected++
+		s.mu.Unlock()
+		return nil, &SchedulerBusyError{Err: ErrTransformQueueFull, RetryAfter: s.opts.QueueTimeout}
+	}
+
+	waiter := &schedulerWaiter{ready: make(chan struct{})}
+	element := queue.PushBack(waiter)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.opts.QueueTimeout)
+	defer timer.Stop()
+
+	var cancelled error
+	select {
+	case <-waiter.ready:
+		return s.releaseOnce(), nil
+	case <-timer.C:
+	case <-ctx.Done():
+		cancelled = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The slot may have been handed over while we were timing out
+	select {
+	case <-waiter.ready:
+		if cancelled != nil {
+			s.releaseLocked()
+			return nil, cancelled
+		}
+		return s.releaseOnce(), nil
+	default:
+	}
+
+	queue.Remove(element)
+	if cancelled != nil {
+		return nil, cancelled
+	}
+	s.timedOut++
+	return nil, &SchedulerBusyError{Err: ErrTransformQueueTimeout, RetryAfter: s.opts.QueueTimeout}
+}
+
+// releaseOnce returns a release function that frees the slot on its first call only
+func (s *TransformScheduler) releaseOnce() func() {
+	var once sync.Once
+	return func() { once.Do(s.release) }
+}
+
+// release hands the slot to the next waiter, preferring interactive work
+func (s *TransformScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.completed++
+	s.releaseLocked()
+}
+
+func (s *TransformScheduler) releaseLocked() {
+	for _, queue := range s.queues {
+		if front := queue.Front(); front != nil {
+			queue.Remove(front)
+			close(front.Value.(*schedulerWaiter).ready)
+			return
+		}
+	}
+	s.running--
+}
+
+// Stats returns the current queue depth and counters for monitoring
+func (s *TransformScheduler) Stats() SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SchedulerStats{
+		Running:           s.running,
+		MaxConcurrent:     s.opts.MaxConcurrent,
+		QueueDepth:        s.queuedLocked(),
+		InteractiveQueued: s.queues[PriorityInteractive].Len(),
+		BulkQueued:        s.queues[PriorityBulk].Len(),
+		MaxQueue:          s.opts.MaxQueue,
+		Completed:         s.completed,
+		Rejected:          s.rejected,
+		TimedOut:          s.timedOut,
+	}
+}
+
+func (s *TransformScheduler) queue(priority TransformPriority) *list.List {
+	if priority == PriorityBulk {
+		return s.queues[PriorityBulk]
+	}
+	return s.queues[PriorityInteractive]
+}
+
+func (s *TransformScheduler) queuedLocked() int {
+	return s.queues[PriorityInteractive].Len() + s.queues[PriorityBulk].Len()
+}
+
+// scheduledImageUtils runs TransformImage through a TransformScheduler
+type scheduledImageUtils struct {
+	ImageUtils
+	scheduler *TransformScheduler
+	priority  TransformPriority
+}
+
+// NewScheduledImageUtils wraps ImageUtils so that every transform waits for a
+// scheduler slot with the given priority before it starts
+func NewScheduledImageUtils(imageUtils ImageUtils, scheduler *TransformScheduler, priority TransformPriority) ImageUtils {
+	return &scheduledImageUtils{
+		ImageUtils: imageUtils,
+		scheduler:  scheduler,
+		priority:   priority,
+	}
+}
+
+func (s *scheduledImageUtils) TransformImage(ctx context.Context, imgData []byte, opts ImageTransformOptions) ([]byte, error) {
+	var result []byte
+	err := s.scheduler.Run(ctx, s.priority, func() error {
+		var err error
+		result, err = s.ImageUtils.TransformImage(ctx, imgData, opts)
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTransformScheduler_InvalidOptions(t *testing.T) {
+	_, err := NewTransformScheduler(SchedulerOptions{MaxConcurrent: 0, MaxQueue: 1, QueueTimeout: time.Second})
+	assert.Error(t, err)
+
+	_, err = NewTransformScheduler(SchedulerOptions{MaxConcurrent: 1, MaxQueue: -1, QueueTimeout: time.Second})
+	assert.Error(t, err)
+
+	_, err = NewTransformScheduler(SchedulerOptions{MaxConcurrent: 1, MaxQueue: 1})
+	assert.Error(t, err)
+}
+
+func TestTransformScheduler_QueueFull(t *testing.T) {
+	scheduler, err := NewTransformScheduler(SchedulerOptions{MaxConcurrent: 1, MaxQueue: 0, QueueTimeout: 2 * time.Second})
+	require.NoError(t, err)
+
+	release, err := scheduler.Acquire(context.Background(), PriorityInteractive)
+	require.NoError(t, err)
+	defer release()
+
+	_, err = scheduler.Acquire(context.Background(), PriorityInteractive)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrTransformQueueFull))
+
+	var busy *SchedulerBusyError
+	require.True(t, errors.As(err, &busy))
+	assert.Equal(t, 2, busy.RetryAfterSeconds())
+	assert.Equal(t, uint64(1), scheduler.Stats().Rejected)
+}
+
+func TestTransformScheduler_QueueTimeout(t *testing.T) {
+	scheduler, err := NewTransformScheduler(SchedulerOptions{MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: 20 * time.Millisecond})
+	require.NoError(t, err)
+
+	release, err := scheduler.Acquire(context.Background(), PriorityInteractive)
+	require.NoError(t, err)
+	defer release()
+
+	_, err = scheduler.Acquire(context.Background(), PriorityBulk)
+	assert.True(t, errors.Is(err, ErrTransformQueueTimeout))
+
+	stats := scheduler.Stats()
+	assert.Equal(t, uint64(1), stats.TimedOut)
+	assert.Equal(t, 0, stats.QueueDepth)
+}
+
+func TestTransformScheduler_Cancelled(t *testing.T) {
+	scheduler, err := NewTransformScheduler(SchedulerOptions{MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: time.Minute})
+	require.NoError(t, err)
+
+	release, err := scheduler.Acquire(context.Background(), PriorityInteractive)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := scheduler.Acquire(ctx, PriorityInteractive)
+		done <- err
+	}()
+	waitForQueueDepth(t, scheduler, 1)
+	cancel()
+	assert.True(t, errors.Is(<-done, context.Canceled))
+
+	// The slot left by the cancelled waiter goes to live requests
+	stats := scheduler.Stats()
+	assert.Equal(t, 0, stats.QueueDepth)
+	assert.Equal(t, uint64(0), stats.TimedOut)
+	release()
+	release, err = scheduler.Acquire(context.Background(), PriorityInteractive)
+	require.NoError(t, err)
+	release()
+	assert.Equal(t, 0, scheduler.Stats().Running)
+}
+
+func TestTransformScheduler_ReleaseOnce(t *testing.T) {
+	scheduler, err := NewTransformScheduler(SchedulerOptions{MaxConcurrent: 2, MaxQueue: 0, QueueTimeout: time.Second})
+	require.NoError(t, err)
+
+	first, err := scheduler.Acquire(context.Background(), PriorityInteractive)
+	require.NoError(t, err)
+	_, err = scheduler.Acquire(context.Background(), PriorityInteractive)
+	require.NoError(t, err)
+
+	// Releasing twice doesn't free the slot of the other caller
+	first()
+	first()
+	stats := scheduler.Stats()
+	assert.Equal(t, 1, stats.Running)
+	assert.Equal(t, uint64(1), stats.Completed)
+}
+
+func TestTransformScheduler_InteractiveBeforeBulk(t *testing.T) {
+	scheduler, err := NewTransformScheduler(SchedulerOptions{MaxConcurrent: 1, MaxQueue: 10, QueueTimeout: time.Second})
+	require.NoError(t, err)
+
+	release, err := scheduler.Acquire(context.Background(), PriorityInteractive)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+
+	start := func(name string, priority TransformPriority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := scheduler.Run(context.Background(), priority, func() error {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+
+	// Queue the bulk job first so that ordering is decided by priority only
+	start("bulk", PriorityBulk)
+	waitForQueueDepth(t, scheduler, 1)
+	start("interactive", PriorityInteractive)
+	waitForQueueDepth(t, scheduler, 2)
+
+	stats := scheduler.Stats()
+	assert.Equal(t, 1, stats.InteractiveQueued)
+	assert.Equal(t, 1, stats.BulkQueued)
+
+	release()
+	wg.Wait()
+
+	assert.Equal(t, []string{"interactive", "bulk"}, order)
+	stats = scheduler.Stats()
+	assert.Equal(t, 0, stats.Running)
+	assert.Equal(t, uint64(3), stats.Completed)
+}
+
+func TestScheduledImageUtils(t *testing.T) {
+	scheduler, err := NewTransformScheduler(SchedulerOptions{MaxConcurrent: 1, MaxQueue: 0, QueueTimeout: time.Second})
+	require.NoError(t, err)
+
+	imageUtils := NewScheduledImageUtils(&stubImageUtils{}, scheduler, PriorityInteractive)
+
+	output, err := imageUtils.TransformImage(context.Background(), []byte("input"), ImageTransformOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("transformed"), output)
+
+	release, err := scheduler.Acquire(context.Background(), PriorityBulk)
+	require.NoError(t, err)
+	defer release()
+
+	_, err = imageUtils.TransformImage(context.Background(), []byte("input"), ImageTransformOptions{})
+	assert.True(t, errors.Is(err, ErrTransformQueueFull))
+}
+
+type stubImageUtils struct{}
+
+func (s *stubImageUtils) GetMimeType(data []byte) (string, error) {
+	return "image/jpeg", nil
+}
+
+func (s *stubImageUtils) TransformImage(ctx context.Context, imgData []byte, opts ImageTransformOptions) ([]byte, error) {
+	return []byte("transformed"), nil
+}
+
+func (s *stubImageUtils) GetImageMetadata(data []byte) (ImageMetadata, error) {
+	return ImageMetadata{}, nil
+}
+
+func waitForQueueDepth(t *testing.T, scheduler *TransformScheduler, depth int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for scheduler.Stats().QueueDepth != depth {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth did not reach %d", depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
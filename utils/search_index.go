@@ -0,0 +1,405 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexedFile is a file of a domain with the image metadata read when it was indexed
+type IndexedFile struct {
+	Path       string // full path in the domain
+	Size       int64
+	ModTime    string
+	MimeType   string
+	Width      int
+	Height     int
+	CapturedAt time.Time
+	Keywords   []string
+}
+
+// SearchIndex holds the indexed files of domains
+type SearchIndex interface {
+	// Files returns the indexed files of domain sorted by path and when its last crawl
+	// finished, false when it hasn't been crawled yet. The files are shared, callers
+	// must not modify them.
+	Files(domain string) ([]IndexedFile, time.Time, bool)
+}
+
+// MockSearchIndex implements SearchIndex
+type MockSearchIndex struct {
+	FilesFunc func(domain string) ([]IndexedFile, time.Time, bool)
+}
+
+func (m *MockSearchIndex) Files(domain string) ([]IndexedFile, time.Time, bool) {
+	return m.FilesFunc(domain)
+}
+
+// minIndexCompaction is the number of changes a change log holds at least before it's
+// compacted into the index file of its domain
+const minIndexCompaction = 1000
+
+// MetadataIndex is a SearchIndex kept in memory and saved to one file per domain in a
+// directory, which is loaded again on startup. Changes between crawls are appended to a
+// change log next to the file, which is compacted into it once it holds more changes
+// than the domain has files. Searches scan the files of a domain, the index is meant
+// for domains of up to a few hundred thousand files.
+type MetadataIndex struct {
+	dir string
+
+	mu      sync.RWMutex
+	domains map[string]*domainIndex
+	// crawls holds the changes made to the domains being crawled, which are applied
+	// again over the files of the crawl
+	crawls map[string][]indexOp
+}
+
+// indexOp is a change made to a domain index, a Put of File or a Remove of File.Path
+type indexOp struct {
+	File    IndexedFile
+	Removed bool
+}
+
+type domainIndex struct {
+	files     map[string]IndexedFile
+	sorted    []IndexedFile // files sorted by path, nil after changes
+	indexedAt time.Time
+	// unsaved are the changes not yet appended to the change log, rewrite is set when
+	// the whole index is written again instead
+	unsaved []indexOp
+	rewrite bool
+	// logged counts the changes in the change log
+	logged int
+}
+
+// indexSnapshot is the saved form of a domain index
+type indexSnapshot struct {
+	IndexedAt time.Time
+	Files     []IndexedFile
+}
+
+// NewMetadataIndex creates a MetadataIndex saved in dir, loading the domains saved there
+func NewMetadataIndex(dir string) (*MetadataIndex, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("index directory is required")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	m := &MetadataIndex{dir: dir, domains: make(map[string]*domainIndex), crawls: make(map[string][]indexOp)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index directory: %w", err)
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".index")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		domain, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		index, err := m.load(domain)
+		if err != nil {
+			// A broken index is crawled again
+			Warn("Failed to load search index", "domain", domain, "error", err)
+			continue
+		}
+		m.domains[domain] = index
+	}
+
+	Info("Search index ready", "dir", dir, "domains", len(m.domains))
+	return m, nil
+}
+
+func (m *MetadataIndex) indexPath(domain string) string {
+	return filepath.Join(m.dir, url.PathEscape(domain)+".index")
+}
+
+func (m *MetadataIndex) logPath(domain string) string {
+	return filepath.Join(m.dir, url.PathEscape(domain)+".log")
+}
+
+func (m *MetadataIndex) load(domain string) (*domainIndex, error) {
+	file, err := os.Open(m.indexPath(domain))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var snapshot indexSnapshot
+	if err := gob.NewDecoder(file).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	index := &domainIndex{files: make(map[string]IndexedFile, len(snapshot.Files)), indexedAt: snapshot.IndexedAt}
+	for _, file := range snapshot.Files {
+		index.files[file.Path] = file
+	}
+
+	log, err := os.Open(m.logPath(domain))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+	decoder := json.NewDecoder(log)
+	for {
+		var op indexOp
+		err := decoder.Decode(&op)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// A change cut off by a crash ends the log, compact what was read
+			Warn("Failed to read search index change log", "domain", domain, "error", err)
+			index.rewrite = true
+			break
+		}
+		index.apply(op)
+		index.logged++
+	}
+	return index, nil
+}
+
+func (m *MetadataIndex) Files(domain string) ([]IndexedFile, time.Time, bool) {
+	m.mu.RLock()
+	index, ok := m.domains[domain]
+	if ok && index.sorted != nil {
+		defer m.mu.RUnlock()
+		return index.sorted, index.indexedAt, true
+	}
+	m.mu.RUnlock()
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return index.sortedFiles(), index.indexedAt, true
+}
+
+func (d *domainIndex) sortedFiles() []IndexedFile {
+	if d.sorted == nil {
+		d.sorted = make([]IndexedFile, 0, len(d.files))
+		for _, file := range d.files {
+			d.sorted = append(d.sorted, file)
+		}
+		sort.Slice(d.sorted, func(i, j int) bool { return d.sorted[i].Path < d.sorted[j].Path })
+	}
+	return d.sorted
+}
+
+// File returns the indexed file at path
+func (m *MetadataIndex) File(domain string, path string) (IndexedFile, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	index, ok := m.domains[domain]
+	if !ok {
+		return IndexedFile{}, false
+	}
+	file, ok := index.files[path]
+	return file, ok
+}
+
+// IndexedAt returns when the last crawl of domain finished, zero when it hasn't been crawled
+func (m *MetadataIndex) IndexedAt(domain string) time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if index, ok := m.domains[domain]; ok {
+		return index.indexedAt
+	}
+	return time.Time{}
+}
+
+// startCrawl records the changes made to domain until the crawl ends with Replace or
+// endCrawl, so that Replace doesn't undo them with the older state of the crawl
+func (m *MetadataIndex) startCrawl(domain string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.crawls[domain] = []indexOp{}
+}
+
+// endCrawl stops recording the changes of a failed crawl
+func (m *MetadataIndex) endCrawl(domain string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.crawls, domain)
+}
+
+// crawling reports whether a crawl of domain is running
+func (m *MetadataIndex) crawling(domain string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.crawls[domain]
+	return ok
+}
+
+// Replace swaps the files of domain for those of a finished crawl, the changes made
+// since the crawl started are applied over them
+func (m *MetadataIndex) Replace(domain string, files []IndexedFile, indexedAt time.Time) {
+	index := &domainIndex{files: make(map[string]IndexedFile, len(files)), indexedAt: indexedAt, rewrite: true}
+	for _, file := range files {
+		index.files[file.Path] = file
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, op := range m.crawls[domain] {
+		index.apply(op)
+	}
+	delete(m.crawls, domain)
+	m.domains[domain] = index
+}
+
+// Put adds or updates a file of an indexed domain, files of domains that haven't been
+// crawled yet are left to their first crawl unless it's running
+func (m *MetadataIndex) Put(domain string, file IndexedFile) {
+	m.change(domain, indexOp{File: file})
+}
+
+// Remove drops path and the files below it from the index of domain
+func (m *MetadataIndex) Remove(domain string, path string) {
+	m.change(domain, indexOp{File: IndexedFile{Path: path}, Removed: true})
+}
+
+func (m *MetadataIndex) change(domain string, op indexOp) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ops, ok := m.crawls[domain]; ok {
+		m.crawls[domain] = append(ops, op)
+	}
+	if index, ok := m.domains[domain]; ok {
+		index.apply(op)
+		index.unsaved = append(index.unsaved, op)
+	}
+}
+
+func (d *domainIndex) apply(op indexOp) {
+	if !op.Removed {
+		d.files[op.File.Path] = op.File
+		d.sorted = nil
+		return
+	}
+	path := op.File.Path
+	for filePath := range d.files {
+		if filePath == path || path == "" || strings.HasPrefix(filePath, path+"/") {
+			delete(d.files, filePath)
+			d.sorted = nil
+		}
+	}
+}
+
+// Save appends the changes of the domains since they were last saved to their change
+// logs, and writes the domains that were crawled or whose log grew too long as a whole.
+// Searches aren't blocked while the files are written.
+func (m *MetadataIndex) Save() error {
+	type pending struct {
+		domain   string
+		index    *domainIndex
+		snapshot *indexSnapshot // set when the whole index is written
+		changes  []indexOp
+	}
+	var changed []pending
+	m.mu.Lock()
+	for domain, index := range m.domains {
+		if index.logged+len(index.unsaved) > max(len(index.files), minIndexCompaction) {
+			index.rewrite = true
+		}
+		p := pending{domain: domain, index: index, changes: index.unsaved[:len(index.unsaved):len(index.unsaved)]}
+		if index.rewrite {
+			p.snapshot = &indexSnapshot{IndexedAt: index.indexedAt, Files: index.sortedFiles()}
+		} else if len(p.changes) == 0 {
+			continue
+		}
+		changed = append(changed, p)
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, p := range changed {
+		var err error
+		if p.snapshot != nil {
+			err = m.writeIndex(p.domain, *p.snapshot)
+		} else {
+			err = m.appendLog(p.domain, p.changes)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to save search index of %s: %w", p.domain, err))
+			continue
+		}
+
+		m.mu.Lock()
+		p.index.unsaved = p.index.unsaved[len(p.changes):]
+		if p.snapshot != nil {
+			p.index.rewrite = false
+			p.index.logged = 0
+		} else {
+			p.index.logged += len(p.changes)
+		}
+		m.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// writeIndex writes the whole index of domain. Its change log is dropped first, a crash
+// in between loses the changes since the last save rather than applying them to a newer
+// index.
+func (m *MetadataIndex) writeIndex(domain string, snapshot indexSnapshot) error {
+	if err := os.Remove(m.logPath(domain)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return m.writeAtomic(m.indexPath(domain), snapshot)
+}
+
+// appendLog appends changes to the change log of domain, one JSON object per line
+func (m *MetadataIndex) appendLog(domain string, changes []indexOp) error {
+	log, err := os.OpenFile(m.logPath(domain), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(log)
+	encoder := json.NewEncoder(writer)
+	for _, op := range changes {
+		if err := encoder.Encode(op); err != nil {
+			log.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		log.Close()
+		return err
+	}
+	return log.Close()
+}
+
+// writeAtomic writes to a temporary file first, so a crash never leaves a partial index
+func (m *MetadataIndex) writeAtomic(indexPath string, snapshot indexSnapshot) error {
+	tmp, err := os.CreateTemp(m.dir, "index-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if err := gob.NewEncoder(tmp).Encode(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), indexPath)
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataIndex(t *testing.T) {
+	dir := t.TempDir()
+	index, err := NewMetadataIndex(dir)
+	require.NoError(t, err)
+
+	_, _, ok := index.Files("example.com")
+	assert.False(t, ok, "domains are only searchable once crawled")
+	index.Put("example.com", IndexedFile{Path: "early.jpg"})
+	_, _, ok = index.Files("example.com")
+	assert.False(t, ok, "changes before the first crawl are left to it")
+
+	indexedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	captured := time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)
+	index.Replace("example.com", []IndexedFile{
+		{Path: "b/launch.jpg", Size: 10, MimeType: "image/jpeg", Width: 40, Height: 30, CapturedAt: captured, Keywords: []string{"launch"}},
+		{Path: "a.txt", Size: 5, MimeType: "text/plain"},
+		{Path: "b/c/d.jpg", Size: 7, MimeType: "image/jpeg"},
+	}, indexedAt)
+	index.Put("example.com", IndexedFile{Path: "a.jpg", Size: 3, MimeType: "image/jpeg"})
+	index.Remove("example.com", "b/c")
+
+	paths := func(files []IndexedFile) []string {
+		var paths []string
+		for _, file := range files {
+			paths = append(paths, file.Path)
+		}
+		return paths
+	}
+	files, at, ok := index.Files("example.com")
+	require.True(t, ok)
+	assert.Equal(t, indexedAt, at)
+	assert.Equal(t, []string{"a.jpg", "a.txt", "b/launch.jpg"}, paths(files))
+
+	// Saved domains are loaded again, domain names are escaped in file names
+	index.Replace("example.com:8080", []IndexedFile{{Path: "x.png"}}, indexedAt)
+	require.NoError(t, index.Save())
+	saved, _ := filepath.Glob(filepath.Join(dir, "*.index"))
+	assert.Len(t, saved, 2)
+
+	reloaded, err := NewMetadataIndex(dir)
+	require.NoError(t, err)
+	files, at, ok = reloaded.Files("example.com")
+	require.True(t, ok)
+	assert.True(t, indexedAt.Equal(at))
+	assert.Equal(t, []string{"a.jpg", "a.txt", "b/launch.jpg"}, paths(files))
+	assert.Equal(t, []string{"launch"}, files[2].Keywords)
+	assert.True(t, captured.Equal(files[2].CapturedAt))
+	files, _, _ = reloaded.Files("example.com:8080")
+	assert.Equal(t, []string{"x.png"}, paths(files))
+
+	// Unchanged domains aren't written again, broken files are skipped on load
+	info, err := os.Stat(reloaded.indexPath("example.com"))
+	require.NoError(t, err)
+	require.NoError(t, reloaded.Save())
+	after, _ := os.Stat(reloaded.indexPath("example.com"))
+	assert.Equal(t, info.ModTime(), after.ModTime())
+
+	// Changes are appended to a change log instead of writing the index again
+	reloaded.Put("example.com", IndexedFile{Path: "z.jpg"})
+	reloaded.Remove("example.com", "a.txt")
+	require.NoError(t, reloaded.Save())
+	after, _ = os.Stat(reloaded.indexPath("example.com"))
+	assert.Equal(t, info.ModTime(), after.ModTime())
+	reloaded, err = NewMetadataIndex(dir)
+	require.NoError(t, err)
+	files, _, _ = reloaded.Files("example.com")
+	assert.Equal(t, []string{"a.jpg", "b/launch.jpg", "z.jpg"}, paths(files))
+
+	// A change cut off by a crash is skipped
+	log, err := os.OpenFile(reloaded.logPath("example.com"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = log.WriteString(`{"File":{"Path":"cut`)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	reloaded, err = NewMetadataIndex(dir)
+	require.NoError(t, err)
+	files, _, _ = reloaded.Files("example.com")
+	assert.Equal(t, []string{"a.jpg", "b/launch.jpg", "z.jpg"}, paths(files))
+
+	// Long logs are compacted into the index
+	for i := 0; i <= minIndexCompaction; i++ {
+		reloaded.Put("example.com", IndexedFile{Path: "z.jpg", Size: int64(i)})
+	}
+	require.NoError(t, reloaded.Save())
+	_, err = os.Stat(reloaded.logPath("example.com"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	reloaded, err = NewMetadataIndex(dir)
+	require.NoError(t, err)
+	file, _ := reloaded.File("example.com", "z.jpg")
+	assert.Equal(t, int64(minIndexCompaction), file.Size)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.index"), []byte("not gob"), 0o644))
+	reloaded, err = NewMetadataIndex(dir)
+	require.NoError(t, err)
+	_, _, ok = reloaded.Files("broken")
+	assert.False(t, ok)
+}
+
+func TestMetadataIndex_ChangesDuringCrawl(t *testing.T) {
+	index, err := NewMetadataIndex(t.TempDir())
+	require.NoError(t, err)
+	indexedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Changes made while the first crawl runs are kept
+	index.startCrawl("example.com")
+	index.Put("example.com", IndexedFile{Path: "new.jpg", Size: 1})
+	index.Replace("example.com", []IndexedFile{{Path: "a.jpg"}, {Path: "b/c.jpg"}}, indexedAt)
+	_, ok := index.File("example.com", "new.jpg")
+	assert.True(t, ok, "uploads while crawling aren't lost")
+
+	// A crawl listing a file before it was deleted doesn't bring it back
+	index.startCrawl("example.com")
+	index.Remove("example.com", "b")
+	index.Put("example.com", IndexedFile{Path: "a.jpg", Size: 2})
+	index.Replace("example.com", []IndexedFile{{Path: "a.jpg", Size: 1}, {Path: "b/c.jpg"}, {Path: "new.jpg", Size: 1}}, indexedAt)
+	_, ok = index.File("example.com", "b/c.jpg")
+	assert.False(t, ok, "deleted files don't come back")
+	file, _ := index.File("example.com", "a.jpg")
+	assert.Equal(t, int64(2), file.Size)
+
+	// A failed crawl stops recording, its changes aren't applied to a later Replace
+	index.Remove("example.com", "new.jpg")
+	index.startCrawl("example.com")
+	index.endCrawl("example.com")
+	index.Replace("example.com", []IndexedFile{{Path: "new.jpg"}}, indexedAt)
+	_, ok = index.File("example.com", "new.jpg")
+	assert.True(t, ok)
+}
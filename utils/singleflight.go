@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errCallPanicked = errors.New("coalesced call panicked")
+
+// CallGroup coalesces concurrent calls that share the same key, so the work
+// runs once and its result is handed to every caller waiting on that key.
+// The zero value is ready to use.
+type CallGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*groupCall[T]
+}
+
+type groupCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+
+	// Used by DoContext, the work is cancelled once no caller waits for it anymore
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Do runs fn for the given key unless a call for the same key is already in
+// flight, in which case it waits for that call and returns its result.
+// shared reports whether the result was produced by another caller.
+func (g *CallGroup[T]) Do(key string, fn func() (T, error)) (value T, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*groupCall[T])
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.value, c.err, true
+	}
+
+	c := &groupCall[T]{done: make(chan struct{}), err: errCallPanicked}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// Always release the waiters, even if fn panics
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.value, c.err = fn()
+	return c.value, c.err, false
+}
+
+// DoContext is like Do, but fn runs with its own context that is only cancelled once
+// every caller waiting on the key has given up, so one client going away doesn't fail
+// the others. The deadline of the caller starting the call is kept.
+func (g *CallGroup[T]) DoContext(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (value T, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*groupCall[T])
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := detachedContext(ctx)
+		c = &groupCall[T]{done: make(chan struct{}), err: errCallPanicked, cancel: cancel}
+		g.calls[key] = c
+		go g.run(callCtx, key, c, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.value, c.err, shared
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			// Later callers start over instead of joining the cancelled call
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return value, ctx.Err(), shared
+	}
+}
+
+func (g *CallGroup[T]) run(ctx context.Context, key string, c *groupCall[T], fn func(ctx context.Context) (T, error)) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			Error("Coalesced call panicked", "key", key, "panic", recovered)
+		}
+		c.cancel()
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.value, c.err = fn(ctx)
+}
+
+// detachedContext keeps the values and deadline of ctx but not its cancellation
+func detachedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
+
+// InFlight returns the number of distinct keys currently being processed
+func (g *CallGroup[T]) InFlight() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.calls)
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallGroup_CoalescesConcurrentCalls(t *testing.T) {
+	var group CallGroup[string]
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var startOnce sync.Once
+
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	sharedCount := int32(0)
+
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, err, shared := group.Do("key", func() (string, error) {
+				atomic.AddInt32(&calls, 1)
+				startOnce.Do(func() { close(started) })
+				<-release
+				return "value", nil
+			})
+			assert.NoError(t, err)
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+			results[i] = value
+		}(i)
+
+		// Make sure the first call is in flight before the others join it
+		if i == 0 {
+			<-started
+		}
+	}
+
+	// Give the other callers time to join the in-flight call
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, group.InFlight())
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, int32(len(results)-1), atomic.LoadInt32(&sharedCount))
+	for _, value := range results {
+		assert.Equal(t, "value", value)
+	}
+	assert.Equal(t, 0, group.InFlight())
+}
+
+func TestCallGroup_SequentialCallsRunAgain(t *testing.T) {
+	var group CallGroup[int]
+	calls := 0
+
+	for i := 0; i < 2; i++ {
+		_, err, shared := group.Do("key", func() (int, error) {
+			calls++
+			return 0, errors.New("failed")
+		})
+		assert.EqualError(t, err, "failed")
+		assert.False(t, shared)
+	}
+
+	assert.Equal(t, 2, calls)
+}
+
+func TestCallGroup_PanicReleasesWaiters(t *testing.T) {
+	var group CallGroup[int]
+
+	assert.Panics(t, func() {
+		group.Do("key", func() (int, error) {
+			panic("boom")
+		})
+	})
+
+	value, err, _ := group.Do("key", func() (int, error) {
+		return 42, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 42, value)
+}
+
+func TestCallGroup_DoContextOutlivesCancelledCaller(t *testing.T) {
+	var group CallGroup[string]
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		_, err, _ := group.DoContext(first, "key", func(ctx context.Context) (string, error) {
+			close(started)
+			select {
+			case <-release:
+				return "value", nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		})
+		firstDone <- err
+	}()
+	<-started
+
+	secondDone := make(chan string)
+	go func() {
+		value, err, shared := group.DoContext(context.Background(), "key", func(ctx context.Context) (string, error) {
+			return "second", nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, shared)
+		secondDone <- value
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The first caller giving up doesn't cancel the work the second one waits for
+	cancelFirst()
+	assert.ErrorIs(t, <-firstDone, context.Canceled)
+	close(release)
+	assert.Equal(t, "value", <-secondDone)
+}
+
+func TestCallGroup_DoContextCancelsAbandonedWork(t *testing.T) {
+	var group CallGroup[string]
+	cancelled := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err, _ := group.DoContext(ctx, "key", func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return "", ctx.Err()
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the abandoned call to be cancelled")
+	}
+
+	// A new caller starts over instead of joining the cancelled call
+	value, err, shared := group.DoContext(context.Background(), "key", func(ctx context.Context) (string, error) {
+		return "fresh", nil
+	})
+	assert.NoError(t, err)
+	assert.False(t, shared)
+	assert.Equal(t, "fresh", value)
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Storage backends tag their failures with one of these, check them with errors.Is
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrPermission         = errors.New("permission denied")
+	ErrTimeout            = errors.New("storage timeout")
+	ErrBackendUnavailable = errors.New("storage backend unavailable")
+	ErrIsDirectory        = errors.New("is a directory")
+)
+
+// StorageError is a backend failure of a known kind. The message is the one of the
+// underlying error, errors.Is matches both the kind and the underlying error.
+type StorageError struct {
+	Kind error
+	Err  error
+}
+
+func (e *StorageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StorageError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// storageError tags err with kind, a nil kind leaves err unclassified
+func storageError(kind error, err error) error {
+	if err == nil || kind == nil {
+		return err
+	}
+	return &StorageError{Kind: kind, Err: err}
+}
+
+// rclone exit codes, see https://rclone.org/docs/#exit-code
+const (
+	rcloneExitDirNotFound  = 3
+	rcloneExitFileNotFound = 4
+	rcloneExitTemporary    = 5
+)
+
+// classifyRcloneError derives the kind of a failed rclone invocation from its exit
+// code and, for the generic codes, from the message it printed on stderr
+func classifyRcloneError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var storageErr *StorageError
+	if errors.As(err, &storageErr) || errors.Is(err, context.Canceled) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return storageError(ErrTimeout, err)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case rcloneExitDirNotFound, rcloneExitFileNotFound:
+			return storageError(ErrNotFound, err)
+		}
+	}
+
+	if kind := classifyMessage(err.Error()); kind != nil {
+		return storageError(kind, err)
+	}
+	if exitErr != nil && exitErr.ExitCode() == rcloneExitTemporary {
+		return storageError(ErrBackendUnavailable, err)
+	}
+	return err
+}
+
+// classifyTransportError tags failures to reach an HTTP backend at all
+func classifyTransportError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return storageError(ErrTimeout, err)
+	}
+	return storageError(ErrBackendUnavailable, err)
+}
+
+// classifyStatus maps an HTTP status returned by a backend to a kind
+func classifyStatus(status int) error {
+	switch {
+	case status == 404:
+		return ErrNotFound
+	case status == 401 || status == 403:
+		return ErrPermission
+	case status == 408 || status == 504:
+		return ErrTimeout
+	case status >= 500:
+		return ErrBackendUnavailable
+	default:
+		return nil
+	}
+}
+
+func classifyMessage(message string) error {
+	message = strings.ToLower(message)
+	switch {
+	case containsAny(message, "directory not found", "object not found", "file not found", "doesn't exist", "no such file"):
+		return ErrNotFound
+	case containsAny(message, "permission denied", "access denied", "accessdenied", "forbidden"):
+		return ErrPermission
+	case containsAny(message, "timeout", "timed out", "deadline exceeded"):
+		return ErrTimeout
+	case containsAny(message, "connection refused", "connection reset", "no such host", "network is unreachable", "service unavailable", "bad gateway"):
+		return ErrBackendUnavailable
+	case containsAny(message, "is a directory", "is a dir"):
+		return ErrIsDirectory
+	default:
+		return nil
+	}
+}
+
+func containsAny(s string, substrings ...string) bool {
+	for _, sub := range substrings {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyingReader tags errors that surface while a command's output is read
+type classifyingReader struct {
+	reader io.ReadCloser
+}
+
+func (c *classifyingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = classifyRcloneError(err)
+	}
+	return n, err
+}
+
+func (c *classifyingReader) Close() error {
+	return c.reader.Close()
+}
+
+// uploadSource is the data of an upload. The first failing read cancels the upload's
+// context, so a truncated upload is aborted rather than stored, and is kept to be
+// reported in place of the error of the aborted transfer.
+type uploadSource struct {
+	reader io.Reader
+	cancel context.CancelFunc
+	n      int64
+	err    error
+}
+
+func newUploadSource(ctx context.Context, reader io.Reader) (*uploadSource, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &uploadSource{reader: reader, cancel: cancel}, ctx
+}
+
+func (u *uploadSource) Read(p []byte) (int, error) {
+	n, err := u.reader.Read(p)
+	u.n += int64(n)
+	if err != nil && err != io.EOF {
+		u.err = err
+		u.cancel()
+	}
+	return n, err
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"shuto-api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exitError(t *testing.T, code int, stderr string) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	if stderr == "" {
+		return fmt.Errorf("command failed: %w", err)
+	}
+	return fmt.Errorf("command failed: %w: %s", err, stderr)
+}
+
+func TestClassifyRcloneError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"directory not found exit code", exitError(t, 3, ""), ErrNotFound},
+		{"file not found exit code", exitError(t, 4, ""), ErrNotFound},
+		{"object not found on stderr", exitError(t, 1, "ERROR : a.jpg: error reading source root directory: object not found"), ErrNotFound},
+		{"access denied", exitError(t, 1, "Failed to lsjson: AccessDenied: Access Denied status code: 403"), ErrPermission},
+		{"local permission", exitError(t, 2, "open /data/a.jpg: permission denied"), ErrPermission},
+		{"io timeout", exitError(t, 1, "dial tcp 10.0.0.1:443: i/o timeout"), ErrTimeout},
+		{"connection refused", exitError(t, 1, "dial tcp 127.0.0.1:9000: connect: connection refused"), ErrBackendUnavailable},
+		{"temporary exit code", exitError(t, 5, "low level retry 3/3"), ErrBackendUnavailable},
+		{"directory", exitError(t, 1, "read /data/photos: is a directory"), ErrIsDirectory},
+		{"without exit code", errors.New("couldn't find section in config file: directory not found"), ErrNotFound},
+		{"unknown", exitError(t, 1, "syntax error"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyRcloneError(tt.err)
+			assert.Equal(t, tt.err.Error(), err.Error())
+			assert.ErrorIs(t, err, tt.err)
+			for _, kind := range []error{ErrNotFound, ErrPermission, ErrTimeout, ErrBackendUnavailable, ErrIsDirectory} {
+				assert.Equal(t, kind == tt.kind, errors.Is(err, kind), "kind %v", kind)
+			}
+		})
+	}
+}
+
+func TestClassifyStatus(t *testing.T) {
+	assert.Equal(t, ErrNotFound, classifyStatus(404))
+	assert.Equal(t, ErrPermission, classifyStatus(403))
+	assert.Equal(t, ErrTimeout, classifyStatus(504))
+	assert.Equal(t, ErrBackendUnavailable, classifyStatus(503))
+	assert.Nil(t, classifyStatus(400))
+}
+
+func TestRcloneErrorsAreClassified(t *testing.T) {
+	executor := &MockCommandExecutor{
+		ExecuteFunc: func(ctx context.Context, env []string, command string, args ...string) ([]byte, error) {
+			return nil, errors.New("command failed: exit status 3: directory not found")
+		},
+	}
+	configManager := &config.MockDomainConfigManager{
+		GetDomainConfigFunc: func(domain string) (config.DomainConfig, error) {
+			return config.DomainConfig{Rclone: config.RcloneConfig{Remote: "test"}}, nil
+		},
+	}
+	rclone := NewRclone(executor, configManager)
+
+	_, err := rclone.ListPath(context.Background(), "missing", "test")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.EqualError(t, err, "failed to list path: rclone command failed: command failed: exit status 3: directory not found")
+}